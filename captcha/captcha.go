@@ -0,0 +1,148 @@
+// Copyright (c) 2024 Owen Waller. All rights reserved.
+package captcha
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/owenwaller/emailformgateway/config"
+)
+
+// The siteverify endpoints of the providers
+const (
+	HCaptchaVerifyURL  = "https://api.hcaptcha.com/siteverify"
+	RecaptchaVerifyURL = "https://www.google.com/recaptcha/api/siteverify"
+	TurnstileVerifyURL = "https://challenges.cloudflare.com/turnstile/v0/siteverify"
+)
+
+// The fields the providers' widgets put the response in
+const (
+	HCaptchaResponseField  = "h-captcha-response"
+	RecaptchaResponseField = "g-recaptcha-response"
+	TurnstileResponseField = "cf-turnstile-response"
+)
+
+// DefaultTimeout is how long the provider has to answer.
+const DefaultTimeout = 10 * time.Second
+
+// maxResponseSize limits how much of the provider's answer is read.
+const maxResponseSize = 64 << 10
+
+// ErrFailed means the provider did not accept the response, the form was probably posted by a bot.
+// Any other error from Verify means the response could not be checked.
+var ErrFailed = errors.New("The CAPTCHA was not solved.")
+
+// Verifier checks the response a CAPTCHA widget put in a form.
+type Verifier interface {
+	// Verify returns nil if the response is accepted, ErrFailed (possibly wrapped) if it is not,
+	// or another error if the provider could not be asked.
+	Verify(ctx context.Context, response, remoteIP string) error
+	// ResponseField is the name of the form field the response is posted in.
+	ResponseField() string
+}
+
+// siteVerifier asks a siteverify endpoint about a response. hCaptcha, reCAPTCHA and Turnstile
+// all use the same request and answer, reCAPTCHA v3 adds a score and an action.
+type siteVerifier struct {
+	url      string
+	secret   string
+	field    string
+	minScore float64
+	action   string
+	client   *http.Client
+}
+
+// siteVerifyAnswer is the JSON a siteverify endpoint answers with.
+type siteVerifyAnswer struct {
+	Success    bool     `json:"success"`
+	Score      *float64 `json:"score"`  // reCAPTCHA v3 only
+	Action     string   `json:"action"` // reCAPTCHA v3 and Turnstile
+	Hostname   string   `json:"hostname"`
+	ErrorCodes []string `json:"error-codes"`
+}
+
+// New returns the verifier for the form's CAPTCHA config, or nil if the form has no CAPTCHA.
+func New(cd config.CaptchaData) (Verifier, error) {
+	if cd.Provider == "" {
+		return nil, nil
+	}
+	v := &siteVerifier{secret: cd.Secret, url: cd.VerifyURL, field: cd.ResponseField}
+	switch strings.ToLower(cd.Provider) {
+	case config.CaptchaProviderHCaptcha:
+		v.setDefaults(HCaptchaVerifyURL, HCaptchaResponseField)
+	case config.CaptchaProviderRecaptcha:
+		v.setDefaults(RecaptchaVerifyURL, RecaptchaResponseField)
+		v.minScore = cd.MinScore
+		v.action = cd.Action
+	case config.CaptchaProviderTurnstile:
+		v.setDefaults(TurnstileVerifyURL, TurnstileResponseField)
+	default:
+		return nil, fmt.Errorf("Unknown CAPTCHA provider %q", cd.Provider)
+	}
+	timeout := cd.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	v.client = &http.Client{Timeout: timeout}
+	return v, nil
+}
+
+func (v *siteVerifier) setDefaults(verifyURL, field string) {
+	if v.url == "" {
+		v.url = verifyURL
+	}
+	if v.field == "" {
+		v.field = field
+	}
+}
+
+func (v *siteVerifier) ResponseField() string {
+	return v.field
+}
+
+func (v *siteVerifier) Verify(ctx context.Context, response, remoteIP string) error {
+	if response == "" {
+		return fmt.Errorf("%w The %q field is empty.", ErrFailed, v.field)
+	}
+	form := url.Values{}
+	form.Set("secret", v.secret)
+	form.Set("response", response)
+	if remoteIP != "" {
+		form.Set("remoteip", remoteIP)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, v.url, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Could not verify the CAPTCHA: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Could not verify the CAPTCHA: %s answered %s", v.url, resp.Status)
+	}
+	var answer siteVerifyAnswer
+	err = json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(&answer)
+	if err != nil {
+		return fmt.Errorf("Could not verify the CAPTCHA: %w", err)
+	}
+	if !answer.Success {
+		return fmt.Errorf("%w Error codes %v.", ErrFailed, answer.ErrorCodes)
+	}
+	if v.minScore > 0 && (answer.Score == nil || *answer.Score < v.minScore) {
+		return fmt.Errorf("%w The score is below %.2f.", ErrFailed, v.minScore)
+	}
+	if v.action != "" && answer.Action != v.action {
+		return fmt.Errorf("%w The action %q is not %q.", ErrFailed, answer.Action, v.action)
+	}
+	return nil
+}
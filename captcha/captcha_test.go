@@ -0,0 +1,112 @@
+// Copyright (c) 2024 Owen Waller. All rights reserved.
+package captcha
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/owenwaller/emailformgateway/config"
+)
+
+// newTestEndpoint stands in for a siteverify endpoint, it accepts the response "good"
+// and answers with the given score and action.
+func newTestEndpoint(t *testing.T, score, action string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := r.ParseForm()
+		if err != nil {
+			t.Errorf("Could not parse the siteverify request: %s", err)
+		}
+		if r.PostForm.Get("secret") != "secret" {
+			t.Errorf("Expected the secret %q but got %q", "secret", r.PostForm.Get("secret"))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if r.PostForm.Get("response") != "good" {
+			fmt.Fprint(w, `{"success": false, "error-codes": ["invalid-input-response"]}`)
+			return
+		}
+		if score == "" {
+			fmt.Fprint(w, `{"success": true, "hostname": "localhost"}`)
+			return
+		}
+		fmt.Fprintf(w, `{"success": true, "score": %s, "action": %q}`, score, action)
+	}))
+}
+
+func TestNew(t *testing.T) {
+	var providers = []struct {
+		provider string
+		field    string
+	}{
+		{"hCaptcha", HCaptchaResponseField},
+		{"recaptcha", RecaptchaResponseField},
+		{"turnstile", TurnstileResponseField},
+	}
+	for _, p := range providers {
+		v, err := New(config.CaptchaData{Provider: p.provider, Secret: "secret"})
+		if err != nil {
+			t.Fatalf("%s: could not create the verifier: %s", p.provider, err)
+		}
+		if v.ResponseField() != p.field {
+			t.Fatalf("%s: expected the response field %q but got %q", p.provider, p.field, v.ResponseField())
+		}
+	}
+	v, err := New(config.CaptchaData{})
+	if v != nil || err != nil {
+		t.Fatalf("Expected no verifier and no error without a provider, but got %v, %v", v, err)
+	}
+	_, err = New(config.CaptchaData{Provider: "unknown"})
+	if err == nil {
+		t.Fatalf("Expected an error for an unknown provider but got nil")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	var checks = []struct {
+		provider string
+		minScore float64
+		action   string
+		score    string // the score the endpoint answers with, empty for none
+		response string
+		err      error
+	}{
+		{"hcaptcha", 0, "", "", "good", nil},
+		{"hcaptcha", 0, "", "", "bad", ErrFailed},
+		{"turnstile", 0, "", "", "", ErrFailed},
+		{"recaptcha", 0, "", "", "good", nil},
+		{"recaptcha", 0.5, "", "0.9", "good", nil},
+		{"recaptcha", 0.5, "", "0.1", "good", ErrFailed},
+		{"recaptcha", 0.5, "", "", "good", ErrFailed},
+		{"recaptcha", 0.5, "contact", "0.9", "good", ErrFailed},
+	}
+	for i, c := range checks {
+		endpoint := newTestEndpoint(t, c.score, "submit")
+		v, err := New(config.CaptchaData{Provider: c.provider, Secret: "secret", MinScore: c.minScore, Action: c.action, VerifyURL: endpoint.URL})
+		if err != nil {
+			t.Fatalf("Check %d: could not create the verifier: %s", i, err)
+		}
+		err = v.Verify(context.Background(), c.response, "192.0.2.1")
+		endpoint.Close()
+		if !errors.Is(err, c.err) {
+			t.Fatalf("Check %d: expected %v but got %v", i, c.err, err)
+		}
+	}
+}
+
+func TestVerifyUnavailable(t *testing.T) {
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusBadGateway)
+	}))
+	defer endpoint.Close()
+	v, err := New(config.CaptchaData{Provider: "hcaptcha", Secret: "secret", VerifyURL: endpoint.URL})
+	if err != nil {
+		t.Fatalf("Could not create the verifier: %s", err)
+	}
+	err = v.Verify(context.Background(), "good", "")
+	if err == nil || errors.Is(err, ErrFailed) {
+		t.Fatalf("Expected an error that is not ErrFailed but got %v", err)
+	}
+}
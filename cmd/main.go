@@ -3,9 +3,14 @@
 package main
 
 import (
+	"os"
+
 	"github.com/owenwaller/emailformgateway/commands"
 )
 
 func main() {
-	commands.RootCmd.Execute()
+	err := commands.RootCmd.Execute()
+	if err != nil {
+		os.Exit(1) // cobra has already printed the error
+	}
 }
@@ -0,0 +1,40 @@
+// Copyright (c) 2024 Owen Waller. All rights reserved.
+package commands
+
+import (
+	"fmt"
+
+	"github.com/owenwaller/emailformgateway/server"
+	"github.com/spf13/cobra"
+)
+
+var ConfigCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Work with the gateway's config file",
+}
+
+var CheckCmd = &cobra.Command{
+	Use:   "check",
+	Short: "Check the config file and its templates, then exit",
+	Long: `Check reads the config file and reports every problem it finds, with the TOML key
+of the problem. The emails of every form are built from sample data, but not sent.
+The exit status is non zero if the config has any problems, so it can be used in CI.`,
+	Args:         cobra.NoArgs,
+	RunE:         checkCmd,
+	SilenceUsage: true, // a bad config is not a usage error
+}
+
+func init() {
+	ConfigCmd.AddCommand(CheckCmd)
+	RootCmd.AddCommand(ConfigCmd)
+}
+
+func checkCmd(cmd *cobra.Command, args []string) error {
+	s := server.NewServer(host, port, domain)
+	err := s.CheckConfig(configFilename, route)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(cmd.OutOrStdout(), "The config is OK")
+	return nil
+}
@@ -28,17 +28,20 @@ func init() {
 	RootCmd.PersistentFlags().StringVarP(&configFilename, "config", "c", "", "The name of the configuration file to use, minus the TOML extension")
 	RootCmd.PersistentFlags().StringVarP(&host, "host", "h", "localhost", "The hostname of the gateway server")
 	RootCmd.PersistentFlags().StringVarP(&port, "port", "p", "9301", "The port the gateway server listens on")
-	RootCmd.PersistentFlags().StringVarP(&route, "route", "r", "/", "The URL path that the form data is POSTed to")
-	RootCmd.PersistentFlags().StringVarP(&domain, "domain", "d", "example.com", "The domain the email form gateway receives form data from")
+	RootCmd.PersistentFlags().StringVarP(&route, "route", "r", "/", "The URL path that the top level form data is POSTed to")
+	RootCmd.PersistentFlags().StringVarP(&domain, "domain", "d", "example.com", "The domain the email form gateway receives form data from, unless a tenant sets its own")
 	// Remove the default -h help shorthand as we want this for hostname as above.
 	RootCmd.PersistentFlags().BoolP("help", "", false, "help for this command")
 }
 
 func rootCmd(cmd *cobra.Command, args []string) error {
 	s := server.NewServer(host, port, domain)
-	s.SetRouteHandler(route)
 	if err := s.ReadConfig(configFilename); err != nil {
 		return err
 	}
+	// the routes of the named forms come from the config
+	if err := s.SetRouteHandler(route); err != nil {
+		return err
+	}
 	return s.Start()
 }
@@ -2,20 +2,186 @@
 package config
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"net/netip"
+	"os"
+	"os/exec"
 	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/spf13/viper"
 )
 
 type Config struct {
-	LogFile   LogFileData
-	Smtp      SmtpData
-	Auth      AuthData
-	Addresses EmailAddressData
-	Subjects  EmailSubjectData
-	Templates EmailTemplatesData
-	Fields    map[string]FieldData
+	LogFile    LogFileData
+	Smtp       SmtpData
+	Auth       AuthData
+	Relays     []RelayData
+	Transport  TransportData
+	Addresses  EmailAddressData
+	Subjects   EmailSubjectData
+	Templates  EmailTemplatesData
+	Fields     map[string]FieldData
+	Queue      QueueData
+	Invalid    InvalidFormData
+	Redirect   RedirectData
+	Cors       CorsData
+	AntiSpam   AntiSpamData
+	Captcha    CaptchaData
+	Scoring    ScoringData
+	SpamFilter SpamFilterData
+	EmailCheck EmailCheckData
+	RateLimit  RateLimitData
+	Proxies    ProxiesData
+	Forms      map[string]FormData
+	Tenants    map[string]TenantData
+}
+
+// FormData is one named form, from a [Forms.<name>] section. Viper lower cases the names.
+// The top level sections of the config are the form with an empty name, served on the route
+// given on the command line. Any section a named form leaves out is taken from the top level,
+// except that Auth is only taken from the top level when Smtp is as well, so credentials are
+// never sent to a relay they were not configured for. Transport is only taken from the top level
+// when the form has no Smtp section of its own, as that says the form sends through that relay.
+type FormData struct {
+	Route      string // defaults to "/<name>"
+	Smtp       SmtpData
+	Auth       AuthData
+	Relays     []RelayData
+	Transport  TransportData
+	Addresses  EmailAddressData
+	Subjects   EmailSubjectData
+	Templates  EmailTemplatesData
+	Fields     map[string]FieldData
+	Invalid    InvalidFormData
+	Redirect   RedirectData
+	Cors       CorsData
+	AntiSpam   AntiSpamData
+	Captcha    CaptchaData
+	Scoring    ScoringData
+	SpamFilter SpamFilterData
+	EmailCheck EmailCheckData
+}
+
+// CorsData is the cross origin policy for the forms. Requests from an origin that is not allowed
+// are refused. An origin may be "*", or contain one wildcard e.g. "https://*.example.com".
+// No AllowedOrigins only allows the origins of the tenant's Hosts, or none if there are no tenants,
+// so "*" must be given to allow every origin. No AllowedMethods allows GET, POST and HEAD.
+type CorsData struct {
+	AllowedOrigins   []string
+	AllowedMethods   []string
+	AllowedHeaders   []string
+	AllowCredentials bool
+	MaxAge           time.Duration // how long a browser may cache a preflight response
+}
+
+// AntiSpamData holds the checks that catch bots before a submission is validated. A submission
+// that fails a check is answered as if it had been sent, so the bot learns nothing from the response.
+// When Secret is set the form must be posted with a token from the GET <route>/token endpoint.
+// A token can only be used by one submission, and is refused if it is younger than MinFillTime
+// or older than MaxTokenAge.
+type AntiSpamData struct {
+	Honeypots   []string      // hidden fields that a person leaves empty and a bot fills in
+	Secret      string        // signs the tokens, no tokens are issued or required when it is empty
+	TokenField  string        // the field the token is posted in, defaults to DefaultTokenField
+	MinFillTime time.Duration // the least time a person takes to fill in the form
+	MaxTokenAge time.Duration // defaults to DefaultMaxTokenAge
+}
+
+// CaptchaData is the CAPTCHA a form must be posted with, no Provider means the form has none.
+// The response the CAPTCHA widget puts in the form is checked with the provider before the form is validated.
+type CaptchaData struct {
+	Provider      string        // one of the CaptchaProvider* constants
+	Secret        string        // the secret key the provider issued for the site
+	ResponseField string        // defaults to the field the provider's widget uses e.g. "h-captcha-response"
+	MinScore      float64       // reCAPTCHA v3 only, the lowest score accepted from 0.0 (a bot) to 1.0 (a person)
+	Action        string        // reCAPTCHA v3 only, if set the action the response must be for
+	VerifyURL     string        // defaults to the provider's siteverify endpoint
+	Timeout       time.Duration // defaults to captcha.DefaultTimeout
+}
+
+// ScoringData scores the content of a submission against the rules, each rule adds its Score for
+// every match. A submission that scores Threshold or more is spam, and is rejected or quarantined.
+// The score and the rules that matched are given to the system email templates.
+type ScoringData struct {
+	Threshold       float64 // no Threshold turns scoring off
+	Action          string  // one of the ScoreAction* constants, defaults to ScoreActionReject
+	QuarantineTo    string  // ScoreActionQuarantine sends the system email here rather than to SystemTo
+	Links           ScoreRuleData
+	Phrases         ScoreRuleData
+	Shorteners      ScoreRuleData
+	RepeatedChars   ScoreRuleData
+	MixedScripts    ScoreRuleData
+	DisposableEmail ScoreRuleData
+	Caps            ScoreRuleData
+}
+
+// ScoreRuleData is one of the scoring rules, no Score turns the rule off. Each rule only uses some of the settings.
+type ScoreRuleData struct {
+	Score float64
+	Max   int      // Links: the links allowed before each one scores. RepeatedChars: the longest run of one character allowed
+	Ratio float64  // Caps: the ratio of capital letters to letters that scores
+	List  []string // Phrases: the phrases. Shorteners and DisposableEmail: the domains, added to the built in ones
+	File  string   // as List, one a line, read again when it changes
+}
+
+// SpamFilterData is the spam filter the system email is passed through before it is sent, no Type means
+// there is none. The filter's verdict and score are added to the system email as X-Spam-* headers.
+// A system email that scores Threshold or more is not sent, it is kept in the spool's quarantine directory.
+// If the filter can't be asked the email is sent without the headers.
+type SpamFilterData struct {
+	Type      string        // one of the SpamFilter* constants
+	Address   string        // spamd's host:port, or the URL of rspamd e.g. "http://localhost:11333"
+	User      string        // spamd only, the user whose preferences are used
+	Password  string        // rspamd only, the controller password if it needs one
+	Threshold float64       // no Threshold never blocks an email, it is only marked
+	Timeout   time.Duration // defaults to spamfilter.DefaultTimeout
+}
+
+// EmailCheckData is how thoroughly the email fields of a form are checked. By default an address only has
+// to parse. EmailCheckDeliverable also checks the domain could receive email: its syntax, that it is not an
+// IP address or a local only domain such as "localhost", and that it has MX, A or AAAA records. A look up
+// that fails for a reason other than the domain not existing does not fail the field.
+type EmailCheckData struct {
+	Mode           string        // one of the EmailCheck* constants, defaults to EmailCheckSyntax
+	Disposable     bool          // refuse addresses at throw away email services, scoring.DisposableDomains and DisposableFile
+	DisposableFile string        // more throw away email domains, one a line, read again when it changes
+	Suggest        bool          // suggest a correction for a misspelt domain e.g. gmial.com, in the form response
+	Timeout        time.Duration // how long the DNS look ups may take, defaults to validation.DefaultLookupTimeout
+}
+
+// RateLimitData limits how often the forms can be posted. Each limit is a token bucket that holds Burst
+// tokens, and gets Requests tokens every Per. A submission takes a token from the bucket of its client's IP
+// address, from the bucket of each email address it was posted with, and from the global bucket. When a
+// bucket is empty the submission is refused with HTTP 429. A limit without Requests is not applied.
+type RateLimitData struct {
+	PerIP    LimitData
+	PerEmail LimitData // so the gateway can't be used to flood someone with acknowledgements
+	Global   LimitData
+	Store    string // a file to share the buckets between gateways on one host, read when the gateway starts
+}
+
+type LimitData struct {
+	Requests int
+	Per      time.Duration
+	Burst    int // defaults to Requests
+}
+
+// ProxiesData lists the reverse proxies in front of the gateway. The client's IP address is taken from
+// the Header of a request from a trusted proxy, and from the connection otherwise. Only the one header
+// is used, as a proxy passes on any other header the client made up.
+type ProxiesData struct {
+	Trusted []string // IP addresses or CIDR ranges e.g. "10.0.0.0/8"
+	Header  string   // one of the ProxyHeader* constants, defaults to ProxyHeaderXForwardedFor
 }
 
 type LogFileData struct {
@@ -24,14 +190,228 @@ type LogFileData struct {
 	Level    string
 }
 
+// SmtpData is the SMTP server the emails are sent to, and how the connection to it is secured.
+// The TLS settings are used whether or not the server needs Auth, but credentials are never sent
+// over a connection that is not encrypted unless TLS is SmtpTLSNone.
 type SmtpData struct {
-	Host string
-	Port int
+	Host          string
+	Port          int
+	TLS           string // one of the SmtpTLS* constants, defaults to SmtpTLSImplicit on port 465 or with Auth, and SmtpTLSStartTLSRequired otherwise
+	CAFile        string // a PEM bundle of the CAs the server's certificate is checked against, rather than the system's
+	CertFile      string // a PEM client certificate, for a server that wants one, with its KeyFile
+	KeyFile       string
+	ServerName    string // the name the server's certificate is checked against, defaults to the Host
+	MinTLSVersion string // "1.0", "1.1", "1.2" or "1.3", defaults to "1.2"
+
+	// The connections to the server are kept open and reused, so an email need not wait for a TLS
+	// handshake and auth, and the server sees fewer new connections.
+	MaxConnections int           // how many connections can be open at once, defaults to DefaultSmtpMaxConnections
+	IdleTimeout    time.Duration // how long an unused connection is kept open, defaults to DefaultSmtpIdleTimeout. A negative one closes each connection after its email
 }
 
+// TLSMode returns the TLS mode, with the default if none is set. A server the gateway logs in to
+// has always been sent TLS from the start, whatever its port, and still is unless the config says otherwise.
+func (s SmtpData) TLSMode(auth AuthData) string {
+	if s.TLS != "" {
+		return strings.ToLower(s.TLS)
+	}
+	if s.Port == 465 || auth.Username != "" {
+		return SmtpTLSImplicit
+	}
+	return SmtpTLSStartTLSRequired
+}
+
+// TLSConfig returns the TLS config for the connection to the server, with the CAs and client
+// certificate read from their files.
+func (s SmtpData) TLSConfig() (*tls.Config, error) {
+	tc := &tls.Config{ServerName: s.ServerName}
+	if tc.ServerName == "" {
+		tc.ServerName = s.Host
+	}
+	if s.MinTLSVersion != "" {
+		v, found := TLSVersion(s.MinTLSVersion)
+		if !found {
+			return nil, fmt.Errorf("%q is not a TLS version", s.MinTLSVersion)
+		}
+		tc.MinVersion = v
+	}
+	if s.CAFile != "" {
+		pool, err := loadCAFile(s.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tc.RootCAs = pool
+	}
+	if s.CertFile != "" || s.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(s.CertFile, s.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("can't load the client certificate: %w", err)
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+	return tc, nil
+}
+
+// loadCAFile reads a PEM bundle of CA certificates.
+func loadCAFile(filename string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("can't read the CA bundle %q", filename)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%q has no PEM certificates", filename)
+	}
+	return pool, nil
+}
+
+// TLSVersion returns the crypto/tls version for a MinTLSVersion, e.g. tls.VersionTLS12 for "1.2".
+func TLSVersion(version string) (uint16, bool) {
+	v, found := tlsVersions[version]
+	return v, found
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// AuthData is the credentials for the SMTP server. So the password need not be kept in the config
+// file it can instead be read from an environment variable, a file e.g. a Docker or Kubernetes secret,
+// or the output of a command. For XOAUTH2 and OAUTHBEARER the password is the access token, or it is
+// fetched from a TokenURL, and fetched again when it expires.
 type AuthData struct {
-	Username string
-	Password string
+	Mechanism       string // one of the Auth* constants, defaults to AuthPlain
+	Username        string
+	Password        string
+	PasswordEnv     string // the environment variable the password is in
+	PasswordFile    string // the file the password is in, read again for each delivery
+	PasswordCommand string // the command, and its arguments, that prints the password
+	TokenURL        string // xoauth2 and oauthbearer: the local endpoint that hands out access tokens
+}
+
+// AuthMechanism returns the mechanism in lower case, or AuthPlain if there is none.
+func (a AuthData) AuthMechanism() string {
+	if a.Mechanism == "" {
+		return AuthPlain
+	}
+	return strings.ToLower(a.Mechanism)
+}
+
+// Secret returns the password from wherever the config says it is kept. The trailing new line of a
+// password read from a file or a command is removed. A command's password is kept for
+// DefaultSecretCommandCacheTime, so the command is not run for each new connection.
+func (a AuthData) Secret() (string, error) {
+	switch {
+	case a.PasswordEnv != "":
+		secret, found := os.LookupEnv(a.PasswordEnv)
+		if !found {
+			return "", fmt.Errorf("the environment variable %s is not set", a.PasswordEnv)
+		}
+		return secret, nil
+	case a.PasswordFile != "":
+		b, err := os.ReadFile(a.PasswordFile)
+		if err != nil {
+			return "", fmt.Errorf("can't read the password file %q", a.PasswordFile)
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+	case a.PasswordCommand != "":
+		return cachedSecretCommand(a.PasswordCommand, time.Now())
+	}
+	return a.Password, nil
+}
+
+// ForgetSecret drops the cached password of the PasswordCommand, e.g. after the server refused it,
+// so the next Secret runs the command again.
+func (a AuthData) ForgetSecret() {
+	if a.PasswordCommand == "" {
+		return
+	}
+	secretCommands.mu.Lock()
+	delete(secretCommands.cached, a.PasswordCommand)
+	secretCommands.mu.Unlock()
+}
+
+// secretCommands caches the password each PasswordCommand printed.
+var secretCommands = struct {
+	mu     sync.Mutex
+	cached map[string]cachedSecret
+}{cached: make(map[string]cachedSecret)}
+
+type cachedSecret struct {
+	value   string
+	expires time.Time
+}
+
+// cachedSecretCommand returns the command's cached password, or runs the command if it has none
+// or the cached one has expired.
+func cachedSecretCommand(command string, now time.Time) (string, error) {
+	secretCommands.mu.Lock()
+	cached, found := secretCommands.cached[command]
+	secretCommands.mu.Unlock()
+	if found && now.Before(cached.expires) {
+		return cached.value, nil
+	}
+	secret, err := runSecretCommand(command)
+	if err != nil {
+		return "", err
+	}
+	secretCommands.mu.Lock()
+	secretCommands.cached[command] = cachedSecret{value: secret, expires: now.Add(DefaultSecretCommandCacheTime)}
+	secretCommands.mu.Unlock()
+	return secret, nil
+}
+
+// runSecretCommand runs the command, its arguments are split on white space as there is no shell.
+func runSecretCommand(command string) (string, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return "", errors.New("the password command is empty")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultSecretCommandTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%s failed: %w %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimRight(string(out), "\r\n"), nil
+}
+
+// RelayData is one of a list of SMTP servers, each with its own TLS settings and credentials, that
+// replaces the Smtp and Auth sections. An email is sent through the first relay that takes it, one
+// that refuses the connection or answers with a 4xx temporary error is failed over from. Relays with
+// a Weight are tried first, in a random order that favours the heavier ones, then those without in
+// the order they are listed. A relay that fails DefaultRelayMaxFailures times in a row is not tried
+// again for the DefaultRelayCooldown.
+type RelayData struct {
+	Smtp   SmtpData
+	Auth   AuthData
+	Weight int
+}
+
+// TransportData is how a form's emails are sent. No Type sends them to the SMTP server in the Smtp
+// and Auth sections, the other transports don't use those sections. Each transport only uses some of
+// the settings.
+type TransportData struct {
+	Type    string        // one of the Transport* constants, defaults to TransportSMTP
+	Command string        // sendmail: the command and its arguments, defaults to DefaultSendmailCommand
+	Dir     string        // maildir and file: the directory the emails are written to
+	URL     string        // the HTTP APIs: the API's base URL, defaults to the provider's, e.g. for Mailgun's EU region
+	APIKey  string        // the HTTP APIs: the key, or for SES the access key ID
+	Secret  string        // ses: the secret access key
+	Domain  string        // mailgun: the domain the key sends for
+	Region  string        // ses: the AWS region e.g. "eu-west-1"
+	Timeout time.Duration // how long one email may take to send, defaults to emailer.DefaultTimeout
+}
+
+// IsSMTP reports if the emails are sent over SMTP, with the Smtp and Auth sections.
+func (t TransportData) IsSMTP() bool {
+	return t.Type == "" || strings.EqualFold(t.Type, TransportSMTP)
 }
 
 type EmailAddressData struct {
@@ -62,21 +442,240 @@ type EmailTemplatesData struct {
 	SystemHtmlFileName   string
 }
 
+type QueueData struct {
+	Dir            string
+	Workers        int
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// InvalidFormData says what happens to a submission that fails validation.
+// Policy is one of the InvalidPolicy* constants, an empty policy is the same as InvalidPolicyReject.
+type InvalidFormData struct {
+	Policy        string
+	FlaggedPrefix string // prepended to the system subject by InvalidPolicyFlag
+	UnknownFields string // what is done with posted fields the form does not have, one of the UnknownFields* constants
+}
+
+// TenantData is one of the web sites the gateway serves, from a [Tenants.<name>] section.
+// A request belongs to the tenant whose Hosts include the host in its Origin header, or the Host
+// header when there is no Origin. Any section a tenant sets replaces the same section of every form
+// it submits, so each site's mail goes through its own relay and addresses. Auth is only used with
+// the tenant's Smtp, never with a form's. A tenant's Smtp without a Transport sends over SMTP, whatever
+// transport the form has.
+type TenantData struct {
+	Hosts          []string // a host may start with a wildcard e.g. "*.example.com"
+	Domain         string   // used for the Message-ID, defaults to the -d flag
+	AllowedOrigins []string // the origins allowed by CORS, defaults to http and https on each of Hosts
+	Smtp           SmtpData
+	Auth           AuthData
+	Relays         []RelayData
+	Transport      TransportData
+	Addresses      EmailAddressData
+	Templates      EmailTemplatesData
+}
+
+// RedirectData holds the pages a browser is sent to after a plain HTML form post.
+// If a URL is empty the browser gets the JSON form response instead.
+type RedirectData struct {
+	Success string
+	Failure string // the bad fields and any error code are added to the query string
+}
+
 type FieldData struct {
 	Name string
-	Type string
+	Type string // one of the FieldType* constants
+	// Only used by "file" fields. A zero MaxSize or MaxCount means the Default* value,
+	// an empty AllowedTypes accepts any type. A type may end in a wildcard e.g. "image/*".
+	MaxSize      int64
+	MaxCount     int
+	AllowedTypes []string
+	// Only used by "integer" and "decimal" fields, the lowest and highest value allowed. Leave one out for no limit.
+	Min *float64
+	Max *float64
+	// Only used by "select" and "multiselect" fields, the values that can be chosen. They are compared
+	// without regard to case, the value from the config is the one the templates get.
+	AllowedValues []string
+	// Required defaults to true, except for "checkbox" and "multiselect" fields where it means one must be
+	// ticked or chosen. A field that is not required may be left out or empty, it then has the Default value.
+	Required  *bool
+	MinLength int    // the fewest characters the value may have, the value is trimmed first
+	MaxLength int    // the most characters the value may have, no MaxLength is no limit
+	Pattern   string // a regexp the whole value must match, e.g. "[A-Z]{2}[0-9]{6}"
+	Default   string
+	Message   string // what the form response says about the field when it is bad, rather than the message for the problem
+}
+
+// IsRequired reports if the field must be posted with a value.
+func (f FieldData) IsRequired() bool {
+	if f.Required != nil {
+		return *f.Required
+	}
+	switch strings.ToLower(f.Type) {
+	case FieldTypeCheckbox, FieldTypeBoolean, FieldTypeMultiSelect:
+		return false
+	}
+	return true
+}
+
+// FieldValue is the typed value of a field, for the templates e.g. {{(index .Values "Quantity").Int}}.
+// Text is the value as it was posted, scrubbed, except that a "phone" field's is the number in E.164 form,
+// a "select" field's is the allowed value as the config writes it, and a "multiselect" field's is the
+// choices separated by commas. Only the member for the field's Type is set otherwise: Int for "integer",
+// Decimal for "decimal", Bool for "checkbox", Time for "date" and "datetime", and List for "multiselect".
+type FieldValue struct {
+	Type    string
+	Text    string
+	Int     int64   `json:",omitempty"`
+	Decimal float64 `json:",omitempty"`
+	Bool    bool    `json:",omitempty"`
+	Time    time.Time
+	List    []string `json:",omitempty"`
+}
+
+func (v FieldValue) String() string {
+	return v.Text
+}
+
+// Attachment is a file uploaded through a "file" field, it is attached to the system email.
+type Attachment struct {
+	Field       string // the name of the form field the file was uploaded with
+	Filename    string
+	ContentType string // sniffed from the content, not the type the browser claimed
+	Data        []byte
 }
 
 type EmailTemplateData struct {
+	Form          string // the name of the form that was submitted, empty for the top level form
+	Tenant        string // the name of the tenant the form was submitted to, empty if there are no tenants
 	FormData      map[string]string
+	Values        map[string]FieldValue // the typed values of the valid fields, by the same names as FormData
+	CustomerTo    string                // the valid address of the form's email field the acknowledgement is sent to
 	UserAgent     string
-	RemoteIp      string
+	ClientIP      string // the client's IP address, taken from the trusted proxies' header when there is one
+	RemoteIp      string // the IP address the request came from, which may be a proxy
 	XForwardedFor string
+	Flagged       bool     // the submission failed validation but is delivered anyway
+	BadFields     []string // the names of the fields that failed validation
+	Attachments   []Attachment
+	Spam          bool     // the submission scored over the form's Scoring.Threshold
+	SpamScore     float64  // the content score of the submission
+	SpamRules     []string // the scoring rules the submission matched
 }
 
 const (
-	DefaultConfigFilename = "config"
-	DefaultConfigType     = "toml"
+	DefaultConfigFilename  = "config"
+	DefaultConfigType      = "toml"
+	DefaultQueueDir        = "/var/spool/emailformgateway"
+	DefaultFlaggedPrefix   = "[FLAGGED]"
+	DefaultSpamPrefix      = "[SPAM]"
+	DefaultMaxFileSize     = 10 << 20
+	DefaultMaxFileCount    = 1
+	DefaultTokenField      = "_token"
+	DefaultMaxTokenAge     = 2 * time.Hour
+	DefaultSendmailCommand = "/usr/sbin/sendmail"
+
+	DefaultSecretCommandTimeout   = 10 * time.Second
+	DefaultSecretCommandCacheTime = 5 * time.Minute
+	DefaultSmtpMaxConnections     = 4
+	DefaultSmtpIdleTimeout        = 30 * time.Second
+	DefaultRelayMaxFailures       = 3
+	DefaultRelayCooldown          = time.Minute
+)
+
+// The SMTP auth mechanisms, a mechanism is compared without regard to case
+const (
+	AuthPlain       = "plain"
+	AuthLogin       = "login"    // for servers that only offer LOGIN, e.g. older Exchange servers
+	AuthCramMD5     = "cram-md5" // the password is never sent, only a hash of it and the server's challenge
+	AuthXOAuth2     = "xoauth2"  // Google's and Microsoft's OAuth 2.0 mechanism
+	AuthOAuthBearer = "oauthbearer"
+)
+
+// How the connection to the SMTP server is secured, a mode is compared without regard to case
+const (
+	SmtpTLSImplicit              = "implicit"               // TLS from the start, usually on port 465
+	SmtpTLSStartTLSRequired      = "starttls-required"      // upgraded with STARTTLS, and refused if the server can't
+	SmtpTLSStartTLSOpportunistic = "starttls-opportunistic" // upgraded with STARTTLS if the server offers it
+	SmtpTLSNone                  = "none"                   // never encrypted, only for a server on the same host or network
+)
+
+// The transports, a transport's Type is compared without regard to case
+const (
+	TransportSMTP     = "smtp"
+	TransportSendmail = "sendmail" // pipes the email to a sendmail compatible command e.g. msmtp
+	TransportMaildir  = "maildir"  // delivers into a Maildir, for a local mail server or IMAP server to pick up
+	TransportFile     = "file"     // writes each email to a .eml file, for testing
+	TransportSendGrid = "sendgrid"
+	TransportMailgun  = "mailgun"
+	TransportPostmark = "postmark"
+	TransportSES      = "ses" // Amazon SES, version 2 of its API
+)
+
+// The field types, a field's Type is compared without regard to case
+const (
+	FieldTypeEmail            = "email"
+	FieldTypeTextRestricted   = "textrestricted"
+	FieldTypeTextUnrestricted = "textunrestricted"
+	FieldTypeFile             = "file"
+	FieldTypeInteger          = "integer"
+	FieldTypeDecimal          = "decimal"
+	FieldTypePhone            = "phone" // an international number, E.164 once the spaces and punctuation are removed
+	FieldTypeURL              = "url"   // an absolute http or https URL
+	FieldTypeDate             = "date"  // as an HTML date input sends it, e.g. 2024-03-01
+	FieldTypeDateTime         = "datetime"
+	FieldTypeSelect           = "select" // one of the AllowedValues
+	FieldTypeEnum             = "enum"   // the same as "select"
+	FieldTypeMultiSelect      = "multiselect"
+	FieldTypeCheckbox         = "checkbox"
+	FieldTypeBoolean          = "boolean" // the same as "checkbox"
+)
+
+// The CAPTCHA providers, a provider is compared without regard to case
+const (
+	CaptchaProviderHCaptcha  = "hcaptcha"
+	CaptchaProviderRecaptcha = "recaptcha" // v2 and v3
+	CaptchaProviderTurnstile = "turnstile" // Cloudflare Turnstile
+)
+
+// The spam filters, a filter's Type is compared without regard to case
+const (
+	SpamFilterSpamd  = "spamd"  // SpamAssassin's spamd protocol
+	SpamFilterRspamd = "rspamd" // rspamd's HTTP API
+)
+
+// How thoroughly an email field is checked, a mode is compared without regard to case
+const (
+	EmailCheckSyntax      = "syntax"      // the address parses
+	EmailCheckDeliverable = "deliverable" // and its domain can receive email
+)
+
+// The headers a proxy can give the client's IP address in, a header is compared without regard to case
+const (
+	ProxyHeaderXForwardedFor = "X-Forwarded-For"
+	ProxyHeaderXRealIP       = "X-Real-IP"
+	ProxyHeaderForwarded     = "Forwarded" // RFC 7239
+)
+
+// What happens to a submission that scores over the threshold
+const (
+	ScoreActionReject     = "reject"     // answer as if it had been sent, but send nothing
+	ScoreActionQuarantine = "quarantine" // send only the system email, to QuarantineTo or into the spool's quarantine directory
+)
+
+// The policies for submissions that fail validation
+const (
+	InvalidPolicyReject     = "reject"     // send nothing, only tell the client which fields are bad
+	InvalidPolicyFlag       = "flag"       // send only the system email, with a flagged subject
+	InvalidPolicyQuarantine = "quarantine" // keep the system email in the spool's quarantine directory
+)
+
+// What is done with a posted field that is not one of the form's fields, a policy is compared without regard to case
+const (
+	UnknownFieldsKeep   = "keep"   // the default, the field is given to the templates as it was posted
+	UnknownFieldsDrop   = "drop"   // the field is ignored
+	UnknownFieldsReject = "reject" // the field is a bad field, so the submission fails validation
 )
 
 var c Config
@@ -131,7 +730,8 @@ func SetConfigFile(configFilename string) error {
 	ext := filepath.Ext(configFilename)
 	base := filepath.Base(configFilename) // will be filename.ext or filename or last dir name
 	viper.AddConfigPath(path)
-	viper.SetConfigType(ext)
+	// viper wants "toml" not ".toml"
+	viper.SetConfigType(strings.TrimPrefix(ext, "."))
 	configFilename = base[:len(base)-len(ext)] // if this filename does not exit we will fail when we try to open it for reading,
 	viper.SetConfigName(configFilename)        // just in case the slicing results in an empty string
 
@@ -150,9 +750,267 @@ func BuildTemplateFilename(dir, filename string) string {
 	return filepath.Join(dir, filename)
 }
 
+// Form returns the named form, with the sections it leaves out taken from the top level.
+// An empty name returns the top level form.
+func (c *Config) Form(name string) (FormData, bool) {
+	top := FormData{
+		Smtp:       c.Smtp,
+		Auth:       c.Auth,
+		Relays:     c.Relays,
+		Transport:  c.Transport,
+		Addresses:  c.Addresses,
+		Subjects:   c.Subjects,
+		Templates:  c.Templates,
+		Fields:     c.Fields,
+		Invalid:    c.Invalid,
+		Redirect:   c.Redirect,
+		Cors:       c.Cors,
+		AntiSpam:   c.AntiSpam,
+		Captcha:    c.Captcha,
+		Scoring:    c.Scoring,
+		SpamFilter: c.SpamFilter,
+		EmailCheck: c.EmailCheck,
+	}
+	if name == "" {
+		top.Templates.setFileNames()
+		return top, true
+	}
+	f, found := c.Forms[strings.ToLower(name)]
+	if !found {
+		return FormData{}, false
+	}
+	if f.Route == "" {
+		f.Route = "/" + strings.ToLower(name)
+	}
+	if f.Smtp == (SmtpData{}) && f.Relays == nil {
+		if f.Transport == (TransportData{}) {
+			f.Transport = top.Transport
+		}
+		f.Smtp = top.Smtp
+		f.Auth = top.Auth
+		f.Relays = top.Relays
+	}
+	if f.Addresses == (EmailAddressData{}) {
+		f.Addresses = top.Addresses
+	}
+	if f.Subjects == (EmailSubjectData{}) {
+		f.Subjects = top.Subjects
+	}
+	if f.Templates == (EmailTemplatesData{}) {
+		f.Templates = top.Templates
+	}
+	if f.Fields == nil {
+		f.Fields = top.Fields
+	}
+	if f.Invalid == (InvalidFormData{}) {
+		f.Invalid = top.Invalid
+	}
+	if f.Invalid.Policy == "" {
+		f.Invalid.Policy = InvalidPolicyReject
+	}
+	if f.Invalid.FlaggedPrefix == "" {
+		f.Invalid.FlaggedPrefix = DefaultFlaggedPrefix
+	}
+	if f.Redirect == (RedirectData{}) {
+		f.Redirect = top.Redirect
+	}
+	if reflect.DeepEqual(f.Cors, CorsData{}) {
+		f.Cors = top.Cors
+	}
+	if reflect.DeepEqual(f.AntiSpam, AntiSpamData{}) {
+		f.AntiSpam = top.AntiSpam
+	}
+	if f.Captcha == (CaptchaData{}) {
+		f.Captcha = top.Captcha
+	}
+	if reflect.DeepEqual(f.Scoring, ScoringData{}) {
+		f.Scoring = top.Scoring
+	}
+	if f.SpamFilter == (SpamFilterData{}) {
+		f.SpamFilter = top.SpamFilter
+	}
+	if f.EmailCheck == (EmailCheckData{}) {
+		f.EmailCheck = top.EmailCheck
+	}
+	f.Templates.setFileNames()
+	return f, true
+}
+
+// Tenant returns the named tenant.
+func (c *Config) Tenant(name string) (TenantData, bool) {
+	t, found := c.Tenants[strings.ToLower(name)]
+	return t, found
+}
+
+// MatchTenant returns the name of the tenant that serves host.
+// If more than one tenant matches, an exact match wins over a wildcard.
+func (c *Config) MatchTenant(host string) (string, bool) {
+	host = strings.ToLower(host)
+	var wildcard string
+	for _, name := range sortedNames(c.Tenants) {
+		for _, h := range c.Tenants[name].Hosts {
+			h = strings.ToLower(h)
+			if h == host {
+				return name, true
+			}
+			if wildcard == "" && strings.HasPrefix(h, "*.") && strings.HasSuffix(host, h[1:]) {
+				wildcard = name
+			}
+		}
+	}
+	return wildcard, wildcard != ""
+}
+
+// AllowsOrigin reports if a browser page served from origin may post to the tenant's forms.
+func (t TenantData) AllowsOrigin(origin string) bool {
+	origin = strings.ToLower(strings.TrimSuffix(origin, "/"))
+	if len(t.AllowedOrigins) != 0 {
+		for _, o := range t.AllowedOrigins {
+			o = strings.ToLower(strings.TrimSuffix(o, "/"))
+			if o == "*" || o == origin {
+				return true
+			}
+		}
+		return false
+	}
+	for _, h := range t.Hosts {
+		h = strings.ToLower(h)
+		for _, scheme := range []string{"http://", "https://"} {
+			if !strings.HasPrefix(origin, scheme) {
+				continue
+			}
+			host := strings.TrimPrefix(origin, scheme)
+			if i := strings.LastIndex(host, ":"); i != -1 {
+				host = host[:i] // drop any port
+			}
+			if h == host || (strings.HasPrefix(h, "*.") && strings.HasSuffix(host, h[1:])) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Apply replaces the sections of the form that the tenant sets.
+func (t TenantData) Apply(f FormData) FormData {
+	if t.Smtp != (SmtpData{}) || t.Relays != nil {
+		f.Smtp = t.Smtp
+		f.Auth = t.Auth
+		f.Relays = t.Relays
+		f.Transport = TransportData{}
+	}
+	if t.Transport != (TransportData{}) {
+		f.Transport = t.Transport
+	}
+	if t.Addresses != (EmailAddressData{}) {
+		f.Addresses = t.Addresses
+	}
+	if t.Templates != (EmailTemplatesData{}) {
+		f.Templates = t.Templates
+		f.Templates.setFileNames()
+	}
+	return f
+}
+
+// Changes returns the keys of the sections that differ between two configs, e.g. "Smtp" or
+// "Forms.support". The sections that are maps are compared key by key.
+func Changes(old, new *Config) []string {
+	var changes []string
+	ov := reflect.ValueOf(old).Elem()
+	nv := reflect.ValueOf(new).Elem()
+	for i := 0; i < ov.NumField(); i++ {
+		name := ov.Type().Field(i).Name
+		of, nf := ov.Field(i), nv.Field(i)
+		if of.Kind() != reflect.Map {
+			if !reflect.DeepEqual(of.Interface(), nf.Interface()) {
+				changes = append(changes, name)
+			}
+			continue
+		}
+		keys := make(map[string]bool)
+		for _, k := range of.MapKeys() {
+			keys[k.String()] = true
+		}
+		for _, k := range nf.MapKeys() {
+			keys[k.String()] = true
+		}
+		for _, k := range sortedNames(keys) {
+			o := of.MapIndex(reflect.ValueOf(k))
+			n := nf.MapIndex(reflect.ValueOf(k))
+			switch {
+			case !o.IsValid():
+				changes = append(changes, name+"."+k+" (added)")
+			case !n.IsValid():
+				changes = append(changes, name+"."+k+" (removed)")
+			case !reflect.DeepEqual(o.Interface(), n.Interface()):
+				changes = append(changes, name+"."+k)
+			}
+		}
+	}
+	return changes
+}
+
+func sortedNames[V any](m map[string]V) []string {
+	names := make([]string, 0, len(m))
+	for k := range m {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Prefixes parses the trusted proxies, a single address becomes a prefix that matches only itself.
+func (p ProxiesData) Prefixes() ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(p.Trusted))
+	for _, t := range p.Trusted {
+		if strings.Contains(t, "/") {
+			prefix, err := netip.ParsePrefix(t)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(t)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+// setFileNames sets the full paths of any templates that do not already have one.
+func (t *EmailTemplatesData) setFileNames() {
+	if t.CustomerTextFileName == "" {
+		t.CustomerTextFileName = BuildTemplateFilename(t.Dir, t.CustomerText)
+	}
+	if t.CustomerHtmlFileName == "" {
+		t.CustomerHtmlFileName = BuildTemplateFilename(t.Dir, t.CustomerHtml)
+	}
+	if t.SystemTextFileName == "" {
+		t.SystemTextFileName = BuildTemplateFilename(t.Dir, t.SystemText)
+	}
+	if t.SystemHtmlFileName == "" {
+		t.SystemHtmlFileName = BuildTemplateFilename(t.Dir, t.SystemHtml)
+	}
+}
+
 func ReadConfig(filename string) (*Config, error) {
-	c := new(Config)
+	viper.SetConfigFile("") // search for the file, rather than use one an earlier RereadConfig gave
 	SetConfigFile(filename)
+	return readConfig()
+}
+
+// RereadConfig reads the config again from the file an earlier ReadConfig found, e.g. viper.ConfigFileUsed(),
+// without searching the config paths for it again.
+func RereadConfig(path string) (*Config, error) {
+	viper.SetConfigFile(path)
+	return readConfig()
+}
+
+func readConfig() (*Config, error) {
+	c := new(Config)
 	err := viper.ReadInConfig()
 	if err != nil {
 		re := NewConfigReadError("Could not read in config.", err.Error())
@@ -163,5 +1021,15 @@ func ReadConfig(filename string) (*Config, error) {
 		me := NewConfigMarshalError("Failed to marshal config.", err.Error())
 		return nil, me
 	}
+	// the spool directory has to live somewhere, even if the config does not say where
+	if c.Queue.Dir == "" {
+		c.Queue.Dir = DefaultQueueDir
+	}
+	if c.Invalid.Policy == "" {
+		c.Invalid.Policy = InvalidPolicyReject
+	}
+	if c.Invalid.FlaggedPrefix == "" {
+		c.Invalid.FlaggedPrefix = DefaultFlaggedPrefix
+	}
 	return c, err // will be nil
 }
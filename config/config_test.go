@@ -4,7 +4,10 @@ package config
 import (
 	"fmt"
 	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/spf13/viper"
 )
@@ -87,6 +90,225 @@ func TestReadConfigWithEnvVarOverload(t *testing.T) {
 	}
 }
 
+func TestForm(t *testing.T) {
+	c, err := ReadConfig(DefaultConfigFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	top, found := c.Form("")
+	if !found || top.Smtp != c.Smtp || top.Subjects != c.Subjects || len(top.Fields) != len(c.Fields) {
+		t.Fatalf("The top level form does not match the top level of the config. Got %+v\n", top)
+	}
+	if top.Templates.SystemHtmlFileName != BuildTemplateFilename(c.Templates.Dir, c.Templates.SystemHtml) {
+		t.Fatalf("The top level form template filenames were not set. Got %+v\n", top.Templates)
+	}
+
+	support, found := c.Form("Support")
+	if !found {
+		t.Fatalf("Could not find the support form\n")
+	}
+	if support.Smtp.Host != "smtp.support.localhost" || support.Auth != (AuthData{}) {
+		t.Fatalf("The support form should have its own SMTP server, without the top level auth. Got %+v %+v\n", support.Smtp, support.Auth)
+	}
+	if support.Subjects.System != "Localhost Support Form Message:" || len(support.Fields) != 2 {
+		t.Fatalf("The support form should have its own subjects and fields. Got %+v %+v\n", support.Subjects, support.Fields)
+	}
+	if len(support.Cors.AllowedOrigins) != 1 || support.Cors.MaxAge != 0 {
+		t.Fatalf("The support form should have its own CORS policy. Got %+v\n", support.Cors)
+	}
+	if support.Addresses != c.Addresses || support.Invalid != c.Invalid || support.Redirect != c.Redirect {
+		t.Fatalf("The support form should take the sections it leaves out from the top level.\n")
+	}
+
+	c.Forms["sales"] = FormData{}
+	sales, _ := c.Form("sales")
+	if sales.Route != "/sales" || sales.Smtp != c.Smtp || sales.Auth != c.Auth || !reflect.DeepEqual(sales.Cors, c.Cors) {
+		t.Fatalf("The sales form should default its route and take the top level SMTP server and auth. Got %+v\n", sales)
+	}
+
+	c.Transport = TransportData{Type: TransportFile, Dir: "/tmp/mail"}
+	sales, _ = c.Form("sales")
+	if sales.Transport != c.Transport {
+		t.Fatalf("The sales form should take the top level transport. Got %+v\n", sales.Transport)
+	}
+	support, _ = c.Form("support")
+	if !support.Transport.IsSMTP() {
+		t.Fatalf("The support form has its own SMTP server, so should not take the top level transport. Got %+v\n", support.Transport)
+	}
+
+	c.Relays = []RelayData{{Smtp: SmtpData{Host: "relay1.localhost", Port: 587}}, {Smtp: SmtpData{Host: "relay2.localhost", Port: 587}}}
+	sales, _ = c.Form("sales")
+	if !reflect.DeepEqual(sales.Relays, c.Relays) {
+		t.Fatalf("The sales form should take the top level relays. Got %+v\n", sales.Relays)
+	}
+	support, _ = c.Form("support")
+	if support.Relays != nil {
+		t.Fatalf("The support form has its own SMTP server, so should not take the top level relays. Got %+v\n", support.Relays)
+	}
+
+	_, found = c.Form("missing")
+	if found {
+		t.Fatalf("Found a form that is not in the config\n")
+	}
+}
+
+func TestSmtpTLSMode(t *testing.T) {
+	var modes = []struct {
+		smtp SmtpData
+		auth AuthData
+		mode string
+	}{
+		{SmtpData{Port: 465}, AuthData{}, SmtpTLSImplicit},
+		{SmtpData{Port: 587}, AuthData{}, SmtpTLSStartTLSRequired},
+		{SmtpData{Port: 587}, AuthData{Username: "me"}, SmtpTLSImplicit},
+		{SmtpData{Port: 587, TLS: SmtpTLSStartTLSRequired}, AuthData{Username: "me"}, SmtpTLSStartTLSRequired},
+		{SmtpData{Port: 25, TLS: "None"}, AuthData{}, SmtpTLSNone},
+		{SmtpData{Port: 465, TLS: SmtpTLSStartTLSOpportunistic}, AuthData{}, SmtpTLSStartTLSOpportunistic},
+	}
+	for _, m := range modes {
+		if mode := m.smtp.TLSMode(m.auth); mode != m.mode {
+			t.Fatalf("Expected the TLS mode of %+v with %+v to be %q but got %q\n", m.smtp, m.auth, m.mode, mode)
+		}
+	}
+}
+
+func TestAuthSecret(t *testing.T) {
+	t.Setenv("TEST_SMTP_PASSWORD", "from-env")
+	filename := filepath.Join(t.TempDir(), "password")
+	err := os.WriteFile(filename, []byte("from-file\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var secrets = []struct {
+		auth   AuthData
+		secret string
+	}{
+		{AuthData{Password: "from-config"}, "from-config"},
+		{AuthData{PasswordEnv: "TEST_SMTP_PASSWORD"}, "from-env"},
+		{AuthData{PasswordFile: filename}, "from-file"},
+		{AuthData{PasswordCommand: "echo from-command"}, "from-command"},
+	}
+	for _, s := range secrets {
+		secret, err := s.auth.Secret()
+		if err != nil || secret != s.secret {
+			t.Fatalf("Expected the secret of %+v to be %q but got %q %v\n", s.auth, s.secret, secret, err)
+		}
+	}
+	_, err = AuthData{PasswordCommand: "false"}.Secret()
+	if err == nil {
+		t.Fatalf("Expected an error from a failing password command\n")
+	}
+}
+
+func TestAuthSecretCommandCached(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "password")
+	err := os.WriteFile(filename, []byte("first\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := AuthData{PasswordCommand: "cat " + filename}
+	now := time.Now()
+	secret, err := cachedSecretCommand(auth.PasswordCommand, now)
+	if err != nil || secret != "first" {
+		t.Fatalf("Expected the secret %q but got %q %v\n", "first", secret, err)
+	}
+	err = os.WriteFile(filename, []byte("second\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the command is not run again until its password expires or is forgotten
+	secret, _ = cachedSecretCommand(auth.PasswordCommand, now.Add(time.Minute))
+	if secret != "first" {
+		t.Fatalf("Expected the cached secret %q but got %q\n", "first", secret)
+	}
+	secret, _ = cachedSecretCommand(auth.PasswordCommand, now.Add(DefaultSecretCommandCacheTime))
+	if secret != "second" {
+		t.Fatalf("Expected the expired secret to be read again but got %q\n", secret)
+	}
+	err = os.WriteFile(filename, []byte("third\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth.ForgetSecret()
+	secret, _ = auth.Secret()
+	if secret != "third" {
+		t.Fatalf("Expected the forgotten secret to be read again but got %q\n", secret)
+	}
+}
+
+func TestTenants(t *testing.T) {
+	c, err := ReadConfig(DefaultConfigFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Tenants["other"] = TenantData{Hosts: []string{"www.example.localhost"}}
+	var hosts = []struct {
+		host   string
+		tenant string
+		found  bool
+	}{
+		{"example.localhost", "example", true},
+		{"EXAMPLE.localhost", "example", true},
+		{"shop.example.localhost", "example", true},
+		{"www.example.localhost", "other", true}, // an exact match wins over a wildcard
+		{"notexample.localhost", "", false},
+		{"localhost", "", false},
+	}
+	for _, h := range hosts {
+		tenant, found := c.MatchTenant(h.host)
+		if tenant != h.tenant || found != h.found {
+			t.Fatalf("%s: expected tenant %q, %t but got %q, %t\n", h.host, h.tenant, h.found, tenant, found)
+		}
+	}
+
+	example, _ := c.Tenant("Example")
+	if !example.AllowsOrigin("https://www.example.localhost") || example.AllowsOrigin("https://example.localhost") {
+		t.Fatalf("The example tenant should only allow its configured origin\n")
+	}
+	other, _ := c.Tenant("other")
+	if !other.AllowsOrigin("https://www.example.localhost:8443") || !other.AllowsOrigin("http://www.example.localhost") ||
+		other.AllowsOrigin("https://evil.localhost") {
+		t.Fatalf("A tenant without allowed origins should only allow its own hosts\n")
+	}
+
+	top, _ := c.Form("")
+	f := example.Apply(top)
+	if f.Smtp != example.Smtp || f.Auth != example.Auth || f.Addresses != example.Addresses {
+		t.Fatalf("The example tenant's sections should replace the form's. Got %+v\n", f)
+	}
+	top.Transport = TransportData{Type: TransportFile, Dir: "/tmp/mail"}
+	if f := example.Apply(top); !f.Transport.IsSMTP() {
+		t.Fatalf("The example tenant's own Smtp section should replace the form's transport. Got %+v\n", f.Transport)
+	}
+	relays := []RelayData{{Smtp: SmtpData{Host: "relay.example.com", Port: 465}, Weight: 1}}
+	if f := (TenantData{Relays: relays}).Apply(top); !reflect.DeepEqual(f.Relays, relays) || f.Smtp != (SmtpData{}) {
+		t.Fatalf("A tenant's relays should replace the form's SMTP server. Got %+v %+v\n", f.Smtp, f.Relays)
+	}
+	example.Transport = TransportData{Type: TransportPostmark, APIKey: "key"}
+	if f := example.Apply(top); f.Transport != example.Transport {
+		t.Fatalf("The example tenant's transport should replace the form's. Got %+v\n", f.Transport)
+	}
+	if f.Templates != top.Templates || f.Subjects != top.Subjects {
+		t.Fatalf("The sections the tenant leaves out should come from the form. Got %+v\n", f)
+	}
+}
+
+func TestChanges(t *testing.T) {
+	old := newDefaultTestConfig()
+	new := newDefaultTestConfig()
+	if changes := Changes(old, new); len(changes) != 0 {
+		t.Fatalf("Expected no changes between two identical configs but got %v\n", changes)
+	}
+	new.Smtp.Port = 587
+	new.Fields["field2"] = FieldData{Name: "email", Type: "textRestricted"}
+	delete(new.Fields, "field4")
+	new.Forms["sales"] = FormData{Route: "/sales"}
+	expected := []string{"Smtp", "Fields.field2", "Fields.field4 (removed)", "Forms.sales (added)"}
+	if changes := Changes(old, new); !reflect.DeepEqual(changes, expected) {
+		t.Fatalf("Expected the changes %v but got %v\n", expected, changes)
+	}
+}
+
 func newDefaultTestConfig() *Config {
 	ec := new(Config)
 
@@ -124,6 +346,89 @@ func newDefaultTestConfig() *Config {
 	ec.Fields["field2"] = FieldData{Name: "email", Type: "email"}
 	ec.Fields["field3"] = FieldData{Name: "subject", Type: "textRestricted"}
 	ec.Fields["field4"] = FieldData{Name: "feedback", Type: "textUnrestricted"}
+	ec.Fields["field5"] = FieldData{Name: "screenshot", Type: "file", MaxSize: 1048576, MaxCount: 2, AllowedTypes: []string{"image/png", "image/jpeg"}}
+	minAge, maxAge := 8.0, 18.0
+	optional := false
+	ec.Fields["field6"] = FieldData{Name: "age", Type: "integer", Min: &minAge, Max: &maxAge}
+	ec.Fields["field7"] = FieldData{Name: "topic", Type: "select", AllowedValues: []string{"Go", "Python"}, Required: &optional, Default: "Go"}
+
+	ec.Queue.Dir = "/var/spool/emailformgateway"
+	ec.Queue.Workers = 2
+	ec.Queue.MaxAttempts = 10
+	ec.Queue.InitialBackoff = 30 * time.Second
+	ec.Queue.MaxBackoff = time.Hour
+
+	ec.Invalid.Policy = "reject"
+	ec.Invalid.FlaggedPrefix = "[FLAGGED]"
+	ec.Invalid.UnknownFields = "drop"
+
+	ec.Redirect.Success = "https://localhost/thanks.html"
+	ec.Redirect.Failure = "https://localhost/sorry.html"
+
+	ec.Cors.AllowedOrigins = []string{"https://localhost", "https://*.localhost"}
+	ec.Cors.AllowedMethods = []string{"POST"}
+	ec.Cors.AllowedHeaders = []string{"Content-Type"}
+	ec.Cors.MaxAge = 10 * time.Minute
+
+	ec.AntiSpam.Honeypots = []string{"website"}
+	ec.AntiSpam.Secret = "a-localhost-secret-for-the-tokens"
+	ec.AntiSpam.TokenField = "_token"
+	ec.AntiSpam.MinFillTime = 3 * time.Second
+	ec.AntiSpam.MaxTokenAge = 2 * time.Hour
+
+	ec.Scoring.Threshold = 5
+	ec.Scoring.Action = "quarantine"
+	ec.Scoring.QuarantineTo = "spam@localhost"
+	ec.Scoring.Links = ScoreRuleData{Score: 1, Max: 2}
+	ec.Scoring.Phrases = ScoreRuleData{Score: 3, List: []string{"crypto investment", "seo services"}}
+	ec.Scoring.DisposableEmail = ScoreRuleData{Score: 3}
+	ec.Scoring.Caps = ScoreRuleData{Score: 2, Ratio: 0.8}
+
+	ec.SpamFilter = SpamFilterData{Type: "spamd", Address: "localhost:783", User: "forms", Threshold: 10, Timeout: 5 * time.Second}
+
+	ec.EmailCheck = EmailCheckData{Mode: "deliverable", Disposable: true, Suggest: true, Timeout: 3 * time.Second}
+
+	ec.RateLimit.Store = "/var/lib/emailformgateway/ratelimit.json"
+	ec.RateLimit.PerIP = LimitData{Requests: 5, Per: time.Minute, Burst: 10}
+	ec.RateLimit.PerEmail = LimitData{Requests: 3, Per: time.Hour}
+	ec.RateLimit.Global = LimitData{Requests: 1000, Per: time.Hour}
+
+	ec.Proxies.Trusted = []string{"127.0.0.1", "10.0.0.0/8"}
+	ec.Proxies.Header = "Forwarded"
+
+	ec.Forms = make(map[string]FormData)
+	var support FormData
+	support.Route = "/support"
+	support.Smtp.Host = "smtp.support.localhost"
+	support.Smtp.Port = 587
+	support.Subjects.Customer = "Thank you for contacting localhost support!"
+	support.Subjects.System = "Localhost Support Form Message:"
+	support.Cors.AllowedOrigins = []string{"https://support.localhost"}
+	support.Captcha.Provider = "hcaptcha"
+	support.Captcha.Secret = "0x0000000000000000000000000000000000000000"
+	support.Fields = make(map[string]FieldData)
+	support.Fields["field1"] = FieldData{Name: "email", Type: "email"}
+	support.Fields["field2"] = FieldData{Name: "problem", Type: "textUnrestricted"}
+	ec.Forms["support"] = support
+
+	ec.Tenants = make(map[string]TenantData)
+	var example TenantData
+	example.Hosts = []string{"example.localhost", "*.example.localhost"}
+	example.Domain = "example.localhost"
+	example.AllowedOrigins = []string{"https://www.example.localhost"}
+	example.Smtp.Host = "smtp.example.localhost"
+	example.Smtp.Port = 465
+	example.Auth.Username = "example.user@localhost"
+	example.Auth.Password = "password456"
+	example.Addresses.CustomerFrom = "do-not-reply@example.localhost"
+	example.Addresses.CustomerFromName = "Example Contact Us"
+	example.Addresses.CustomerReplyTo = "do-not-reply@example.localhost"
+	example.Addresses.SystemTo = "to@example.localhost"
+	example.Addresses.SystemToName = "Example Contact Us Form"
+	example.Addresses.SystemFrom = "do-not-reply@example.localhost"
+	example.Addresses.SystemFromName = "Example Contact Us Form"
+	example.Addresses.SystemReplyTo = "do-not-reply@example.localhost"
+	ec.Tenants["example"] = example
 
 	return ec
 }
@@ -147,12 +452,48 @@ func verifyConfigs(c, ec *Config) error {
 	if c.Templates != ec.Templates {
 		return fmt.Errorf("Templates\nGot\n%+v\nExpected\n%+v\n", c.Templates, ec.Templates)
 	}
+	if c.Queue != ec.Queue {
+		return fmt.Errorf("Queue\nGot\n%+v\nExpected\n%+v\n", c.Queue, ec.Queue)
+	}
+	if c.Invalid != ec.Invalid {
+		return fmt.Errorf("Invalid\nGot\n%+v\nExpected\n%+v\n", c.Invalid, ec.Invalid)
+	}
+	if c.Redirect != ec.Redirect {
+		return fmt.Errorf("Redirect\nGot\n%+v\nExpected\n%+v\n", c.Redirect, ec.Redirect)
+	}
+	if !reflect.DeepEqual(c.Cors, ec.Cors) {
+		return fmt.Errorf("Cors\nGot\n%+v\nExpected\n%+v\n", c.Cors, ec.Cors)
+	}
+	if !reflect.DeepEqual(c.AntiSpam, ec.AntiSpam) {
+		return fmt.Errorf("AntiSpam\nGot\n%+v\nExpected\n%+v\n", c.AntiSpam, ec.AntiSpam)
+	}
+	if !reflect.DeepEqual(c.Scoring, ec.Scoring) {
+		return fmt.Errorf("Scoring\nGot\n%+v\nExpected\n%+v\n", c.Scoring, ec.Scoring)
+	}
+	if c.SpamFilter != ec.SpamFilter {
+		return fmt.Errorf("SpamFilter\nGot\n%+v\nExpected\n%+v\n", c.SpamFilter, ec.SpamFilter)
+	}
+	if c.EmailCheck != ec.EmailCheck {
+		return fmt.Errorf("EmailCheck\nGot\n%+v\nExpected\n%+v\n", c.EmailCheck, ec.EmailCheck)
+	}
+	if c.RateLimit != ec.RateLimit {
+		return fmt.Errorf("RateLimit\nGot\n%+v\nExpected\n%+v\n", c.RateLimit, ec.RateLimit)
+	}
+	if !reflect.DeepEqual(c.Proxies, ec.Proxies) {
+		return fmt.Errorf("Proxies\nGot\n%+v\nExpected\n%+v\n", c.Proxies, ec.Proxies)
+	}
+	if !reflect.DeepEqual(c.Forms, ec.Forms) {
+		return fmt.Errorf("Forms\nGot\n%+v\nExpected\n%+v\n", c.Forms, ec.Forms)
+	}
+	if !reflect.DeepEqual(c.Tenants, ec.Tenants) {
+		return fmt.Errorf("Tenants\nGot\n%+v\nExpected\n%+v\n", c.Tenants, ec.Tenants)
+	}
 	for k, f := range c.Fields {
 		value, found := ec.Fields[k]
 		if !found {
 			return fmt.Errorf("Fields[%s]: Can't find key: %q", k, k)
 		}
-		if value != f {
+		if !reflect.DeepEqual(value, f) {
 			return fmt.Errorf("Fields\nGot: Fields[%s]=%+v\nExpected: Fields[%s]=%+v. ", k, value, k, f)
 		}
 	}
@@ -0,0 +1,805 @@
+// Copyright (c) 2024 Owen Waller. All rights reserved.
+package config
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/url"
+	"os"
+	"os/exec"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// ConfigValidationError lists every problem found in a config. Each problem starts with
+// the TOML key it is about, e.g. "Forms.support.Smtp.Port: 0 is not a valid port".
+type ConfigValidationError struct {
+	Problems []string
+}
+
+func NewConfigValidationError(problems []string) ConfigValidationError {
+	return ConfigValidationError{problems}
+}
+
+func (e ConfigValidationError) Error() string {
+	return fmt.Sprintf("The config has %d problem(s):\n%s", len(e.Problems), strings.Join(e.Problems, "\n"))
+}
+
+var fieldTypes = map[string]bool{
+	FieldTypeEmail:            true,
+	FieldTypeTextRestricted:   true,
+	FieldTypeTextUnrestricted: true,
+	FieldTypeFile:             true,
+	FieldTypeInteger:          true,
+	FieldTypeDecimal:          true,
+	FieldTypePhone:            true,
+	FieldTypeURL:              true,
+	FieldTypeDate:             true,
+	FieldTypeDateTime:         true,
+	FieldTypeSelect:           true,
+	FieldTypeEnum:             true,
+	FieldTypeMultiSelect:      true,
+	FieldTypeCheckbox:         true,
+	FieldTypeBoolean:          true,
+}
+
+var captchaProviders = map[string]bool{
+	CaptchaProviderHCaptcha:  true,
+	CaptchaProviderRecaptcha: true,
+	CaptchaProviderTurnstile: true,
+}
+
+var spamFilters = map[string]bool{
+	SpamFilterSpamd:  true,
+	SpamFilterRspamd: true,
+}
+
+var smtpTLSModes = map[string]bool{
+	SmtpTLSImplicit:              true,
+	SmtpTLSStartTLSRequired:      true,
+	SmtpTLSStartTLSOpportunistic: true,
+	SmtpTLSNone:                  true,
+}
+
+var authMechanisms = map[string]bool{
+	AuthPlain:       true,
+	AuthLogin:       true,
+	AuthCramMD5:     true,
+	AuthXOAuth2:     true,
+	AuthOAuthBearer: true,
+}
+
+var transports = map[string]bool{
+	TransportSMTP:     true,
+	TransportSendmail: true,
+	TransportMaildir:  true,
+	TransportFile:     true,
+	TransportSendGrid: true,
+	TransportMailgun:  true,
+	TransportPostmark: true,
+	TransportSES:      true,
+}
+
+// httpTransports are the transports that post the email to a mail service's HTTP API.
+var httpTransports = []string{TransportSendGrid, TransportMailgun, TransportPostmark, TransportSES}
+
+var invalidPolicies = map[string]bool{
+	InvalidPolicyReject:     true,
+	InvalidPolicyFlag:       true,
+	InvalidPolicyQuarantine: true,
+}
+
+var unknownFieldsPolicies = map[string]bool{
+	UnknownFieldsKeep:   true,
+	UnknownFieldsDrop:   true,
+	UnknownFieldsReject: true,
+}
+
+// FormNames returns the names of the forms that are served, the top level form has an empty name.
+// The top level form is not served if the config only has named forms.
+func (c *Config) FormNames() []string {
+	var names []string
+	if len(c.Forms) == 0 || len(c.Fields) != 0 {
+		names = append(names, "")
+	}
+	return append(names, sortedNames(c.Forms)...)
+}
+
+// Validate checks everything the gateway needs from the config before a form is submitted,
+// as each form will be used. A problem with a section a form takes from the top level is reported
+// against the top level key, once. It returns a ConfigValidationError, or nil if there are no problems.
+func (c *Config) Validate() error {
+	v := new(validator)
+	for _, name := range c.FormNames() {
+		v.form(c, name)
+	}
+	for _, name := range sortedNames(c.Tenants) {
+		v.tenant(name, c.Tenants[name])
+	}
+	v.rateLimit(c.RateLimit)
+	v.proxies(c.Proxies)
+	v.queue(c.Queue)
+	if len(v.problems) == 0 {
+		return nil
+	}
+	return NewConfigValidationError(v.problems)
+}
+
+type validator struct {
+	problems []string
+	seen     map[string]bool
+}
+
+func (v *validator) add(key, format string, args ...interface{}) {
+	p := key + ": " + fmt.Sprintf(format, args...)
+	if v.seen == nil {
+		v.seen = make(map[string]bool)
+	}
+	if !v.seen[p] {
+		v.seen[p] = true
+		v.problems = append(v.problems, p)
+	}
+}
+
+func (v *validator) form(c *Config, name string) {
+	f, _ := c.Form(name)
+	own := FormData{}
+	prefix := ""
+	if name != "" {
+		own = c.Forms[name]
+		prefix = "Forms." + name + "."
+		if !strings.HasPrefix(f.Route, "/") {
+			v.add(prefix+"Route", "%q does not start with \"/\"", f.Route)
+		}
+	}
+	// where each section comes from
+	section := func(s string, isOwn bool) string {
+		if isOwn {
+			return prefix + s
+		}
+		return s
+	}
+	ownSmtp := own.Smtp != (SmtpData{}) || own.Relays != nil
+	v.transport(section("Transport", ownSmtp || own.Transport != (TransportData{})), f.Transport)
+	if f.Transport.IsSMTP() && len(f.Relays) != 0 {
+		v.relays(section("", ownSmtp), f.Smtp, f.Auth, f.Relays)
+	} else if f.Transport.IsSMTP() {
+		v.smtp(section("Smtp", ownSmtp), f.Smtp)
+		v.auth(section("Auth", ownSmtp), f.Auth)
+	}
+	v.addresses(section("Addresses", own.Addresses != (EmailAddressData{})), f.Addresses, true)
+	v.templates(section("Templates", own.Templates != (EmailTemplatesData{})), f.Templates)
+	v.fields(section("Fields", own.Fields != nil), f.Fields)
+	v.invalid(section("Invalid", own.Invalid != (InvalidFormData{})), f.Invalid)
+	v.redirect(section("Redirect", own.Redirect != (RedirectData{})), f.Redirect)
+	v.cors(section("Cors", !reflect.DeepEqual(own.Cors, CorsData{})), f.Cors)
+	v.antiSpam(section("AntiSpam", !reflect.DeepEqual(own.AntiSpam, AntiSpamData{})), f.AntiSpam, f.Fields)
+	v.captcha(section("Captcha", own.Captcha != (CaptchaData{})), f.Captcha)
+	v.scoring(section("Scoring", !reflect.DeepEqual(own.Scoring, ScoringData{})), f.Scoring)
+	v.spamFilter(section("SpamFilter", own.SpamFilter != (SpamFilterData{})), f.SpamFilter)
+	v.emailCheck(section("EmailCheck", own.EmailCheck != (EmailCheckData{})), f.EmailCheck)
+}
+
+// tenant checks the sections a tenant sets, the rest come from the forms.
+func (v *validator) tenant(name string, t TenantData) {
+	prefix := "Tenants." + name + "."
+	if len(t.Hosts) == 0 {
+		v.add(prefix+"Hosts", "no hosts, so the tenant can never be used")
+	}
+	for _, o := range t.AllowedOrigins {
+		v.origin(prefix+"AllowedOrigins", o)
+	}
+	if len(t.Relays) != 0 {
+		v.relays(prefix, t.Smtp, t.Auth, t.Relays)
+	} else if t.Smtp != (SmtpData{}) {
+		v.smtp(prefix+"Smtp", t.Smtp)
+		v.auth(prefix+"Auth", t.Auth)
+	} else if t.Auth != (AuthData{}) {
+		v.add(prefix+"Auth", "is only used with the tenant's own Smtp section, which is missing")
+	}
+	if t.Transport != (TransportData{}) {
+		v.transport(prefix+"Transport", t.Transport)
+	}
+	if t.Addresses != (EmailAddressData{}) {
+		v.addresses(prefix+"Addresses", t.Addresses, true)
+	}
+	if t.Templates != (EmailTemplatesData{}) {
+		v.templates(prefix+"Templates", t.Templates)
+	}
+}
+
+// transport checks the transport has the settings it needs, and none that it does not use.
+func (v *validator) transport(key string, t TransportData) {
+	transport := strings.ToLower(t.Type)
+	if transport == "" {
+		transport = TransportSMTP
+	}
+	if !transports[transport] {
+		v.add(key+".Type", "%q is not a known transport", t.Type)
+		return
+	}
+	fileTransports := []string{TransportMaildir, TransportFile}
+	var settings = []struct {
+		name     string
+		value    string
+		usedBy   []string
+		required bool
+	}{
+		{"Command", t.Command, []string{TransportSendmail}, false},
+		{"Dir", t.Dir, fileTransports, true},
+		{"URL", t.URL, httpTransports, false},
+		{"APIKey", t.APIKey, httpTransports, true},
+		{"Secret", t.Secret, []string{TransportSES}, true},
+		{"Domain", t.Domain, []string{TransportMailgun}, true},
+		{"Region", t.Region, []string{TransportSES}, t.URL == ""},
+	}
+	for _, s := range settings {
+		used := contains(s.usedBy, transport)
+		switch {
+		case s.value == "" && used && s.required:
+			v.add(key+"."+s.name, "is empty")
+		case s.value != "" && !used:
+			v.add(key+"."+s.name, "is only used by %s", quoteList(s.usedBy))
+		}
+	}
+	if t.URL != "" && contains(httpTransports, transport) {
+		u, err := url.Parse(t.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			v.add(key+".URL", "%q is not an http or https URL", t.URL)
+		}
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+// quoteList quotes the names and joins them e.g. "maildir" and "file".
+func quoteList(names []string) string {
+	quoted := make([]string, len(names))
+	for i, n := range names {
+		quoted[i] = fmt.Sprintf("%q", n)
+	}
+	if len(quoted) == 1 {
+		return quoted[0]
+	}
+	return strings.Join(quoted[:len(quoted)-1], ", ") + " and " + quoted[len(quoted)-1]
+}
+
+func (v *validator) smtp(key string, s SmtpData) {
+	if s.Host == "" {
+		v.add(key+".Host", "is empty")
+	}
+	if s.Port < 1 || s.Port > 65535 {
+		v.add(key+".Port", "%d is not a valid port", s.Port)
+	}
+	if s.TLS != "" && !smtpTLSModes[strings.ToLower(s.TLS)] {
+		v.add(key+".TLS", "%q is not a known TLS mode", s.TLS)
+	}
+	if _, found := TLSVersion(s.MinTLSVersion); s.MinTLSVersion != "" && !found {
+		v.add(key+".MinTLSVersion", "%q is not a TLS version", s.MinTLSVersion)
+	}
+	if s.CAFile != "" {
+		_, err := loadCAFile(s.CAFile)
+		if err != nil {
+			v.add(key+".CAFile", "%s", err)
+		}
+	}
+	if (s.CertFile == "") != (s.KeyFile == "") {
+		v.add(key, "needs both a CertFile and a KeyFile, or neither")
+	} else if s.CertFile != "" {
+		_, err := tls.LoadX509KeyPair(s.CertFile, s.KeyFile)
+		if err != nil {
+			v.add(key+".CertFile", "can't load the client certificate: %s", err)
+		}
+	}
+	if s.MaxConnections < 0 {
+		v.add(key+".MaxConnections", "%d is not a number of connections", s.MaxConnections)
+	}
+}
+
+// relays checks each relay, and that the Smtp and Auth sections the relays replace are not set.
+func (v *validator) relays(prefix string, s SmtpData, a AuthData, relays []RelayData) {
+	if s != (SmtpData{}) {
+		v.add(prefix+"Smtp", "is not used as the emails are sent through the Relays")
+	}
+	if a != (AuthData{}) {
+		v.add(prefix+"Auth", "is not used as the emails are sent through the Relays")
+	}
+	for i, r := range relays {
+		key := fmt.Sprintf("%sRelays[%d]", prefix, i)
+		v.smtp(key+".Smtp", r.Smtp)
+		v.auth(key+".Auth", r.Auth)
+		if r.Weight < 0 {
+			v.add(key+".Weight", "%d is not a weight", r.Weight)
+		}
+	}
+}
+
+func (v *validator) auth(key string, a AuthData) {
+	mechanism := a.AuthMechanism()
+	if !authMechanisms[mechanism] {
+		v.add(key+".Mechanism", "%q is not a known mechanism", a.Mechanism)
+	}
+	var sources []string
+	for _, s := range []struct{ name, value string }{
+		{"Password", a.Password},
+		{"PasswordEnv", a.PasswordEnv},
+		{"PasswordFile", a.PasswordFile},
+		{"PasswordCommand", a.PasswordCommand},
+		{"TokenURL", a.TokenURL},
+	} {
+		if s.value != "" {
+			sources = append(sources, s.name)
+		}
+	}
+	if (a.Username == "") != (len(sources) == 0) {
+		v.add(key, "needs both a Username and a Password, or neither")
+	}
+	if len(sources) > 1 {
+		v.add(key, "only one of %s can be given", strings.Join(sources, ", "))
+	}
+	oauth := []string{AuthXOAuth2, AuthOAuthBearer}
+	if a.TokenURL != "" {
+		if !contains(oauth, mechanism) {
+			v.add(key+".TokenURL", "is only used by %s", quoteList(oauth))
+		}
+		u, err := url.Parse(a.TokenURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			v.add(key+".TokenURL", "%q is not an http or https URL", a.TokenURL)
+		}
+	}
+	// an empty password would otherwise only be found when an email is sent
+	if secret, found := os.LookupEnv(a.PasswordEnv); a.PasswordEnv != "" && !found {
+		v.add(key+".PasswordEnv", "%s is not set", a.PasswordEnv)
+	} else if a.PasswordEnv != "" && secret == "" {
+		v.add(key+".PasswordEnv", "%s is empty", a.PasswordEnv)
+	}
+	if a.PasswordFile != "" {
+		b, err := os.ReadFile(a.PasswordFile)
+		if err != nil {
+			v.add(key+".PasswordFile", "can't read the password file %q", a.PasswordFile)
+		} else if strings.TrimRight(string(b), "\r\n") == "" {
+			v.add(key+".PasswordFile", "the password file %q is empty", a.PasswordFile)
+		}
+	}
+	if args := strings.Fields(a.PasswordCommand); len(args) != 0 {
+		_, err := exec.LookPath(args[0])
+		if err != nil {
+			v.add(key+".PasswordCommand", "%q is not a command that can be run", args[0])
+		}
+	}
+}
+
+func (v *validator) addresses(key string, a EmailAddressData, required bool) {
+	var addresses = []struct {
+		name     string
+		address  string
+		required bool
+	}{
+		{"CustomerFrom", a.CustomerFrom, required},
+		{"CustomerReplyTo", a.CustomerReplyTo, false},
+		{"SystemTo", a.SystemTo, required},
+		{"SystemFrom", a.SystemFrom, required},
+		{"SystemReplyTo", a.SystemReplyTo, false},
+	}
+	for _, addr := range addresses {
+		if addr.address == "" {
+			if addr.required {
+				v.add(key+"."+addr.name, "is empty")
+			}
+			continue
+		}
+		_, err := mail.ParseAddress(addr.address)
+		if err != nil {
+			v.add(key+"."+addr.name, "%q is not an email address", addr.address)
+		}
+	}
+}
+
+func (v *validator) templates(key string, t EmailTemplatesData) {
+	t.setFileNames()
+	var templates = []struct {
+		name     string
+		template string
+		filename string
+	}{
+		{"CustomerText", t.CustomerText, t.CustomerTextFileName},
+		{"CustomerHtml", t.CustomerHtml, t.CustomerHtmlFileName},
+		{"SystemText", t.SystemText, t.SystemTextFileName},
+		{"SystemHtml", t.SystemHtml, t.SystemHtmlFileName},
+	}
+	for _, tmpl := range templates {
+		if tmpl.template == "" {
+			v.add(key+"."+tmpl.name, "is empty")
+			continue
+		}
+		info, err := os.Stat(tmpl.filename)
+		if err != nil {
+			v.add(key+"."+tmpl.name, "can't read the template %q", tmpl.filename)
+		} else if info.IsDir() {
+			v.add(key+"."+tmpl.name, "%q is a directory", tmpl.filename)
+		}
+	}
+}
+
+func (v *validator) fields(key string, fields map[string]FieldData) {
+	if len(fields) == 0 {
+		v.add(key, "the form has no fields")
+	}
+	names := make(map[string]string) // field name to the key that declared it
+	for _, k := range sortedNames(fields) {
+		f := fields[k]
+		fk := key + "." + k
+		if f.Name == "" {
+			v.add(fk+".Name", "is empty")
+		} else if other, found := names[strings.ToLower(f.Name)]; found {
+			v.add(fk+".Name", "%q is already used by %s", f.Name, other)
+		} else {
+			names[strings.ToLower(f.Name)] = fk
+		}
+		t := strings.ToLower(f.Type)
+		if !fieldTypes[t] {
+			v.add(fk+".Type", "%q is not a known field type", f.Type)
+		}
+		v.fieldRange(fk, t, f)
+		v.fieldValues(fk, t, f)
+		v.fieldConstraints(fk, f)
+		if t != FieldTypeFile {
+			continue
+		}
+		if f.MaxSize < 0 {
+			v.add(fk+".MaxSize", "%d is negative", f.MaxSize)
+		}
+		if f.MaxCount < 0 {
+			v.add(fk+".MaxCount", "%d is negative", f.MaxCount)
+		}
+		for _, a := range f.AllowedTypes {
+			if !strings.Contains(a, "/") {
+				v.add(fk+".AllowedTypes", "%q is not a MIME type", a)
+			}
+		}
+	}
+}
+
+// fieldRange checks the range of a number field.
+func (v *validator) fieldRange(key, t string, f FieldData) {
+	if f.Min == nil && f.Max == nil {
+		return
+	}
+	if t != FieldTypeInteger && t != FieldTypeDecimal {
+		v.add(key, "Min and Max are only used by %q and %q fields", FieldTypeInteger, FieldTypeDecimal)
+		return
+	}
+	if f.Min != nil && f.Max != nil && *f.Min > *f.Max {
+		v.add(key, "Min %g is more than Max %g", *f.Min, *f.Max)
+	}
+}
+
+// fieldConstraints checks the lengths, the pattern and the default of a field.
+func (v *validator) fieldConstraints(key string, f FieldData) {
+	if f.MinLength < 0 {
+		v.add(key+".MinLength", "%d is negative", f.MinLength)
+	}
+	if f.MaxLength < 0 {
+		v.add(key+".MaxLength", "%d is negative", f.MaxLength)
+	}
+	if f.MaxLength > 0 && f.MinLength > f.MaxLength {
+		v.add(key, "MinLength %d is more than MaxLength %d", f.MinLength, f.MaxLength)
+	}
+	if f.Pattern != "" {
+		_, err := regexp.Compile(f.Pattern)
+		if err != nil {
+			v.add(key+".Pattern", "%q is not a regexp: %s", f.Pattern, err)
+		}
+	}
+	if f.Default != "" && f.IsRequired() {
+		v.add(key+".Default", "is never used as the field is required")
+	}
+}
+
+// fieldValues checks the values that can be chosen in a select field.
+func (v *validator) fieldValues(key, t string, f FieldData) {
+	choice := t == FieldTypeSelect || t == FieldTypeEnum || t == FieldTypeMultiSelect
+	if !choice {
+		if len(f.AllowedValues) != 0 {
+			v.add(key+".AllowedValues", "is only used by %q and %q fields", FieldTypeSelect, FieldTypeMultiSelect)
+		}
+		return
+	}
+	if len(f.AllowedValues) == 0 {
+		v.add(key+".AllowedValues", "no values, so nothing can be chosen")
+	}
+	seen := make(map[string]bool)
+	for _, a := range f.AllowedValues {
+		if seen[strings.ToLower(a)] {
+			v.add(key+".AllowedValues", "%q is listed more than once", a)
+		}
+		seen[strings.ToLower(a)] = true
+	}
+}
+
+func (v *validator) invalid(key string, i InvalidFormData) {
+	if i.Policy != "" && !invalidPolicies[strings.ToLower(i.Policy)] {
+		v.add(key+".Policy", "%q is not a known policy", i.Policy)
+	}
+	if i.UnknownFields != "" && !unknownFieldsPolicies[strings.ToLower(i.UnknownFields)] {
+		v.add(key+".UnknownFields", "%q is not a known policy", i.UnknownFields)
+	}
+}
+
+func (v *validator) redirect(key string, r RedirectData) {
+	for _, u := range []struct{ name, url string }{{"Success", r.Success}, {"Failure", r.Failure}} {
+		if u.url == "" {
+			continue
+		}
+		parsed, err := url.Parse(u.url)
+		if err != nil || !parsed.IsAbs() {
+			v.add(key+"."+u.name, "%q is not an absolute URL", u.url)
+		}
+	}
+}
+
+func (v *validator) cors(key string, cd CorsData) {
+	for _, o := range cd.AllowedOrigins {
+		v.origin(key+".AllowedOrigins", o)
+	}
+	if cd.MaxAge < 0 {
+		v.add(key+".MaxAge", "%s is negative", cd.MaxAge)
+	}
+}
+
+func (v *validator) origin(key, origin string) {
+	if origin == "*" {
+		return
+	}
+	if strings.Count(origin, "*") > 1 {
+		v.add(key, "%q has more than one wildcard", origin)
+	}
+	if !strings.Contains(origin, "://") {
+		v.add(key, "%q has no scheme, e.g. https://", origin)
+	}
+}
+
+// minSecretLength is the shortest AntiSpam.Secret accepted, a short secret can be guessed from the tokens.
+const minSecretLength = 16
+
+func (v *validator) antiSpam(key string, a AntiSpamData, fields map[string]FieldData) {
+	for _, h := range a.Honeypots {
+		if h == "" {
+			v.add(key+".Honeypots", "has an empty field name")
+			continue
+		}
+		for k, f := range fields {
+			if strings.EqualFold(f.Name, h) {
+				v.add(key+".Honeypots", "%q is also the name of Fields.%s", h, k)
+			}
+		}
+	}
+	if a.Secret == "" {
+		if a.MinFillTime != 0 || a.MaxTokenAge != 0 || a.TokenField != "" {
+			v.add(key+".Secret", "is empty, so the form has no tokens to check")
+		}
+		return
+	}
+	if len(a.Secret) < minSecretLength {
+		v.add(key+".Secret", "is shorter than %d characters", minSecretLength)
+	}
+	if a.MinFillTime < 0 {
+		v.add(key+".MinFillTime", "%s is negative", a.MinFillTime)
+	}
+	if a.MaxTokenAge < 0 {
+		v.add(key+".MaxTokenAge", "%s is negative", a.MaxTokenAge)
+	}
+	maxAge := a.MaxTokenAge
+	if maxAge == 0 {
+		maxAge = DefaultMaxTokenAge
+	}
+	if a.MinFillTime >= maxAge {
+		v.add(key+".MinFillTime", "%s is not shorter than the MaxTokenAge of %s", a.MinFillTime, maxAge)
+	}
+}
+
+func (v *validator) captcha(key string, cd CaptchaData) {
+	if cd.Provider == "" {
+		if cd != (CaptchaData{}) {
+			v.add(key+".Provider", "is empty, so the form has no CAPTCHA")
+		}
+		return
+	}
+	provider := strings.ToLower(cd.Provider)
+	if !captchaProviders[provider] {
+		v.add(key+".Provider", "%q is not a known CAPTCHA provider", cd.Provider)
+	}
+	if cd.Secret == "" {
+		v.add(key+".Secret", "is empty")
+	}
+	if cd.MinScore < 0 || cd.MinScore > 1 {
+		v.add(key+".MinScore", "%g is not between 0 and 1", cd.MinScore)
+	}
+	if provider != CaptchaProviderRecaptcha && (cd.MinScore != 0 || cd.Action != "") {
+		v.add(key, "MinScore and Action are only used by %q", CaptchaProviderRecaptcha)
+	}
+	if cd.VerifyURL != "" {
+		u, err := url.Parse(cd.VerifyURL)
+		if err != nil || !u.IsAbs() {
+			v.add(key+".VerifyURL", "%q is not an absolute URL", cd.VerifyURL)
+		}
+	}
+	if cd.Timeout < 0 {
+		v.add(key+".Timeout", "%s is negative", cd.Timeout)
+	}
+}
+
+func (v *validator) scoring(key string, sd ScoringData) {
+	if sd.Threshold < 0 {
+		v.add(key+".Threshold", "%g is negative", sd.Threshold)
+	}
+	switch strings.ToLower(sd.Action) {
+	case "", ScoreActionReject, ScoreActionQuarantine:
+	default:
+		v.add(key+".Action", "%q is not a known action", sd.Action)
+	}
+	if sd.QuarantineTo != "" {
+		_, err := mail.ParseAddress(sd.QuarantineTo)
+		if err != nil {
+			v.add(key+".QuarantineTo", "%q is not an email address", sd.QuarantineTo)
+		}
+	}
+	var rules = []struct {
+		name string
+		rule ScoreRuleData
+	}{
+		{"Links", sd.Links},
+		{"Phrases", sd.Phrases},
+		{"Shorteners", sd.Shorteners},
+		{"RepeatedChars", sd.RepeatedChars},
+		{"MixedScripts", sd.MixedScripts},
+		{"DisposableEmail", sd.DisposableEmail},
+		{"Caps", sd.Caps},
+	}
+	for _, r := range rules {
+		rk := key + "." + r.name
+		if r.rule.Score < 0 {
+			v.add(rk+".Score", "%g is negative", r.rule.Score)
+		}
+		if r.rule.Max < 0 {
+			v.add(rk+".Max", "%d is negative", r.rule.Max)
+		}
+		if r.rule.Ratio < 0 || r.rule.Ratio > 1 {
+			v.add(rk+".Ratio", "%g is not between 0 and 1", r.rule.Ratio)
+		}
+		if r.rule.File != "" {
+			f, err := os.Open(r.rule.File)
+			if err != nil {
+				v.add(rk+".File", "can't read the list %q", r.rule.File)
+			} else {
+				f.Close()
+			}
+		}
+	}
+}
+
+func (v *validator) spamFilter(key string, fd SpamFilterData) {
+	if fd.Type == "" {
+		if fd != (SpamFilterData{}) {
+			v.add(key+".Type", "is empty, so the form has no spam filter")
+		}
+		return
+	}
+	filter := strings.ToLower(fd.Type)
+	if !spamFilters[filter] {
+		v.add(key+".Type", "%q is not a known spam filter", fd.Type)
+	}
+	switch {
+	case fd.Address == "":
+		v.add(key+".Address", "is empty")
+	case filter == SpamFilterSpamd:
+		_, port, err := net.SplitHostPort(fd.Address)
+		if err != nil || port == "" {
+			v.add(key+".Address", "%q is not a host:port", fd.Address)
+		}
+	case filter == SpamFilterRspamd:
+		u, err := url.Parse(fd.Address)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			v.add(key+".Address", "%q is not an http or https URL", fd.Address)
+		}
+	}
+	if fd.User != "" && filter != SpamFilterSpamd {
+		v.add(key+".User", "is only used by %q", SpamFilterSpamd)
+	}
+	if fd.Password != "" && filter != SpamFilterRspamd {
+		v.add(key+".Password", "is only used by %q", SpamFilterRspamd)
+	}
+	if fd.Threshold < 0 {
+		v.add(key+".Threshold", "%g is negative", fd.Threshold)
+	}
+	if fd.Timeout < 0 {
+		v.add(key+".Timeout", "%s is negative", fd.Timeout)
+	}
+}
+
+func (v *validator) emailCheck(key string, ed EmailCheckData) {
+	switch strings.ToLower(ed.Mode) {
+	case "", EmailCheckSyntax, EmailCheckDeliverable:
+	default:
+		v.add(key+".Mode", "%q is not a known mode", ed.Mode)
+	}
+	if ed.DisposableFile != "" {
+		if !ed.Disposable {
+			v.add(key+".DisposableFile", "is only used when Disposable is true")
+		}
+		f, err := os.Open(ed.DisposableFile)
+		if err != nil {
+			v.add(key+".DisposableFile", "can't read the list %q", ed.DisposableFile)
+		} else {
+			f.Close()
+		}
+	}
+	if ed.Timeout < 0 {
+		v.add(key+".Timeout", "%s is negative", ed.Timeout)
+	}
+}
+
+func (v *validator) rateLimit(rd RateLimitData) {
+	var limits = []struct {
+		name  string
+		limit LimitData
+	}{
+		{"PerIP", rd.PerIP},
+		{"PerEmail", rd.PerEmail},
+		{"Global", rd.Global},
+	}
+	for _, l := range limits {
+		key := "RateLimit." + l.name
+		if l.limit.Requests < 0 {
+			v.add(key+".Requests", "%d is negative", l.limit.Requests)
+		}
+		if l.limit.Burst < 0 {
+			v.add(key+".Burst", "%d is negative", l.limit.Burst)
+		}
+		if l.limit.Requests > 0 && l.limit.Per <= 0 {
+			v.add(key+".Per", "%s is not a time to spread the Requests over", l.limit.Per)
+		}
+	}
+}
+
+func (v *validator) proxies(p ProxiesData) {
+	switch strings.ToLower(p.Header) {
+	case "", strings.ToLower(ProxyHeaderXForwardedFor), strings.ToLower(ProxyHeaderXRealIP), strings.ToLower(ProxyHeaderForwarded):
+	default:
+		v.add("Proxies.Header", "%q is not a header the gateway can take the client's IP address from", p.Header)
+	}
+	for _, t := range p.Trusted {
+		_, err := ProxiesData{Trusted: []string{t}}.Prefixes()
+		if err != nil {
+			v.add("Proxies.Trusted", "%q is not an IP address or CIDR range", t)
+		}
+	}
+}
+
+func (v *validator) queue(q QueueData) {
+	if q.Workers < 0 {
+		v.add("Queue.Workers", "%d is negative", q.Workers)
+	}
+	if q.MaxAttempts < 0 {
+		v.add("Queue.MaxAttempts", "%d is negative", q.MaxAttempts)
+	}
+	if q.InitialBackoff < 0 {
+		v.add("Queue.InitialBackoff", "%s is negative", q.InitialBackoff)
+	}
+	if q.MaxBackoff < 0 {
+		v.add("Queue.MaxBackoff", "%s is negative", q.MaxBackoff)
+	}
+	if q.InitialBackoff > 0 && q.MaxBackoff > 0 && q.InitialBackoff > q.MaxBackoff {
+		v.add("Queue.InitialBackoff", "%s is longer than the MaxBackoff of %s", q.InitialBackoff, q.MaxBackoff)
+	}
+}
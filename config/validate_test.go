@@ -0,0 +1,152 @@
+// Copyright (c) 2024 Owen Waller. All rights reserved.
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newValidTestConfig uses the templates in the root of the repository.
+func newValidTestConfig() *Config {
+	c := new(Config)
+	c.Smtp = SmtpData{Host: "localhost", Port: 25}
+	c.Addresses = EmailAddressData{CustomerFrom: "from@example.com", SystemTo: "to@example.com", SystemFrom: "from@example.com"}
+	c.Templates = EmailTemplatesData{Dir: "..", CustomerText: "customer-email-text.template", CustomerHtml: "customer-email-html.template",
+		SystemText: "system-email-text.template", SystemHtml: "system-email-html.template"}
+	c.Fields = map[string]FieldData{
+		"field1": {Name: "name", Type: "textRestricted"},
+		"field2": {Name: "email", Type: "email"},
+	}
+	return c
+}
+
+func TestValidate(t *testing.T) {
+	c := newValidTestConfig()
+	err := c.Validate()
+	if err != nil {
+		t.Fatalf("Expected the config to be valid but got: %s", err)
+	}
+}
+
+func TestValidateProblems(t *testing.T) {
+	c := newValidTestConfig()
+	c.Smtp.Port = 0
+	c.Auth.Username = "me"
+	c.Addresses.SystemTo = "not an address"
+	c.Templates.SystemHtml = "missing.template"
+	c.Fields["field3"] = FieldData{Name: "colour", Type: "colour"}
+	c.Fields["field4"] = FieldData{Name: "Name", Type: "textRestricted"}
+	min, max := 10.0, 1.0
+	c.Fields["field5"] = FieldData{Name: "quantity", Type: "integer", Min: &min, Max: &max}
+	c.Fields["field6"] = FieldData{Name: "topic", Type: "select"}
+	c.Fields["field7"] = FieldData{Name: "notes", Type: "textUnrestricted", Min: &min, AllowedValues: []string{"a"}}
+	c.Fields["field8"] = FieldData{Name: "code", Type: "textRestricted", MinLength: 5, MaxLength: 2, Pattern: "[a-z", Default: "abc"}
+	c.Invalid.UnknownFields = "ignore"
+	c.Redirect.Success = "/thanks"
+	c.AntiSpam = AntiSpamData{Honeypots: []string{"email"}, Secret: "short"}
+	c.Captcha = CaptchaData{Provider: "turnstile", MinScore: 0.5}
+	c.Scoring = ScoringData{Threshold: 5, Action: "bounce", Phrases: ScoreRuleData{Score: 1, File: "missing.txt"}}
+	c.SpamFilter = SpamFilterData{Type: "spamd", Address: "localhost", Password: "secret"}
+	c.EmailCheck = EmailCheckData{Mode: "mx"}
+	c.RateLimit.PerIP = LimitData{Requests: 5}
+	c.Proxies = ProxiesData{Trusted: []string{"10.0.0.0/8", "proxy.localhost"}, Header: "X-Client"}
+	c.Queue = QueueData{InitialBackoff: time.Hour, MaxBackoff: time.Minute}
+	c.Forms = map[string]FormData{
+		// the support form has its own Smtp section, but takes the bad addresses from the top level
+		"support": {Route: "support", Smtp: SmtpData{Host: "smtp.localhost", Port: 70000, TLS: "starttls", MinTLSVersion: "1.4",
+			CAFile: "missing.pem", CertFile: "client.pem", MaxConnections: -1},
+			Auth: AuthData{Mechanism: "ntlm", Username: "me", Password: "secret", PasswordFile: "missing-password", TokenURL: "localhost"}},
+		// the api form has no Smtp section to check, as it sends through Mailgun
+		"api": {Transport: TransportData{Type: "Mailgun", APIKey: "key", Dir: "/tmp", URL: "api.mailgun.net"}},
+		// the relayed form's relays replace its Smtp section
+		"relayed": {Smtp: SmtpData{Host: "smtp.localhost", Port: 25}, Relays: []RelayData{{Smtp: SmtpData{Port: 25}, Weight: -1}}},
+	}
+	c.Tenants = map[string]TenantData{"example": {Transport: TransportData{Type: "pigeon"}}}
+
+	err := c.Validate()
+	var cve ConfigValidationError
+	if !errors.As(err, &cve) {
+		t.Fatalf("Expected a ConfigValidationError but got %v", err)
+	}
+	var expected = []string{
+		`Smtp.Port: 0 is not a valid port`,
+		`Auth: needs both a Username and a Password, or neither`,
+		`Addresses.SystemTo: "not an address" is not an email address`,
+		`Templates.SystemHtml: can't read the template "../missing.template"`,
+		`Fields.field3.Type: "colour" is not a known field type`,
+		`Fields.field4.Name: "Name" is already used by Fields.field1`,
+		`Fields.field5: Min 10 is more than Max 1`,
+		`Fields.field6.AllowedValues: no values, so nothing can be chosen`,
+		`Fields.field7: Min and Max are only used by "integer" and "decimal" fields`,
+		`Fields.field7.AllowedValues: is only used by "select" and "multiselect" fields`,
+		`Fields.field8: MinLength 5 is more than MaxLength 2`,
+		"Fields.field8.Pattern: \"[a-z\" is not a regexp: error parsing regexp: missing closing ]: `[a-z`",
+		`Fields.field8.Default: is never used as the field is required`,
+		`Invalid.UnknownFields: "ignore" is not a known policy`,
+		`Redirect.Success: "/thanks" is not an absolute URL`,
+		`AntiSpam.Honeypots: "email" is also the name of Fields.field2`,
+		`AntiSpam.Secret: is shorter than 16 characters`,
+		`Captcha.Secret: is empty`,
+		`Captcha: MinScore and Action are only used by "recaptcha"`,
+		`Scoring.Action: "bounce" is not a known action`,
+		`Scoring.Phrases.File: can't read the list "missing.txt"`,
+		`SpamFilter.Address: "localhost" is not a host:port`,
+		`SpamFilter.Password: is only used by "rspamd"`,
+		`EmailCheck.Mode: "mx" is not a known mode`,
+		`Forms.api.Transport.Dir: is only used by "maildir" and "file"`,
+		`Forms.api.Transport.Domain: is empty`,
+		`Forms.api.Transport.URL: "api.mailgun.net" is not an http or https URL`,
+		`Forms.relayed.Smtp: is not used as the emails are sent through the Relays`,
+		`Forms.relayed.Relays[0].Smtp.Host: is empty`,
+		`Forms.relayed.Relays[0].Weight: -1 is not a weight`,
+		`Forms.support.Route: "support" does not start with "/"`,
+		`Forms.support.Smtp.Port: 70000 is not a valid port`,
+		`Forms.support.Smtp.TLS: "starttls" is not a known TLS mode`,
+		`Forms.support.Smtp.MinTLSVersion: "1.4" is not a TLS version`,
+		`Forms.support.Smtp.CAFile: can't read the CA bundle "missing.pem"`,
+		`Forms.support.Smtp: needs both a CertFile and a KeyFile, or neither`,
+		`Forms.support.Smtp.MaxConnections: -1 is not a number of connections`,
+		`Forms.support.Auth.Mechanism: "ntlm" is not a known mechanism`,
+		`Forms.support.Auth: only one of Password, PasswordFile, TokenURL can be given`,
+		`Forms.support.Auth.TokenURL: is only used by "xoauth2" and "oauthbearer"`,
+		`Forms.support.Auth.TokenURL: "localhost" is not an http or https URL`,
+		`Forms.support.Auth.PasswordFile: can't read the password file "missing-password"`,
+		`Tenants.example.Hosts: no hosts, so the tenant can never be used`,
+		`Tenants.example.Transport.Type: "pigeon" is not a known transport`,
+		`RateLimit.PerIP.Per: 0s is not a time to spread the Requests over`,
+		`Proxies.Header: "X-Client" is not a header the gateway can take the client's IP address from`,
+		`Proxies.Trusted: "proxy.localhost" is not an IP address or CIDR range`,
+		`Queue.InitialBackoff: 1h0m0s is longer than the MaxBackoff of 1m0s`,
+	}
+	if !reflect.DeepEqual(cve.Problems, expected) {
+		t.Fatalf("Expected the problems\n%q\nbut got\n%q", expected, cve.Problems)
+	}
+}
+
+func TestValidateEmptySecrets(t *testing.T) {
+	t.Setenv("TEST_SMTP_EMPTY", "")
+	filename := filepath.Join(t.TempDir(), "password")
+	err := os.WriteFile(filename, []byte("\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newValidTestConfig()
+	c.Auth = AuthData{Username: "me", PasswordEnv: "TEST_SMTP_EMPTY"}
+	c.Forms = map[string]FormData{"support": {Smtp: SmtpData{Host: "smtp.localhost", Port: 25}, Auth: AuthData{Username: "me", PasswordFile: filename}}}
+	err = c.Validate()
+	var cve ConfigValidationError
+	if !errors.As(err, &cve) {
+		t.Fatalf("Expected a ConfigValidationError but got %v", err)
+	}
+	var expected = []string{
+		`Auth.PasswordEnv: TEST_SMTP_EMPTY is empty`,
+		`Forms.support.Auth.PasswordFile: the password file "` + filename + `" is empty`,
+	}
+	if !reflect.DeepEqual(cve.Problems, expected) {
+		t.Fatalf("Expected the problems\n%q\nbut got\n%q", expected, cve.Problems)
+	}
+}
@@ -0,0 +1,183 @@
+// Copyright (c) 2024 Owen Waller. All rights reserved.
+package emailer
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-sasl"
+	"github.com/owenwaller/emailformgateway/config"
+)
+
+// tokenEarly is how long before it expires a cached access token is fetched again, so it does not
+// expire while it is being used.
+const tokenEarly = time.Minute
+
+// tokens caches the access tokens fetched from each TokenURL.
+var tokens = struct {
+	mu     sync.Mutex
+	cached map[string]token
+}{cached: make(map[string]token)}
+
+type token struct {
+	value   string
+	expires time.Time
+}
+
+// tokenResponse is an OAuth 2.0 token response, as e.g. oauth2-proxy or a cloud metadata server answer.
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"` // seconds
+}
+
+// newSASLClient returns the client for the config's auth mechanism, with the password or access token
+// read from wherever the config keeps it. It returns nil if the server needs no auth, which is when
+// there is no Username. An empty password or token is an error, rather than sending without a login.
+func newSASLClient(ctx context.Context, smtpData config.SmtpData, authData config.AuthData) (sasl.Client, error) {
+	if authData.Username == "" {
+		return nil, nil
+	}
+	var secret string
+	var err error
+	if authData.TokenURL != "" {
+		secret, err = fetchToken(ctx, authData.TokenURL)
+	} else {
+		secret, err = authData.Secret()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Could not get the SMTP password: %w", err)
+	}
+	if secret == "" {
+		return nil, fmt.Errorf("Could not get the SMTP password for %s: %s is empty", authData.AuthMechanism(), secretSource(authData))
+	}
+	switch authData.AuthMechanism() {
+	case config.AuthLogin:
+		return sasl.NewLoginClient(authData.Username, secret), nil
+	case config.AuthCramMD5:
+		return &cramMD5Client{username: authData.Username, password: secret}, nil
+	case config.AuthXOAuth2:
+		return &xoauth2Client{username: authData.Username, token: secret}, nil
+	case config.AuthOAuthBearer:
+		return sasl.NewOAuthBearerClient(&sasl.OAuthBearerOptions{Username: authData.Username, Token: secret,
+			Host: smtpData.Host, Port: smtpData.Port}), nil
+	}
+	return sasl.NewPlainClient("", authData.Username, secret), nil
+}
+
+// fetchToken returns an access token from the endpoint, which answers with either an OAuth 2.0 token
+// response or just the token. A token with an expiry is cached until shortly before it expires.
+func fetchToken(ctx context.Context, url string) (string, error) {
+	tokens.mu.Lock()
+	cached, found := tokens.cached[url]
+	tokens.mu.Unlock()
+	if found && time.Now().Before(cached.expires) {
+		return cached.value, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("could not fetch an access token: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxAPIAnswer))
+	if err != nil {
+		return "", fmt.Errorf("could not fetch an access token: %w", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", fmt.Errorf("could not fetch an access token: the endpoint answered %s %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	t := token{value: strings.TrimSpace(string(body))}
+	if strings.HasPrefix(t.value, "{") {
+		var tr tokenResponse
+		err = json.Unmarshal(body, &tr)
+		if err != nil {
+			return "", fmt.Errorf("could not read the access token: %w", err)
+		}
+		t.value = tr.AccessToken
+		if tr.ExpiresIn > 0 {
+			t.expires = time.Now().Add(time.Duration(tr.ExpiresIn)*time.Second - tokenEarly)
+		}
+	}
+	if t.value == "" {
+		return "", errors.New("the endpoint answered without an access token")
+	}
+	if !t.expires.IsZero() {
+		tokens.mu.Lock()
+		tokens.cached[url] = t
+		tokens.mu.Unlock()
+	}
+	return t.value, nil
+}
+
+// secretSource describes where the config says the password or access token is kept.
+func secretSource(authData config.AuthData) string {
+	switch {
+	case authData.TokenURL != "":
+		return fmt.Sprintf("the access token from %q", authData.TokenURL)
+	case authData.PasswordEnv != "":
+		return "the environment variable " + authData.PasswordEnv
+	case authData.PasswordFile != "":
+		return fmt.Sprintf("the password file %q", authData.PasswordFile)
+	case authData.PasswordCommand != "":
+		return fmt.Sprintf("the output of the password command %q", authData.PasswordCommand)
+	}
+	return "the Password"
+}
+
+// forgetSecret drops the cached access token or password of the config, after the server refused it.
+func forgetSecret(authData config.AuthData) {
+	if authData.TokenURL == "" {
+		authData.ForgetSecret()
+		return
+	}
+	tokens.mu.Lock()
+	delete(tokens.cached, authData.TokenURL)
+	tokens.mu.Unlock()
+}
+
+// cramMD5Client is the CRAM-MD5 mechanism of RFC 2195, the server is sent an HMAC of its challenge
+// rather than the password.
+type cramMD5Client struct {
+	username string
+	password string
+}
+
+func (a *cramMD5Client) Start() (mech string, ir []byte, err error) {
+	return "CRAM-MD5", nil, nil
+}
+
+func (a *cramMD5Client) Next(challenge []byte) ([]byte, error) {
+	h := hmac.New(md5.New, []byte(a.password))
+	h.Write(challenge)
+	return []byte(a.username + " " + hex.EncodeToString(h.Sum(nil))), nil
+}
+
+// xoauth2Client is the XOAUTH2 mechanism Gmail and Outlook use for OAuth 2.0 access tokens.
+type xoauth2Client struct {
+	username string
+	token    string
+}
+
+func (a *xoauth2Client) Start() (mech string, ir []byte, err error) {
+	return "XOAUTH2", []byte("user=" + a.username + "\x01auth=Bearer " + a.token + "\x01\x01"), nil
+}
+
+// Next is only called when the token is refused. The challenge is a JSON error, which the server
+// wants an empty answer to before it fails the auth.
+func (a *xoauth2Client) Next(challenge []byte) ([]byte, error) {
+	return []byte{}, nil
+}
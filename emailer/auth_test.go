@@ -0,0 +1,234 @@
+// Copyright (c) 2024 Owen Waller. All rights reserved.
+package emailer
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+	"github.com/owenwaller/emailformgateway/config"
+)
+
+// cramMD5Challenge is the challenge the stand-in server sends for CRAM-MD5.
+const cramMD5Challenge = "<1896.697170952@localhost>"
+
+// enableTestAuth adds LOGIN, CRAM-MD5, XOAUTH2 and OAUTHBEARER to the stand-in server. Each checks the
+// backend's credentials, with the password as the access token, and logs the session in.
+func enableTestAuth(s *smtp.Server, be *testSMTPBackend) {
+	login := func(conn *smtp.Conn, username, password string) error {
+		return conn.Session().(*testSMTPSession).AuthPlain(username, password)
+	}
+	s.EnableAuth(sasl.Login, func(conn *smtp.Conn) sasl.Server {
+		return sasl.NewLoginServer(func(username, password string) error {
+			return login(conn, username, password)
+		})
+	})
+	s.EnableAuth("CRAM-MD5", func(conn *smtp.Conn) sasl.Server {
+		return &testCramMD5Server{be: be, login: func(username string) error { return login(conn, username, be.password) }}
+	})
+	s.EnableAuth("XOAUTH2", func(conn *smtp.Conn) sasl.Server {
+		return &testXOAuth2Server{login: func(username, token string) error { return login(conn, username, token) }}
+	})
+	s.EnableAuth(sasl.OAuthBearer, func(conn *smtp.Conn) sasl.Server {
+		return sasl.NewOAuthBearerServer(func(opts sasl.OAuthBearerOptions) *sasl.OAuthBearerError {
+			if login(conn, opts.Username, opts.Token) != nil {
+				return &sasl.OAuthBearerError{Status: "invalid_token", Schemes: "bearer"}
+			}
+			return nil
+		})
+	})
+}
+
+type testCramMD5Server struct {
+	be      *testSMTPBackend
+	login   func(username string) error
+	started bool
+}
+
+func (a *testCramMD5Server) Next(response []byte) ([]byte, bool, error) {
+	if !a.started {
+		a.started = true
+		return []byte(cramMD5Challenge), false, nil
+	}
+	username, digest, _ := strings.Cut(string(response), " ")
+	h := hmac.New(md5.New, []byte(a.be.password))
+	h.Write([]byte(cramMD5Challenge))
+	if username != a.be.username || digest != hex.EncodeToString(h.Sum(nil)) {
+		return nil, true, errors.New("Invalid username or password")
+	}
+	return nil, true, a.login(username)
+}
+
+type testXOAuth2Server struct {
+	login func(username, token string) error
+	err   error
+}
+
+func (a *testXOAuth2Server) Next(response []byte) ([]byte, bool, error) {
+	// the client's empty answer to the error challenge
+	if a.err != nil {
+		return nil, true, a.err
+	}
+	var username, token string
+	for _, f := range bytes.Split(response, []byte{1}) {
+		if v, found := bytes.CutPrefix(f, []byte("user=")); found {
+			username = string(v)
+		}
+		if v, found := bytes.CutPrefix(f, []byte("auth=Bearer ")); found {
+			token = string(v)
+		}
+	}
+	a.err = a.login(username, token)
+	if a.err != nil {
+		return []byte(`{"status":"401","schemes":"bearer"}`), false, nil
+	}
+	return nil, true, nil
+}
+
+func TestAuthMechanisms(t *testing.T) {
+	var checks = []struct {
+		mechanism string
+		password  string
+		err       string
+	}{
+		{"plain", "secret", ""},
+		{"LOGIN", "secret", ""},
+		{"cram-md5", "secret", ""},
+		{"xoauth2", "secret", ""},
+		{"oauthbearer", "secret", ""},
+		{"login", "wrong", "Invalid username or password"},
+		{"cram-md5", "wrong", "Invalid username or password"},
+		{"xoauth2", "wrong", "Invalid username or password"},
+		{"oauthbearer", "wrong", "invalid_token"},
+	}
+	for _, c := range checks {
+		be := &testSMTPBackend{username: "user", password: "secret"}
+		smtpData, _, _ := newTestSMTPServer(t, be, testSMTPServer{implicitTLS: true, allAuth: true})
+		smtpData.TLS = config.SmtpTLSImplicit
+		transport, err := newSMTPTransport(smtpData, config.AuthData{Mechanism: c.mechanism, Username: "user", Password: c.password}, 10*time.Second)
+		if err != nil {
+			t.Fatalf("%s: could not create the transport: %s", c.mechanism, err)
+		}
+		err = transport.Send(context.Background(), "from@example.com", []string{"to@example.com"}, []byte("Subject: Hello\r\n\r\nHello\r\n"))
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Fatalf("%s: expected an error containing %q but got %v", c.mechanism, c.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: could not send the email: %s", c.mechanism, err)
+		}
+		if received := be.received(); len(received) != 1 || received[0].user != "user" {
+			t.Fatalf("%s: expected one email sent by %q but got %+v", c.mechanism, "user", received)
+		}
+	}
+}
+
+func TestNewSASLClientSecrets(t *testing.T) {
+	t.Setenv("TEST_SMTP_PASSWORD", "from-env")
+	client, err := newSASLClient(context.Background(), config.SmtpData{}, config.AuthData{Username: "user", PasswordEnv: "TEST_SMTP_PASSWORD"})
+	if err != nil {
+		t.Fatalf("Could not create the client: %s", err)
+	}
+	if _, ir, _ := client.Start(); string(ir) != "\x00user\x00from-env" {
+		t.Fatalf("Expected the password from the environment but got %q", ir)
+	}
+
+	client, err = newSASLClient(context.Background(), config.SmtpData{}, config.AuthData{})
+	if client != nil || err != nil {
+		t.Fatalf("Expected no client without a Username but got %v %v", client, err)
+	}
+
+	// an empty password is not the same as no auth
+	t.Setenv("TEST_SMTP_EMPTY", "")
+	client, err = newSASLClient(context.Background(), config.SmtpData{}, config.AuthData{Username: "user", Mechanism: "login", PasswordEnv: "TEST_SMTP_EMPTY"})
+	if client != nil || err == nil || !strings.Contains(err.Error(), "login") || !strings.Contains(err.Error(), "TEST_SMTP_EMPTY is empty") {
+		t.Fatalf("Expected an error for an empty password but got %v %v", client, err)
+	}
+
+	_, err = newSASLClient(context.Background(), config.SmtpData{}, config.AuthData{Username: "user", PasswordEnv: "TEST_SMTP_MISSING"})
+	if err == nil || !strings.Contains(err.Error(), "TEST_SMTP_MISSING is not set") {
+		t.Fatalf("Expected an error for a missing environment variable but got %v", err)
+	}
+}
+
+func TestFetchToken(t *testing.T) {
+	var fetches atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := fetches.Add(1)
+		switch r.URL.Path {
+		case "/json":
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"access_token":"token%d","expires_in":3600,"token_type":"Bearer"}`, n)
+		case "/text":
+			fmt.Fprintf(w, "token%d\n", n)
+		default:
+			http.Error(w, "no token", http.StatusForbidden)
+		}
+	}))
+	defer srv.Close()
+
+	// a token with an expiry is cached, a plain token is fetched each time
+	for i := 0; i < 2; i++ {
+		token, err := fetchToken(context.Background(), srv.URL+"/json")
+		if err != nil || token != "token1" {
+			t.Fatalf("Expected the cached token %q but got %q %v", "token1", token, err)
+		}
+	}
+	for _, expected := range []string{"token2", "token3"} {
+		token, err := fetchToken(context.Background(), srv.URL+"/text")
+		if err != nil || token != expected {
+			t.Fatalf("Expected the token %q but got %q %v", expected, token, err)
+		}
+	}
+	_, err := fetchToken(context.Background(), srv.URL+"/forbidden")
+	if err == nil || !strings.Contains(err.Error(), "403") {
+		t.Fatalf("Expected an error for a refused token but got %v", err)
+	}
+}
+
+func TestRefusedTokenForgotten(t *testing.T) {
+	var fetches atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := "secret"
+		if fetches.Add(1) == 1 {
+			token = "revoked"
+		}
+		fmt.Fprintf(w, `{"access_token":%q,"expires_in":3600}`, token)
+	}))
+	defer srv.Close()
+
+	be := &testSMTPBackend{username: "user", password: "secret"}
+	smtpData, _, _ := newTestSMTPServer(t, be, testSMTPServer{implicitTLS: true, allAuth: true})
+	smtpData.TLS = config.SmtpTLSImplicit
+	transport, err := newSMTPTransport(smtpData, config.AuthData{Mechanism: "xoauth2", Username: "user", TokenURL: srv.URL}, 10*time.Second)
+	if err != nil {
+		t.Fatalf("Could not create the transport: %s", err)
+	}
+	email := []byte("Subject: Hello\r\n\r\nHello\r\n")
+	err = transport.Send(context.Background(), "from@example.com", []string{"to@example.com"}, email)
+	if err == nil {
+		t.Fatalf("Expected the revoked token to be refused")
+	}
+	// the refused token is not used again
+	err = transport.Send(context.Background(), "from@example.com", []string{"to@example.com"}, email)
+	if err != nil {
+		t.Fatalf("Expected a new token to be fetched but got %v", err)
+	}
+	if n := fetches.Load(); n != 2 {
+		t.Fatalf("Expected two fetches of the token but got %d", n)
+	}
+}
@@ -3,15 +3,13 @@ package emailer
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
-	"strconv"
 	"time"
 
-	"github.com/emersion/go-sasl"
-	"github.com/emersion/go-smtp"
-
 	//"fmt"
 	"html/template"
 
@@ -33,93 +31,133 @@ func populateTemplate(td config.EmailTemplateData, t string) (string, error) {
 	return buf.String(), nil
 }
 
+// CheckTemplates parses the four templates, so a broken template is found before an email needs it.
+func CheckTemplates(templatesData config.EmailTemplatesData) error {
+	for _, filename := range []string{templatesData.CustomerTextFileName, templatesData.CustomerHtmlFileName,
+		templatesData.SystemTextFileName, templatesData.SystemHtmlFileName} {
+		_, err := template.ParseFiles(filename)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CheckEmails builds, but does not send, the customer and system emails for the template data.
+// A template can parse and still fail when it is run, e.g. if it uses a field that does not exist.
+func CheckEmails(etd config.EmailTemplateData, addr config.EmailAddressData,
+	subject config.EmailSubjectData, templatesData config.EmailTemplatesData, domain string) error {
+
+	_, err := newCustomerEmail(etd, addr, subject, templatesData, domain)
+	if err != nil {
+		return fmt.Errorf("Error building the customer email: %w", err)
+	}
+	_, err = newSystemEmail(etd, addr, subject, templatesData, domain)
+	if err != nil {
+		return fmt.Errorf("Error building the system email: %w", err)
+	}
+	return nil
+}
+
+// SendEmail builds and sends both emails to the SMTP server, the system email reuses the customer email's connection.
+//
+// Deprecated: SendEmail only sends through the Smtp and Auth sections. Use NewTransport, for the transport
+// and relays the config says, with SendCustomerEmail and SendSystemEmail.
 func SendEmail(etd config.EmailTemplateData, smtpData config.SmtpData, authData config.AuthData, addr config.EmailAddressData,
 	subject config.EmailSubjectData, templatesData config.EmailTemplatesData, domain string) error {
 
-	// write the email we want to send into the customerEmail bytes.Buffer or fail.
-	customerEmail, err := newCustomerEmail(etd, addr, subject, templatesData, domain)
+	t, err := NewTransport(config.TransportData{}, smtpData, authData, nil)
 	if err != nil {
 		return err
 	}
-
-	systemEmail, err := newSystemEmail(etd, addr, subject, templatesData, domain)
+	// the callers from before CustomerTo give the customer's address in the form data
+	if etd.CustomerTo == "" {
+		etd.CustomerTo = etd.FormData["Email"]
+	}
+	err = SendCustomerEmail(etd, t, addr, subject, templatesData, domain)
 	if err != nil {
 		return err
 	}
+	return SendSystemEmail(etd, t, addr, subject, templatesData, domain)
+}
+
+// SendCustomerEmail builds and sends only the acknowledgement email to the customer.
+// The queue uses this so a failure to send the system email does not resend the customer email.
+func SendCustomerEmail(etd config.EmailTemplateData, t Transport, addr config.EmailAddressData,
+	subject config.EmailSubjectData, templatesData config.EmailTemplatesData, domain string) error {
 
-	err = sendCustomerEmail(etd, smtpData, authData, addr, customerEmail.Bytes())
+	// write the email we want to send into the customerEmail bytes.Buffer or fail.
+	customerEmail, err := newCustomerEmail(etd, addr, subject, templatesData, domain)
 	if err != nil {
 		return err
 	}
+	return sendCustomerEmail(etd, t, addr, customerEmail.Bytes())
+}
 
-	err = sendSystemEmail(etd, smtpData, authData, addr, systemEmail.Bytes())
+// SendSystemEmail builds and sends only the email to the system (site owner) address.
+func SendSystemEmail(etd config.EmailTemplateData, t Transport, addr config.EmailAddressData,
+	subject config.EmailSubjectData, templatesData config.EmailTemplatesData, domain string) error {
+
+	systemEmail, err := newSystemEmail(etd, addr, subject, templatesData, domain)
 	if err != nil {
 		return err
 	}
-	return err
+	return sendSystemEmail(t, addr, systemEmail.Bytes())
 }
 
-func sendCustomerEmail(etd config.EmailTemplateData, smtpData config.SmtpData, authData config.AuthData, addr config.EmailAddressData, email []byte) error {
+// BuildSystemEmail builds, but does not send, the system email, so it can be passed through
+// a spam filter before it is sent with SendSystemMessage.
+func BuildSystemEmail(etd config.EmailTemplateData, addr config.EmailAddressData,
+	subject config.EmailSubjectData, templatesData config.EmailTemplatesData, domain string) ([]byte, error) {
 
-	to := []*mail.Address{{etd.FormData["Name"], etd.FormData["Email"]}}
-
-	toStrs := make([]string, 0)
-	for i := range to {
-		toStrs = append(toStrs, to[i].Address)
+	systemEmail, err := newSystemEmail(etd, addr, subject, templatesData, domain)
+	if err != nil {
+		return nil, err
 	}
-	hostname := smtpData.Host + ":" + strconv.Itoa(smtpData.Port)
+	return systemEmail.Bytes(), nil
+}
 
-	var err error
-	//	do we need auth for this server?
-	if authData.Password != "" && authData.Username != "" {
-		clientAuth := sasl.NewPlainClient("", authData.Username, authData.Password)
-		err = smtp.SendMailTLS(hostname, clientAuth, addr.CustomerFrom, toStrs, bytes.NewReader(email)) // the Krystal SMTP hosts NEED TLS from the get go
-	} else {
-		// no auth version
-		err = smtp.SendMail(hostname, nil, addr.CustomerFrom, toStrs, bytes.NewReader(email))
+// SendSystemMessage sends a system email built by BuildSystemEmail.
+func SendSystemMessage(t Transport, addr config.EmailAddressData, email []byte) error {
+	return sendSystemEmail(t, addr, email)
+}
+
+func sendCustomerEmail(etd config.EmailTemplateData, t Transport, addr config.EmailAddressData, email []byte) error {
+	if etd.CustomerTo == "" {
+		return errors.New("Error sending customer email: there is no address to send it to")
 	}
+	err := t.Send(context.Background(), addr.CustomerFrom, []string{etd.CustomerTo}, email)
 	if err != nil {
 		return fmt.Errorf("Error sending customer email: %w", err)
 	}
-	return err
+	return nil
 }
 
-func sendSystemEmail(etd config.EmailTemplateData, smtpData config.SmtpData, authData config.AuthData, addr config.EmailAddressData, email []byte) error {
-
-	to := []*mail.Address{{addr.SystemToName, addr.SystemTo}}
-
-	toStrs := make([]string, 0)
-	for i := range to {
-		toStrs = append(toStrs, to[i].Address)
-	}
-	hostname := smtpData.Host + ":" + strconv.Itoa(smtpData.Port)
-
-	var err error
-	//	do we need auth for this server?
-	if authData.Password != "" && authData.Username != "" {
-		clientAuth := sasl.NewPlainClient("", authData.Username, authData.Password)
-		err = smtp.SendMailTLS(hostname, clientAuth, addr.SystemFrom, toStrs, bytes.NewReader(email))
-	} else {
-		// no auth version
-		err = smtp.SendMail(hostname, nil, addr.SystemFrom, toStrs, bytes.NewReader(email))
-	}
-	if err != nil {
-		log.Printf("From: %qn", addr.SystemFrom)
-		log.Printf("To: %v\n", toStrs)
+func sendSystemEmail(t Transport, addr config.EmailAddressData, email []byte) error {
+	err := t.Send(context.Background(), addr.SystemFrom, []string{addr.SystemTo}, email)
+	if err != nil {
+		log.Printf("From: %q\n", addr.SystemFrom)
+		log.Printf("To: %q\n", addr.SystemTo)
 		return fmt.Errorf("Error sending system email: %w", err)
 	}
-	return err
+	return nil
 }
 
 func newCustomerEmail(etd config.EmailTemplateData, addr config.EmailAddressData,
 	subject config.EmailSubjectData, templatesData config.EmailTemplatesData, domain string) (bytes.Buffer, error) {
-	// now create the templates
-	ctt := template.Must(template.ParseFiles(templatesData.CustomerTextFileName))
-	cht := template.Must(template.ParseFiles(templatesData.CustomerHtmlFileName))
+	// now create the templates, a missing template is an error not a panic as we run inside the queue workers
+	ctt, err := template.ParseFiles(templatesData.CustomerTextFileName)
+	if err != nil {
+		return bytes.Buffer{}, err
+	}
+	cht, err := template.ParseFiles(templatesData.CustomerHtmlFileName)
+	if err != nil {
+		return bytes.Buffer{}, err
+	}
 	// now populate the templates - must have set the FormData before this
 	var cttbuf = new(bytes.Buffer) // buffer implements io.Writer
 	var chtbuf = new(bytes.Buffer)
-	err := ctt.Execute(cttbuf, etd)
+	err = ctt.Execute(cttbuf, etd)
 	if err != nil {
 		return bytes.Buffer{}, err
 	}
@@ -131,7 +169,7 @@ func newCustomerEmail(etd config.EmailTemplateData, addr config.EmailAddressData
 	// now build the customer email as a multi part email
 	var customerEmail bytes.Buffer
 	from := []*mail.Address{{addr.CustomerFromName, addr.CustomerFrom}}
-	to := []*mail.Address{{etd.FormData["Name"], etd.FormData["Email"]}}
+	to := []*mail.Address{{"", etd.CustomerTo}}
 	replyTo := []*mail.Address{{addr.CustomerReplyTo, addr.CustomerReplyTo}}
 	var h mail.Header
 	h.SetDate(time.Now())
@@ -144,62 +182,30 @@ func newCustomerEmail(etd config.EmailTemplateData, addr config.EmailAddressData
 		return bytes.Buffer{}, err
 	}
 
-	h.SetContentType("multipart/alternative", nil)
-	emailWriter, err := mail.CreateWriter(&customerEmail, h)
-	if err != nil {
-		return bytes.Buffer{}, err
-	}
-	defer emailWriter.Close()
-
-	htmlWriter, err := emailWriter.CreateInline()
-	if err != nil {
-		return bytes.Buffer{}, err
-	}
-	defer htmlWriter.Close()
-
-	var htmlHeader mail.InlineHeader
-	htmlHeader.SetContentType("text/html", nil)
-	htmlPartWriter, err := htmlWriter.CreatePart(htmlHeader)
-	if err != nil {
-		return bytes.Buffer{}, err
-	}
-	defer htmlPartWriter.Close()
-	_, err = io.Copy(htmlPartWriter, chtbuf)
+	err = writeEmail(&customerEmail, h, chtbuf, cttbuf, nil)
 	if err != nil {
 		return bytes.Buffer{}, err
 	}
 
-	plainWriter, err := emailWriter.CreateInline()
-	if err != nil {
-		return bytes.Buffer{}, err
-	}
-	defer plainWriter.Close()
+	//log.Println(customerEmail.String())
+	return customerEmail, nil
+}
 
-	var plainHeader mail.InlineHeader
-	plainHeader.SetContentType("text/plain", nil)
-	plainPartWriter, err := plainWriter.CreatePart(plainHeader)
+func newSystemEmail(etd config.EmailTemplateData, addr config.EmailAddressData,
+	subject config.EmailSubjectData, templatesData config.EmailTemplatesData, domain string) (bytes.Buffer, error) {
+	// now create the templates, a missing template is an error not a panic as we run inside the queue workers
+	stt, err := template.ParseFiles(templatesData.SystemTextFileName)
 	if err != nil {
 		return bytes.Buffer{}, err
 	}
-	defer plainPartWriter.Close()
-	_, err = io.Copy(plainPartWriter, cttbuf)
+	sht, err := template.ParseFiles(templatesData.SystemHtmlFileName)
 	if err != nil {
 		return bytes.Buffer{}, err
 	}
-
-	//log.Println(customerEmail.String())
-	return customerEmail, nil
-}
-
-func newSystemEmail(etd config.EmailTemplateData, addr config.EmailAddressData,
-	subject config.EmailSubjectData, templatesData config.EmailTemplatesData, domain string) (bytes.Buffer, error) {
-	// now create the templates
-	stt := template.Must(template.ParseFiles(templatesData.SystemTextFileName))
-	sht := template.Must(template.ParseFiles(templatesData.SystemHtmlFileName))
 	// now populate the templates - must have set the FormData before this
 	var sttbuf = new(bytes.Buffer)
 	var shtbuf = new(bytes.Buffer)
-	err := stt.Execute(sttbuf, etd)
+	err = stt.Execute(sttbuf, etd)
 	if err != nil {
 		return bytes.Buffer{}, err
 	}
@@ -224,49 +230,73 @@ func newSystemEmail(etd config.EmailTemplateData, addr config.EmailAddressData,
 		return bytes.Buffer{}, err
 	}
 
-	h.SetContentType("multipart/alternative", nil)
-	emailWriter, err := mail.CreateWriter(&systemEmail, h)
+	// any files the customer uploaded are attached to the system email only
+	err = writeEmail(&systemEmail, h, shtbuf, sttbuf, etd.Attachments)
 	if err != nil {
 		return bytes.Buffer{}, err
 	}
-	defer emailWriter.Close()
 
-	htmlWriter, err := emailWriter.CreateInline()
+	//log.Println(customerEmail.String())
+	return systemEmail, nil
+}
+
+// writeEmail writes the html and plain text versions of the body, followed by the attachments.
+// Each part is closed before the next one is started, so the encoders have flushed into the right part.
+func writeEmail(email io.Writer, h mail.Header, html, plain io.Reader, attachments []config.Attachment) error {
+	emailWriter, err := mail.CreateWriter(email, h)
 	if err != nil {
-		return bytes.Buffer{}, err
+		return err
 	}
-	defer htmlWriter.Close()
-
-	var htmlHeader mail.InlineHeader
-	htmlHeader.SetContentType("text/html", nil)
-	htmlPartWriter, err := htmlWriter.CreatePart(htmlHeader)
+	err = writeInline(emailWriter, "text/html", html)
 	if err != nil {
-		return bytes.Buffer{}, err
+		return err
 	}
-	defer htmlPartWriter.Close()
-	_, err = io.Copy(htmlPartWriter, shtbuf)
+	err = writeInline(emailWriter, "text/plain", plain)
 	if err != nil {
-		return bytes.Buffer{}, err
+		return err
 	}
+	for _, a := range attachments {
+		err = writeAttachment(emailWriter, a)
+		if err != nil {
+			return err
+		}
+	}
+	return emailWriter.Close()
+}
 
-	plainWriter, err := emailWriter.CreateInline()
+func writeInline(emailWriter *mail.Writer, contentType string, body io.Reader) error {
+	inlineWriter, err := emailWriter.CreateInline()
 	if err != nil {
-		return bytes.Buffer{}, err
+		return err
 	}
-	defer plainWriter.Close()
-
-	var plainHeader mail.InlineHeader
-	plainHeader.SetContentType("text/plain", nil)
-	plainPartWriter, err := plainWriter.CreatePart(plainHeader)
+	var inlineHeader mail.InlineHeader
+	inlineHeader.SetContentType(contentType, nil)
+	partWriter, err := inlineWriter.CreatePart(inlineHeader)
 	if err != nil {
-		return bytes.Buffer{}, err
+		return err
 	}
-	defer plainPartWriter.Close()
-	_, err = io.Copy(plainPartWriter, sttbuf)
+	_, err = io.Copy(partWriter, body)
 	if err != nil {
-		return bytes.Buffer{}, err
+		return err
 	}
+	err = partWriter.Close()
+	if err != nil {
+		return err
+	}
+	return inlineWriter.Close()
+}
 
-	//log.Println(customerEmail.String())
-	return systemEmail, nil
+func writeAttachment(emailWriter *mail.Writer, a config.Attachment) error {
+	var attachmentHeader mail.AttachmentHeader
+	attachmentHeader.SetContentType(a.ContentType, nil)
+	attachmentHeader.SetFilename(a.Filename)
+	attachmentWriter, err := emailWriter.CreateAttachment(attachmentHeader)
+	if err != nil {
+		return err
+	}
+	_, err = attachmentWriter.Write(a.Data)
+	if err != nil {
+		return err
+	}
+	return attachmentWriter.Close()
 }
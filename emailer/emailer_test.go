@@ -2,12 +2,16 @@
 package emailer
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
+	"github.com/emersion/go-message/mail"
 	"github.com/owenwaller/emailformgateway/config"
 	"github.com/spf13/viper"
 )
@@ -55,6 +59,74 @@ func TestEmailTemplateMapData(t *testing.T) {
 	}
 }
 
+// newTestTemplatesData uses the templates in the root of the repository.
+func newTestTemplatesData() config.EmailTemplatesData {
+	var td config.EmailTemplatesData
+	td.Dir = ".."
+	td.CustomerTextFileName = config.BuildTemplateFilename(td.Dir, "customer-email-text.template")
+	td.CustomerHtmlFileName = config.BuildTemplateFilename(td.Dir, "customer-email-html.template")
+	td.SystemTextFileName = config.BuildTemplateFilename(td.Dir, "system-email-text.template")
+	td.SystemHtmlFileName = config.BuildTemplateFilename(td.Dir, "system-email-html.template")
+	return td
+}
+
+func TestCheckTemplates(t *testing.T) {
+	td := newTestTemplatesData()
+	err := CheckTemplates(td)
+	if err != nil {
+		t.Fatalf("Could not parse the templates. Error: %v\n", err)
+	}
+	td.SystemHtmlFileName = config.BuildTemplateFilename(td.Dir, "missing.template")
+	err = CheckTemplates(td)
+	if err == nil {
+		t.Fatalf("Expected an error for a missing template but got nil\n")
+	}
+}
+
+func TestSystemEmailAttachments(t *testing.T) {
+	var td config.EmailTemplateData
+	td.FormData = map[string]string{"Name": "Joe Blogs", "Email": "joe@example.com", "Subject": "subject", "Feedback": "feedback"}
+	var png = []byte("\x89PNG\x0D\x0A\x1A\x0A\x00\x00\x00\x0DIHDR")
+	td.Attachments = []config.Attachment{{Field: "screenshot", Filename: "screen.png", ContentType: "image/png", Data: png}}
+	var addr = config.EmailAddressData{SystemTo: "to@example.com", SystemFrom: "from@example.com", SystemReplyTo: "from@example.com"}
+
+	email, err := newSystemEmail(td, addr, config.EmailSubjectData{System: "subject"}, newTestTemplatesData(), "example.com")
+	if err != nil {
+		t.Fatalf("Could not create the system email. Error: %v\n", err)
+	}
+	r, err := mail.CreateReader(bytes.NewReader(email.Bytes()))
+	if err != nil {
+		t.Fatalf("Could not read the system email. Error: %v\n", err)
+	}
+	var inline, attachments int
+	for {
+		p, err := r.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Could not read the next part of the system email. Error: %v\n", err)
+		}
+		switch h := p.Header.(type) {
+		case *mail.InlineHeader:
+			inline++
+		case *mail.AttachmentHeader:
+			attachments++
+			filename, _ := h.Filename()
+			if filename != "screen.png" {
+				t.Fatalf("Expected an attachment called %q but got %q\n", "screen.png", filename)
+			}
+			b, err := io.ReadAll(p.Body)
+			if err != nil || !bytes.Equal(b, png) {
+				t.Fatalf("The attachment did not survive encoding. Got %q. Error: %v\n", b, err)
+			}
+		}
+	}
+	if inline != 2 || attachments != 1 {
+		t.Fatalf("Expected %d inline parts and %d attachment but got %d and %d\n", 2, 1, inline, attachments)
+	}
+}
+
 func TestSendEmail(t *testing.T) {
 	// read a config
 	//var c config.Config
@@ -69,6 +141,7 @@ func TestSendEmail(t *testing.T) {
 		t.Fatalf("The environmental TEST_CUSTOMER_TO_EMAIL_ADDRESS is undefined.")
 	}
 	td.FormData["Email"] = toAddr
+	td.CustomerTo = toAddr
 	td.FormData["Subject"] = "the feedback subject"
 	td.FormData["Feedback"] = "this is the feedback"
 
@@ -154,9 +227,54 @@ func TestSendEmail(t *testing.T) {
 		t.Fatalf("The environmental TEST_DOMAIN is undefined.")
 	}
 
-	err = SendEmail(td, c.Smtp, c.Auth, c.Addresses, c.Subjects, c.Templates, domain)
+	transport, err := NewTransport(c.Transport, c.Smtp, c.Auth, c.Relays)
+	if err != nil {
+		t.Fatalf("unexpected error creating the transport %v\n", err)
+	}
+	err = SendCustomerEmail(td, transport, c.Addresses, c.Subjects, c.Templates, domain)
+	if err != nil {
+		t.Fatalf("unexpected error sending email %v\n", err)
+	}
+	err = SendSystemEmail(td, transport, c.Addresses, c.Subjects, c.Templates, domain)
 	if err != nil {
 		t.Fatalf("unexpected error sending email %v\n", err)
 	}
 	t.Log("Sent - err was nil")
 }
+
+func TestSendEmailThroughTransport(t *testing.T) {
+	be := &testSMTPBackend{}
+	smtpData, _, _ := newTestSMTPServer(t, be, testSMTPServer{withTLS: true})
+	var td config.EmailTemplateData
+	td.FormData = map[string]string{"Name": "Joe Blogs", "Email": "joe@example.com", "Subject": "subject", "Feedback": "feedback"}
+	var addr = config.EmailAddressData{CustomerFrom: "from@example.com", SystemTo: "to@example.com", SystemFrom: "from@example.com"}
+	err := SendEmail(td, smtpData, config.AuthData{}, addr, config.EmailSubjectData{}, newTestTemplatesData(), "example.com")
+	if err != nil {
+		t.Fatalf("Could not send the emails. Error: %v\n", err)
+	}
+	received := be.received()
+	if len(received) != 2 || received[0].to[0] != "joe@example.com" || received[1].to[0] != "to@example.com" {
+		t.Fatalf("Expected the customer and then the system email but got %+v\n", received)
+	}
+}
+
+func TestCheckEmails(t *testing.T) {
+	var td config.EmailTemplateData
+	td.FormData = map[string]string{"Name": "Joe Blogs", "Email": "joe@example.com"}
+	var addr = config.EmailAddressData{CustomerFrom: "from@example.com", SystemTo: "to@example.com", SystemFrom: "from@example.com"}
+	templates := newTestTemplatesData()
+	err := CheckEmails(td, addr, config.EmailSubjectData{}, templates, "example.com")
+	if err != nil {
+		t.Fatalf("Could not build the emails. Error: %v\n", err)
+	}
+	// a template that parses but uses a field the template data does not have
+	templates.SystemTextFileName = filepath.Join(t.TempDir(), "broken.template")
+	err = os.WriteFile(templates.SystemTextFileName, []byte("{{.NoSuchField}}"), 0o600)
+	if err != nil {
+		t.Fatalf("Could not write the broken template. Error: %v\n", err)
+	}
+	err = CheckEmails(td, addr, config.EmailSubjectData{}, templates, "example.com")
+	if err == nil {
+		t.Fatalf("Expected an error for a template that can't be run but got nil\n")
+	}
+}
@@ -0,0 +1,315 @@
+// Copyright (c) 2024 Owen Waller. All rights reserved.
+package emailer
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/mail"
+	"github.com/owenwaller/emailformgateway/config"
+)
+
+// The providers' API URLs, the paths of their endpoints are added to them
+const (
+	sendGridURL = "https://api.sendgrid.com"
+	mailgunURL  = "https://api.mailgun.net" // the EU region is https://api.eu.mailgun.net
+	postmarkURL = "https://api.postmarkapp.com"
+)
+
+// maxAPIAnswer limits how much of an API's answer is read, only its error message is used.
+const maxAPIAnswer = 4 << 10
+
+// api is a mail service's HTTP API.
+type api struct {
+	url    string
+	client *http.Client
+}
+
+func newAPI(url, defaultURL string, timeout time.Duration) api {
+	if url == "" {
+		url = defaultURL
+	}
+	return api{url: strings.TrimSuffix(url, "/"), client: &http.Client{Timeout: timeout}}
+}
+
+// post posts the body to the endpoint.
+func (a api) post(ctx context.Context, name, path, contentType string, body []byte, header http.Header) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.url+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", contentType)
+	return a.do(req, name)
+}
+
+// do sends the request, and returns an error if the API does not answer with a 2xx status.
+func (a api) do(req *http.Request, name string) error {
+	req.Header.Set("Accept", "application/json")
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Could not send the email with %s: %w", name, err)
+	}
+	defer resp.Body.Close()
+	answer, _ := io.ReadAll(io.LimitReader(resp.Body, maxAPIAnswer))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Could not send the email with %s: it answered %s %s", name, resp.Status, strings.TrimSpace(string(answer)))
+	}
+	return nil
+}
+
+// postJSON posts the value as JSON.
+func (a api) postJSON(ctx context.Context, name, path string, v interface{}, header http.Header) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return a.post(ctx, name, path, "application/json", body, header)
+}
+
+// parsedEmail is a built email taken apart again, for the APIs that are sent its parts rather than the email.
+type parsedEmail struct {
+	from        *mail.Address
+	to          []*mail.Address
+	replyTo     *mail.Address // nil if the email has none
+	subject     string
+	text        string
+	html        string
+	headers     [][2]string // the X- headers, e.g. the spam filter's, which the APIs are asked to add
+	attachments []config.Attachment
+}
+
+func parseEmail(email []byte) (parsedEmail, error) {
+	var e parsedEmail
+	r, err := mail.CreateReader(bytes.NewReader(email))
+	if err != nil {
+		return e, fmt.Errorf("Could not read the email: %w", err)
+	}
+	defer r.Close()
+	from, err := r.Header.AddressList("From")
+	if err != nil || len(from) == 0 {
+		return e, fmt.Errorf("Could not read the email's From address: %v", err)
+	}
+	e.from = from[0]
+	e.to, _ = r.Header.AddressList("To")
+	replyTo, _ := r.Header.AddressList("Reply-To")
+	if len(replyTo) != 0 && replyTo[0].Address != "" {
+		e.replyTo = replyTo[0]
+	}
+	e.subject, _ = r.Header.Subject()
+	fields := r.Header.Fields()
+	for fields.Next() {
+		if strings.HasPrefix(strings.ToUpper(fields.Key()), "X-") {
+			v, _ := fields.Text()
+			e.headers = append(e.headers, [2]string{fields.Key(), v})
+		}
+	}
+	for {
+		p, err := r.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return e, fmt.Errorf("Could not read the email: %w", err)
+		}
+		body, err := io.ReadAll(p.Body)
+		if err != nil {
+			return e, fmt.Errorf("Could not read the email: %w", err)
+		}
+		switch h := p.Header.(type) {
+		case *mail.InlineHeader:
+			contentType, _, _ := h.ContentType()
+			switch contentType {
+			case "text/plain":
+				e.text = string(body)
+			case "text/html":
+				e.html = string(body)
+			}
+		case *mail.AttachmentHeader:
+			contentType, _, _ := h.ContentType()
+			filename, _ := h.Filename()
+			e.attachments = append(e.attachments, config.Attachment{Filename: filename, ContentType: contentType, Data: body})
+		}
+	}
+	return e, nil
+}
+
+// recipients returns the envelope's recipients, with their names from the To header.
+func (e parsedEmail) recipients(to []string) []*mail.Address {
+	addrs := make([]*mail.Address, 0, len(to))
+	for _, a := range to {
+		addr := &mail.Address{Address: a}
+		for _, t := range e.to {
+			if strings.EqualFold(t.Address, a) {
+				addr.Name = t.Name
+			}
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+// sendGridTransport sends the emails with SendGrid's v3 mail send API.
+type sendGridTransport struct {
+	api api
+	key string
+}
+
+type sendGridAddress struct {
+	Email string `json:"email"`
+	Name  string `json:"name,omitempty"`
+}
+
+type sendGridContent struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type sendGridAttachment struct {
+	Content     string `json:"content"` // base64
+	Type        string `json:"type"`
+	Filename    string `json:"filename"`
+	Disposition string `json:"disposition"`
+}
+
+type sendGridPersonalization struct {
+	To []sendGridAddress `json:"to"`
+}
+
+type sendGridMessage struct {
+	Personalizations []sendGridPersonalization `json:"personalizations"`
+	From             sendGridAddress           `json:"from"`
+	ReplyTo          *sendGridAddress          `json:"reply_to,omitempty"`
+	Subject          string                    `json:"subject"`
+	Content          []sendGridContent         `json:"content"`
+	Attachments      []sendGridAttachment      `json:"attachments,omitempty"`
+	Headers          map[string]string         `json:"headers,omitempty"`
+}
+
+func (t *sendGridTransport) Send(ctx context.Context, from string, to []string, email []byte) error {
+	e, err := parseEmail(email)
+	if err != nil {
+		return err
+	}
+	var m sendGridMessage
+	m.Personalizations = make([]sendGridPersonalization, 1)
+	for _, r := range e.recipients(to) {
+		m.Personalizations[0].To = append(m.Personalizations[0].To, sendGridAddress{r.Address, r.Name})
+	}
+	m.From = sendGridAddress{e.from.Address, e.from.Name}
+	if e.replyTo != nil {
+		m.ReplyTo = &sendGridAddress{e.replyTo.Address, e.replyTo.Name}
+	}
+	m.Subject = e.subject
+	// SendGrid wants the plain text first
+	if e.text != "" {
+		m.Content = append(m.Content, sendGridContent{"text/plain", e.text})
+	}
+	if e.html != "" {
+		m.Content = append(m.Content, sendGridContent{"text/html", e.html})
+	}
+	for _, a := range e.attachments {
+		m.Attachments = append(m.Attachments, sendGridAttachment{base64.StdEncoding.EncodeToString(a.Data), a.ContentType, a.Filename, "attachment"})
+	}
+	if len(e.headers) != 0 {
+		m.Headers = make(map[string]string)
+		for _, h := range e.headers {
+			m.Headers[h[0]] = h[1]
+		}
+	}
+	header := http.Header{"Authorization": {"Bearer " + t.key}}
+	return t.api.postJSON(ctx, "SendGrid", "/v3/mail/send", m, header)
+}
+
+// mailgunTransport sends the emails with Mailgun's API, which takes the whole email so nothing is lost.
+type mailgunTransport struct {
+	api    api
+	key    string
+	domain string
+}
+
+func (t *mailgunTransport) Send(ctx context.Context, from string, to []string, email []byte) error {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	for _, r := range to {
+		w.WriteField("to", r)
+	}
+	part, err := w.CreateFormFile("message", "message.mime")
+	if err != nil {
+		return err
+	}
+	part.Write(email)
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+	header := http.Header{"Authorization": {"Basic " + base64.StdEncoding.EncodeToString([]byte("api:"+t.key))}}
+	return t.api.post(ctx, "Mailgun", "/v3/"+t.domain+"/messages.mime", w.FormDataContentType(), body.Bytes(), header)
+}
+
+// postmarkTransport sends the emails with Postmark's email API.
+type postmarkTransport struct {
+	api api
+	key string
+}
+
+type postmarkHeader struct {
+	Name  string
+	Value string
+}
+
+type postmarkAttachment struct {
+	Name        string
+	Content     string // base64
+	ContentType string
+}
+
+type postmarkMessage struct {
+	From        string
+	To          string
+	ReplyTo     string `json:",omitempty"`
+	Subject     string
+	HtmlBody    string               `json:",omitempty"`
+	TextBody    string               `json:",omitempty"`
+	Headers     []postmarkHeader     `json:",omitempty"`
+	Attachments []postmarkAttachment `json:",omitempty"`
+}
+
+func (t *postmarkTransport) Send(ctx context.Context, from string, to []string, email []byte) error {
+	e, err := parseEmail(email)
+	if err != nil {
+		return err
+	}
+	var recipients []string
+	for _, r := range e.recipients(to) {
+		recipients = append(recipients, r.String())
+	}
+	m := postmarkMessage{
+		From:     e.from.String(),
+		To:       strings.Join(recipients, ", "),
+		Subject:  e.subject,
+		HtmlBody: e.html,
+		TextBody: e.text,
+	}
+	if e.replyTo != nil {
+		m.ReplyTo = e.replyTo.String()
+	}
+	for _, h := range e.headers {
+		m.Headers = append(m.Headers, postmarkHeader{h[0], h[1]})
+	}
+	for _, a := range e.attachments {
+		m.Attachments = append(m.Attachments, postmarkAttachment{a.Filename, base64.StdEncoding.EncodeToString(a.Data), a.ContentType})
+	}
+	header := http.Header{"X-Postmark-Server-Token": {t.key}}
+	return t.api.postJSON(ctx, "Postmark", "/email", m, header)
+}
@@ -0,0 +1,172 @@
+// Copyright (c) 2024 Owen Waller. All rights reserved.
+package emailer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/owenwaller/emailformgateway/config"
+)
+
+// newTestSystemEmail builds a system email with an attachment and a spam filter header.
+func newTestSystemEmail(t *testing.T) []byte {
+	var td config.EmailTemplateData
+	td.FormData = map[string]string{"Name": "Joe Blogs", "Email": "joe@example.com", "Subject": "subject", "Feedback": "feedback"}
+	td.Attachments = []config.Attachment{{Field: "notes", Filename: "notes.txt", ContentType: "text/plain", Data: []byte("my notes")}}
+	var addr = config.EmailAddressData{SystemTo: "to@example.com", SystemToName: "The Owner", SystemFrom: "from@example.com",
+		SystemFromName: "The Form", SystemReplyTo: "reply@example.com"}
+	email, err := newSystemEmail(td, addr, config.EmailSubjectData{System: "A message"}, newTestTemplatesData(), "example.com")
+	if err != nil {
+		t.Fatalf("Could not create the system email: %s", err)
+	}
+	return append([]byte("X-Spam-Score: 1.0\r\n"), email.Bytes()...)
+}
+
+// testAPI is a stand-in for a mail service's API, it keeps a copy of the last request.
+// The request itself belongs to the server, so only copies are kept.
+type testAPI struct {
+	status int
+	path   string
+	header http.Header
+	body   []byte
+}
+
+func newTestAPI(t *testing.T, status int) (*testAPI, string) {
+	a := &testAPI{status: status}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a.path = r.URL.Path
+		a.header = r.Header.Clone()
+		a.body, _ = io.ReadAll(r.Body)
+		w.WriteHeader(a.status)
+		io.WriteString(w, `{"message":"answered"}`)
+	}))
+	t.Cleanup(srv.Close)
+	return a, srv.URL
+}
+
+func TestParseEmail(t *testing.T) {
+	e, err := parseEmail(newTestSystemEmail(t))
+	if err != nil {
+		t.Fatalf("Could not parse the email: %s", err)
+	}
+	if e.from.Address != "from@example.com" || e.from.Name != "The Form" || e.replyTo.Address != "reply@example.com" {
+		t.Fatalf("Expected the From and Reply-To addresses but got %+v %+v", e.from, e.replyTo)
+	}
+	if e.subject != "A message" || e.text == "" || e.html == "" {
+		t.Fatalf("Expected the subject and both bodies but got %+v", e)
+	}
+	if len(e.headers) != 1 || e.headers[0] != [2]string{"X-Spam-Score", "1.0"} {
+		t.Fatalf("Expected the X-Spam-Score header but got %v", e.headers)
+	}
+	if len(e.attachments) != 1 || e.attachments[0].Filename != "notes.txt" || string(e.attachments[0].Data) != "my notes" {
+		t.Fatalf("Expected the attachment but got %+v", e.attachments)
+	}
+	to := e.recipients([]string{"TO@example.com", "bcc@example.com"})
+	if to[0].Name != "The Owner" || to[1].Name != "" {
+		t.Fatalf("Expected the recipients' names from the To header but got %+v %+v", to[0], to[1])
+	}
+}
+
+func TestSendGridTransport(t *testing.T) {
+	a, url := newTestAPI(t, http.StatusAccepted)
+	transport := &sendGridTransport{api: newAPI(url, sendGridURL, 10*time.Second), key: "key"}
+	err := transport.Send(context.Background(), "from@example.com", []string{"to@example.com"}, newTestSystemEmail(t))
+	if err != nil {
+		t.Fatalf("Could not send the email: %s", err)
+	}
+	if a.path != "/v3/mail/send" || a.header.Get("Authorization") != "Bearer key" {
+		t.Fatalf("Expected a request to the mail send endpoint with the key but got %s %v", a.path, a.header)
+	}
+	var m sendGridMessage
+	err = json.Unmarshal(a.body, &m)
+	if err != nil {
+		t.Fatalf("Could not decode the request: %s", err)
+	}
+	if len(m.Personalizations) != 1 || m.Personalizations[0].To[0] != (sendGridAddress{"to@example.com", "The Owner"}) {
+		t.Fatalf("Expected the recipient but got %+v", m.Personalizations)
+	}
+	if m.From.Email != "from@example.com" || m.ReplyTo == nil || m.Subject != "A message" || m.Headers["X-Spam-Score"] != "1.0" {
+		t.Fatalf("Expected the headers of the email but got %+v", m)
+	}
+	if len(m.Content) != 2 || m.Content[0].Type != "text/plain" || m.Content[1].Type != "text/html" {
+		t.Fatalf("Expected the plain text and then the html but got %+v", m.Content)
+	}
+	if len(m.Attachments) != 1 || m.Attachments[0].Content != "bXkgbm90ZXM=" {
+		t.Fatalf("Expected the attachment in base64 but got %+v", m.Attachments)
+	}
+}
+
+func TestMailgunTransport(t *testing.T) {
+	a, url := newTestAPI(t, http.StatusOK)
+	transport := &mailgunTransport{api: newAPI(url, mailgunURL, 10*time.Second), key: "key", domain: "mg.example.com"}
+	email := newTestSystemEmail(t)
+	err := transport.Send(context.Background(), "from@example.com", []string{"to@example.com"}, email)
+	if err != nil {
+		t.Fatalf("Could not send the email: %s", err)
+	}
+	user, password, _ := (&http.Request{Header: a.header}).BasicAuth()
+	if a.path != "/v3/mg.example.com/messages.mime" || user != "api" || password != "key" {
+		t.Fatalf("Expected a request to the domain's mime endpoint with the key but got %s %v", a.path, a.header)
+	}
+	_, params, err := mime.ParseMediaType(a.header.Get("Content-Type"))
+	if err != nil {
+		t.Fatalf("Could not read the content type: %s", err)
+	}
+	form, err := multipart.NewReader(bytes.NewReader(a.body), params["boundary"]).ReadForm(1 << 20)
+	if err != nil {
+		t.Fatalf("Could not read the request: %s", err)
+	}
+	defer form.RemoveAll()
+	if to := form.Value["to"]; len(to) != 1 || to[0] != "to@example.com" {
+		t.Fatalf("Expected the recipient but got %v", to)
+	}
+	f, err := form.File["message"][0].Open()
+	if err != nil {
+		t.Fatalf("Could not read the message: %s", err)
+	}
+	got, _ := io.ReadAll(f)
+	if string(got) != string(email) {
+		t.Fatalf("Expected the whole email to be sent")
+	}
+}
+
+func TestPostmarkTransport(t *testing.T) {
+	a, url := newTestAPI(t, http.StatusOK)
+	transport := &postmarkTransport{api: newAPI(url, postmarkURL, 10*time.Second), key: "key"}
+	err := transport.Send(context.Background(), "from@example.com", []string{"to@example.com"}, newTestSystemEmail(t))
+	if err != nil {
+		t.Fatalf("Could not send the email: %s", err)
+	}
+	if a.path != "/email" || a.header.Get("X-Postmark-Server-Token") != "key" {
+		t.Fatalf("Expected a request to the email endpoint with the key but got %s %v", a.path, a.header)
+	}
+	var m postmarkMessage
+	err = json.Unmarshal(a.body, &m)
+	if err != nil {
+		t.Fatalf("Could not decode the request: %s", err)
+	}
+	if m.From != `"The Form" <from@example.com>` || m.To != `"The Owner" <to@example.com>` || m.ReplyTo == "" || m.Subject != "A message" {
+		t.Fatalf("Expected the addresses and subject of the email but got %+v", m)
+	}
+	if m.TextBody == "" || m.HtmlBody == "" || len(m.Headers) != 1 || len(m.Attachments) != 1 {
+		t.Fatalf("Expected the bodies, the header and the attachment but got %+v", m)
+	}
+}
+
+func TestAPIError(t *testing.T) {
+	_, url := newTestAPI(t, http.StatusUnauthorized)
+	transport := &postmarkTransport{api: newAPI(url, postmarkURL, 10*time.Second), key: "wrong"}
+	err := transport.Send(context.Background(), "from@example.com", []string{"to@example.com"}, newTestSystemEmail(t))
+	if err == nil || !strings.Contains(err.Error(), "401") || !strings.Contains(err.Error(), "answered") {
+		t.Fatalf("Expected an error with the API's answer but got %v", err)
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright (c) 2024 Owen Waller. All rights reserved.
+package emailer
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// deliveries numbers the files written by this process, so two written in the same microsecond have different names.
+var deliveries atomic.Uint64
+
+// uniqueName returns a file name no other delivery has, in the form the Maildir spec gives
+// e.g. "1709300000.M123456P42Q1.host".
+func uniqueName() string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "localhost"
+	}
+	now := time.Now()
+	return fmt.Sprintf("%d.M%dP%dQ%d.%s", now.Unix(), now.Nanosecond()/1000, os.Getpid(), deliveries.Add(1), host)
+}
+
+// maildirTransport delivers the emails into a Maildir, for a mail server or an IMAP server that reads one.
+// Each email is written to tmp and then moved to new, so a reader never sees half an email.
+type maildirTransport struct {
+	dir string
+}
+
+func (t *maildirTransport) Send(ctx context.Context, from string, to []string, email []byte) error {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		err := os.MkdirAll(filepath.Join(t.dir, sub), 0o700)
+		if err != nil {
+			return fmt.Errorf("Could not create the Maildir: %w", err)
+		}
+	}
+	name := uniqueName()
+	tmp := filepath.Join(t.dir, "tmp", name)
+	// the Return-Path is where a local delivery keeps the envelope sender
+	data := append([]byte("Return-Path: <"+from+">\n"), withLF(email)...)
+	err := os.WriteFile(tmp, data, 0o600)
+	if err != nil {
+		return fmt.Errorf("Could not deliver the email to the Maildir: %w", err)
+	}
+	err = os.Rename(tmp, filepath.Join(t.dir, "new", name))
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("Could not deliver the email to the Maildir: %w", err)
+	}
+	return nil
+}
+
+// fileTransport writes each email to a .eml file in the directory, so the emails can be looked at
+// without a mail server e.g. when testing the templates.
+type fileTransport struct {
+	dir string
+}
+
+func (t *fileTransport) Send(ctx context.Context, from string, to []string, email []byte) error {
+	err := os.MkdirAll(t.dir, 0o700)
+	if err != nil {
+		return fmt.Errorf("Could not create the email directory: %w", err)
+	}
+	filename := filepath.Join(t.dir, uniqueName()+".eml")
+	err = os.WriteFile(filename, email, 0o600)
+	if err != nil {
+		return fmt.Errorf("Could not write the email: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+// Copyright (c) 2024 Owen Waller. All rights reserved.
+package emailer
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMaildirTransport(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "Maildir")
+	transport := &maildirTransport{dir: dir}
+	for i := 0; i < 2; i++ {
+		err := transport.Send(context.Background(), "from@example.com", []string{"to@example.com"}, []byte("Subject: Hello\r\n\r\nHello\r\n"))
+		if err != nil {
+			t.Fatalf("Could not deliver the email: %s", err)
+		}
+	}
+	tmp, _ := os.ReadDir(filepath.Join(dir, "tmp"))
+	delivered, _ := os.ReadDir(filepath.Join(dir, "new"))
+	if len(tmp) != 0 || len(delivered) != 2 {
+		t.Fatalf("Expected %d emails in new and none in tmp but got %d and %d", 2, len(delivered), len(tmp))
+	}
+	got, err := os.ReadFile(filepath.Join(dir, "new", delivered[0].Name()))
+	if err != nil {
+		t.Fatalf("Could not read the email: %s", err)
+	}
+	expected := "Return-Path: <from@example.com>\nSubject: Hello\n\nHello\n"
+	if string(got) != expected {
+		t.Fatalf("Expected the email %q but got %q", expected, got)
+	}
+}
+
+func TestFileTransport(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "emails")
+	transport := &fileTransport{dir: dir}
+	email := "Subject: Hello\r\n\r\nHello\r\n"
+	err := transport.Send(context.Background(), "from@example.com", []string{"to@example.com"}, []byte(email))
+	if err != nil {
+		t.Fatalf("Could not write the email: %s", err)
+	}
+	files, _ := os.ReadDir(dir)
+	if len(files) != 1 || !strings.HasSuffix(files[0].Name(), ".eml") {
+		t.Fatalf("Expected one .eml file but got %v", files)
+	}
+	got, _ := os.ReadFile(filepath.Join(dir, files[0].Name()))
+	if string(got) != email {
+		t.Fatalf("Expected the email %q but got %q", email, got)
+	}
+}
@@ -0,0 +1,208 @@
+// Copyright (c) 2024 Owen Waller. All rights reserved.
+package emailer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/owenwaller/emailformgateway/config"
+)
+
+// pools are the SMTP connection pools, one for each server and set of credentials, shared by every
+// transport that sends to them so the customer and system emails, and the queue's workers, reuse the
+// same connections. A pool is dropped once it has no connections, no email is being sent over it and its
+// relay's failures are forgotten, so the pool of a server or credentials that are no longer in the config
+// does not stay behind.
+var pools = struct {
+	mu    sync.Mutex
+	pools map[poolKey]*smtpPool
+}{pools: make(map[poolKey]*smtpPool)}
+
+type poolKey struct {
+	smtp    config.SmtpData
+	auth    config.AuthData
+	timeout time.Duration
+}
+
+// sharedPool returns the pool for the key, a new pool connects with the function.
+// The pool is kept until release is called.
+func sharedPool(key poolKey, connect func(ctx context.Context) (*smtp.Client, error)) *smtpPool {
+	pools.mu.Lock()
+	defer pools.mu.Unlock()
+	p, found := pools.pools[key]
+	if !found {
+		p = newSMTPPool(key.smtp.MaxConnections, key.smtp.IdleTimeout, connect)
+		p.key = key
+		pools.pools[key] = p
+	}
+	p.users++
+	return p
+}
+
+// release gives back a pool from sharedPool, and drops it if it is no longer used.
+func (p *smtpPool) release() {
+	pools.mu.Lock()
+	defer pools.mu.Unlock()
+	p.users--
+	p.dropUnused()
+}
+
+// dropUnused drops the pool if no one is using it, it has no idle connections and the relay's health
+// has no failures left to remember. Until they can be forgotten the pool is kept, and looked at again then.
+// pools.mu must be held.
+func (p *smtpPool) dropUnused() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.users != 0 || len(p.idle) != 0 || pools.pools[p.key] != p {
+		return
+	}
+	if quiet := p.health.quiet(); time.Now().Before(quiet) {
+		if p.timer == nil {
+			p.timer = time.AfterFunc(time.Until(quiet), p.closeIdle)
+		}
+		return
+	}
+	delete(pools.pools, p.key)
+}
+
+// smtpPool keeps the logged in connections to an SMTP server open, and hands them out one email at a time.
+// No more than max connections are open at once, an email waits for one to be free.
+type smtpPool struct {
+	key         poolKey
+	users       int // how many are using the pool, guarded by pools.mu
+	connect     func(ctx context.Context) (*smtp.Client, error)
+	idleTimeout time.Duration
+	slots       chan struct{} // a connection that is sending holds a slot
+	mu          sync.Mutex
+	idle        []idleConn // the most recently used last
+	timer       *time.Timer
+	health      relayHealth // only used when the server is a relay
+}
+
+// errNoFreeConnection is the error for an email that waited too long for one of the pool's connections.
+// The server is busy rather than broken.
+var errNoFreeConnection = errors.New("smtp: no free connection")
+
+// connectError is an error connecting or logging in to the server, rather than one sending an email.
+type connectError struct {
+	err error
+}
+
+func (e *connectError) Error() string {
+	return e.err.Error()
+}
+
+func (e *connectError) Unwrap() error {
+	return e.err
+}
+
+type idleConn struct {
+	c     *smtp.Client
+	since time.Time
+}
+
+func newSMTPPool(max int, idleTimeout time.Duration, connect func(ctx context.Context) (*smtp.Client, error)) *smtpPool {
+	if max <= 0 {
+		max = config.DefaultSmtpMaxConnections
+	}
+	if idleTimeout == 0 {
+		idleTimeout = config.DefaultSmtpIdleTimeout
+	}
+	return &smtpPool{connect: connect, idleTimeout: idleTimeout, slots: make(chan struct{}, max)}
+}
+
+// send sends the email over an idle connection, or a new one if there are none.
+func (p *smtpPool) send(ctx context.Context, from string, to []string, email []byte) error {
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return fmt.Errorf("%w: %w", errNoFreeConnection, ctx.Err())
+	}
+	defer func() { <-p.slots }()
+	c, err := p.get(ctx)
+	if err != nil {
+		return err
+	}
+	err = c.SendMail(from, to, bytes.NewReader(email))
+	if err != nil {
+		// the server refused the email, but the connection can send others once it is reset
+		var smtpErr *smtp.SMTPError
+		if errors.As(err, &smtpErr) && c.Reset() == nil {
+			p.put(c)
+		} else {
+			c.Close()
+		}
+		return err
+	}
+	p.put(c)
+	return nil
+}
+
+// get returns the most recently used idle connection that still answers a RSET, or a new connection.
+func (p *smtpPool) get(ctx context.Context) (*smtp.Client, error) {
+	for {
+		p.mu.Lock()
+		if len(p.idle) == 0 {
+			p.mu.Unlock()
+			c, err := p.connect(ctx)
+			if err != nil {
+				return nil, &connectError{err}
+			}
+			return c, nil
+		}
+		ic := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		p.mu.Unlock()
+		if time.Since(ic.since) < p.idleTimeout && ic.c.Reset() == nil {
+			return ic.c, nil
+		}
+		// the server has closed it, or will soon
+		ic.c.Close()
+	}
+}
+
+// put keeps the connection for the next email, and has it closed once it has been idle for the idleTimeout.
+func (p *smtpPool) put(c *smtp.Client) {
+	if p.idleTimeout < 0 {
+		c.Quit()
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.idle = append(p.idle, idleConn{c: c, since: time.Now()})
+	if p.timer == nil {
+		p.timer = time.AfterFunc(p.idleTimeout, p.closeIdle)
+	}
+}
+
+// closeIdle closes the connections that have been idle for the idleTimeout, and is run again when the
+// next one will have been. The pool is dropped once it has none left.
+func (p *smtpPool) closeIdle() {
+	p.mu.Lock()
+	var expired []*smtp.Client
+	kept := p.idle[:0]
+	for _, ic := range p.idle {
+		if time.Since(ic.since) >= p.idleTimeout {
+			expired = append(expired, ic.c)
+		} else {
+			kept = append(kept, ic)
+		}
+	}
+	p.idle = kept
+	p.timer = nil
+	if len(p.idle) != 0 {
+		p.timer = time.AfterFunc(p.idleTimeout-time.Since(p.idle[0].since), p.closeIdle)
+	}
+	p.mu.Unlock()
+	for _, c := range expired {
+		c.Quit()
+	}
+	pools.mu.Lock()
+	p.dropUnused()
+	pools.mu.Unlock()
+}
@@ -0,0 +1,98 @@
+// Copyright (c) 2024 Owen Waller. All rights reserved.
+package emailer
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/owenwaller/emailformgateway/config"
+)
+
+// newPoolTestTransport returns a transport for a new stand-in server that wants a login over implicit TLS.
+func newPoolTestTransport(t *testing.T, maxConnections int, idleTimeout time.Duration) (*smtpTransport, *testSMTPBackend) {
+	be := &testSMTPBackend{username: "user", password: "secret"}
+	smtpData, _, _ := newTestSMTPServer(t, be, testSMTPServer{implicitTLS: true})
+	smtpData.TLS = config.SmtpTLSImplicit
+	smtpData.MaxConnections = maxConnections
+	smtpData.IdleTimeout = idleTimeout
+	transport, err := newSMTPTransport(smtpData, config.AuthData{Username: "user", Password: "secret"}, 10*time.Second)
+	if err != nil {
+		t.Fatalf("Could not create the transport: %s", err)
+	}
+	return transport, be
+}
+
+func sendPoolTestEmail(t *testing.T, transport Transport) {
+	err := transport.Send(context.Background(), "from@example.com", []string{"to@example.com"}, []byte("Subject: Hello\r\n\r\nHello\r\n"))
+	if err != nil {
+		t.Fatalf("Could not send the email: %s", err)
+	}
+}
+
+func TestPoolReusesConnections(t *testing.T) {
+	transport, be := newPoolTestTransport(t, 1, time.Minute)
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := transport.Send(context.Background(), "from@example.com", []string{"to@example.com"}, []byte("Subject: Hello\r\n\r\nHello\r\n"))
+			if err != nil {
+				t.Errorf("Could not send the email: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+	// another transport for the same server and credentials shares the pool
+	other, err := newSMTPTransport(transport.smtp, transport.auth, transport.timeout)
+	if err != nil {
+		t.Fatalf("Could not create the transport: %s", err)
+	}
+	sendPoolTestEmail(t, other)
+	if emails, conns := len(be.received()), len(be.connections()); emails != 6 || conns != 1 {
+		t.Fatalf("Expected %d emails over %d connection but got %d over %d", 6, 1, emails, conns)
+	}
+	for _, e := range be.received() {
+		if e.user != "user" {
+			t.Fatalf("Expected every email to be sent logged in but got %+v", e)
+		}
+	}
+}
+
+func TestPoolReplacesDeadConnections(t *testing.T) {
+	transport, be := newPoolTestTransport(t, 1, time.Minute)
+	sendPoolTestEmail(t, transport)
+	// the server drops the idle connection, the next email finds out with a RSET
+	be.connections()[0].Close()
+	sendPoolTestEmail(t, transport)
+	if emails, conns := len(be.received()), len(be.connections()); emails != 2 || conns != 2 {
+		t.Fatalf("Expected %d emails over %d connections but got %d over %d", 2, 2, emails, conns)
+	}
+}
+
+func TestPoolIdleTimeout(t *testing.T) {
+	transport, be := newPoolTestTransport(t, 1, 50*time.Millisecond)
+	sendPoolTestEmail(t, transport)
+	time.Sleep(200 * time.Millisecond)
+	// the pool, with the credentials it connects with, is dropped with its last connection
+	pools.mu.Lock()
+	_, found := pools.pools[transport.key]
+	pools.mu.Unlock()
+	if found {
+		t.Fatalf("Expected the pool to be dropped once its idle connection was closed")
+	}
+	sendPoolTestEmail(t, transport)
+	if conns := len(be.connections()); conns != 2 {
+		t.Fatalf("Expected a new connection after the idle timeout but got %d connections", conns)
+	}
+
+	// a negative timeout never keeps a connection
+	transport, be = newPoolTestTransport(t, 1, -1)
+	sendPoolTestEmail(t, transport)
+	sendPoolTestEmail(t, transport)
+	if conns := len(be.connections()); conns != 2 {
+		t.Fatalf("Expected a connection for each email but got %d connections", conns)
+	}
+}
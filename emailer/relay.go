@@ -0,0 +1,196 @@
+// Copyright (c) 2024 Owen Waller. All rights reserved.
+package emailer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/owenwaller/emailformgateway/config"
+)
+
+// errRelayDown is the error for a relay whose circuit is open.
+var errRelayDown = errors.New("is down")
+
+// relayHealth is a relay's circuit breaker. After maxFailures failures in a row the circuit opens and
+// the relay is not tried for the cooldown. After that a single email is let through to try it, which
+// closes the circuit if it is sent, and opens it for another cooldown if not. It is kept on the relay's
+// pool, so it goes when the pool is dropped.
+type relayHealth struct {
+	mu         sync.Mutex
+	failures   int
+	openUntil  time.Time
+	quietUntil time.Time // when the failures are old enough to forget
+	trying     bool      // an email is trying the relay after a cooldown
+}
+
+// quiet returns when the failures can be forgotten, the zero time if there are none.
+func (h *relayHealth) quiet() time.Time {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.failures == 0 {
+		return time.Time{}
+	}
+	return h.quietUntil
+}
+
+// allow reports whether an email can be sent through the relay.
+func (h *relayHealth) allow(maxFailures int) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.failures < maxFailures {
+		return true
+	}
+	if h.trying || time.Now().Before(h.openUntil) {
+		return false
+	}
+	h.trying = true
+	return true
+}
+
+func (h *relayHealth) succeeded() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.failures = 0
+	h.trying = false
+}
+
+// untried is for an email that was let through but not sent through the relay after all.
+func (h *relayHealth) untried() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.trying = false
+}
+
+func (h *relayHealth) failed(maxFailures int, cooldown time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.failures++
+	h.trying = false
+	now := time.Now()
+	h.quietUntil = now.Add(cooldown)
+	if h.failures >= maxFailures {
+		h.openUntil = now.Add(cooldown)
+		// an open circuit is remembered until a cooldown after an email could have tried the relay again
+		h.quietUntil = h.openUntil.Add(cooldown)
+	}
+}
+
+type relay struct {
+	name      string // its host:port
+	weight    int
+	transport *smtpTransport
+}
+
+// relayTransport sends the emails through the first of its relays that takes them.
+type relayTransport struct {
+	relays      []relay
+	maxFailures int
+	cooldown    time.Duration
+}
+
+func newRelayTransport(relays []config.RelayData, timeout time.Duration) (*relayTransport, error) {
+	t := &relayTransport{maxFailures: config.DefaultRelayMaxFailures, cooldown: config.DefaultRelayCooldown}
+	for _, r := range relays {
+		transport, err := newSMTPTransport(r.Smtp, r.Auth, timeout)
+		if err != nil {
+			return nil, err
+		}
+		t.relays = append(t.relays, relay{name: transport.addr, weight: r.Weight, transport: transport})
+	}
+	return t, nil
+}
+
+// Send tries each relay in turn until one takes the email. A relay whose circuit is open is skipped,
+// and so is one whose connections are all busy, without it counting as a failure.
+func (t *relayTransport) Send(ctx context.Context, from string, to []string, email []byte) error {
+	var problems []string
+	for _, r := range t.order() {
+		err := t.send(ctx, r, from, to, email)
+		if err == nil || !failsOver(err) {
+			return err
+		}
+		problems = append(problems, r.name+": "+err.Error())
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return fmt.Errorf("Could not send the email through any relay; %s", strings.Join(problems, "; "))
+}
+
+// send sends the email through the relay, unless its circuit is open, and records how it went in the
+// health on the relay's pool. The pool is held until then so it is not dropped, and the health with it.
+func (t *relayTransport) send(ctx context.Context, r relay, from string, to []string, email []byte) error {
+	p := sharedPool(r.transport.key, r.transport.connect)
+	defer p.release()
+	if !p.health.allow(t.maxFailures) {
+		return errRelayDown
+	}
+	err := r.transport.Send(ctx, from, to, email)
+	switch {
+	case err == nil || !failsOver(err):
+		// the relay is working, if it refused the email it did so as any relay would
+		p.health.succeeded()
+	case errors.Is(err, errNoFreeConnection):
+		// every connection to the relay is busy, which says nothing about whether it works
+		p.health.untried()
+	default:
+		p.health.failed(t.maxFailures, t.cooldown)
+	}
+	return err
+}
+
+// order returns the relays in the order they are tried, those with a weight first in a random order
+// where a relay is ahead of another in proportion to its weight, then those without in the config's order.
+func (t *relayTransport) order() []relay {
+	var weighted, ordered []relay
+	for _, r := range t.relays {
+		if r.weight > 0 {
+			weighted = append(weighted, r)
+		} else {
+			ordered = append(ordered, r)
+		}
+	}
+	// each relay is given a random key of u^(1/weight) and the largest go first (Efraimidis and Spirakis)
+	keys := make([]float64, len(weighted))
+	for i, r := range weighted {
+		keys[i] = math.Pow(rand.Float64(), 1/float64(r.weight))
+	}
+	sort.Sort(byKey{weighted, keys})
+	return append(weighted, ordered...)
+}
+
+// byKey sorts the relays by their keys, the largest first.
+type byKey struct {
+	relays []relay
+	keys   []float64
+}
+
+func (b byKey) Len() int           { return len(b.relays) }
+func (b byKey) Less(i, j int) bool { return b.keys[i] > b.keys[j] }
+func (b byKey) Swap(i, j int) {
+	b.relays[i], b.relays[j] = b.relays[j], b.relays[i]
+	b.keys[i], b.keys[j] = b.keys[j], b.keys[i]
+}
+
+// failsOver reports whether the email should be tried through the next relay, which it should if the
+// relay could not be reached or logged in to, or answered with a temporary error. A permanent error
+// about the email itself, e.g. an unknown recipient, would be the same from any relay.
+func failsOver(err error) bool {
+	var ce *connectError
+	if errors.As(err, &ce) {
+		return true
+	}
+	var smtpErr *smtp.SMTPError
+	if errors.As(err, &smtpErr) {
+		return smtpErr.Temporary()
+	}
+	return true
+}
@@ -0,0 +1,203 @@
+// Copyright (c) 2024 Owen Waller. All rights reserved.
+package emailer
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/owenwaller/emailformgateway/config"
+)
+
+// newTestRelay starts a stand-in server, that wants its own login, and returns it as a relay.
+func newTestRelay(t *testing.T, be *testSMTPBackend, weight int) config.RelayData {
+	be.username, be.password = "user", "secret"
+	smtpData, _, _ := newTestSMTPServer(t, be, testSMTPServer{implicitTLS: true})
+	smtpData.TLS = config.SmtpTLSImplicit
+	return config.RelayData{Smtp: smtpData, Auth: config.AuthData{Username: "user", Password: "secret"}, Weight: weight}
+}
+
+// newDeadRelay returns a relay on a port nothing listens on.
+func newDeadRelay(t *testing.T) config.RelayData {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	return config.RelayData{Smtp: config.SmtpData{Host: "127.0.0.1", Port: port, TLS: config.SmtpTLSNone}}
+}
+
+// relayFailures returns the failures in a row of the relay, kept on its pool.
+func relayFailures(r relay) int {
+	pools.mu.Lock()
+	p := pools.pools[r.transport.key]
+	pools.mu.Unlock()
+	if p == nil {
+		return 0
+	}
+	p.health.mu.Lock()
+	defer p.health.mu.Unlock()
+	return p.health.failures
+}
+
+func sendRelayTestEmail(transport Transport) error {
+	return transport.Send(context.Background(), "from@example.com", []string{"to@example.com"}, []byte("Subject: Hello\r\n\r\nHello\r\n"))
+}
+
+func TestRelayFailover(t *testing.T) {
+	busy := &testSMTPBackend{mailErr: &smtp.SMTPError{Code: 451, Message: "Try again later"}}
+	good := &testSMTPBackend{}
+	relays := []config.RelayData{newDeadRelay(t), newTestRelay(t, busy, 0), newTestRelay(t, good, 0)}
+	transport, err := newRelayTransport(relays, 10*time.Second)
+	if err != nil {
+		t.Fatalf("Could not create the transport: %s", err)
+	}
+	err = sendRelayTestEmail(transport)
+	if err != nil {
+		t.Fatalf("Could not send the email: %s", err)
+	}
+	if len(busy.received()) != 0 || len(good.received()) != 1 || good.received()[0].user != "user" {
+		t.Fatalf("Expected the email to fail over to the last relay but it got %+v", good.received())
+	}
+	for i, expected := range []int{1, 1, 0} {
+		if failures := relayFailures(transport.relays[i]); failures != expected {
+			t.Fatalf("Expected relay %d to have %d failures but it has %d", i, expected, failures)
+		}
+	}
+
+	// a permanent error is the same from any relay
+	refused := &testSMTPBackend{mailErr: &smtp.SMTPError{Code: 550, Message: "No such sender"}}
+	good = &testSMTPBackend{}
+	transport, err = newRelayTransport([]config.RelayData{newTestRelay(t, refused, 0), newTestRelay(t, good, 0)}, 10*time.Second)
+	if err != nil {
+		t.Fatalf("Could not create the transport: %s", err)
+	}
+	err = sendRelayTestEmail(transport)
+	if err == nil || !strings.Contains(err.Error(), "No such sender") || len(good.received()) != 0 {
+		t.Fatalf("Expected the permanent error without a failover but got %v", err)
+	}
+}
+
+func TestRelayCircuitBreaker(t *testing.T) {
+	good := &testSMTPBackend{}
+	transport, err := newRelayTransport([]config.RelayData{newDeadRelay(t), newTestRelay(t, good, 0)}, 10*time.Second)
+	if err != nil {
+		t.Fatalf("Could not create the transport: %s", err)
+	}
+	transport.maxFailures = 2
+	transport.cooldown = 100 * time.Millisecond
+	// the third email skips the dead relay as its circuit is open
+	for i := 0; i < 3; i++ {
+		err = sendRelayTestEmail(transport)
+		if err != nil {
+			t.Fatalf("Could not send email %d: %s", i, err)
+		}
+	}
+	if failures := relayFailures(transport.relays[0]); failures != 2 {
+		t.Fatalf("Expected the dead relay to be tried %d times but it was tried %d times", 2, failures)
+	}
+	// after the cooldown it is tried again
+	time.Sleep(150 * time.Millisecond)
+	err = sendRelayTestEmail(transport)
+	if err != nil {
+		t.Fatalf("Could not send the email: %s", err)
+	}
+	if failures := relayFailures(transport.relays[0]); failures != 3 || len(good.received()) != 4 {
+		t.Fatalf("Expected the dead relay to be tried after the cooldown. Got %d failures and %d emails", failures, len(good.received()))
+	}
+
+	// with every relay down the email is not sent
+	transport, err = newRelayTransport([]config.RelayData{newDeadRelay(t)}, 10*time.Second)
+	if err != nil {
+		t.Fatalf("Could not create the transport: %s", err)
+	}
+	transport.maxFailures = 1
+	transport.cooldown = time.Minute
+	sendRelayTestEmail(transport)
+	err = sendRelayTestEmail(transport)
+	if err == nil || !strings.Contains(err.Error(), "is down") {
+		t.Fatalf("Expected an error as the only relay is down but got %v", err)
+	}
+}
+
+func TestRelayBusy(t *testing.T) {
+	busy := newTestRelay(t, &testSMTPBackend{}, 0)
+	busy.Smtp.MaxConnections = 1
+	good := &testSMTPBackend{}
+	transport, err := newRelayTransport([]config.RelayData{busy, newTestRelay(t, good, 0)}, 100*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Could not create the transport: %s", err)
+	}
+	// the busy relay's only connection is in use
+	p := sharedPool(transport.relays[0].transport.key, transport.relays[0].transport.connect)
+	p.slots <- struct{}{}
+	defer p.release()
+	defer func() { <-p.slots }()
+	err = sendRelayTestEmail(transport)
+	if err != nil {
+		t.Fatalf("Could not send the email: %s", err)
+	}
+	if failures := relayFailures(transport.relays[0]); failures != 0 || len(good.received()) != 1 {
+		t.Fatalf("Expected the email to fail over without a failure. Got %d failures and %d emails", failures, len(good.received()))
+	}
+
+	// the same server with other credentials is another relay
+	other := busy
+	other.Auth.Username = "other"
+	otherTransport, err := newRelayTransport([]config.RelayData{other}, 100*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Could not create the transport: %s", err)
+	}
+	if otherTransport.relays[0].transport.key == transport.relays[0].transport.key {
+		t.Fatalf("Expected the relays with different credentials to have their own pool and health")
+	}
+}
+
+func TestRelayHealthDropped(t *testing.T) {
+	transport, err := newRelayTransport([]config.RelayData{newDeadRelay(t)}, 10*time.Second)
+	if err != nil {
+		t.Fatalf("Could not create the transport: %s", err)
+	}
+	transport.maxFailures = 1
+	transport.cooldown = 50 * time.Millisecond
+	sendRelayTestEmail(transport)
+	// the failure is remembered after the email is sent
+	if failures := relayFailures(transport.relays[0]); failures != 1 {
+		t.Fatalf("Expected the dead relay to have %d failures but it has %d", 1, failures)
+	}
+	// and forgotten, with the pool, a cooldown after the circuit could have closed
+	time.Sleep(200 * time.Millisecond)
+	pools.mu.Lock()
+	_, ok := pools.pools[transport.relays[0].transport.key]
+	pools.mu.Unlock()
+	if ok {
+		t.Fatalf("Expected the dead relay's pool and health to be dropped")
+	}
+}
+
+func TestRelayOrder(t *testing.T) {
+	transport := &relayTransport{relays: []relay{
+		{name: "first", weight: 0},
+		{name: "light", weight: 1},
+		{name: "second", weight: 0},
+		{name: "heavy", weight: 9},
+	}}
+	heavyFirst := 0
+	for i := 0; i < 1000; i++ {
+		order := transport.order()
+		if order[2].name != "first" || order[3].name != "second" {
+			t.Fatalf("Expected the relays without a weight last, in order, but got %v", order)
+		}
+		if order[0].name == "heavy" {
+			heavyFirst++
+		}
+	}
+	// the heavy relay should be first about 90% of the time
+	if heavyFirst < 800 || heavyFirst > 970 {
+		t.Fatalf("Expected the heavy relay first about 900 times in 1000 but it was first %d times", heavyFirst)
+	}
+}
@@ -0,0 +1,51 @@
+// Copyright (c) 2024 Owen Waller. All rights reserved.
+package emailer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/owenwaller/emailformgateway/config"
+)
+
+// sendmailTransport pipes the emails to a sendmail compatible command, e.g. sendmail, msmtp or
+// Postfix's sendmail, which delivers them or hands them on to a relay.
+type sendmailTransport struct {
+	command []string // the command and its own arguments
+	timeout time.Duration
+}
+
+func newSendmailTransport(command string, timeout time.Duration) (*sendmailTransport, error) {
+	if command == "" {
+		command = config.DefaultSendmailCommand
+	}
+	// the arguments are split on white space, so the config can give e.g. msmtp its account
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil, errors.New("The sendmail command is empty")
+	}
+	return &sendmailTransport{command: args, timeout: timeout}, nil
+}
+
+// Send runs the command with the envelope as its arguments, -i so a line with a single dot does not
+// end the email, -f for the envelope sender and the recipients after --, so none is taken as an option.
+func (t *sendmailTransport) Send(ctx context.Context, from string, to []string, email []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	args := append(t.command[1:len(t.command):len(t.command)], "-i", "-f", from, "--")
+	args = append(args, to...)
+	cmd := exec.CommandContext(ctx, t.command[0], args...)
+	cmd.Stdin = bytes.NewReader(withLF(email))
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("%s failed: %w %s", t.command[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
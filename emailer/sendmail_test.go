@@ -0,0 +1,66 @@
+// Copyright (c) 2024 Owen Waller. All rights reserved.
+package emailer
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestSendmail writes a shell script that stands in for sendmail, it saves its arguments and the email.
+func writeTestSendmail(t *testing.T, exitCode string) (script, dir string) {
+	dir = t.TempDir()
+	script = filepath.Join(dir, "sendmail")
+	body := "#!/bin/sh\n" +
+		"echo \"$@\" > \"" + filepath.Join(dir, "args") + "\"\n" +
+		"cat > \"" + filepath.Join(dir, "email") + "\"\n" +
+		"echo 'sendmail: something went wrong' >&2\n" +
+		"exit " + exitCode + "\n"
+	err := os.WriteFile(script, []byte(body), 0o700)
+	if err != nil {
+		t.Fatalf("Could not write the stand in sendmail: %s", err)
+	}
+	return script, dir
+}
+
+func TestSendmailTransport(t *testing.T) {
+	script, dir := writeTestSendmail(t, "0")
+	// the command's own arguments come before the envelope
+	transport, err := newSendmailTransport(script+" -C msmtprc", 10*time.Second)
+	if err != nil {
+		t.Fatalf("Could not create the transport: %s", err)
+	}
+	email := "Subject: Hello\r\n\r\nHello\r\n"
+	err = transport.Send(context.Background(), "from@example.com", []string{"to@example.com", "-oi@example.com"}, []byte(email))
+	if err != nil {
+		t.Fatalf("Could not send the email: %s", err)
+	}
+	args, _ := os.ReadFile(filepath.Join(dir, "args"))
+	expected := "-C msmtprc -i -f from@example.com -- to@example.com -oi@example.com\n"
+	if string(args) != expected {
+		t.Fatalf("Expected the arguments %q but got %q", expected, args)
+	}
+	got, _ := os.ReadFile(filepath.Join(dir, "email"))
+	if string(got) != "Subject: Hello\n\nHello\n" {
+		t.Fatalf("Expected the email with LF line endings but got %q", got)
+	}
+}
+
+func TestSendmailTransportFails(t *testing.T) {
+	script, _ := writeTestSendmail(t, "75")
+	transport, err := newSendmailTransport(script, 10*time.Second)
+	if err != nil {
+		t.Fatalf("Could not create the transport: %s", err)
+	}
+	err = transport.Send(context.Background(), "from@example.com", []string{"to@example.com"}, []byte("Subject: Hello\r\n\r\n"))
+	if err == nil || !strings.Contains(err.Error(), "something went wrong") {
+		t.Fatalf("Expected an error with what sendmail said but got %v", err)
+	}
+	_, err = newSendmailTransport("  ", time.Second)
+	if err == nil {
+		t.Fatalf("Expected an error for an empty command but got nil")
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright (c) 2024 Owen Waller. All rights reserved.
+package emailer
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/owenwaller/emailformgateway/config"
+)
+
+// sesPath is the endpoint of version 2 of the SES API that sends an email.
+const sesPath = "/v2/email/outbound-emails"
+
+// sesDefaultRegion is the region the requests are signed for when a URL is given without one.
+const sesDefaultRegion = "us-east-1"
+
+// sesTransport sends the emails with Amazon SES, which is given the whole email. The requests
+// are signed with AWS Signature Version 4.
+type sesTransport struct {
+	api     api
+	keyID   string
+	secret  string
+	region  string
+	timeNow func() time.Time
+}
+
+type sesMessage struct {
+	FromEmailAddress string
+	Destination      struct {
+		ToAddresses []string
+	}
+	Content struct {
+		Raw struct {
+			Data []byte // encoding/json base64 encodes it, as SES wants
+		}
+	}
+}
+
+func newSESTransport(td config.TransportData, timeout time.Duration) *sesTransport {
+	region := td.Region
+	if region == "" {
+		region = sesDefaultRegion
+	}
+	return &sesTransport{
+		api:     newAPI(td.URL, "https://email."+region+".amazonaws.com", timeout),
+		keyID:   td.APIKey,
+		secret:  td.Secret,
+		region:  region,
+		timeNow: time.Now,
+	}
+}
+
+func (t *sesTransport) Send(ctx context.Context, from string, to []string, email []byte) error {
+	var m sesMessage
+	m.FromEmailAddress = from
+	m.Destination.ToAddresses = to
+	m.Content.Raw.Data = email
+	body, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.api.url+sesPath, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	signV4(req, body, t.keyID, t.secret, t.region, "ses", t.timeNow())
+	return t.api.do(req, "SES")
+}
+
+// signV4 adds the X-Amz-Date and Authorization headers of AWS Signature Version 4 to the request.
+// The Content-Type, Host and X-Amz-Date headers are signed.
+func signV4(req *http.Request, body []byte, keyID, secret, region, service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	signedHeaders := "content-type;host;x-amz-date"
+	canonicalHeaders := "content-type:" + strings.TrimSpace(req.Header.Get("Content-Type")) + "\n" +
+		"host:" + req.URL.Host + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		hexSHA256(body),
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hexSHA256([]byte(canonicalRequest))
+	key := hmacSHA256([]byte("AWS4"+secret), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+keyID+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+// canonicalQuery sorts the query by name and then value, and escapes it as AWS wants, with spaces as %20.
+func canonicalQuery(q url.Values) string {
+	var params []string
+	for name, values := range q {
+		for _, v := range values {
+			params = append(params, awsEscape(name)+"="+awsEscape(v))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+func awsEscape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+func hexSHA256(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
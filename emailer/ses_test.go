@@ -0,0 +1,54 @@
+// Copyright (c) 2024 Owen Waller. All rights reserved.
+package emailer
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/owenwaller/emailformgateway/config"
+)
+
+func TestSignV4(t *testing.T) {
+	// the example from the AWS Signature Version 4 documentation
+	req, err := http.NewRequest(http.MethodGet, "https://iam.amazonaws.com/?Action=ListUsers&Version=2010-05-08", nil)
+	if err != nil {
+		t.Fatalf("Could not create the request: %s", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+	signV4(req, nil, "AKIDEXAMPLE", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", "us-east-1", "iam", now)
+	expected := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request, " +
+		"SignedHeaders=content-type;host;x-amz-date, Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7"
+	if got := req.Header.Get("Authorization"); got != expected {
+		t.Fatalf("Expected the Authorization header\n%s\nbut got\n%s", expected, got)
+	}
+	if req.Header.Get("X-Amz-Date") != "20150830T123600Z" {
+		t.Fatalf("Expected the X-Amz-Date header but got %q", req.Header.Get("X-Amz-Date"))
+	}
+}
+
+func TestSESTransport(t *testing.T) {
+	a, url := newTestAPI(t, http.StatusOK)
+	transport := newSESTransport(config.TransportData{URL: url, APIKey: "AKIDEXAMPLE", Secret: "secret", Region: "eu-west-1"}, 10*time.Second)
+	email := newTestSystemEmail(t)
+	err := transport.Send(context.Background(), "from@example.com", []string{"to@example.com"}, email)
+	if err != nil {
+		t.Fatalf("Could not send the email: %s", err)
+	}
+	if a.path != sesPath || !strings.HasPrefix(a.header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/") ||
+		!strings.Contains(a.header.Get("Authorization"), "/eu-west-1/ses/aws4_request") {
+		t.Fatalf("Expected a signed request to the outbound emails endpoint but got %s %v", a.path, a.header)
+	}
+	var m sesMessage
+	err = json.Unmarshal(a.body, &m)
+	if err != nil {
+		t.Fatalf("Could not decode the request: %s", err)
+	}
+	if m.FromEmailAddress != "from@example.com" || len(m.Destination.ToAddresses) != 1 || string(m.Content.Raw.Data) != string(email) {
+		t.Fatalf("Expected the envelope and the whole email but got %+v", m)
+	}
+}
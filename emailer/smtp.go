@@ -0,0 +1,113 @@
+// Copyright (c) 2024 Owen Waller. All rights reserved.
+package emailer
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/owenwaller/emailformgateway/config"
+)
+
+// smtpTransport sends the emails to an SMTP server. Its TLS mode says how the connection is encrypted,
+// by default with TLS from the start on port 465 or when it logs in, and otherwise with STARTTLS,
+// which the server must offer. The transports for the same server and credentials share a pool of connections.
+type smtpTransport struct {
+	smtp      config.SmtpData
+	addr      string
+	auth      config.AuthData
+	mode      string
+	tlsConfig *tls.Config
+	timeout   time.Duration
+	key       poolKey
+}
+
+func newSMTPTransport(smtpData config.SmtpData, authData config.AuthData, timeout time.Duration) (*smtpTransport, error) {
+	tlsConfig, err := smtpData.TLSConfig()
+	if err != nil {
+		return nil, fmt.Errorf("Could not set up TLS for %s: %w", smtpData.Host, err)
+	}
+	return &smtpTransport{smtp: smtpData, addr: smtpAddress(smtpData), auth: authData, mode: smtpData.TLSMode(authData),
+		tlsConfig: tlsConfig, timeout: timeout, key: poolKey{smtp: smtpData, auth: authData, timeout: timeout}}, nil
+}
+
+// Send sends the email over one of the pool's connections.
+func (t *smtpTransport) Send(ctx context.Context, from string, to []string, email []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	p := sharedPool(t.key, t.connect)
+	defer p.release()
+	return p.send(ctx, from, to, email)
+}
+
+// connect opens a new connection to the server, and logs in if the server needs auth.
+func (t *smtpTransport) connect(ctx context.Context) (*smtp.Client, error) {
+	// the password is read for each connection, so a new one in its file or a refreshed token is used
+	auth, err := newSASLClient(ctx, t.smtp, t.auth)
+	if err != nil {
+		return nil, err
+	}
+	c, err := t.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if auth == nil {
+		return c, nil
+	}
+	// the credentials are only sent in the clear if the config says the connection is plaintext
+	if _, encrypted := c.TLSConnectionState(); !encrypted && t.mode != config.SmtpTLSNone {
+		c.Close()
+		return nil, errors.New("smtp: refusing to send the credentials over an unencrypted connection")
+	}
+	if ok, _ := c.Extension("AUTH"); !ok {
+		c.Close()
+		return nil, errors.New("smtp: server doesn't support AUTH")
+	}
+	err = c.Auth(auth)
+	if err != nil {
+		c.Close()
+		// the next connection reads the password or token again, it may have been changed
+		forgetSecret(t.auth)
+		return nil, err
+	}
+	return c, nil
+}
+
+// dial connects to the server, and has the connection encrypted as the TLS mode says before anything is sent.
+func (t *smtpTransport) dial(ctx context.Context) (*smtp.Client, error) {
+	var d net.Dialer
+	var conn net.Conn
+	var err error
+	if t.mode == config.SmtpTLSImplicit {
+		conn, err = (&tls.Dialer{NetDialer: &d, Config: t.tlsConfig}).DialContext(ctx, "tcp", t.addr)
+	} else {
+		conn, err = d.DialContext(ctx, "tcp", t.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := smtp.NewClient(conn)
+	// the client sets its own deadline for each command
+	c.CommandTimeout = t.timeout
+	c.SubmissionTimeout = t.timeout
+	if t.mode == config.SmtpTLSImplicit || t.mode == config.SmtpTLSNone {
+		return c, nil
+	}
+	if ok, _ := c.Extension("STARTTLS"); !ok {
+		if t.mode == config.SmtpTLSStartTLSOpportunistic {
+			return c, nil
+		}
+		c.Close()
+		return nil, errors.New("smtp: server doesn't support STARTTLS")
+	}
+	err = c.StartTLS(t.tlsConfig)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
@@ -0,0 +1,279 @@
+// Copyright (c) 2024 Owen Waller. All rights reserved.
+package emailer
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/owenwaller/emailformgateway/config"
+)
+
+// testCert returns a self signed certificate for 127.0.0.1, which is also its own CA, and the
+// PEM files of the certificate and its key.
+func testCert(t *testing.T) (cert tls.Certificate, certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Could not generate a key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Could not create a certificate: %s", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("Could not marshal the key: %s", err)
+	}
+	dir := t.TempDir()
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	if err != nil {
+		t.Fatalf("Could not write the certificate: %s", err)
+	}
+	err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600)
+	if err != nil {
+		t.Fatalf("Could not write the key: %s", err)
+	}
+	cert, err = tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("Could not load the certificate: %s", err)
+	}
+	return cert, certFile, keyFile
+}
+
+// testEmail is an email the stand-in SMTP server was sent.
+type testEmail struct {
+	user string
+	from string
+	to   []string
+	data string
+}
+
+// testSMTPBackend is a stand-in SMTP server's backend, it keeps the emails it is sent.
+type testSMTPBackend struct {
+	username string // the credentials the server wants, none if empty
+	password string
+	mu       sync.Mutex
+	emails   []testEmail
+	conns    []*smtp.Conn // the connections the server has been sent, in order
+	mailErr  error        // the answer to every MAIL command, if not nil
+}
+
+func (be *testSMTPBackend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	be.mu.Lock()
+	be.conns = append(be.conns, c)
+	be.mu.Unlock()
+	return &testSMTPSession{be: be}, nil
+}
+
+func (be *testSMTPBackend) connections() []*smtp.Conn {
+	be.mu.Lock()
+	defer be.mu.Unlock()
+	return append([]*smtp.Conn(nil), be.conns...)
+}
+
+func (be *testSMTPBackend) received() []testEmail {
+	be.mu.Lock()
+	defer be.mu.Unlock()
+	return append([]testEmail(nil), be.emails...)
+}
+
+type testSMTPSession struct {
+	be    *testSMTPBackend
+	email testEmail
+}
+
+func (s *testSMTPSession) AuthPlain(username, password string) error {
+	if username != s.be.username || password != s.be.password {
+		return errors.New("Invalid username or password")
+	}
+	s.email.user = username
+	return nil
+}
+
+func (s *testSMTPSession) Mail(from string, opts *smtp.MailOptions) error {
+	if s.be.username != "" && s.email.user == "" {
+		return smtp.ErrAuthRequired
+	}
+	if s.be.mailErr != nil {
+		return s.be.mailErr
+	}
+	s.email.from = from
+	return nil
+}
+
+func (s *testSMTPSession) Rcpt(to string, opts *smtp.RcptOptions) error {
+	s.email.to = append(s.email.to, to)
+	return nil
+}
+
+func (s *testSMTPSession) Data(r io.Reader) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.email.data = string(b)
+	s.be.mu.Lock()
+	s.be.emails = append(s.be.emails, s.email)
+	s.be.mu.Unlock()
+	return nil
+}
+
+func (s *testSMTPSession) Reset() {
+	s.email = testEmail{user: s.email.user}
+}
+
+func (s *testSMTPSession) Logout() error {
+	return nil
+}
+
+// testSMTPServer says how the stand-in SMTP server talks TLS.
+type testSMTPServer struct {
+	implicitTLS bool // TLS from the start
+	withTLS     bool // offers STARTTLS
+	clientCert  bool // wants a client certificate signed by its own CA
+	allAuth     bool // offers every auth mechanism the transport has, not just PLAIN
+}
+
+// newTestSMTPServer starts a stand-in SMTP server on 127.0.0.1. It returns the server's address,
+// with its certificate as the CA bundle, and the files of a client certificate it trusts.
+func newTestSMTPServer(t *testing.T, be *testSMTPBackend, opts testSMTPServer) (smtpData config.SmtpData, certFile, keyFile string) {
+	s := smtp.NewServer(be)
+	s.Domain = "localhost"
+	s.ReadTimeout = 10 * time.Second
+	s.WriteTimeout = 10 * time.Second
+	// the modes without TLS are tested too
+	s.AllowInsecureAuth = true
+	if opts.allAuth {
+		enableTestAuth(s, be)
+	}
+	cert, certFile, keyFile := testCert(t)
+	if opts.withTLS || opts.implicitTLS {
+		s.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		if opts.clientCert {
+			pool := x509.NewCertPool()
+			pool.AddCert(cert.Leaf)
+			s.TLSConfig.ClientCAs = pool
+			s.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+	if opts.implicitTLS {
+		l = tls.NewListener(l, s.TLSConfig)
+	}
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+	return config.SmtpData{Host: "127.0.0.1", Port: l.Addr().(*net.TCPAddr).Port, CAFile: certFile}, certFile, keyFile
+}
+
+func TestSMTPTransport(t *testing.T) {
+	user := config.AuthData{Username: "user", Password: "secret"}
+	var checks = []struct {
+		name       string
+		tls        string
+		auth       config.AuthData
+		server     testSMTPServer
+		clientCert bool
+		serverName string
+		err        string
+	}{
+		{"implicit TLS with auth", "implicit", user, testSMTPServer{implicitTLS: true}, false, "", ""},
+		{"STARTTLS without auth", "", config.AuthData{}, testSMTPServer{withTLS: true}, false, "", ""},
+		{"STARTTLS with auth", "starttls-required", user, testSMTPServer{withTLS: true}, false, "", ""},
+		{"no STARTTLS", "", config.AuthData{}, testSMTPServer{}, false, "", "doesn't support STARTTLS"},
+		{"opportunistic STARTTLS", "starttls-opportunistic", config.AuthData{}, testSMTPServer{withTLS: true}, false, "", ""},
+		{"opportunistic without STARTTLS", "starttls-opportunistic", config.AuthData{}, testSMTPServer{}, false, "", ""},
+		{"opportunistic without STARTTLS with auth", "starttls-opportunistic", user, testSMTPServer{}, false, "", "unencrypted connection"},
+		{"plaintext with auth", "none", user, testSMTPServer{}, false, "", ""},
+		{"wrong password", "implicit", config.AuthData{Username: "user", Password: "wrong"}, testSMTPServer{implicitTLS: true}, false, "", "Invalid username or password"},
+		{"client certificate", "implicit", config.AuthData{}, testSMTPServer{implicitTLS: true, clientCert: true}, true, "", ""},
+		{"no client certificate", "implicit", config.AuthData{}, testSMTPServer{implicitTLS: true, clientCert: true}, false, "", "certificate"},
+		{"wrong server name", "implicit", config.AuthData{}, testSMTPServer{implicitTLS: true}, false, "mail.example.com", "certificate"},
+	}
+	for _, c := range checks {
+		be := &testSMTPBackend{}
+		if c.auth.Username != "" {
+			be.username, be.password = "user", "secret"
+		}
+		smtpData, certFile, keyFile := newTestSMTPServer(t, be, c.server)
+		smtpData.TLS = c.tls
+		smtpData.ServerName = c.serverName
+		if c.clientCert {
+			smtpData.CertFile, smtpData.KeyFile = certFile, keyFile
+		}
+		transport, err := newSMTPTransport(smtpData, c.auth, 10*time.Second)
+		if err != nil {
+			t.Fatalf("%s: could not create the transport: %s", c.name, err)
+		}
+		email := "Subject: Hello\r\n\r\nHello\r\n"
+		err = transport.Send(context.Background(), "from@example.com", []string{"to@example.com"}, []byte(email))
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Fatalf("%s: expected an error containing %q but got %v", c.name, c.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: could not send the email: %s", c.name, err)
+		}
+		received := be.received()
+		if len(received) != 1 {
+			t.Fatalf("%s: expected %d email but got %d", c.name, 1, len(received))
+		}
+		got := received[0]
+		if got.user != be.username || got.from != "from@example.com" || len(got.to) != 1 || got.to[0] != "to@example.com" || got.data != email {
+			t.Fatalf("%s: the email was not sent as expected. Got %+v", c.name, got)
+		}
+	}
+}
+
+func TestNewSMTPTransportTLSConfig(t *testing.T) {
+	_, certFile, keyFile := testCert(t)
+	smtpData := config.SmtpData{Host: "smtp.example.com", Port: 587, CAFile: certFile, CertFile: certFile, KeyFile: keyFile, MinTLSVersion: "1.3"}
+	transport, err := newSMTPTransport(smtpData, config.AuthData{}, time.Second)
+	if err != nil {
+		t.Fatalf("Could not create the transport: %s", err)
+	}
+	tc := transport.tlsConfig
+	if transport.mode != config.SmtpTLSStartTLSRequired || tc.ServerName != "smtp.example.com" || tc.MinVersion != tls.VersionTLS13 ||
+		tc.RootCAs == nil || len(tc.Certificates) != 1 {
+		t.Fatalf("The transport was not set up as expected. Got mode %q and %+v", transport.mode, tc)
+	}
+
+	smtpData.CAFile = filepath.Join(t.TempDir(), "missing.pem")
+	_, err = newSMTPTransport(smtpData, config.AuthData{}, time.Second)
+	if err == nil {
+		t.Fatalf("Expected an error for a missing CA bundle")
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright (c) 2024 Owen Waller. All rights reserved.
+package emailer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/owenwaller/emailformgateway/config"
+)
+
+// DefaultTimeout is how long one email may take to send.
+const DefaultTimeout = time.Minute
+
+// Transport sends an email that has been built. The from address and the to addresses are the envelope,
+// which is where any bounces go and who the email is delivered to, rather than the email's headers.
+type Transport interface {
+	Send(ctx context.Context, from string, to []string, email []byte) error
+}
+
+// NewTransport returns the transport the config says the emails are sent with. The SMTP transport
+// uses the relays, or the Smtp and Auth sections if there are none, the others only use their own settings.
+func NewTransport(td config.TransportData, smtpData config.SmtpData, authData config.AuthData, relays []config.RelayData) (Transport, error) {
+	timeout := td.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	switch strings.ToLower(td.Type) {
+	case "", config.TransportSMTP:
+		if len(relays) != 0 {
+			t, err := newRelayTransport(relays, timeout)
+			if err != nil {
+				return nil, err
+			}
+			return t, nil
+		}
+		t, err := newSMTPTransport(smtpData, authData, timeout)
+		if err != nil {
+			return nil, err
+		}
+		return t, nil
+	case config.TransportSendmail:
+		return newSendmailTransport(td.Command, timeout)
+	case config.TransportMaildir:
+		return &maildirTransport{dir: td.Dir}, nil
+	case config.TransportFile:
+		return &fileTransport{dir: td.Dir}, nil
+	case config.TransportSendGrid:
+		return &sendGridTransport{api: newAPI(td.URL, sendGridURL, timeout), key: td.APIKey}, nil
+	case config.TransportMailgun:
+		return &mailgunTransport{api: newAPI(td.URL, mailgunURL, timeout), key: td.APIKey, domain: td.Domain}, nil
+	case config.TransportPostmark:
+		return &postmarkTransport{api: newAPI(td.URL, postmarkURL, timeout), key: td.APIKey}, nil
+	case config.TransportSES:
+		return newSESTransport(td, timeout), nil
+	default:
+		return nil, fmt.Errorf("Unknown transport %q", td.Type)
+	}
+}
+
+// IsPermanent reports whether the error is an SMTP server's permanent (5xx) answer, e.g. an unknown
+// recipient or refused credentials, which sending the email again would only get again.
+func IsPermanent(err error) bool {
+	var smtpErr *smtp.SMTPError
+	return errors.As(err, &smtpErr) && smtpErr.Code/100 == 5
+}
+
+// smtpAddress is the host:port of the SMTP server.
+func smtpAddress(smtpData config.SmtpData) string {
+	return smtpData.Host + ":" + strconv.Itoa(smtpData.Port)
+}
+
+// withLF returns the email with LF line endings, as a local program or a mailbox file expects,
+// rather than the CRLF line endings that are sent over SMTP.
+func withLF(email []byte) []byte {
+	return bytes.ReplaceAll(email, []byte("\r\n"), []byte("\n"))
+}
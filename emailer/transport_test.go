@@ -0,0 +1,68 @@
+// Copyright (c) 2024 Owen Waller. All rights reserved.
+package emailer
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/owenwaller/emailformgateway/config"
+)
+
+func TestNewTransport(t *testing.T) {
+	var transports = []struct {
+		td       config.TransportData
+		expected Transport
+	}{
+		{config.TransportData{}, &smtpTransport{}},
+		{config.TransportData{Type: "SMTP"}, &smtpTransport{}},
+		{config.TransportData{Type: "sendmail"}, &sendmailTransport{}},
+		{config.TransportData{Type: "maildir", Dir: "/tmp"}, &maildirTransport{}},
+		{config.TransportData{Type: "file", Dir: "/tmp"}, &fileTransport{}},
+		{config.TransportData{Type: "sendgrid"}, &sendGridTransport{}},
+		{config.TransportData{Type: "mailgun"}, &mailgunTransport{}},
+		{config.TransportData{Type: "postmark"}, &postmarkTransport{}},
+		{config.TransportData{Type: "ses"}, &sesTransport{}},
+	}
+	for _, tr := range transports {
+		got, err := NewTransport(tr.td, config.SmtpData{Host: "localhost", Port: 25}, config.AuthData{}, nil)
+		if err != nil {
+			t.Fatalf("%q: could not create the transport: %s", tr.td.Type, err)
+		}
+		if reflect.TypeOf(got) != reflect.TypeOf(tr.expected) {
+			t.Fatalf("%q: expected a %T but got a %T", tr.td.Type, tr.expected, got)
+		}
+	}
+	sendmail, _ := NewTransport(config.TransportData{Type: "sendmail"}, config.SmtpData{}, config.AuthData{}, nil)
+	if c := sendmail.(*sendmailTransport).command; len(c) != 1 || c[0] != config.DefaultSendmailCommand {
+		t.Fatalf("Expected the default sendmail command but got %v", c)
+	}
+	ses, _ := NewTransport(config.TransportData{Type: "ses", Region: "eu-west-1"}, config.SmtpData{}, config.AuthData{}, nil)
+	if url := ses.(*sesTransport).api.url; url != "https://email.eu-west-1.amazonaws.com" {
+		t.Fatalf("Expected the region's SES endpoint but got %q", url)
+	}
+	_, err := NewTransport(config.TransportData{Type: "pigeon"}, config.SmtpData{}, config.AuthData{}, nil)
+	if err == nil {
+		t.Fatalf("Expected an error for an unknown transport but got nil")
+	}
+}
+
+func TestIsPermanent(t *testing.T) {
+	var checks = []struct {
+		err       error
+		permanent bool
+	}{
+		{nil, false},
+		{errors.New("connection refused"), false},
+		{&smtp.SMTPError{Code: 451, Message: "Try again later"}, false},
+		{&smtp.SMTPError{Code: 550, Message: "No such user"}, true},
+		{fmt.Errorf("Error sending customer email: %w", &connectError{&smtp.SMTPError{Code: 535, Message: "Bad credentials"}}), true},
+	}
+	for _, c := range checks {
+		if permanent := IsPermanent(c.err); permanent != c.permanent {
+			t.Fatalf("Expected IsPermanent of %v to be %t but got %t", c.err, c.permanent, permanent)
+		}
+	}
+}
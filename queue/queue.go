@@ -0,0 +1,409 @@
+// Copyright (c) 2024 Owen Waller. All rights reserved.
+package queue
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/owenwaller/emailformgateway/config"
+)
+
+// The kinds of email a job can deliver. Each form submission becomes two jobs, so a
+// failure to deliver one email never causes the other one to be sent twice.
+const (
+	CustomerEmail = "customer"
+	SystemEmail   = "system"
+)
+
+const (
+	DefaultWorkers        = 2
+	DefaultMaxAttempts    = 10
+	DefaultInitialBackoff = 30 * time.Second
+	DefaultMaxBackoff     = time.Hour
+)
+
+// The spool directory layout. Jobs waiting for (re)delivery live in pending, jobs that
+// have used all of their attempts are moved to dead for an operator to look at.
+// Quarantined jobs are never delivered, an operator can release one by moving it into pending.
+// New job files are written to tmp, synced and renamed, so a crash never leaves a half written job
+// or loses one the client was told was accepted.
+const (
+	pendingDir    = "pending"
+	deadDir       = "dead"
+	quarantineDir = "quarantine"
+	tmpDir        = "tmp"
+)
+
+type Job struct {
+	ID          string
+	Kind        string
+	Attempts    int
+	Created     time.Time
+	NextAttempt time.Time
+	LastError   string
+	Data        config.EmailTemplateData
+}
+
+// DeliverFunc sends the email described by the job. A nil error means the job is done.
+// An error from Permanent means trying again won't help, the job is not retried.
+type DeliverFunc func(j *Job) error
+
+// PermanentError is a delivery error that would happen again on every attempt, e.g. the SMTP
+// server refused the recipient or the credentials.
+type PermanentError struct {
+	err error
+}
+
+// Permanent marks the delivery error as one that retrying won't fix.
+func Permanent(err error) error {
+	return &PermanentError{err}
+}
+
+func (e *PermanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.err
+}
+
+type Queue struct {
+	dir            string
+	workers        int
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	deliver        DeliverFunc
+
+	jobs   chan *Job
+	done   chan struct{}
+	wg     sync.WaitGroup
+	mu     sync.Mutex
+	timers map[string]*time.Timer
+}
+
+type QueueError struct {
+	msg string
+	err string
+}
+
+func NewQueueError(msg string, err string) QueueError {
+	return QueueError{msg, err}
+}
+
+func (e QueueError) Error() string {
+	return fmt.Sprintf("%s, %s", e.msg, e.err)
+}
+
+// New creates the spool directories under qd.Dir, if they do not already exist.
+// Zero values in qd are replaced by the package defaults.
+func New(qd config.QueueData, deliver DeliverFunc) (*Queue, error) {
+	if qd.Dir == "" {
+		return nil, NewQueueError("Could not create queue.", "no spool directory configured")
+	}
+	q := new(Queue)
+	q.dir = qd.Dir
+	q.workers = qd.Workers
+	if q.workers <= 0 {
+		q.workers = DefaultWorkers
+	}
+	q.maxAttempts = qd.MaxAttempts
+	if q.maxAttempts <= 0 {
+		q.maxAttempts = DefaultMaxAttempts
+	}
+	q.initialBackoff = qd.InitialBackoff
+	if q.initialBackoff <= 0 {
+		q.initialBackoff = DefaultInitialBackoff
+	}
+	q.maxBackoff = qd.MaxBackoff
+	if q.maxBackoff <= 0 {
+		q.maxBackoff = DefaultMaxBackoff
+	}
+	q.deliver = deliver
+	q.jobs = make(chan *Job)
+	q.done = make(chan struct{})
+	q.timers = make(map[string]*time.Timer)
+
+	for _, d := range []string{pendingDir, deadDir, quarantineDir, tmpDir} {
+		err := os.MkdirAll(filepath.Join(q.dir, d), 0o700)
+		if err != nil {
+			return nil, NewQueueError("Could not create spool directory.", err.Error())
+		}
+	}
+	return q, nil
+}
+
+// Start launches the workers and reschedules any jobs left in the spool by a previous run.
+func (q *Queue) Start() error {
+	for i := 0; i < q.workers; i++ {
+		q.wg.Add(1)
+		go q.work()
+	}
+	jobs, err := q.Pending()
+	if err != nil {
+		return err
+	}
+	for _, j := range jobs {
+		q.schedule(j, time.Until(j.NextAttempt))
+	}
+	return nil
+}
+
+// Close stops the workers. Jobs that are being delivered are allowed to finish, everything
+// else stays in the spool and is picked up again by the next call to Start.
+func (q *Queue) Close() {
+	q.mu.Lock()
+	select {
+	case <-q.done:
+		q.mu.Unlock()
+		return
+	default:
+	}
+	close(q.done)
+	for id, t := range q.timers {
+		t.Stop()
+		delete(q.timers, id)
+	}
+	q.mu.Unlock()
+	q.wg.Wait()
+}
+
+// Enqueue writes a new job to the spool and schedules it for immediate delivery.
+// Once Enqueue returns without an error the email will survive a restart of the gateway.
+func (q *Queue) Enqueue(kind string, etd config.EmailTemplateData) (*Job, error) {
+	j, err := newJob(kind, etd)
+	if err != nil {
+		return nil, err
+	}
+	err = q.write(pendingDir, j)
+	if err != nil {
+		return nil, err
+	}
+	q.schedule(j, 0)
+	return j, nil
+}
+
+// Quarantine writes a new job to the quarantine directory, where it is kept but not delivered.
+func (q *Queue) Quarantine(kind string, etd config.EmailTemplateData) (*Job, error) {
+	j, err := newJob(kind, etd)
+	if err != nil {
+		return nil, err
+	}
+	err = q.write(quarantineDir, j)
+	if err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// Pending returns the jobs currently waiting in the spool.
+func (q *Queue) Pending() ([]*Job, error) {
+	return q.read(pendingDir)
+}
+
+// Dead returns the jobs that could not be delivered.
+func (q *Queue) Dead() ([]*Job, error) {
+	return q.read(deadDir)
+}
+
+// Quarantined returns the jobs held in quarantine.
+func (q *Queue) Quarantined() ([]*Job, error) {
+	return q.read(quarantineDir)
+}
+
+func (q *Queue) schedule(j *Job, delay time.Duration) {
+	if delay < 0 {
+		delay = 0
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	select {
+	case <-q.done:
+		return // closed, the job stays in the spool
+	default:
+	}
+	q.timers[j.ID] = time.AfterFunc(delay, func() {
+		q.mu.Lock()
+		delete(q.timers, j.ID)
+		q.mu.Unlock()
+		select {
+		case q.jobs <- j:
+		case <-q.done:
+		}
+	})
+}
+
+func (q *Queue) work() {
+	defer q.wg.Done()
+	for {
+		select {
+		case <-q.done:
+			return
+		case j := <-q.jobs:
+			q.attempt(j)
+		}
+	}
+}
+
+func (q *Queue) attempt(j *Job) {
+	j.Attempts++
+	err := q.deliver(j)
+	if err == nil {
+		err = os.Remove(q.path(pendingDir, j))
+		if err != nil {
+			log.Printf("Could not remove delivered job %s from the spool: %s\n", j.ID, err)
+		}
+		return
+	}
+	j.LastError = err.Error()
+	var permanent *PermanentError
+	if errors.As(err, &permanent) {
+		log.Printf("Giving up on %s email job %s, it was refused: %s\n", j.Kind, j.ID, err)
+		q.bury(j)
+		return
+	}
+	if j.Attempts >= q.maxAttempts {
+		log.Printf("Giving up on %s email job %s after %d attempts: %s\n", j.Kind, j.ID, j.Attempts, err)
+		q.bury(j)
+		return
+	}
+	delay := q.backoff(j.Attempts)
+	j.NextAttempt = time.Now().Add(delay)
+	log.Printf("Failed to deliver %s email job %s (attempt %d of %d), retrying in %s: %s\n",
+		j.Kind, j.ID, j.Attempts, q.maxAttempts, delay, err)
+	err = q.write(pendingDir, j)
+	if err != nil {
+		log.Printf("Could not update job %s in the spool: %s\n", j.ID, err)
+	}
+	q.schedule(j, delay)
+}
+
+// backoff doubles the delay after every failed attempt, up to the configured maximum.
+func (q *Queue) backoff(attempts int) time.Duration {
+	d := q.initialBackoff
+	for i := 1; i < attempts; i++ {
+		d *= 2
+		if d >= q.maxBackoff {
+			return q.maxBackoff
+		}
+	}
+	return d
+}
+
+// bury moves a job that has run out of attempts into the dead letter directory.
+func (q *Queue) bury(j *Job) {
+	err := q.write(deadDir, j)
+	if err != nil {
+		log.Printf("Could not move job %s to the dead letter directory: %s\n", j.ID, err)
+		return
+	}
+	err = os.Remove(q.path(pendingDir, j))
+	if err != nil {
+		log.Printf("Could not remove dead job %s from the spool: %s\n", j.ID, err)
+	}
+}
+
+func (q *Queue) path(dir string, j *Job) string {
+	return filepath.Join(q.dir, dir, j.ID+".json")
+}
+
+func (q *Queue) write(dir string, j *Job) error {
+	b, err := json.Marshal(j)
+	if err != nil {
+		return NewQueueError("Could not encode job "+j.ID+".", err.Error())
+	}
+	tmp := q.path(tmpDir, j)
+	err = writeSynced(tmp, b)
+	if err != nil {
+		return NewQueueError("Could not write job "+j.ID+".", err.Error())
+	}
+	err = os.Rename(tmp, q.path(dir, j))
+	if err != nil {
+		return NewQueueError("Could not spool job "+j.ID+".", err.Error())
+	}
+	// the rename is only on the disk once the directory is
+	err = syncDir(filepath.Join(q.dir, dir))
+	if err != nil {
+		return NewQueueError("Could not spool job "+j.ID+".", err.Error())
+	}
+	return nil
+}
+
+// writeSynced writes the file, and only returns once it is on the disk.
+func writeSynced(filename string, b []byte) error {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (q *Queue) read(dir string) ([]*Job, error) {
+	entries, err := os.ReadDir(filepath.Join(q.dir, dir))
+	if err != nil {
+		return nil, NewQueueError("Could not read spool directory.", err.Error())
+	}
+	jobs := make([]*Job, 0, len(entries))
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(q.dir, dir, e.Name()))
+		if err != nil {
+			return nil, NewQueueError("Could not read job "+e.Name()+".", err.Error())
+		}
+		j := new(Job)
+		err = json.Unmarshal(b, j)
+		if err != nil {
+			// leave the file where it is for an operator to look at, but don't block the rest of the spool
+			log.Printf("Skipping corrupt job file %q: %s\n", e.Name(), err)
+			continue
+		}
+		jobs = append(jobs, j)
+	}
+	return jobs, nil
+}
+
+func newJob(kind string, etd config.EmailTemplateData) (*Job, error) {
+	id, err := newID()
+	if err != nil {
+		return nil, NewQueueError("Could not create job id.", err.Error())
+	}
+	j := &Job{ID: id, Kind: kind, Created: time.Now(), Data: etd}
+	j.NextAttempt = j.Created
+	return j, nil
+}
+
+func newID() (string, error) {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d-%s", time.Now().UnixNano(), hex.EncodeToString(b)), nil
+}
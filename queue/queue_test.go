@@ -0,0 +1,253 @@
+// Copyright (c) 2024 Owen Waller. All rights reserved.
+package queue
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/owenwaller/emailformgateway/config"
+)
+
+func newTestQueueData(t *testing.T) config.QueueData {
+	var qd config.QueueData
+	qd.Dir = t.TempDir()
+	qd.Workers = 1
+	qd.MaxAttempts = 3
+	qd.InitialBackoff = time.Millisecond
+	qd.MaxBackoff = 4 * time.Millisecond
+	return qd
+}
+
+func newTestTemplateData() config.EmailTemplateData {
+	var etd config.EmailTemplateData
+	etd.FormData = make(map[string]string)
+	etd.FormData["Name"] = "Joe Blogs"
+	etd.FormData["Email"] = "joe@example.com"
+	return etd
+}
+
+// waitFor polls until f returns true or the test times out.
+func waitFor(t *testing.T, what string, f func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if f() {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("Timed out waiting for %s\n", what)
+}
+
+func TestNewWithoutDir(t *testing.T) {
+	_, err := New(config.QueueData{}, nil)
+	if err == nil {
+		t.Fatalf("Expected an error creating a queue without a spool directory but got nil\n")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	q, err := New(config.QueueData{Dir: t.TempDir(), InitialBackoff: time.Second, MaxBackoff: 5 * time.Second}, nil)
+	if err != nil {
+		t.Fatalf("Could not create queue. Error: %s\n", err)
+	}
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i, e := range expected {
+		result := q.backoff(i + 1)
+		if result != e {
+			t.Fatalf("Attempt %d: expected a backoff of %s but got %s\n", i+1, e, result)
+		}
+	}
+}
+
+func TestDeliverWithRetry(t *testing.T) {
+	var mu sync.Mutex
+	var attempts = make(map[string]int)
+	var delivered = make(map[string]bool)
+	deliver := func(j *Job) error {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts[j.Kind]++
+		if attempts[j.Kind] < 2 {
+			return errors.New("421 try again later")
+		}
+		delivered[j.Kind] = true
+		return nil
+	}
+
+	q, err := New(newTestQueueData(t), deliver)
+	if err != nil {
+		t.Fatalf("Could not create queue. Error: %s\n", err)
+	}
+	err = q.Start()
+	if err != nil {
+		t.Fatalf("Could not start queue. Error: %s\n", err)
+	}
+	defer q.Close()
+
+	_, err = q.Enqueue(CustomerEmail, newTestTemplateData())
+	if err != nil {
+		t.Fatalf("Could not enqueue customer email. Error: %s\n", err)
+	}
+	_, err = q.Enqueue(SystemEmail, newTestTemplateData())
+	if err != nil {
+		t.Fatalf("Could not enqueue system email. Error: %s\n", err)
+	}
+
+	waitFor(t, "both emails to be delivered", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return delivered[CustomerEmail] && delivered[SystemEmail]
+	})
+	waitFor(t, "the spool to empty", func() bool {
+		jobs, err := q.Pending()
+		return err == nil && len(jobs) == 0
+	})
+}
+
+func TestDeadLetter(t *testing.T) {
+	deliver := func(j *Job) error {
+		return errors.New("550 mailbox unavailable")
+	}
+	q, err := New(newTestQueueData(t), deliver)
+	if err != nil {
+		t.Fatalf("Could not create queue. Error: %s\n", err)
+	}
+	err = q.Start()
+	if err != nil {
+		t.Fatalf("Could not start queue. Error: %s\n", err)
+	}
+	defer q.Close()
+
+	j, err := q.Enqueue(SystemEmail, newTestTemplateData())
+	if err != nil {
+		t.Fatalf("Could not enqueue system email. Error: %s\n", err)
+	}
+
+	var dead []*Job
+	waitFor(t, "the job to reach the dead letter directory", func() bool {
+		dead, err = q.Dead()
+		return err == nil && len(dead) == 1
+	})
+	if dead[0].ID != j.ID {
+		t.Fatalf("Expected dead job %q but got %q\n", j.ID, dead[0].ID)
+	}
+	if dead[0].Attempts != 3 {
+		t.Fatalf("Expected the dead job to have been attempted %d times but got %d\n", 3, dead[0].Attempts)
+	}
+	if dead[0].LastError != "550 mailbox unavailable" {
+		t.Fatalf("Expected the dead job to record the last error, got %q\n", dead[0].LastError)
+	}
+	if dead[0].Data.FormData["Email"] != "joe@example.com" {
+		t.Fatalf("Expected the dead job to keep the form data, got %v\n", dead[0].Data.FormData)
+	}
+	// the job is only removed from the spool once it is safely in the dead letter directory
+	waitFor(t, "the dead job to leave the spool", func() bool {
+		pending, err := q.Pending()
+		return err == nil && len(pending) == 0
+	})
+}
+
+func TestDeadLetterPermanent(t *testing.T) {
+	deliver := func(j *Job) error {
+		return Permanent(errors.New("550 mailbox unavailable"))
+	}
+	q, err := New(newTestQueueData(t), deliver)
+	if err != nil {
+		t.Fatalf("Could not create queue. Error: %s\n", err)
+	}
+	err = q.Start()
+	if err != nil {
+		t.Fatalf("Could not start queue. Error: %s\n", err)
+	}
+	defer q.Close()
+
+	_, err = q.Enqueue(SystemEmail, newTestTemplateData())
+	if err != nil {
+		t.Fatalf("Could not enqueue system email. Error: %s\n", err)
+	}
+	var dead []*Job
+	waitFor(t, "the job to reach the dead letter directory", func() bool {
+		dead, err = q.Dead()
+		return err == nil && len(dead) == 1
+	})
+	// a refused job is not tried again
+	if dead[0].Attempts != 1 || dead[0].LastError != "550 mailbox unavailable" {
+		t.Fatalf("Expected the job to be given up after %d attempt but got %d, %q\n", 1, dead[0].Attempts, dead[0].LastError)
+	}
+}
+
+func TestSpoolSurvivesRestart(t *testing.T) {
+	qd := newTestQueueData(t)
+	// the first queue is never started, so nothing is delivered
+	q, err := New(qd, nil)
+	if err != nil {
+		t.Fatalf("Could not create queue. Error: %s\n", err)
+	}
+	_, err = q.Enqueue(CustomerEmail, newTestTemplateData())
+	if err != nil {
+		t.Fatalf("Could not enqueue customer email. Error: %s\n", err)
+	}
+	q.Close()
+
+	var mu sync.Mutex
+	var delivered []*Job
+	q, err = New(qd, func(j *Job) error {
+		mu.Lock()
+		defer mu.Unlock()
+		delivered = append(delivered, j)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Could not reopen queue. Error: %s\n", err)
+	}
+	err = q.Start()
+	if err != nil {
+		t.Fatalf("Could not start queue. Error: %s\n", err)
+	}
+	defer q.Close()
+
+	waitFor(t, "the spooled job to be delivered", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(delivered) == 1
+	})
+	if delivered[0].Data.FormData["Name"] != "Joe Blogs" {
+		t.Fatalf("Expected the spooled job to keep the form data, got %v\n", delivered[0].Data.FormData)
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	delivered := make(chan *Job, 1)
+	q, err := New(newTestQueueData(t), func(j *Job) error {
+		delivered <- j
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Could not create queue. Error: %s\n", err)
+	}
+	err = q.Start()
+	if err != nil {
+		t.Fatalf("Could not start queue. Error: %s\n", err)
+	}
+	defer q.Close()
+
+	j, err := q.Quarantine(SystemEmail, newTestTemplateData())
+	if err != nil {
+		t.Fatalf("Could not quarantine system email. Error: %s\n", err)
+	}
+	held, err := q.Quarantined()
+	if err != nil || len(held) != 1 || held[0].ID != j.ID {
+		t.Fatalf("Expected job %q in quarantine but got %v. Error: %v\n", j.ID, held, err)
+	}
+	pending, err := q.Pending()
+	if err != nil || len(pending) != 0 {
+		t.Fatalf("Expected no pending jobs but got %d. Error: %v\n", len(pending), err)
+	}
+	select {
+	case j := <-delivered:
+		t.Fatalf("Quarantined job %q was delivered\n", j.ID)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright (c) 2024 Owen Waller. All rights reserved.
+
+//go:build unix
+
+package ratelimit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/owenwaller/emailformgateway/config"
+)
+
+// FileStore keeps the buckets in a JSON file, so the gateways on one host share them.
+// The file is locked while a bucket is taken from, so the gateways take turns.
+type FileStore struct {
+	filename string
+}
+
+func NewFileStore(filename string) (*FileStore, error) {
+	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open the rate limit store: %w", err)
+	}
+	f.Close()
+	return &FileStore{filename: filename}, nil
+}
+
+func (fs *FileStore) Take(key string, l config.LimitData, now time.Time) (bool, time.Duration, error) {
+	if !enabled(l) {
+		return true, 0, nil
+	}
+	var allowed bool
+	var wait time.Duration
+	err := fs.update(now, func(buckets map[string]*Bucket) {
+		b, found := buckets[key]
+		if !found {
+			b = new(Bucket)
+			buckets[key] = b
+		}
+		allowed, wait = b.take(l, now)
+	})
+	if err != nil {
+		return false, 0, err
+	}
+	return allowed, wait, nil
+}
+
+func (fs *FileStore) Give(key string, l config.LimitData, now time.Time) error {
+	if !enabled(l) {
+		return nil
+	}
+	return fs.update(now, func(buckets map[string]*Bucket) {
+		if b, found := buckets[key]; found {
+			b.give(l, now)
+		}
+	})
+}
+
+// update changes the buckets with the file locked, and writes them back.
+func (fs *FileStore) update(now time.Time, change func(buckets map[string]*Bucket)) error {
+	f, err := os.OpenFile(fs.filename, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		return err
+	}
+	defer syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+
+	buckets, err := readBuckets(f)
+	if err != nil {
+		return err
+	}
+	prune(buckets, now)
+	change(buckets)
+	return writeBuckets(f, buckets)
+}
+
+func (fs *FileStore) Close() error {
+	return nil
+}
+
+func readBuckets(f *os.File) (map[string]*Bucket, error) {
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	buckets := make(map[string]*Bucket)
+	if len(data) == 0 {
+		return buckets, nil
+	}
+	err = json.Unmarshal(data, &buckets)
+	if err != nil {
+		return nil, fmt.Errorf("The rate limit store %q is corrupt: %w", f.Name(), err)
+	}
+	return buckets, nil
+}
+
+func writeBuckets(f *os.File, buckets map[string]*Bucket) error {
+	data, err := json.Marshal(buckets)
+	if err != nil {
+		return err
+	}
+	err = f.Truncate(0)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteAt(data, 0)
+	return err
+}
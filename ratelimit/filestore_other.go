@@ -0,0 +1,31 @@
+// Copyright (c) 2024 Owen Waller. All rights reserved.
+
+//go:build !unix
+
+package ratelimit
+
+import (
+	"errors"
+	"time"
+
+	"github.com/owenwaller/emailformgateway/config"
+)
+
+// FileStore needs file locks, which are only used on unix.
+type FileStore struct{}
+
+func NewFileStore(filename string) (*FileStore, error) {
+	return nil, errors.New("A rate limit store file is only supported on unix.")
+}
+
+func (fs *FileStore) Take(key string, l config.LimitData, now time.Time) (bool, time.Duration, error) {
+	return true, 0, nil
+}
+
+func (fs *FileStore) Give(key string, l config.LimitData, now time.Time) error {
+	return nil
+}
+
+func (fs *FileStore) Close() error {
+	return nil
+}
@@ -0,0 +1,144 @@
+// Copyright (c) 2024 Owen Waller. All rights reserved.
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/owenwaller/emailformgateway/config"
+)
+
+// pruneInterval is how often the buckets that have filled up again are thrown away,
+// a full bucket is the same as no bucket.
+const pruneInterval = time.Minute
+
+// Store holds the token buckets.
+type Store interface {
+	// Take takes a token from the bucket called key. If the bucket is empty it returns false,
+	// and how long until the bucket has a token again. A limit without Requests always allows the take.
+	Take(key string, l config.LimitData, now time.Time) (bool, time.Duration, error)
+	// Give gives back a token taken by Take, e.g. for a request that a later limit refused.
+	Give(key string, l config.LimitData, now time.Time) error
+	Close() error
+}
+
+// New returns the store for the config, the buckets are kept in memory unless there is a Store file.
+func New(rd config.RateLimitData) (Store, error) {
+	if rd.Store == "" {
+		return NewMemoryStore(), nil
+	}
+	fs, err := NewFileStore(rd.Store)
+	if err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+// Bucket is a token bucket. Rather than adding tokens as time passes, the tokens are
+// worked out from the time of the last take.
+type Bucket struct {
+	Tokens float64
+	Last   time.Time // when Tokens was worked out
+	Full   time.Time // when the bucket will have filled up again
+}
+
+func enabled(l config.LimitData) bool {
+	return l.Requests > 0 && l.Per > 0
+}
+
+// fill works out the tokens the bucket has now, and returns its capacity and its rate in tokens a second.
+func (b *Bucket) fill(l config.LimitData, now time.Time) (float64, float64) {
+	capacity := float64(l.Burst)
+	if l.Burst <= 0 {
+		capacity = float64(l.Requests)
+	}
+	rate := float64(l.Requests) / l.Per.Seconds() // tokens a second
+	if b.Last.IsZero() {
+		b.Tokens = capacity
+	} else if elapsed := now.Sub(b.Last).Seconds(); elapsed > 0 {
+		b.Tokens = math.Min(capacity, b.Tokens+elapsed*rate)
+	}
+	b.Last = now
+	return capacity, rate
+}
+
+// take takes a token from the bucket, if it has one.
+func (b *Bucket) take(l config.LimitData, now time.Time) (bool, time.Duration) {
+	capacity, rate := b.fill(l, now)
+	allowed := b.Tokens >= 1
+	if allowed {
+		b.Tokens--
+	}
+	b.Full = now.Add(seconds((capacity - b.Tokens) / rate))
+	if allowed {
+		return true, 0
+	}
+	return false, seconds((1 - b.Tokens) / rate)
+}
+
+// give puts a token back in the bucket, a full bucket stays full.
+func (b *Bucket) give(l config.LimitData, now time.Time) {
+	capacity, rate := b.fill(l, now)
+	b.Tokens = math.Min(capacity, b.Tokens+1)
+	b.Full = now.Add(seconds((capacity - b.Tokens) / rate))
+}
+
+// seconds rounds to the microsecond, to hide the float rounding errors.
+func seconds(s float64) time.Duration {
+	return time.Duration(math.Round(s*1e6)) * time.Microsecond
+}
+
+// MemoryStore keeps the buckets in memory, each gateway has its own.
+type MemoryStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*Bucket
+	lastPrune time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: make(map[string]*Bucket)}
+}
+
+func (m *MemoryStore) Take(key string, l config.LimitData, now time.Time) (bool, time.Duration, error) {
+	if !enabled(l) {
+		return true, 0, nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if now.Sub(m.lastPrune) > pruneInterval {
+		prune(m.buckets, now)
+		m.lastPrune = now
+	}
+	b, found := m.buckets[key]
+	if !found {
+		b = new(Bucket)
+		m.buckets[key] = b
+	}
+	allowed, wait := b.take(l, now)
+	return allowed, wait, nil
+}
+
+func (m *MemoryStore) Give(key string, l config.LimitData, now time.Time) error {
+	if !enabled(l) {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if b, found := m.buckets[key]; found {
+		b.give(l, now)
+	}
+	return nil
+}
+
+func (m *MemoryStore) Close() error {
+	return nil
+}
+
+func prune(buckets map[string]*Bucket, now time.Time) {
+	for k, b := range buckets {
+		if !now.Before(b.Full) {
+			delete(buckets, k)
+		}
+	}
+}
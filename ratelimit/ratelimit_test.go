@@ -0,0 +1,101 @@
+// Copyright (c) 2024 Owen Waller. All rights reserved.
+package ratelimit
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/owenwaller/emailformgateway/config"
+)
+
+// takes takes from the bucket at each offset from now, and checks which takes were allowed.
+func takes(t *testing.T, s Store, l config.LimitData, offsets []time.Duration, expected []bool) {
+	now := time.Now()
+	for i, o := range offsets {
+		allowed, wait, err := s.Take("key", l, now.Add(o))
+		if err != nil {
+			t.Fatalf("Take %d: %s", i, err)
+		}
+		if allowed != expected[i] {
+			t.Fatalf("Take %d at %s: expected allowed to be %t", i, o, expected[i])
+		}
+		if !allowed && wait <= 0 {
+			t.Fatalf("Take %d at %s: expected a time to wait but got %s", i, o, wait)
+		}
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	// 2 requests a minute, with a burst of 3
+	l := config.LimitData{Requests: 2, Per: time.Minute, Burst: 3}
+	offsets := []time.Duration{0, 0, 0, 0, 29 * time.Second, 31 * time.Second, 32 * time.Second}
+	expected := []bool{true, true, true, false, false, true, false}
+	takes(t, NewMemoryStore(), l, offsets, expected)
+}
+
+func TestRetryAfter(t *testing.T) {
+	s := NewMemoryStore()
+	l := config.LimitData{Requests: 1, Per: time.Minute}
+	now := time.Now()
+	s.Take("key", l, now)
+	allowed, wait, _ := s.Take("key", l, now.Add(20*time.Second))
+	if allowed || wait != 40*time.Second {
+		t.Fatalf("Expected to wait 40s but got allowed %t and wait %s", allowed, wait)
+	}
+}
+
+func TestGive(t *testing.T) {
+	for _, s := range []Store{NewMemoryStore(), newTestFileStore(t)} {
+		l := config.LimitData{Requests: 1, Per: time.Minute}
+		now := time.Now()
+		s.Take("key", l, now)
+		err := s.Give("key", l, now)
+		if err != nil {
+			t.Fatalf("Could not give back the token: %s", err)
+		}
+		// the token that was given back can be taken again, but the bucket holds no more than it did
+		s.Give("key", l, now)
+		takes(t, s, l, []time.Duration{0, 0}, []bool{true, false})
+	}
+}
+
+func TestNoLimit(t *testing.T) {
+	s := NewMemoryStore()
+	for i := 0; i < 100; i++ {
+		allowed, _, _ := s.Take("key", config.LimitData{}, time.Now())
+		if !allowed {
+			t.Fatalf("Expected a limit without Requests to allow every take")
+		}
+	}
+}
+
+func newTestFileStore(t *testing.T) *FileStore {
+	fs, err := NewFileStore(filepath.Join(t.TempDir(), "ratelimit.json"))
+	if err != nil {
+		t.Fatalf("Could not open the store: %s", err)
+	}
+	return fs
+}
+
+func TestFileStore(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "ratelimit.json")
+	l := config.LimitData{Requests: 2, Per: time.Minute}
+	offsets := []time.Duration{0, 0, 0, 31 * time.Second}
+	expected := []bool{true, true, false, true}
+	s, err := New(config.RateLimitData{Store: filename})
+	if err != nil {
+		t.Fatalf("Could not open the store: %s", err)
+	}
+	takes(t, s, l, offsets, expected)
+
+	// a second gateway sees the buckets of the first
+	other, err := NewFileStore(filename)
+	if err != nil {
+		t.Fatalf("Could not open the store again: %s", err)
+	}
+	allowed, _, err := other.Take("key", l, time.Now().Add(31*time.Second))
+	if err != nil || allowed {
+		t.Fatalf("Expected the shared bucket to be empty but got allowed %t, %v", allowed, err)
+	}
+}
@@ -0,0 +1,301 @@
+// Copyright (c) 2024 Owen Waller. All rights reserved.
+package scoring
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/owenwaller/emailformgateway/config"
+)
+
+// The defaults of the rules that need a limit to be useful
+const (
+	DefaultMaxRepeatedChars = 4
+	DefaultCapsRatio        = 0.7
+	minCapsLetters          = 10 // shorter text is often all capitals, e.g. a name
+)
+
+// Shorteners are the URL shortening services, a shortened link hides where it goes.
+var Shorteners = []string{
+	"bit.ly", "buff.ly", "cutt.ly", "goo.gl", "is.gd", "ow.ly", "rb.gy", "rebrand.ly",
+	"shorturl.at", "t.co", "t.ly", "tiny.cc", "tinyurl.com", "v.gd",
+}
+
+// DisposableDomains are the throw away email services, add to them with the rule's List or File.
+var DisposableDomains = []string{
+	"10minutemail.com", "dispostable.com", "getnada.com", "guerrillamail.com", "maildrop.cc",
+	"mailinator.com", "sharklasers.com", "temp-mail.org", "throwawaymail.com", "yopmail.com",
+}
+
+// the scripts a word is checked for a mix of, a word that mixes them is usually made to fool a filter
+var scripts = []struct {
+	name  string
+	table *unicode.RangeTable
+}{
+	{"Latin", unicode.Latin},
+	{"Cyrillic", unicode.Cyrillic},
+	{"Greek", unicode.Greek},
+	{"Armenian", unicode.Armenian},
+}
+
+var linkPattern = regexp.MustCompile(`(?i)\b(?:https?://|www\.)[^\s<>"']+`)
+
+// Result is the score of a submission.
+type Result struct {
+	Score float64
+	Rules []string // the rules that matched e.g. "Links: 5 links"
+}
+
+// Spam reports if the result is over the threshold.
+func (r Result) Spam(sd config.ScoringData) bool {
+	return sd.Threshold > 0 && r.Score >= sd.Threshold
+}
+
+func (r *Result) add(rule string, score float64, format string, args ...interface{}) {
+	r.Score += score
+	r.Rules = append(r.Rules, fmt.Sprintf("%s: %s (%g)", rule, fmt.Sprintf(format, args...), score))
+}
+
+// Score scores the text fields and the email addresses of a submission. It only returns an error if
+// a rule's File can't be read, the score is still worked out without it.
+func Score(sd config.ScoringData, texts []string, emails []string) (Result, error) {
+	var r Result
+	if sd.Threshold <= 0 {
+		return r, nil
+	}
+	var errs []string
+	links := findLinks(texts)
+	if sd.Links.Score > 0 && len(links) > sd.Links.Max {
+		over := len(links) - sd.Links.Max
+		r.add("Links", sd.Links.Score*float64(over), "%d links", len(links))
+	}
+	if sd.Phrases.Score > 0 {
+		phrases, err := list(sd.Phrases, nil)
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+		for _, p := range phrases {
+			if containsFold(texts, p) {
+				r.add("Phrases", sd.Phrases.Score, "%q", p)
+			}
+		}
+	}
+	if sd.Shorteners.Score > 0 {
+		domains, err := list(sd.Shorteners, Shorteners)
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+		for _, l := range links {
+			if host := linkHost(l); inDomains(host, domains) {
+				r.add("Shorteners", sd.Shorteners.Score, "%s", host)
+			}
+		}
+	}
+	if sd.RepeatedChars.Score > 0 {
+		max := sd.RepeatedChars.Max
+		if max <= 0 {
+			max = DefaultMaxRepeatedChars
+		}
+		for _, t := range texts {
+			if run := longestRun(t); run > max {
+				r.add("RepeatedChars", sd.RepeatedChars.Score, "%d in a row", run)
+			}
+		}
+	}
+	if sd.MixedScripts.Score > 0 {
+		for _, t := range texts {
+			if word := mixedScriptWord(t); word != "" {
+				r.add("MixedScripts", sd.MixedScripts.Score, "%q", word)
+			}
+		}
+	}
+	if sd.DisposableEmail.Score > 0 {
+		domains, err := list(sd.DisposableEmail, DisposableDomains)
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+		for _, e := range emails {
+			_, domain, found := strings.Cut(e, "@")
+			if found && inDomains(domain, domains) {
+				r.add("DisposableEmail", sd.DisposableEmail.Score, "%s", strings.ToLower(domain))
+			}
+		}
+	}
+	if sd.Caps.Score > 0 {
+		ratio := sd.Caps.Ratio
+		if ratio <= 0 {
+			ratio = DefaultCapsRatio
+		}
+		for _, t := range texts {
+			if caps, letters := countCaps(t); letters >= minCapsLetters && float64(caps)/float64(letters) >= ratio {
+				r.add("Caps", sd.Caps.Score, "%d of %d letters", caps, letters)
+			}
+		}
+	}
+	if len(errs) != 0 {
+		return r, fmt.Errorf("Could not read the scoring lists: %s", strings.Join(errs, "; "))
+	}
+	return r, nil
+}
+
+func findLinks(texts []string) []string {
+	var links []string
+	for _, t := range texts {
+		links = append(links, linkPattern.FindAllString(t, -1)...)
+	}
+	return links
+}
+
+// linkHost returns the lower case host of a link found by linkPattern.
+func linkHost(link string) string {
+	l := strings.ToLower(link)
+	l = strings.TrimPrefix(strings.TrimPrefix(l, "http://"), "https://")
+	if i := strings.IndexAny(l, "/?#:"); i >= 0 {
+		l = l[:i]
+	}
+	return l
+}
+
+// inDomains reports if the host is one of the domains, or a sub domain of one.
+func inDomains(host string, domains []string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, d := range domains {
+		d = strings.ToLower(d)
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(texts []string, phrase string) bool {
+	phrase = strings.ToLower(phrase)
+	for _, t := range texts {
+		if strings.Contains(strings.ToLower(t), phrase) {
+			return true
+		}
+	}
+	return false
+}
+
+// longestRun returns the length of the longest run of one character, ignoring white space.
+func longestRun(s string) int {
+	longest, run := 0, 0
+	var last rune
+	for _, c := range s {
+		if c == last && !unicode.IsSpace(c) {
+			run++
+		} else {
+			run = 1
+		}
+		last = c
+		if run > longest {
+			longest = run
+		}
+	}
+	return longest
+}
+
+// mixedScriptWord returns the first word that has letters from more than one script.
+func mixedScriptWord(s string) string {
+	for _, word := range strings.FieldsFunc(s, func(c rune) bool { return !unicode.IsLetter(c) }) {
+		found := ""
+		for _, c := range word {
+			for _, sc := range scripts {
+				if !unicode.Is(sc.table, c) {
+					continue
+				}
+				if found != "" && found != sc.name {
+					return word
+				}
+				found = sc.name
+			}
+		}
+	}
+	return ""
+}
+
+func countCaps(s string) (int, int) {
+	caps, letters := 0, 0
+	for _, c := range s {
+		if !unicode.IsLetter(c) {
+			continue
+		}
+		letters++
+		if unicode.IsUpper(c) {
+			caps++
+		}
+	}
+	return caps, letters
+}
+
+// list returns the built in list with the rule's List and the lines of its File.
+func list(rule config.ScoreRuleData, builtIn []string) ([]string, error) {
+	l := append(append([]string{}, builtIn...), rule.List...)
+	if rule.File == "" {
+		return l, nil
+	}
+	lines, err := LoadList(rule.File)
+	return append(l, lines...), err
+}
+
+// LoadList returns the list in the file, the file is only read again when it changes.
+func LoadList(filename string) ([]string, error) {
+	return files.read(filename)
+}
+
+// listFiles caches the lists read from files, a file is read again when it changes.
+type listFiles struct {
+	mu    sync.Mutex
+	files map[string]listFile
+}
+
+type listFile struct {
+	modTime time.Time
+	lines   []string
+}
+
+var files = &listFiles{files: make(map[string]listFile)}
+
+func (lf *listFiles) read(filename string) ([]string, error) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	if cached, found := lf.files[filename]; found && cached.modTime.Equal(info.ModTime()) {
+		return cached.lines, nil
+	}
+	lines, err := ReadList(filename)
+	if err != nil {
+		return nil, err
+	}
+	lf.files[filename] = listFile{modTime: info.ModTime(), lines: lines}
+	return lines, nil
+}
+
+// ReadList reads a list file, one item a line. Blank lines and lines starting with # are skipped.
+func ReadList(filename string) ([]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, scanner.Err()
+}
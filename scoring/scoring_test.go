@@ -0,0 +1,83 @@
+// Copyright (c) 2024 Owen Waller. All rights reserved.
+package scoring
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/owenwaller/emailformgateway/config"
+)
+
+func TestScoreRules(t *testing.T) {
+	var checks = []struct {
+		name     string
+		sd       config.ScoringData
+		texts    []string
+		emails   []string
+		expected float64
+	}{
+		{"links", config.ScoringData{Links: config.ScoreRuleData{Score: 1, Max: 1}},
+			[]string{"see https://a.example.com and www.b.example.com and http://c.example.com/x"}, nil, 2},
+		{"phrases", config.ScoringData{Phrases: config.ScoreRuleData{Score: 3, List: []string{"SEO services", "casino"}}},
+			[]string{"We offer seo services"}, nil, 3},
+		{"shorteners", config.ScoringData{Shorteners: config.ScoreRuleData{Score: 2}},
+			[]string{"click https://bit.ly/abc", "or https://example.com"}, nil, 2},
+		{"repeated", config.ScoringData{RepeatedChars: config.ScoreRuleData{Score: 1}},
+			[]string{"heeeeelp", "fine", "aaaa"}, nil, 1},
+		{"mixed scripts", config.ScoringData{MixedScripts: config.ScoreRuleData{Score: 2}},
+			[]string{"pаypal login", "привет world"}, nil, 2},
+		{"disposable", config.ScoringData{DisposableEmail: config.ScoreRuleData{Score: 3, List: []string{"spam.example"}}},
+			nil, []string{"a@mailinator.com", "b@mx.spam.example", "c@example.com"}, 6},
+		{"caps", config.ScoringData{Caps: config.ScoreRuleData{Score: 2}},
+			[]string{"BUY NOW THE BEST DEAL", "JOE", "A normal sentence"}, nil, 2},
+	}
+	for _, c := range checks {
+		c.sd.Threshold = 100
+		r, err := Score(c.sd, c.texts, c.emails)
+		if err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		if r.Score != c.expected {
+			t.Fatalf("%s: expected a score of %g but got %g: %v", c.name, c.expected, r.Score, r.Rules)
+		}
+	}
+}
+
+func TestScoreThreshold(t *testing.T) {
+	sd := config.ScoringData{Threshold: 3, Phrases: config.ScoreRuleData{Score: 3, List: []string{"casino"}}}
+	r, err := Score(sd, []string{"Best CASINO bonus"}, nil)
+	if err != nil {
+		t.Fatalf("Could not score: %s", err)
+	}
+	if !r.Spam(sd) {
+		t.Fatalf("Expected a score of %g to be spam", r.Score)
+	}
+	if !reflect.DeepEqual(r.Rules, []string{`Phrases: "casino" (3)`}) {
+		t.Fatalf("Expected the phrase rule to be listed but got %q", r.Rules)
+	}
+	sd.Threshold = 0
+	r, _ = Score(sd, []string{"Best CASINO bonus"}, nil)
+	if r.Score != 0 || r.Spam(sd) {
+		t.Fatalf("Expected no threshold to turn scoring off but got %+v", r)
+	}
+}
+
+func TestScoreListFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "phrases.txt")
+	err := os.WriteFile(filename, []byte("# spam phrases\n\ncheap pills\n"), 0o600)
+	if err != nil {
+		t.Fatalf("Could not write the list: %s", err)
+	}
+	sd := config.ScoringData{Threshold: 1, Phrases: config.ScoreRuleData{Score: 1, File: filename}}
+	r, err := Score(sd, []string{"Cheap pills here"}, nil)
+	if err != nil || r.Score != 1 {
+		t.Fatalf("Expected the phrase from the file to score 1 but got %g, %v", r.Score, err)
+	}
+	sd.Phrases.File = filepath.Join(t.TempDir(), "missing.txt")
+	_, err = Score(sd, []string{"Cheap pills here"}, nil)
+	if err == nil {
+		t.Fatalf("Expected an error for a missing list but got nil")
+	}
+}
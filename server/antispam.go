@@ -0,0 +1,236 @@
+// Copyright (c) 2024 Owen Waller. All rights reserved.
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/owenwaller/emailformgateway/config"
+)
+
+// tokenRoute is added to the route of a form that has an AntiSpam.Secret, to give the route the tokens are issued on.
+const tokenRoute = "token"
+
+// The reasons a submission is taken to be from a bot
+var (
+	errHoneypot      = errors.New("a honeypot field was filled in")
+	errTokenMissing  = errors.New("the token is missing")
+	errTokenInvalid  = errors.New("the token is not valid")
+	errTokenTooEarly = errors.New("the form was filled in too quickly")
+	errTokenExpired  = errors.New("the token has expired")
+	errTokenReused   = errors.New("the token has already been used")
+)
+
+// tokenResponse is written by the token endpoint, the token must be posted in Field.
+type tokenResponse struct {
+	Token string
+	Field string
+}
+
+// usedTokens remembers the tokens that have been used until they expire, so each can only be used once.
+// The tokens are only held in memory, a restart forgets them, but the tokens still expire.
+type usedTokens struct {
+	mu      sync.Mutex
+	tokens  map[string]time.Time // the nonce of the token to when the token expires
+	pruneAt int                  // the expired tokens are removed once there are this many, so each use is O(1) on average
+}
+
+// minPruneAt is the fewest used tokens that are pruned.
+const minPruneAt = 1024
+
+// spamCounts counts the submissions rejected as spam, by reason.
+type spamCounts struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+// tokenHandler returns the handler that issues the tokens for a form, the top level form has an empty name.
+func (s *Server) tokenHandler(name string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		c := s.config.Load()
+		tenant, err := tenantFor(c, r)
+		if err != nil {
+			log.Printf("Refusing token request; %s\n", err)
+			var fr formResponse
+			fr.setError(ErrForbidden)
+			writeResponse(w, &fr)
+			return
+		}
+		form, _, err := s.formConfig(c, name, tenant)
+		if err != nil || form.AntiSpam.Secret == "" {
+			// the form was removed, or no longer uses tokens, since the routes were built
+			http.NotFound(w, r)
+			return
+		}
+		token, err := newToken(form.AntiSpam.Secret, name, time.Now())
+		if err != nil {
+			log.Printf("Could not issue a token; %s\n", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		body, err := json.Marshal(tokenResponse{Token: token, Field: tokenField(form.AntiSpam)})
+		if err != nil {
+			log.Printf("Could not encode the token; %s\n", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store") // every page load needs a new token
+		_, err = w.Write(body)
+		if err != nil {
+			log.Printf("Error: Could not write response \"%s\"\n", err)
+		}
+	}
+}
+
+// newToken returns a token for the form, issued at now. A token is "<issued>.<nonce>.<signature>",
+// the signature covers the name of the form so a token can't be used with another form.
+func newToken(secret, name string, now time.Time) (string, error) {
+	nonce := make([]byte, 16)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+	issued := strconv.FormatInt(now.Unix(), 10)
+	n := hex.EncodeToString(nonce)
+	return issued + "." + n + "." + signToken(secret, name, issued, n), nil
+}
+
+func signToken(secret, name, issued, nonce string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(name + "\n" + issued + "\n" + nonce))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// checkToken checks the signature and age of a token, and returns its nonce and when it expires.
+func checkToken(a config.AntiSpamData, name, token string, now time.Time) (string, time.Time, error) {
+	if token == "" {
+		return "", time.Time{}, errTokenMissing
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", time.Time{}, errTokenInvalid
+	}
+	expected := signToken(a.Secret, name, parts[0], parts[1])
+	if !hmac.Equal([]byte(parts[2]), []byte(expected)) {
+		return "", time.Time{}, errTokenInvalid
+	}
+	seconds, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return "", time.Time{}, errTokenInvalid
+	}
+	issued := time.Unix(seconds, 0)
+	maxAge := a.MaxTokenAge
+	if maxAge <= 0 {
+		maxAge = config.DefaultMaxTokenAge
+	}
+	age := now.Sub(issued)
+	if age < a.MinFillTime {
+		return "", time.Time{}, errTokenTooEarly
+	}
+	if age > maxAge {
+		return "", time.Time{}, errTokenExpired
+	}
+	return parts[1], issued.Add(maxAge), nil
+}
+
+func tokenField(a config.AntiSpamData) string {
+	if a.TokenField == "" {
+		return config.DefaultTokenField
+	}
+	return a.TokenField
+}
+
+// checkSpam looks for the signs of a bot in the submitted fields. It returns the nonce of the token,
+// which is only used up once the submission is delivered, see usedTokens.use.
+func checkSpam(a config.AntiSpamData, name string, fields []Field, now time.Time) (string, time.Time, error) {
+	for _, h := range a.Honeypots {
+		match, err := find(h, fields)
+		if err == nil && strings.TrimSpace(match.Value) != "" {
+			return "", time.Time{}, errHoneypot
+		}
+	}
+	if a.Secret == "" {
+		return "", time.Time{}, nil
+	}
+	var token string
+	if match, err := find(tokenField(a), fields); err == nil {
+		token = strings.TrimSpace(match.Value)
+	}
+	return checkToken(a, name, token, now)
+}
+
+// antiSpamFields returns the names of the honeypots and the token, so they can be removed before
+// the fields are validated or emailed.
+func antiSpamFields(a config.AntiSpamData) []string {
+	return append([]string{tokenField(a)}, a.Honeypots...)
+}
+
+// use reports if the nonce had not been used before, and marks it as used until it expires.
+func (u *usedTokens) use(nonce string, expires time.Time, now time.Time) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.tokens == nil {
+		u.tokens = make(map[string]time.Time)
+	}
+	if len(u.tokens) >= u.pruneAt {
+		for n, e := range u.tokens {
+			if now.After(e) {
+				delete(u.tokens, n) // an expired token is refused anyway
+			}
+		}
+		// the next sweep waits until the tokens that are still live have doubled
+		u.pruneAt = max(minPruneAt, 2*len(u.tokens))
+	}
+	if _, found := u.tokens[nonce]; found {
+		return false
+	}
+	u.tokens[nonce] = expires
+	return true
+}
+
+// add counts one more rejection for the reason, and returns the count.
+func (sc *spamCounts) add(reason error) int {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.counts == nil {
+		sc.counts = make(map[string]int)
+	}
+	sc.counts[reason.Error()]++
+	return sc.counts[reason.Error()]
+}
+
+func (sc *spamCounts) get(reason error) int {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.counts[reason.Error()]
+}
+
+// rejectSpam logs and counts a submission taken to be from a bot, and answers it as if it had been sent.
+func (s *Server) rejectSpam(w http.ResponseWriter, r *http.Request, form config.FormData, name, ip string, reason error) {
+	count := s.spam.add(reason)
+	log.Printf("Rejected a submission to the form %q from %s as spam; %s (%d so far)\n", name, ip, reason, count)
+	var fr formResponse
+	respond(w, r, form.Redirect, &fr)
+}
+
+// tokenPath returns the route the tokens of the form on route are issued on.
+func tokenPath(route string) string {
+	return strings.TrimSuffix(route, "/") + "/" + tokenRoute
+}
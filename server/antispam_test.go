@@ -0,0 +1,179 @@
+// Copyright (c) 2024 Owen Waller. All rights reserved.
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/owenwaller/emailformgateway/config"
+)
+
+const testSecret = "a-test-secret-for-the-tokens"
+
+func withAntiSpam(c *config.Config) {
+	c.AntiSpam = config.AntiSpamData{Honeypots: []string{"website"}, Secret: testSecret, MinFillTime: 2 * time.Second}
+}
+
+// postWithToken posts the test fields, with the token and the website honeypot.
+func postWithToken(t *testing.T, s *Server, token, website string) formResponse {
+	fields := append(newTestFields(), Field{Name: config.DefaultTokenField, Value: token}, Field{Name: "website", Value: website})
+	b, err := json.Marshal(fields)
+	if err != nil {
+		t.Fatalf("Could not encode fields: %s", err)
+	}
+	w, fr := postJSON(t, s, b)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d but got %d", http.StatusOK, w.Code)
+	}
+	return fr
+}
+
+func pendingCount(t *testing.T, s *Server) int {
+	pending, err := s.queue.Pending()
+	if err != nil {
+		t.Fatalf("Could not read the spool: %s", err)
+	}
+	return len(pending)
+}
+
+func TestTokenHandler(t *testing.T) {
+	s := newTestServer(t, withAntiSpam)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/token", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d but got %d", http.StatusOK, w.Code)
+	}
+	var tr tokenResponse
+	err := json.Unmarshal(w.Body.Bytes(), &tr)
+	if err != nil {
+		t.Fatalf("Could not decode the token response %q: %s", w.Body.String(), err)
+	}
+	if tr.Field != config.DefaultTokenField {
+		t.Fatalf("Expected the token field %q but got %q", config.DefaultTokenField, tr.Field)
+	}
+	_, _, err = checkToken(s.config.Load().AntiSpam, "", tr.Token, time.Now().Add(3*time.Second))
+	if err != nil {
+		t.Fatalf("Could not check the issued token: %s", err)
+	}
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/token", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("Expected status %d for a PUT but got %d", http.StatusMethodNotAllowed, w.Code)
+	}
+}
+
+func TestCheckToken(t *testing.T) {
+	a := config.AntiSpamData{Secret: testSecret, MinFillTime: 2 * time.Second, MaxTokenAge: time.Hour}
+	now := time.Now()
+	token, err := newToken(testSecret, "support", now)
+	if err != nil {
+		t.Fatalf("Could not make a token: %s", err)
+	}
+	var checks = []struct {
+		name  string
+		token string
+		at    time.Time
+		err   error
+	}{
+		{"support", token, now.Add(5 * time.Second), nil},
+		{"support", "", now.Add(5 * time.Second), errTokenMissing},
+		{"support", token + "x", now.Add(5 * time.Second), errTokenInvalid},
+		{"sales", token, now.Add(5 * time.Second), errTokenInvalid},
+		{"support", token, now.Add(time.Second), errTokenTooEarly},
+		{"support", token, now.Add(2 * time.Hour), errTokenExpired},
+	}
+	for i, c := range checks {
+		_, _, err := checkToken(a, c.name, c.token, c.at)
+		if err != c.err {
+			t.Fatalf("Check %d: expected %v but got %v", i, c.err, err)
+		}
+	}
+}
+
+func TestAntiSpamRejectsQuietly(t *testing.T) {
+	s := newTestServer(t, withAntiSpam)
+	old, err := newToken(testSecret, "", time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatalf("Could not make a token: %s", err)
+	}
+	fresh, err := newToken(testSecret, "", time.Now())
+	if err != nil {
+		t.Fatalf("Could not make a token: %s", err)
+	}
+	var posts = []struct {
+		token   string
+		website string
+		reason  error
+	}{
+		{old, "https://spam.example.com", errHoneypot},
+		{"", "", errTokenMissing},
+		{fresh, "", errTokenTooEarly},
+	}
+	for _, p := range posts {
+		fr := postWithToken(t, s, p.token, p.website)
+		if !fr.Valid {
+			t.Fatalf("%s: expected a plausible success response but got %+v", p.reason, fr)
+		}
+		if s.spam.get(p.reason) != 1 {
+			t.Fatalf("%s: expected the rejection to be counted", p.reason)
+		}
+	}
+	if n := pendingCount(t, s); n != 0 {
+		t.Fatalf("Expected no queued emails but got %d", n)
+	}
+}
+
+func TestAntiSpamTokenReplay(t *testing.T) {
+	s := newTestServer(t, withAntiSpam)
+	token, err := newToken(testSecret, "", time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatalf("Could not make a token: %s", err)
+	}
+	fr := postWithToken(t, s, token, "")
+	if !fr.Valid {
+		t.Fatalf("Expected the first submission to be valid but got %+v", fr)
+	}
+	if n := pendingCount(t, s); n != 2 {
+		t.Fatalf("Expected %d queued emails but got %d", 2, n)
+	}
+	// the token and the honeypot are not emailed
+	pending, err := s.queue.Pending()
+	if err != nil {
+		t.Fatalf("Could not read the spool: %s", err)
+	}
+	for k := range pending[0].Data.FormData {
+		if k == "Website" || k == "_token" {
+			t.Fatalf("The anti-spam field %q was emailed", k)
+		}
+	}
+	postWithToken(t, s, token, "")
+	if s.spam.get(errTokenReused) != 1 {
+		t.Fatalf("Expected the replayed token to be rejected")
+	}
+	if n := pendingCount(t, s); n != 2 {
+		t.Fatalf("Expected the replay to queue nothing, but there are %d queued emails", n)
+	}
+}
+
+func TestUsedTokensPrune(t *testing.T) {
+	var u usedTokens
+	now := time.Now()
+	for i := 0; i < minPruneAt; i++ {
+		if !u.use(fmt.Sprintf("nonce%d", i), now.Add(time.Minute), now) {
+			t.Fatalf("Expected nonce%d to be unused", i)
+		}
+	}
+	// the expired tokens are only swept once there are enough of them
+	later := now.Add(2 * time.Minute)
+	u.use("late", later.Add(time.Minute), later)
+	if len(u.tokens) != 1 || u.pruneAt != minPruneAt {
+		t.Fatalf("Expected the expired tokens to be pruned, %d are left and the next prune is at %d", len(u.tokens), u.pruneAt)
+	}
+	if u.use("late", later.Add(time.Minute), later) {
+		t.Fatalf("Expected a used nonce to be refused")
+	}
+}
@@ -0,0 +1,41 @@
+// Copyright (c) 2024 Owen Waller. All rights reserved.
+package server
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/owenwaller/emailformgateway/captcha"
+	"github.com/owenwaller/emailformgateway/config"
+)
+
+// checkCaptcha asks the form's CAPTCHA provider about the response posted in fields. It returns
+// the name of the response field, so it can be removed before the fields are validated, and the
+// error code for the client if the response was not accepted.
+func checkCaptcha(r *http.Request, ip string, cd config.CaptchaData, fields []Field) (string, string) {
+	v, err := captcha.New(cd)
+	if err != nil {
+		// config.Validate stops this, unless the config was changed under a running request
+		log.Printf("Could not verify the CAPTCHA; %s\n", err)
+		return "", ErrCaptchaUnavailable
+	}
+	if v == nil {
+		return "", ""
+	}
+	var response string
+	if match, err := find(v.ResponseField(), fields); err == nil {
+		response = strings.TrimSpace(match.Value)
+	}
+	err = v.Verify(r.Context(), response, ip)
+	if errors.Is(err, captcha.ErrFailed) {
+		log.Printf("Refusing request from %s; %s\n", ip, err)
+		return v.ResponseField(), ErrCaptchaFailed
+	}
+	if err != nil {
+		log.Printf("Could not verify the CAPTCHA; %s\n", err)
+		return v.ResponseField(), ErrCaptchaUnavailable
+	}
+	return v.ResponseField(), ""
+}
@@ -0,0 +1,80 @@
+// Copyright (c) 2024 Owen Waller. All rights reserved.
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/owenwaller/emailformgateway/captcha"
+	"github.com/owenwaller/emailformgateway/config"
+)
+
+func TestGatewayHandlerCaptcha(t *testing.T) {
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"success": %t}`, r.PostFormValue("response") == "solved")
+	}))
+	defer endpoint.Close()
+
+	var posts = []struct {
+		response string
+		status   int
+		err      string
+		queued   int
+	}{
+		{"solved", http.StatusOK, "", 2},
+		{"guessed", http.StatusForbidden, ErrCaptchaFailed, 0},
+		{"", http.StatusForbidden, ErrCaptchaFailed, 0},
+	}
+	for _, p := range posts {
+		s := newTestServer(t, func(c *config.Config) {
+			c.Captcha = config.CaptchaData{Provider: "turnstile", Secret: "secret", VerifyURL: endpoint.URL}
+		})
+		fields := newTestFields()
+		if p.response != "" {
+			fields = append(fields, Field{Name: captcha.TurnstileResponseField, Value: p.response})
+		}
+		b, err := json.Marshal(fields)
+		if err != nil {
+			t.Fatalf("Could not encode fields: %s", err)
+		}
+		w, fr := postJSON(t, s, b)
+		if w.Code != p.status || fr.Error != p.err {
+			t.Fatalf("%q: expected status %d and error %q but got %d and %+v", p.response, p.status, p.err, w.Code, fr)
+		}
+		pending, err := s.queue.Pending()
+		if err != nil {
+			t.Fatalf("Could not read the spool: %s", err)
+		}
+		if len(pending) != p.queued {
+			t.Fatalf("%q: expected %d queued emails but got %d", p.response, p.queued, len(pending))
+		}
+		for _, j := range pending {
+			if _, found := j.Data.FormData["Cf-Turnstile-Response"]; found {
+				t.Fatalf("The CAPTCHA response was emailed")
+			}
+		}
+	}
+}
+
+func TestGatewayHandlerCaptchaUnavailable(t *testing.T) {
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusInternalServerError)
+	}))
+	defer endpoint.Close()
+	s := newTestServer(t, func(c *config.Config) {
+		c.Captcha = config.CaptchaData{Provider: "hcaptcha", Secret: "secret", VerifyURL: endpoint.URL}
+	})
+	fields := append(newTestFields(), Field{Name: captcha.HCaptchaResponseField, Value: "solved"})
+	b, err := json.Marshal(fields)
+	if err != nil {
+		t.Fatalf("Could not encode fields: %s", err)
+	}
+	w, fr := postJSON(t, s, b)
+	if w.Code != http.StatusServiceUnavailable || fr.Error != ErrCaptchaUnavailable {
+		t.Fatalf("Expected status %d and error %q but got %d and %+v", http.StatusServiceUnavailable, ErrCaptchaUnavailable, w.Code, fr)
+	}
+}
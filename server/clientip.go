@@ -0,0 +1,108 @@
+// Copyright (c) 2024 Owen Waller. All rights reserved.
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/owenwaller/emailformgateway/config"
+)
+
+// clientIP returns the IP address of the client that posted the form. When the request came through
+// trusted proxies the address is taken from the proxies' header. A proxy adds the address it got the
+// request from to the end of X-Forwarded-For or Forwarded, so the client is the last address that is
+// not a trusted proxy. A client can put anything it likes at the start of the header.
+func clientIP(r *http.Request, proxies config.ProxiesData) string {
+	remote := remoteIP(r)
+	trusted, err := proxies.Prefixes()
+	if err != nil || !isTrusted(remote, trusted) {
+		return remote
+	}
+	var hops []string
+	switch strings.ToLower(proxies.Header) {
+	case strings.ToLower(config.ProxyHeaderXRealIP):
+		hops = []string{strings.TrimSpace(r.Header.Get(config.ProxyHeaderXRealIP))}
+	case strings.ToLower(config.ProxyHeaderForwarded):
+		hops = forwardedFor(r.Header.Values(config.ProxyHeaderForwarded))
+	default:
+		hops = splitList(r.Header.Values(config.ProxyHeaderXForwardedFor))
+	}
+	client := remote
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip, valid := parseIP(hops[i])
+		if !valid {
+			break // e.g. "unknown", the last proxy we trust is as close to the client as we can get
+		}
+		client = ip
+		if !isTrusted(ip, trusted) {
+			break
+		}
+	}
+	return client
+}
+
+// remoteIP returns the IP address the request came from.
+func remoteIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// splitList splits the comma separated values of a header, which may be sent as several headers.
+func splitList(values []string) []string {
+	var list []string
+	for _, v := range values {
+		for _, item := range strings.Split(v, ",") {
+			list = append(list, strings.TrimSpace(item))
+		}
+	}
+	return list
+}
+
+// forwardedFor returns the "for" parameter of each element of RFC 7239 Forwarded headers, e.g.
+// `for=192.0.2.60;proto=http, for="[2001:db8:cafe::17]:4711"`. An element without one is an empty string.
+func forwardedFor(values []string) []string {
+	var hops []string
+	for _, element := range splitList(values) {
+		hop := ""
+		for _, pair := range strings.Split(element, ";") {
+			name, value, found := strings.Cut(strings.TrimSpace(pair), "=")
+			if found && strings.EqualFold(name, "for") {
+				hop = strings.Trim(value, `"`)
+			}
+		}
+		hops = append(hops, hop)
+	}
+	return hops
+}
+
+// parseIP parses an address from a proxy header, which may have a port and IPv6 brackets.
+func parseIP(s string) (string, bool) {
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return "", false
+	}
+	return addr.Unmap().String(), true
+}
+
+func isTrusted(ip string, trusted []netip.Prefix) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range trusted {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
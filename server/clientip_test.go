@@ -0,0 +1,78 @@
+// Copyright (c) 2024 Owen Waller. All rights reserved.
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/owenwaller/emailformgateway/config"
+)
+
+func TestClientIP(t *testing.T) {
+	proxies := config.ProxiesData{Trusted: []string{"127.0.0.1", "10.0.0.0/8"}}
+	var requests = []struct {
+		remote    string
+		forwarded string
+		expected  string
+	}{
+		{"192.0.2.1:1234", "", "192.0.2.1"},
+		{"192.0.2.1:1234", "198.51.100.7", "192.0.2.1"}, // not from a proxy, so the header is ignored
+		{"127.0.0.1:1234", "198.51.100.7", "198.51.100.7"},
+		{"127.0.0.1:1234", "203.0.113.9, 198.51.100.7, 10.1.2.3", "198.51.100.7"},
+		{"127.0.0.1:1234", "10.1.2.3", "10.1.2.3"},
+		{"127.0.0.1:1234", "", "127.0.0.1"},
+		{"[::ffff:10.0.0.1]:1234", "198.51.100.7", "198.51.100.7"},
+	}
+	for _, req := range requests {
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		r.RemoteAddr = req.remote
+		if req.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", req.forwarded)
+		}
+		if ip := clientIP(r, proxies); ip != req.expected {
+			t.Fatalf("%s forwarded for %q: expected %q but got %q", req.remote, req.forwarded, req.expected, ip)
+		}
+	}
+}
+
+func TestClientIPHeaders(t *testing.T) {
+	var requests = []struct {
+		header   string
+		value    string
+		expected string
+	}{
+		{config.ProxyHeaderXRealIP, "198.51.100.7", "198.51.100.7"},
+		{config.ProxyHeaderXRealIP, "not an address", "127.0.0.1"},
+		{config.ProxyHeaderForwarded, "for=198.51.100.7;proto=https", "198.51.100.7"},
+		{config.ProxyHeaderForwarded, `for=203.0.113.9, for="[2001:db8:cafe::17]:4711";by=10.0.0.1, for=10.1.2.3`, "2001:db8:cafe::17"},
+		{config.ProxyHeaderForwarded, "for=unknown, for=10.1.2.3", "10.1.2.3"},
+		{config.ProxyHeaderForwarded, "proto=https", "127.0.0.1"},
+	}
+	for _, req := range requests {
+		proxies := config.ProxiesData{Trusted: []string{"127.0.0.1", "10.0.0.0/8"}, Header: req.header}
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		r.RemoteAddr = "127.0.0.1:1234"
+		r.Header.Set(req.header, req.value)
+		// a header the proxies don't use is ignored, as the client could have sent it
+		r.Header.Set("X-Forwarded-For", "192.0.2.99")
+		if ip := clientIP(r, proxies); ip != req.expected {
+			t.Fatalf("%s: %q: expected %q but got %q", req.header, req.value, req.expected, ip)
+		}
+	}
+}
+
+func TestGatewayHandlerClientIP(t *testing.T) {
+	s := newTestServer(t, func(c *config.Config) { c.Proxies.Trusted = []string{"127.0.0.1"} })
+	w := postFromProxy(t, s, "127.0.0.1", "198.51.100.7")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d but got %d", http.StatusOK, w.Code)
+	}
+	pending, err := s.queue.Pending()
+	if err != nil || len(pending) == 0 {
+		t.Fatalf("Could not read the spool: %d emails, %v", len(pending), err)
+	}
+	if pending[0].Data.ClientIP != "198.51.100.7" || pending[0].Data.RemoteIp != "127.0.0.1" {
+		t.Fatalf("Expected the client IP %q from the proxy %q but got %+v", "198.51.100.7", "127.0.0.1", pending[0].Data)
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright (c) 2024 Owen Waller. All rights reserved.
+package server
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/owenwaller/emailformgateway/config"
+	"github.com/rs/cors"
+)
+
+// corsHandler wraps the handler of a form in the form's cross origin policy.
+// The allowed methods and headers are fixed when the routes are built from c, the allowed
+// origins are read from the current config for every request.
+func (s *Server) corsHandler(c *config.Config, name string, next http.HandlerFunc) http.Handler {
+	var cd config.CorsData
+	if c != nil {
+		form, _ := c.Form(name)
+		cd = form.Cors
+	}
+	return s.newCors(name, cd).Handler(s.rejectOrigin(name, next))
+}
+
+// tokenCorsHandler wraps the token endpoint of a form in the form's cross origin policy.
+// The tokens are fetched with GET, whatever methods the form is posted with.
+func (s *Server) tokenCorsHandler(c *config.Config, name string, next http.HandlerFunc) http.Handler {
+	form, _ := c.Form(name)
+	cd := form.Cors
+	cd.AllowedMethods = []string{http.MethodGet, http.MethodHead}
+	return s.newCors(name, cd).Handler(s.rejectOrigin(name, next))
+}
+
+func (s *Server) newCors(name string, cd config.CorsData) *cors.Cors {
+	return cors.New(cors.Options{
+		AllowOriginRequestFunc: func(r *http.Request, origin string) bool {
+			return s.allowOrigin(name, r, origin)
+		},
+		AllowedMethods:   cd.AllowedMethods,
+		AllowedHeaders:   cd.AllowedHeaders,
+		AllowCredentials: cd.AllowCredentials,
+		MaxAge:           int(cd.MaxAge / time.Second),
+	})
+}
+
+// rejectOrigin refuses a request from an origin the form does not allow, before the form is
+// validated or any email is sent. CORS only stops a browser reading the response, not sending the request.
+func (s *Server) rejectOrigin(name string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin != "" && !s.allowOrigin(name, r, origin) {
+			log.Printf("Refusing request from origin %q\n", origin)
+			var fr formResponse
+			fr.setError(ErrForbidden)
+			writeResponse(w, &fr)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// allowOrigin reports if the form allows requests from origin. When there are
+// tenants the origin must be allowed by the tenant as well as by the form. A form without
+// AllowedOrigins only allows its tenant's origins, and no origin at all if there are no tenants.
+func (s *Server) allowOrigin(name string, r *http.Request, origin string) bool {
+	c := s.config.Load()
+	if c == nil {
+		return true
+	}
+	form, found := c.Form(name)
+	if !found {
+		return false
+	}
+	tenant, err := tenantFor(c, r)
+	if err != nil {
+		return false
+	}
+	if len(form.Cors.AllowedOrigins) == 0 {
+		return tenant != ""
+	}
+	return matchOrigin(form.Cors.AllowedOrigins, origin)
+}
+
+// matchOrigin reports if origin matches one of the patterns, no patterns matches nothing.
+func matchOrigin(patterns []string, origin string) bool {
+	origin = strings.ToLower(origin)
+	for _, p := range patterns {
+		p = strings.ToLower(strings.TrimSuffix(p, "/"))
+		if p == "*" || p == origin {
+			return true
+		}
+		prefix, suffix, found := strings.Cut(p, "*")
+		if found && len(origin) >= len(prefix)+len(suffix) && strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix) {
+			return true
+		}
+	}
+	return false
+}
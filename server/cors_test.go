@@ -0,0 +1,133 @@
+// Copyright (c) 2024 Owen Waller. All rights reserved.
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/owenwaller/emailformgateway/config"
+)
+
+func TestMatchOrigin(t *testing.T) {
+	var patterns = []string{"https://example.com", "https://*.example.org", "http://localhost:*"}
+	var origins = map[string]bool{
+		"https://example.com":         true,
+		"https://EXAMPLE.com":         true,
+		"http://example.com":          false,
+		"https://www.example.org":     true,
+		"https://a.b.example.org":     true,
+		"https://example.org":         false,
+		"https://www.example.org.com": false,
+		"http://localhost:8080":       true,
+		"https://evil.com":            false,
+	}
+	for origin, expected := range origins {
+		if result := matchOrigin(patterns, origin); result != expected {
+			t.Fatalf("%s: expected %t but got %t", origin, expected, result)
+		}
+	}
+	if matchOrigin(nil, "https://anywhere.com") || !matchOrigin([]string{"*"}, "https://anywhere.com") {
+		t.Fatalf("No patterns should allow no origin, and a \"*\" pattern every origin")
+	}
+}
+
+func withCors(c *config.Config) {
+	c.Cors = config.CorsData{
+		AllowedOrigins: []string{"https://example.com"},
+		AllowedMethods: []string{http.MethodPost},
+		MaxAge:         10 * time.Minute,
+	}
+	c.Forms = map[string]config.FormData{
+		"support": {Cors: config.CorsData{AllowedOrigins: []string{"https://support.example.com"}}},
+	}
+}
+
+func TestCorsPreflight(t *testing.T) {
+	s := newTestServer(t, withCors)
+	var preflights = []struct {
+		route   string
+		origin  string
+		allowed bool
+		maxAge  string
+	}{
+		{"/", "https://example.com", true, "600"},
+		{"/", "https://support.example.com", false, ""},
+		{"/support", "https://support.example.com", true, ""},
+		{"/support", "https://example.com", false, ""},
+	}
+	for _, p := range preflights {
+		r := httptest.NewRequest(http.MethodOptions, p.route, nil)
+		r.Header.Set("Origin", p.origin)
+		r.Header.Set("Access-Control-Request-Method", http.MethodPost)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		allowed := w.Header().Get("Access-Control-Allow-Origin") == p.origin
+		if allowed != p.allowed {
+			t.Fatalf("%s %s: expected the origin to be allowed %t but got %t", p.route, p.origin, p.allowed, allowed)
+		}
+		if maxAge := w.Header().Get("Access-Control-Max-Age"); allowed && maxAge != p.maxAge {
+			t.Fatalf("%s %s: expected a max age of %q but got %q", p.route, p.origin, p.maxAge, maxAge)
+		}
+	}
+}
+
+func TestCorsRejectsOrigin(t *testing.T) {
+	var posts = map[string]int{
+		"https://example.com": http.StatusOK,
+		"https://evil.com":    http.StatusForbidden,
+		"":                    http.StatusOK, // not a browser, or a same origin request
+	}
+	for origin, status := range posts {
+		s := newTestServer(t, withCors)
+		b, err := json.Marshal(newTestFields())
+		if err != nil {
+			t.Fatalf("Could not encode fields: %s", err)
+		}
+		r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(b))
+		r.Header.Set("Content-Type", "application/json; charset=utf-8")
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Code != status {
+			t.Fatalf("%q: expected status %d but got %d", origin, status, w.Code)
+		}
+		pending, err := s.queue.Pending()
+		if err != nil {
+			t.Fatalf("Could not read the spool: %s", err)
+		}
+		if status != http.StatusOK && len(pending) != 0 {
+			t.Fatalf("%q: a refused request should not queue any emails but %d were queued", origin, len(pending))
+		}
+	}
+}
+
+func TestCorsNoAllowedOrigins(t *testing.T) {
+	var checks = []struct {
+		origins []string
+		status  int
+	}{
+		{nil, http.StatusForbidden}, // no origin is allowed unless the config says so
+		{[]string{"*"}, http.StatusOK},
+	}
+	for _, c := range checks {
+		s := newTestServer(t, func(tc *config.Config) { tc.Cors = config.CorsData{AllowedOrigins: c.origins} })
+		b, err := json.Marshal(newTestFields())
+		if err != nil {
+			t.Fatalf("Could not encode fields: %s", err)
+		}
+		r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(b))
+		r.Header.Set("Content-Type", "application/json; charset=utf-8")
+		r.Header.Set("Origin", "https://anywhere.com")
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Code != c.status {
+			t.Fatalf("%q: expected status %d but got %d", c.origins, c.status, w.Code)
+		}
+	}
+}
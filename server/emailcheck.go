@@ -0,0 +1,71 @@
+// Copyright (c) 2024 Owen Waller. All rights reserved.
+package server
+
+import (
+	"context"
+	"log"
+	"strings"
+
+	"github.com/owenwaller/emailformgateway/config"
+	"github.com/owenwaller/emailformgateway/scoring"
+	"github.com/owenwaller/emailformgateway/validation"
+)
+
+// checkEmails checks the email fields that parsed could be delivered to, as thoroughly as the form's
+// EmailCheck asks. A field that could not is a bad field. A field that looks misspelt gets a suggestion
+// in the form response, it is not a bad field as the address may be right.
+func (s *Server) checkEmails(ctx context.Context, ed config.EmailCheckData, formFields map[string]config.FieldData,
+	fields []Field, fr *formResponse) {
+
+	deliverable := strings.EqualFold(ed.Mode, config.EmailCheckDeliverable)
+	if !deliverable && !ed.Disposable && !ed.Suggest {
+		return
+	}
+	checker := validation.EmailChecker{Deliverable: deliverable, Timeout: ed.Timeout}
+	if deliverable {
+		checker.Resolver = s.resolver
+	}
+	if ed.Disposable {
+		checker.Disposable = disposableDomains(ed)
+	}
+	for i := range fields {
+		f := &fields[i]
+		if !isEmailField(formFields, f.Name) || f.Value == "" || isBadField(fr, f.Name) {
+			continue
+		}
+		if ed.Suggest {
+			if suggestion := validation.SuggestEmail(f.Value); suggestion != "" {
+				fr.setSuggestion(f.Name, suggestion)
+			}
+		}
+		err := checker.CheckEmail(ctx, f.Value)
+		if err != nil {
+			log.Printf("Refusing the email address in the field %q; %s\n", f.Name, err)
+			fd, _ := formField(formFields, f.Name)
+			fr.setFieldError(fd, f.Name, FieldErrUndeliverable)
+		}
+	}
+}
+
+// disposableDomains returns the built in throw away email domains, with those in the form's DisposableFile.
+func disposableDomains(ed config.EmailCheckData) []string {
+	domains := scoring.DisposableDomains
+	if ed.DisposableFile == "" {
+		return domains
+	}
+	more, err := scoring.LoadList(ed.DisposableFile)
+	if err != nil {
+		log.Printf("Error reading the disposable email domains; %s\n", err)
+		return domains
+	}
+	return append(append([]string{}, domains...), more...)
+}
+
+func isBadField(fr *formResponse, name string) bool {
+	for _, b := range fr.BadFields {
+		if b == name {
+			return true
+		}
+	}
+	return false
+}
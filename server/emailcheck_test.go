@@ -0,0 +1,82 @@
+// Copyright (c) 2024 Owen Waller. All rights reserved.
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/owenwaller/emailformgateway/config"
+)
+
+// mxResolver knows the MX records of its domains, every other domain does not exist.
+type mxResolver map[string]string
+
+func (r mxResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	if host, found := r[name]; found {
+		return []*net.MX{{Host: host, Pref: 10}}, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r mxResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+// postEmail posts the test fields with the email address, and returns the form response.
+func postEmail(t *testing.T, s *Server, email string) formResponse {
+	fields := newTestFields()
+	fields[1].Value = email
+	b, err := json.Marshal(fields)
+	if err != nil {
+		t.Fatalf("Could not encode fields: %s", err)
+	}
+	w, fr := postJSON(t, s, b)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d but got %d", http.StatusOK, w.Code)
+	}
+	return fr
+}
+
+func TestEmailCheckDeliverable(t *testing.T) {
+	s := newTestServer(t, func(c *config.Config) {
+		c.EmailCheck = config.EmailCheckData{Mode: "Deliverable", Disposable: true, Suggest: true}
+	})
+	s.resolver = mxResolver{"example.com": "mx.example.com.", "gmial.com": "mx.gmial.com."}
+	var posts = []struct {
+		email       string
+		valid       bool
+		suggestions map[string]string
+	}{
+		{"me@example.com", true, nil},
+		{"me@gmial.com", true, map[string]string{"email": "me@gmail.com"}},
+		{"me@missing.example.org", false, nil},
+		{"a@b", false, nil},
+		{"me@localhost", false, nil},
+		{"me@mailinator.com", false, nil},
+	}
+	for _, p := range posts {
+		fr := postEmail(t, s, p.email)
+		if fr.Valid != p.valid {
+			t.Fatalf("%q: expected valid to be %t but got %+v", p.email, p.valid, fr)
+		}
+		if !p.valid && !reflect.DeepEqual(fr.BadFields, []string{"email"}) {
+			t.Fatalf("%q: expected the email field to be bad but got %v", p.email, fr.BadFields)
+		}
+		if !reflect.DeepEqual(fr.Suggestions, p.suggestions) {
+			t.Fatalf("%q: expected the suggestions %v but got %v", p.email, p.suggestions, fr.Suggestions)
+		}
+	}
+}
+
+func TestEmailCheckSyntaxOnly(t *testing.T) {
+	s := newTestServer(t)
+	s.resolver = mxResolver{}
+	fr := postEmail(t, s, "a@b")
+	if !fr.Valid || fr.Suggestions != nil {
+		t.Fatalf("Expected only the syntax to be checked but got %+v", fr)
+	}
+}
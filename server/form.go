@@ -0,0 +1,378 @@
+// Copyright (c) 2024 Owen Waller. All rights reserved.
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/owenwaller/emailformgateway/config"
+	"github.com/owenwaller/emailformgateway/validation"
+)
+
+// The request body encodings the gateway understands
+const (
+	contentTypeJSON      = "application/json"
+	contentTypeForm      = "application/x-www-form-urlencoded"
+	contentTypeMultipart = "multipart/form-data"
+)
+
+// maxMultipartMemory is how much of a multipart body is held in memory, the rest goes to temporary files.
+const maxMultipartMemory = 32 << 20
+
+// maxFieldsBody is how big a request's fields may be, on top of the files the form accepts.
+const maxFieldsBody = 1 << 20
+
+// maxBodySize is the largest request body the form can be sent, its fields and as many of the
+// largest files as each file field accepts.
+func maxBodySize(formFields map[string]config.FieldData) int64 {
+	size := int64(maxFieldsBody)
+	for _, fd := range formFields {
+		if !strings.EqualFold(fd.Type, config.FieldTypeFile) {
+			continue
+		}
+		maxSize := fd.MaxSize
+		if maxSize <= 0 {
+			maxSize = config.DefaultMaxFileSize
+		}
+		maxCount := fd.MaxCount
+		if maxCount <= 0 {
+			maxCount = config.DefaultMaxFileCount
+		}
+		size += maxSize * int64(maxCount)
+	}
+	return size
+}
+
+// decodeFields reads the form fields from the request body, whatever encoding the client used.
+// A JSON body may either be the array of name/value objects sent by the gateway's javascript,
+// or a single object mapping field names to values. Plain HTML forms are url or multipart encoded.
+// Every encoding is normalised into the same []Field.
+func decodeFields(r *http.Request) ([]Field, error) {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		mediaType = "" // a missing or broken Content-Type, we look at the body instead
+	}
+	if mediaType == contentTypeMultipart {
+		err = r.ParseMultipartForm(maxMultipartMemory)
+		if err != nil {
+			return nil, err
+		}
+		return valuesToFields(r.MultipartForm.Value), nil
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	// Some javascript clients send a JSON body with the form Content-Type, so anything
+	// that looks like JSON is decoded as JSON.
+	if mediaType == contentTypeJSON || looksLikeJSON(body) {
+		return decodeJSONFields(body)
+	}
+	if mediaType == contentTypeForm {
+		values, err := url.ParseQuery(string(body))
+		if err != nil {
+			return nil, err
+		}
+		return valuesToFields(values), nil
+	}
+	return nil, errors.New("Unsupported Content-Type \"" + mediaType + "\".")
+}
+
+func looksLikeJSON(body []byte) bool {
+	body = bytes.TrimSpace(body)
+	return len(body) != 0 && (body[0] == '[' || body[0] == '{')
+}
+
+func decodeJSONFields(body []byte) ([]Field, error) {
+	body = bytes.TrimSpace(body)
+	if len(body) != 0 && body[0] == '{' {
+		var m map[string]json.RawMessage
+		err := json.Unmarshal(body, &m)
+		if err != nil {
+			return nil, err
+		}
+		fields := make([]Field, 0, len(m))
+		for _, name := range sortedKeys(m) {
+			values, err := jsonValues(m[name])
+			if err != nil {
+				return nil, fmt.Errorf("The field %q %s", name, err)
+			}
+			for _, v := range values {
+				fields = append(fields, Field{Name: name, Value: v})
+			}
+		}
+		return fields, nil
+	}
+	var fields []Field
+	err := json.Unmarshal(body, &fields)
+	if err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+// jsonValues turns a JSON value into the field's values. A string, number or boolean is one value,
+// e.g. 3 is "3" and true is "true", null is an empty value and an array, e.g. of a multiselect's
+// choices, is one value per element.
+func jsonValues(raw json.RawMessage) ([]string, error) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) != 0 && raw[0] == '[' {
+		var elements []json.RawMessage
+		err := json.Unmarshal(raw, &elements)
+		if err != nil {
+			return nil, err
+		}
+		values := make([]string, 0, len(elements))
+		for _, e := range elements {
+			v, err := jsonScalar(e)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+		}
+		return values, nil
+	}
+	v, err := jsonScalar(raw)
+	if err != nil {
+		return nil, err
+	}
+	return []string{v}, nil
+}
+
+func jsonScalar(raw json.RawMessage) (string, error) {
+	raw = bytes.TrimSpace(raw)
+	switch {
+	case len(raw) == 0:
+		return "", errors.New("has no value")
+	case raw[0] == '"':
+		var s string
+		err := json.Unmarshal(raw, &s)
+		return s, err
+	case string(raw) == "null":
+		return "", nil
+	case raw[0] == '{' || raw[0] == '[':
+		return "", errors.New("is not a string, number or boolean")
+	}
+	// a number or boolean is kept as it was written
+	var v interface{}
+	err := json.Unmarshal(raw, &v)
+	if err != nil {
+		return "", err
+	}
+	return string(raw), nil
+}
+
+// valuesToFields turns a parsed HTML form into fields. A name with several values,
+// e.g. a group of checkboxes, becomes one field per value.
+func valuesToFields(values map[string][]string) []Field {
+	fields := make([]Field, 0, len(values))
+	for _, name := range sortedKeys(values) {
+		for _, v := range values[name] {
+			fields = append(fields, Field{Name: name, Value: v})
+		}
+	}
+	return fields
+}
+
+// formField returns the form's field with the name.
+func formField(formFields map[string]config.FieldData, name string) (config.FieldData, bool) {
+	for _, v := range formFields {
+		if strings.EqualFold(v.Name, name) {
+			return v, true
+		}
+	}
+	return config.FieldData{Name: name}, false
+}
+
+// unknownFields applies the form's UnknownFields policy to the posted fields that are not the form's fields.
+// Dropped and rejected fields are left out of the fields that are returned, a rejected field is a bad field too.
+func unknownFields(policy string, formFields map[string]config.FieldData, fields []Field, fr *formResponse) []Field {
+	policy = strings.ToLower(policy)
+	if policy != config.UnknownFieldsDrop && policy != config.UnknownFieldsReject {
+		return fields
+	}
+	known := make([]Field, 0, len(fields))
+	var unknown []string
+	for _, f := range fields {
+		if _, found := formField(formFields, f.Name); found {
+			known = append(known, f)
+			continue
+		}
+		if policy == config.UnknownFieldsReject && !containsFold(unknown, f.Name) {
+			// a field sent with several values is only reported once
+			unknown = append(unknown, f.Name)
+			fr.setFieldError(config.FieldData{Name: f.Name}, f.Name, FieldErrUnknown)
+		}
+	}
+	return known
+}
+
+func containsFold(names []string, name string) bool {
+	for _, n := range names {
+		if strings.EqualFold(n, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// withoutFields returns the fields without any of the named fields.
+func withoutFields(fields []Field, names []string) []Field {
+	kept := make([]Field, 0, len(fields))
+	for _, f := range fields {
+		found := false
+		for _, name := range names {
+			if strings.EqualFold(f.Name, name) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			kept = append(kept, f)
+		}
+	}
+	return kept
+}
+
+// sortedKeys gives the fields a stable order, maps don't have one.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// scrubFiles validates the files uploaded through the "file" fields in the config and returns them
+// as attachments for the system email. Files sent with a name the config does not know are ignored.
+// The files must have been parsed by decodeFields, so only multipart requests can have any.
+func scrubFiles(formFields map[string]config.FieldData, r *http.Request, fr *formResponse) []config.Attachment {
+	if r.MultipartForm == nil {
+		return nil
+	}
+	var attachments []config.Attachment
+	for _, v := range formFields {
+		if !strings.EqualFold(v.Type, config.FieldTypeFile) {
+			continue
+		}
+		headers := findFiles(v.Name, r.MultipartForm.File)
+		if len(headers) == 0 {
+			continue
+		}
+		maxCount := v.MaxCount
+		if maxCount <= 0 {
+			maxCount = config.DefaultMaxFileCount
+		}
+		if len(headers) > maxCount {
+			fr.setFieldError(v, v.Name, FieldErrTooManyFiles)
+			continue
+		}
+		files, valid := readFiles(v, headers)
+		if !valid {
+			fr.setFieldError(v, v.Name, FieldErrInvalid)
+			continue
+		}
+		attachments = append(attachments, files...)
+	}
+	return attachments
+}
+
+func findFiles(name string, files map[string][]*multipart.FileHeader) []*multipart.FileHeader {
+	for k, v := range files {
+		if strings.EqualFold(k, name) {
+			return v
+		}
+	}
+	return nil
+}
+
+// readFiles reads and sniffs every file uploaded through one field, any bad file makes the whole field bad.
+func readFiles(fd config.FieldData, headers []*multipart.FileHeader) ([]config.Attachment, bool) {
+	maxSize := fd.MaxSize
+	if maxSize <= 0 {
+		maxSize = config.DefaultMaxFileSize
+	}
+	attachments := make([]config.Attachment, 0, len(headers))
+	for _, fh := range headers {
+		if fh.Size > maxSize {
+			return nil, false
+		}
+		f, err := fh.Open()
+		if err != nil {
+			log.Printf("Could not open uploaded file %q: %s\n", fh.Filename, err)
+			return nil, false
+		}
+		data, err := io.ReadAll(io.LimitReader(f, maxSize+1))
+		f.Close()
+		if err != nil || int64(len(data)) > maxSize {
+			return nil, false
+		}
+		contentType, valid := validation.ValidateAsFile(data, fd.AllowedTypes)
+		if !valid {
+			return nil, false
+		}
+		a := config.Attachment{Field: fd.Name, Filename: filepath.Base(fh.Filename), ContentType: contentType, Data: data}
+		attachments = append(attachments, a)
+	}
+	return attachments, true
+}
+
+// isBrowserPost reports if the request came from a plain HTML form, rather than from javascript.
+// A browser navigates to the response, so it should get a redirect rather than JSON.
+// Javascript that posts a FormData object asks for JSON in the Accept header.
+func isBrowserPost(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || (mediaType != contentTypeForm && mediaType != contentTypeMultipart) {
+		return false
+	}
+	return !strings.Contains(r.Header.Get("Accept"), contentTypeJSON)
+}
+
+// redirectURL returns the page a browser should be sent to for the form response,
+// or an empty string if no page is configured.
+func redirectURL(rd config.RedirectData, fr *formResponse) string {
+	if len(fr.BadFields) == 0 && fr.Error == "" {
+		return rd.Success
+	}
+	if rd.Failure == "" {
+		return ""
+	}
+	u, err := url.Parse(rd.Failure)
+	if err != nil {
+		return rd.Failure
+	}
+	q := u.Query()
+	if len(fr.BadFields) != 0 {
+		q.Set("badfields", strings.Join(fr.BadFields, ","))
+	}
+	if fr.Error != "" {
+		q.Set("error", fr.Error)
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// respond writes the form response, as a redirect for a plain HTML form post and as JSON otherwise.
+func respond(w http.ResponseWriter, r *http.Request, rd config.RedirectData, fr *formResponse) {
+	if isBrowserPost(r) {
+		if to := redirectURL(rd, fr); to != "" {
+			http.Redirect(w, r, to, http.StatusSeeOther)
+			fr.clearBadFields()
+			return
+		}
+	}
+	writeResponse(w, fr)
+}
@@ -0,0 +1,266 @@
+// Copyright (c) 2024 Owen Waller. All rights reserved.
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/owenwaller/emailformgateway/config"
+	"github.com/owenwaller/emailformgateway/queue"
+)
+
+func newFormValues() url.Values {
+	v := url.Values{}
+	v.Set("name", "Me")
+	v.Set("email", "me@example.com")
+	v.Set("subject", "The subject")
+	v.Set("feedback", "The feedback")
+	return v
+}
+
+func newMultipartBody(t *testing.T, v url.Values) (*bytes.Buffer, string) {
+	var b bytes.Buffer
+	mw := multipart.NewWriter(&b)
+	for name, values := range v {
+		for _, value := range values {
+			err := mw.WriteField(name, value)
+			if err != nil {
+				t.Fatalf("Could not write multipart field %q: %s", name, err)
+			}
+		}
+	}
+	err := mw.Close()
+	if err != nil {
+		t.Fatalf("Could not close the multipart writer: %s", err)
+	}
+	return &b, mw.FormDataContentType()
+}
+
+// newUploadRequest posts the test form with the given files in the screenshot field.
+func newUploadRequest(t *testing.T, files map[string][]byte) *http.Request {
+	var b bytes.Buffer
+	mw := multipart.NewWriter(&b)
+	for name, values := range newFormValues() {
+		err := mw.WriteField(name, values[0])
+		if err != nil {
+			t.Fatalf("Could not write multipart field %q: %s", name, err)
+		}
+	}
+	for filename, data := range files {
+		fw, err := mw.CreateFormFile("screenshot", filename)
+		if err != nil {
+			t.Fatalf("Could not create multipart file %q: %s", filename, err)
+		}
+		_, err = fw.Write(data)
+		if err != nil {
+			t.Fatalf("Could not write multipart file %q: %s", filename, err)
+		}
+	}
+	err := mw.Close()
+	if err != nil {
+		t.Fatalf("Could not close the multipart writer: %s", err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/", &b)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	r.Header.Set("Accept", "application/json")
+	return r
+}
+
+func verifyTestFields(t *testing.T, fields []Field) {
+	expected := map[string]string{"name": "Me", "email": "me@example.com", "subject": "The subject", "feedback": "The feedback"}
+	if len(fields) != len(expected) {
+		t.Fatalf("Expected %d fields but got %d: %+v", len(expected), len(fields), fields)
+	}
+	for _, f := range fields {
+		if expected[f.Name] != f.Value {
+			t.Fatalf("Field %q: expected %q but got %q", f.Name, expected[f.Name], f.Value)
+		}
+	}
+}
+
+func TestDecodeFields(t *testing.T) {
+	b, ct := newMultipartBody(t, newFormValues())
+	var bodies = []struct {
+		contentType string
+		body        string
+	}{
+		{"application/json; charset=utf-8", `[{"name":"name","value":"Me"},{"name":"email","value":"me@example.com"},` +
+			`{"name":"subject","value":"The subject"},{"name":"feedback","value":"The feedback"}]`},
+		{"application/json", `{"name":"Me","email":"me@example.com","subject":"The subject","feedback":"The feedback"}`},
+		{"application/x-www-form-urlencoded", newFormValues().Encode()},
+		{"application/x-www-form-urlencoded; charset=UTF-8", `{"name":"Me","email":"me@example.com","subject":"The subject","feedback":"The feedback"}`},
+		{"", `[{"name":"name","value":"Me"},{"name":"email","value":"me@example.com"},` +
+			`{"name":"subject","value":"The subject"},{"name":"feedback","value":"The feedback"}]`},
+		{ct, b.String()},
+	}
+	for _, b := range bodies {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(b.body))
+		if b.contentType != "" {
+			r.Header.Set("Content-Type", b.contentType)
+		}
+		fields, err := decodeFields(r)
+		if err != nil {
+			t.Fatalf("%q: could not decode fields: %s", b.contentType, err)
+		}
+		verifyTestFields(t, fields)
+	}
+}
+
+func TestDecodeFieldsUnsupported(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("name=Me"))
+	r.Header.Set("Content-Type", "text/plain")
+	_, err := decodeFields(r)
+	if err == nil {
+		t.Fatalf("Expected an error decoding a text/plain body but got nil")
+	}
+}
+
+func TestDecodeFieldsJSONTypes(t *testing.T) {
+	body := `{"quantity": 3, "price": 2.50, "subscribe": true, "topics": ["a", "b"], "notes": null, "name": "Me"}`
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	fields, err := decodeFields(r)
+	if err != nil {
+		t.Fatalf("Could not decode fields: %s", err)
+	}
+	expected := []Field{{"name", "Me"}, {"notes", ""}, {"price", "2.50"}, {"quantity", "3"}, {"subscribe", "true"},
+		{"topics", "a"}, {"topics", "b"}}
+	if !reflect.DeepEqual(fields, expected) {
+		t.Fatalf("Expected the fields %+v but got %+v", expected, fields)
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"address": {"street": "High Street"}}`))
+	r.Header.Set("Content-Type", "application/json")
+	_, err = decodeFields(r)
+	if err == nil || !strings.Contains(err.Error(), "address") {
+		t.Fatalf("Expected an error decoding an object value but got %v", err)
+	}
+}
+
+func TestDecodeFieldsTooLarge(t *testing.T) {
+	body := `{"feedback":"` + strings.Repeat("x", maxFieldsBody) + `"}`
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	r.Body = http.MaxBytesReader(httptest.NewRecorder(), r.Body, maxBodySize(nil))
+	_, err := decodeFields(r)
+	var tooLarge *http.MaxBytesError
+	if !errors.As(err, &tooLarge) {
+		t.Fatalf("Expected a MaxBytesError but got %v", err)
+	}
+
+	fields := map[string]config.FieldData{"field1": {Name: "cv", Type: "file", MaxSize: 1 << 20, MaxCount: 2}}
+	if size := maxBodySize(fields); size != maxFieldsBody+2<<20 {
+		t.Fatalf("Expected the body size to allow for the files, %d, but got %d", maxFieldsBody+2<<20, size)
+	}
+}
+
+func TestDecodeFieldsMultipleValues(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("topic=a&topic=b"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	fields, err := decodeFields(r)
+	if err != nil {
+		t.Fatalf("Could not decode fields: %s", err)
+	}
+	if len(fields) != 2 || fields[0].Value != "a" || fields[1].Value != "b" {
+		t.Fatalf("Expected one field per value but got %+v", fields)
+	}
+}
+
+func TestGatewayHandlerRedirects(t *testing.T) {
+	var posts = []struct {
+		email    string
+		accept   string
+		status   int
+		location string
+	}{
+		{"me@example.com", "text/html", http.StatusSeeOther, "https://example.com/thanks"},
+		{"bad", "text/html", http.StatusSeeOther, "https://example.com/sorry?badfields=email"},
+		{"me@example.com", "application/json", http.StatusOK, ""},
+	}
+	for _, p := range posts {
+		s := newTestServer(t, func(c *config.Config) {
+			c.Redirect.Success = "https://example.com/thanks"
+			c.Redirect.Failure = "https://example.com/sorry"
+		})
+		v := newFormValues()
+		v.Set("email", p.email)
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(v.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("Accept", p.accept)
+		w := httptest.NewRecorder()
+		s.gatewayHandler(w, r)
+		if w.Code != p.status {
+			t.Fatalf("%s: expected status %d but got %d", p.email, p.status, w.Code)
+		}
+		if location := w.Header().Get("Location"); location != p.location {
+			t.Fatalf("%s: expected a redirect to %q but got %q", p.email, p.location, location)
+		}
+	}
+}
+
+func TestGatewayHandlerFormWithoutRedirect(t *testing.T) {
+	s := newTestServer(t)
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(newFormValues().Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	s.gatewayHandler(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d but got %d", http.StatusOK, w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json; charset=utf-8" {
+		t.Fatalf("Expected a JSON response but got %q", ct)
+	}
+}
+
+func TestGatewayHandlerAttachments(t *testing.T) {
+	var png = []byte("\x89PNG\x0D\x0A\x1A\x0A\x00\x00\x00\x0DIHDR")
+	var uploads = []struct {
+		files       map[string][]byte
+		valid       bool
+		attachments int
+	}{
+		{nil, true, 0},
+		{map[string][]byte{"screen.png": png}, true, 1},
+		{map[string][]byte{"a.png": png, "b.png": png}, true, 2},
+		{map[string][]byte{"a.png": png, "b.png": png, "c.png": png}, false, 0},
+		{map[string][]byte{"screen.png": []byte("not really a png")}, false, 0},
+		{map[string][]byte{"big.png": append(png, make([]byte, 64)...)}, false, 0},
+	}
+	for i, u := range uploads {
+		s := newTestServer(t, func(c *config.Config) {
+			c.Fields["field5"] = config.FieldData{Name: "screenshot", Type: "file", MaxSize: 64, MaxCount: 2, AllowedTypes: []string{"image/*"}}
+		})
+		w := httptest.NewRecorder()
+		s.gatewayHandler(w, newUploadRequest(t, u.files))
+
+		var fr formResponse
+		err := json.Unmarshal(w.Body.Bytes(), &fr)
+		if err != nil {
+			t.Fatalf("Case %d: could not decode form response JSON %q: %s", i, w.Body.String(), err)
+		}
+		if fr.Valid != u.valid {
+			t.Fatalf("Case %d: expected valid to be %t but got %+v", i, u.valid, fr)
+		}
+		pending, err := s.queue.Pending()
+		if err != nil {
+			t.Fatalf("Case %d: could not read the spool: %s", i, err)
+		}
+		for _, j := range pending {
+			expected := u.attachments
+			if j.Kind == queue.CustomerEmail {
+				expected = 0
+			}
+			if len(j.Data.Attachments) != expected {
+				t.Fatalf("Case %d: expected the %s email to have %d attachments but got %d", i, j.Kind, expected, len(j.Data.Attachments))
+			}
+		}
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright (c) 2024 Owen Waller. All rights reserved.
+package server
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/owenwaller/emailformgateway/config"
+	"github.com/owenwaller/emailformgateway/ratelimit"
+)
+
+// OpenRateLimits opens the store of the rate limit buckets named in the config.
+// ReadConfig must have been called first. Without it the buckets are kept in memory.
+func (s *Server) OpenRateLimits() error {
+	store, err := ratelimit.New(s.config.Load().RateLimit)
+	if err != nil {
+		return err
+	}
+	s.rateStore = store
+	return nil
+}
+
+// CloseRateLimits closes the store opened by OpenRateLimits.
+func (s *Server) CloseRateLimits() {
+	if s.rateStore != nil {
+		s.rateStore.Close()
+	}
+}
+
+func (s *Server) rateLimits() ratelimit.Store {
+	s.rateOnce.Do(func() {
+		if s.rateStore == nil {
+			s.rateStore = ratelimit.NewMemoryStore()
+		}
+	})
+	return s.rateStore
+}
+
+// limitClient takes a token from the bucket of the client's IP address.
+// It returns how long the client should wait if the bucket was empty.
+func (s *Server) limitClient(rd config.RateLimitData, ip string) (time.Duration, bool) {
+	return s.take("ip:"+ip, rd.PerIP)
+}
+
+// limitSubmission takes a token from the bucket of every email address the form was posted with,
+// and then from the global bucket. The global token is taken last, so a client that is
+// already limited can't use up the tokens of everyone else. If a bucket is empty the tokens
+// already taken are given back, a refused submission uses up no one's tokens.
+func (s *Server) limitSubmission(rd config.RateLimitData, formFields map[string]config.FieldData, fields []Field) (time.Duration, bool) {
+	var taken []string
+	for _, k := range sortedKeys(formFields) {
+		v := formFields[k]
+		if !strings.EqualFold(v.Type, config.FieldTypeEmail) {
+			continue
+		}
+		match, err := find(v.Name, fields)
+		if err != nil {
+			continue
+		}
+		email := strings.ToLower(strings.TrimSpace(match.Value))
+		if email == "" {
+			continue
+		}
+		wait, limited := s.take("email:"+email, rd.PerEmail)
+		if limited {
+			s.give(taken, rd.PerEmail)
+			return wait, true
+		}
+		taken = append(taken, "email:"+email)
+	}
+	wait, limited := s.take("global", rd.Global)
+	if limited {
+		s.give(taken, rd.PerEmail)
+	}
+	return wait, limited
+}
+
+// take takes a token from a bucket. A store that can't be used lets the request through,
+// the gateway keeps working without its rate limits rather than not at all.
+func (s *Server) take(key string, l config.LimitData) (time.Duration, bool) {
+	allowed, wait, err := s.rateLimits().Take(key, l, time.Now())
+	if err != nil {
+		log.Printf("Could not apply the rate limit to %q; %s\n", key, err)
+		return 0, false
+	}
+	if !allowed {
+		log.Printf("Refusing request; the rate limit of %q was reached\n", key)
+	}
+	return wait, !allowed
+}
+
+// give gives back a token to each of the buckets.
+func (s *Server) give(keys []string, l config.LimitData) {
+	for _, key := range keys {
+		err := s.rateLimits().Give(key, l, time.Now())
+		if err != nil {
+			log.Printf("Could not give back the rate limit token of %q; %s\n", key, err)
+		}
+	}
+}
+
+// tooManyRequests tells the client how long to wait before posting the form again.
+func tooManyRequests(w http.ResponseWriter, r *http.Request, rd config.RedirectData, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	var fr formResponse
+	fr.setError(ErrRateLimited)
+	respond(w, r, rd, &fr)
+}
@@ -0,0 +1,158 @@
+// Copyright (c) 2024 Owen Waller. All rights reserved.
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/owenwaller/emailformgateway/config"
+)
+
+// postFrom posts the test fields, with the email address, from the IP address.
+func postFrom(t *testing.T, s *Server, ip, email string) *httptest.ResponseRecorder {
+	fields := newTestFields()
+	fields[1].Value = email
+	b, err := json.Marshal(fields)
+	if err != nil {
+		t.Fatalf("Could not encode fields: %s", err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(b))
+	r.Header.Set("Content-Type", "application/json; charset=utf-8")
+	r.RemoteAddr = ip + ":1234"
+	w := httptest.NewRecorder()
+	s.gatewayHandler(w, r)
+	return w
+}
+
+// postFromProxy posts the test fields through the proxy, for the client.
+func postFromProxy(t *testing.T, s *Server, proxy, client string) *httptest.ResponseRecorder {
+	b, err := json.Marshal(newTestFields())
+	if err != nil {
+		t.Fatalf("Could not encode fields: %s", err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(b))
+	r.Header.Set("Content-Type", "application/json; charset=utf-8")
+	r.Header.Set("X-Forwarded-For", client)
+	r.RemoteAddr = proxy + ":1234"
+	w := httptest.NewRecorder()
+	s.gatewayHandler(w, r)
+	return w
+}
+
+func TestRateLimitPerIP(t *testing.T) {
+	s := newTestServer(t, func(c *config.Config) { c.RateLimit.PerIP = config.LimitData{Requests: 2, Per: time.Minute} })
+	for i, expected := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		w := postFrom(t, s, "192.0.2.1", "me@example.com")
+		if w.Code != expected {
+			t.Fatalf("Post %d: expected status %d but got %d", i, expected, w.Code)
+		}
+		if expected == http.StatusTooManyRequests && w.Header().Get("Retry-After") != "30" {
+			t.Fatalf("Expected Retry-After to be 30 but got %q", w.Header().Get("Retry-After"))
+		}
+	}
+	// another client has its own bucket
+	w := postFrom(t, s, "192.0.2.2", "me@example.com")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected another client to be allowed but got %d", w.Code)
+	}
+}
+
+func TestRateLimitPerEmail(t *testing.T) {
+	s := newTestServer(t, func(c *config.Config) { c.RateLimit.PerEmail = config.LimitData{Requests: 1, Per: time.Hour} })
+	w := postFrom(t, s, "192.0.2.1", "victim@example.com")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the first post to be allowed but got %d", w.Code)
+	}
+	w = postFrom(t, s, "192.0.2.2", "VICTIM@example.com")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected the second post to the same address to be limited but got %d", w.Code)
+	}
+	var fr formResponse
+	err := json.Unmarshal(w.Body.Bytes(), &fr)
+	if err != nil || fr.Error != ErrRateLimited {
+		t.Fatalf("Expected the error %q but got %+v, %v", ErrRateLimited, fr, err)
+	}
+	pending, err := s.queue.Pending()
+	if err != nil {
+		t.Fatalf("Could not read the spool: %s", err)
+	}
+	if len(pending) != 2 {
+		t.Fatalf("Expected only the first post to be queued, but got %d emails", len(pending))
+	}
+}
+
+func TestRateLimitBehindProxy(t *testing.T) {
+	s := newTestServer(t, func(c *config.Config) {
+		c.Proxies.Trusted = []string{"10.0.0.1"}
+		c.RateLimit.PerIP = config.LimitData{Requests: 1, Per: time.Minute}
+	})
+	postFromProxy(t, s, "10.0.0.1", "198.51.100.7")
+	// each client behind the proxy has its own bucket
+	w := postFromProxy(t, s, "10.0.0.1", "198.51.100.8")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected another client behind the proxy to be allowed but got %d", w.Code)
+	}
+	w = postFromProxy(t, s, "10.0.0.1", "198.51.100.7")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected the client behind the proxy to be limited but got %d", w.Code)
+	}
+}
+
+func TestRateLimitGlobal(t *testing.T) {
+	s := newTestServer(t, func(c *config.Config) { c.RateLimit.Global = config.LimitData{Requests: 1, Per: time.Minute} })
+	postFrom(t, s, "192.0.2.1", "a@example.com")
+	w := postFrom(t, s, "192.0.2.2", "b@example.com")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected the global limit to be reached but got %d", w.Code)
+	}
+}
+
+func TestRateLimitGlobalAfterPerIP(t *testing.T) {
+	s := newTestServer(t, func(c *config.Config) {
+		c.RateLimit.PerIP = config.LimitData{Requests: 1, Per: time.Minute}
+		c.RateLimit.Global = config.LimitData{Requests: 2, Per: time.Minute}
+	})
+	postFrom(t, s, "192.0.2.1", "a@example.com")
+	// the throttled client keeps posting, which must not use up the global bucket
+	for i := 0; i < 5; i++ {
+		w := postFrom(t, s, "192.0.2.1", "a@example.com")
+		if w.Code != http.StatusTooManyRequests {
+			t.Fatalf("Post %d: expected the client to be limited but got %d", i, w.Code)
+		}
+	}
+	w := postFrom(t, s, "192.0.2.2", "b@example.com")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected another client to be allowed but got %d", w.Code)
+	}
+}
+
+func TestRateLimitPerEmailGivesBack(t *testing.T) {
+	s := newTestServer(t, func(c *config.Config) {
+		c.Fields["field5"] = config.FieldData{Name: "copyto", Type: "email"}
+		c.RateLimit.PerEmail = config.LimitData{Requests: 1, Per: time.Hour}
+	})
+	post := func(email, copyTo string) int {
+		fields := append(newTestFields(), Field{Name: "copyto", Value: copyTo})
+		fields[1].Value = email
+		b, err := json.Marshal(fields)
+		if err != nil {
+			t.Fatalf("Could not encode fields: %s", err)
+		}
+		w, _ := postJSON(t, s, b)
+		return w.Code
+	}
+	if code := post("a@example.com", "b@example.com"); code != http.StatusOK {
+		t.Fatalf("Expected the first post to be allowed but got %d", code)
+	}
+	// the second address is limited, so the first one's token is given back
+	if code := post("c@example.com", "b@example.com"); code != http.StatusTooManyRequests {
+		t.Fatalf("Expected the post to the limited address to be refused but got %d", code)
+	}
+	if code := post("c@example.com", "d@example.com"); code != http.StatusOK {
+		t.Fatalf("Expected the address of the refused post to still have its token but got %d", code)
+	}
+}
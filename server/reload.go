@@ -0,0 +1,326 @@
+// Copyright (c) 2024 Owen Waller. All rights reserved.
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/owenwaller/emailformgateway/config"
+	"github.com/owenwaller/emailformgateway/emailer"
+)
+
+// reloadDelay is how long the watcher waits for a burst of file events to finish,
+// editors often write a file several times when it is saved.
+const reloadDelay = 500 * time.Millisecond
+
+// The sections that are only used when the gateway starts
+var restartSections = []string{"LogFile", "Queue"}
+
+// watcher watches the config file and the templates, and listens for SIGHUP.
+type watcher struct {
+	fs    *fsnotify.Watcher
+	hup   chan os.Signal
+	done  chan struct{}
+	mu    sync.Mutex
+	files map[string]bool // the files that trigger a reload
+	dirs  map[string]bool // the directories being watched, editors replace files rather than write them
+}
+
+// Reload reads the config file again and, if it is valid, swaps it in for the current config.
+// Requests that are already being handled finish with the config they started with.
+// If the new config is not valid the current config is kept and the error says why.
+func (s *Server) Reload() error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	c, err := reloadConfig(s.configFile)
+	if err != nil {
+		return err
+	}
+	err = s.checkConfig(c)
+	if err != nil {
+		return err
+	}
+	var routes = s.routes.Load()
+	if routes != nil {
+		routes, err = s.buildRoutes(c, s.route)
+		if err != nil {
+			return err
+		}
+	}
+	old := s.config.Swap(c)
+	if routes != nil {
+		s.routes.Store(routes)
+	}
+	logChanges(s.configFile, old, c)
+	if s.watcher != nil {
+		s.watcher.update(watchedFiles(s.configFile, c))
+	}
+	return nil
+}
+
+// checkConfig validates the config, then builds the emails of every form, as it is submitted to every tenant,
+// from sample data. Nothing is sent. The error lists every problem found.
+func (s *Server) checkConfig(c *config.Config) error {
+	var errs []error
+	err := c.Validate()
+	if err != nil {
+		errs = append(errs, err)
+	}
+	tenants := []string{""}
+	if len(c.Tenants) != 0 {
+		tenants = sortedKeys(c.Tenants)
+	}
+	for _, name := range c.FormNames() {
+		for _, tenant := range tenants {
+			err := s.checkForm(c, name, tenant)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("form %q, tenant %q: %w", name, tenant, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *Server) checkForm(c *config.Config, name, tenant string) error {
+	form, domain, err := s.formConfig(c, name, tenant)
+	if err != nil {
+		return err
+	}
+	err = emailer.CheckTemplates(form.Templates)
+	if err != nil {
+		return err
+	}
+	// the templates may only use some of the data when the submission is flagged
+	for _, flagged := range []bool{false, true} {
+		etd := sampleTemplateData(name, tenant, form.Fields, flagged)
+		err = emailer.CheckEmails(etd, form.Addresses, form.Subjects, form.Templates, domain)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sampleTemplateData fills in every field of a form with a made up value.
+func sampleTemplateData(name, tenant string, fields map[string]config.FieldData, flagged bool) config.EmailTemplateData {
+	var formFields []Field
+	var attachments []config.Attachment
+	var badFields []string
+	var spamScore float64
+	var spamRules []string
+	if flagged {
+		spamScore, spamRules = 5, []string{"Links: 5 links (5)"}
+	}
+	for _, k := range sortedKeys(fields) {
+		f := fields[k]
+		switch strings.ToLower(f.Type) {
+		case config.FieldTypeFile:
+			attachments = append(attachments, config.Attachment{Field: f.Name, Filename: "sample.txt",
+				ContentType: "text/plain; charset=utf-8", Data: []byte("A sample file")})
+		case config.FieldTypeMultiSelect:
+			for _, a := range f.AllowedValues {
+				formFields = append(formFields, Field{Name: f.Name, Value: a})
+			}
+		default:
+			formFields = append(formFields, Field{Name: f.Name, Value: sampleValue(f)})
+		}
+		if flagged {
+			badFields = append(badFields, f.Name)
+		}
+	}
+	values := scrubFields(fields, append([]Field{}, formFields...), new(formResponse))
+	formData := createFormDataMap(formFields)
+	setTypedText(formData, values)
+	return config.EmailTemplateData{Form: name, Tenant: tenant, FormData: formData, Values: values,
+		CustomerTo: customerAddress(fields, values), UserAgent: "Mozilla/5.0", ClientIP: "192.0.2.1", RemoteIp: "192.0.2.1", XForwardedFor: "192.0.2.1",
+		Flagged: flagged, BadFields: badFields, Attachments: attachments,
+		Spam: flagged, SpamScore: spamScore, SpamRules: spamRules}
+}
+
+// sampleValue returns a made up value that is valid for the field.
+func sampleValue(f config.FieldData) string {
+	switch strings.ToLower(f.Type) {
+	case config.FieldTypeEmail:
+		return "someone@example.com"
+	case config.FieldTypeInteger, config.FieldTypeDecimal:
+		switch {
+		case f.Min != nil:
+			return strconv.FormatFloat(math.Ceil(*f.Min), 'f', -1, 64)
+		case f.Max != nil:
+			return strconv.FormatFloat(math.Floor(*f.Max), 'f', -1, 64)
+		}
+		return "1"
+	case config.FieldTypePhone:
+		return "+441632960123"
+	case config.FieldTypeURL:
+		return "https://www.example.com/"
+	case config.FieldTypeDate:
+		return "2024-03-01"
+	case config.FieldTypeDateTime:
+		return "2024-03-01T14:30"
+	case config.FieldTypeSelect, config.FieldTypeEnum:
+		if len(f.AllowedValues) != 0 {
+			return f.AllowedValues[0]
+		}
+	case config.FieldTypeCheckbox, config.FieldTypeBoolean:
+		return "on"
+	}
+	return "Sample " + f.Name
+}
+
+func logChanges(file string, old, new *config.Config) {
+	if old == nil {
+		log.Printf("Loaded the config from %q\n", file)
+		return
+	}
+	changes := config.Changes(old, new)
+	if len(changes) == 0 {
+		log.Printf("Reloaded the config from %q, nothing changed\n", file)
+		return
+	}
+	log.Printf("Reloaded the config from %q, changed: %s\n", file, strings.Join(changes, ", "))
+	for _, c := range changes {
+		for _, r := range restartSections {
+			if c == r {
+				log.Printf("The changes to [%s] take effect when the gateway is restarted\n", r)
+			}
+		}
+	}
+}
+
+// watchedFiles returns the config file and the templates of every form and tenant.
+func watchedFiles(file string, c *config.Config) []string {
+	files := []string{file}
+	var templates []config.EmailTemplatesData
+	for _, name := range c.FormNames() {
+		form, _ := c.Form(name)
+		templates = append(templates, form.Templates)
+	}
+	for _, name := range sortedKeys(c.Tenants) {
+		t, _ := c.Tenant(name)
+		form := t.Apply(config.FormData{})
+		if form.Templates != (config.EmailTemplatesData{}) {
+			templates = append(templates, form.Templates)
+		}
+	}
+	for _, t := range templates {
+		files = append(files, t.CustomerTextFileName, t.CustomerHtmlFileName, t.SystemTextFileName, t.SystemHtmlFileName)
+	}
+	return files
+}
+
+// Watch reloads the config when the config file or any of the templates change, or the gateway gets a SIGHUP.
+func (s *Server) Watch() error {
+	fw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("Could not watch the config file: %w", err)
+	}
+	w := &watcher{fs: fw, hup: make(chan os.Signal, 1), done: make(chan struct{})}
+	w.files = make(map[string]bool)
+	w.dirs = make(map[string]bool)
+	w.update(watchedFiles(s.configFile, s.config.Load()))
+	s.watcher = w
+	signal.Notify(w.hup, syscall.SIGHUP)
+	go s.watch(w)
+	return nil
+}
+
+// StopWatching stops the reloads started by Watch.
+func (s *Server) StopWatching() {
+	if s.watcher == nil {
+		return
+	}
+	signal.Stop(s.watcher.hup)
+	close(s.watcher.done)
+	s.watcher.fs.Close()
+}
+
+func (s *Server) watch(w *watcher) {
+	var timer <-chan time.Time
+	for {
+		select {
+		case <-w.done:
+			return
+		case e, ok := <-w.fs.Events:
+			if !ok {
+				return
+			}
+			if w.watching(e.Name) {
+				timer = time.After(reloadDelay) // wait for the burst of events to finish
+			}
+		case err, ok := <-w.fs.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("Error watching the config file: %s\n", err)
+		case <-timer:
+			timer = nil
+			s.reloadAndLog("a file changed")
+		case <-w.hup:
+			s.reloadAndLog("SIGHUP")
+		}
+	}
+}
+
+func (s *Server) reloadAndLog(reason string) {
+	err := s.Reload()
+	if err != nil {
+		log.Printf("Rejected the new config after %s, keeping the current config: %s\n", reason, err)
+	}
+}
+
+// update replaces the watched files, and the directories they are in.
+func (w *watcher) update(files []string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.files = make(map[string]bool)
+	dirs := make(map[string]bool)
+	for _, f := range files {
+		if f == "" {
+			continue
+		}
+		abs, err := filepath.Abs(f)
+		if err != nil {
+			continue
+		}
+		w.files[abs] = true
+		dirs[filepath.Dir(abs)] = true
+	}
+	for d := range w.dirs {
+		if !dirs[d] {
+			w.fs.Remove(d)
+		}
+	}
+	for d := range dirs {
+		if w.dirs[d] {
+			continue
+		}
+		err := w.fs.Add(d)
+		if err != nil {
+			log.Printf("Could not watch %q: %s\n", d, err)
+			delete(dirs, d)
+		}
+	}
+	w.dirs = dirs
+}
+
+func (w *watcher) watching(name string) bool {
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.files[abs]
+}
@@ -0,0 +1,182 @@
+// Copyright (c) 2024 Owen Waller. All rights reserved.
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestConfig writes a config using the templates in the root of the repository.
+// The extra TOML is appended to the end of the config.
+func writeTestConfig(t *testing.T, filename, subject, templateDir, extra string) {
+	const format = `[Smtp]
+Host = "localhost"
+Port = 25
+
+[Addresses]
+CustomerFrom = "from@example.com"
+SystemTo = "to@example.com"
+SystemFrom = "from@example.com"
+
+[Subjects]
+Customer = "Thank you"
+System = %q
+
+[Templates]
+Dir = %q
+CustomerText = "customer-email-text.template"
+CustomerHtml = "customer-email-html.template"
+SystemText = "system-email-text.template"
+SystemHtml = "system-email-html.template"
+
+[Fields]
+    [Fields.Field1]
+    Name="name"
+    Type="textRestricted"
+    [Fields.Field2]
+    Name="email"
+    Type="email"
+%s`
+	err := os.WriteFile(filename, []byte(fmt.Sprintf(format, subject, templateDir, extra)), 0o600)
+	if err != nil {
+		t.Fatalf("Could not write the test config: %s", err)
+	}
+}
+
+// reloadTestConfigs numbers the test configs. Viper keeps every directory it has been told
+// to search, so each config needs its own name or it could find another test's config.
+var reloadTestConfigs int
+
+// readTestConfig writes the first test config, which the server then reads and serves on "/".
+// It returns the config file and the directory of the templates.
+func readTestConfig(t *testing.T, s *Server) (string, string) {
+	templateDir, err := filepath.Abs("..")
+	if err != nil {
+		t.Fatalf("Could not find the templates: %s", err)
+	}
+	reloadTestConfigs++
+	filename := filepath.Join(t.TempDir(), fmt.Sprintf("reload%d.toml", reloadTestConfigs))
+	writeTestConfig(t, filename, "First", templateDir, "")
+	err = s.ReadConfig(filename)
+	if err != nil {
+		t.Fatalf("Could not read the test config: %s", err)
+	}
+	err = s.SetRouteHandler("/")
+	if err != nil {
+		t.Fatalf("Could not set the routes: %s", err)
+	}
+	return filename, templateDir
+}
+
+func TestReload(t *testing.T) {
+	s := newTestServer(t)
+	filename, templateDir := readTestConfig(t, s)
+	old := s.config.Load()
+
+	writeTestConfig(t, filename, "Second", templateDir, `
+[Forms]
+    [Forms.Support]
+    Route = "/support"
+`)
+	err := s.Reload()
+	if err != nil {
+		t.Fatalf("Could not reload the config: %s", err)
+	}
+	if s.config.Load().Subjects.System != "Second" {
+		t.Fatalf("Expected the reloaded subject %q but got %q", "Second", s.config.Load().Subjects.System)
+	}
+	if old.Subjects.System != "First" {
+		t.Fatalf("The old config was changed by the reload, got the subject %q", old.Subjects.System)
+	}
+	b, err := json.Marshal([]Field{{Name: "name", Value: "Me"}, {Name: "email", Value: "me@example.com"}})
+	if err != nil {
+		t.Fatalf("Could not encode fields: %s", err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/support", bytes.NewReader(b))
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code == http.StatusNotFound {
+		t.Fatalf("The route of the reloaded support form was not added")
+	}
+}
+
+func TestReloadRejected(t *testing.T) {
+	var configs = map[string]string{
+		"missing templates": "",
+		"bad toml":          "[Smtp\nHost=",
+		"duplicate route":   "[Forms]\n[Forms.Support]\nRoute = \"/\"\n",
+		"unknown type":      "    [Fields.Field3]\n    Name=\"colour\"\n    Type=\"colour\"\n",
+	}
+	for what, extra := range configs {
+		s := newTestServer(t)
+		filename, templateDir := readTestConfig(t, s)
+		if what == "missing templates" {
+			templateDir = t.TempDir()
+		}
+		writeTestConfig(t, filename, "Second", templateDir, extra)
+		err := s.Reload()
+		if err == nil {
+			t.Fatalf("%s: expected the reload to be rejected but got nil", what)
+		}
+		if s.config.Load().Subjects.System != "First" {
+			t.Fatalf("%s: the rejected config replaced the current config", what)
+		}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	s := newTestServer(t)
+	filename, templateDir := readTestConfig(t, s)
+	err := s.Watch()
+	if err != nil {
+		t.Fatalf("Could not watch the config: %s", err)
+	}
+	defer s.StopWatching()
+
+	writeTestConfig(t, filename, "Watched", templateDir, "")
+	deadline := time.Now().Add(5 * time.Second)
+	for s.config.Load().Subjects.System != "Watched" {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for the changed config file to be reloaded")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestSampleTemplateDataTypedFields(t *testing.T) {
+	s := newTestServer(t, withTypedFields)
+	etd := sampleTemplateData("", "", s.config.Load().Fields, false)
+	// every field but the file fields gets a valid sample value
+	if len(etd.Values) != len(s.config.Load().Fields) {
+		t.Fatalf("Expected a typed value for each of the %d fields but got %v", len(s.config.Load().Fields), etd.Values)
+	}
+	if etd.Values["Quantity"].Int != 1 || etd.FormData["Languages"] != "Go, Python, Scratch" {
+		t.Fatalf("The sample values are wrong: %+v", etd.Values)
+	}
+}
+
+func TestCheckConfigListsEveryProblem(t *testing.T) {
+	s := newTestServer(t)
+	filename, _ := readTestConfig(t, s)
+	// the templates can be read, but use data that is not there, which only building the emails finds
+	templateDir := t.TempDir()
+	for _, name := range []string{"customer-email-text", "customer-email-html", "system-email-text", "system-email-html"} {
+		err := os.WriteFile(filepath.Join(templateDir, name+".template"), []byte("{{.Missing}}"), 0o600)
+		if err != nil {
+			t.Fatalf("Could not write the template: %s", err)
+		}
+	}
+	writeTestConfig(t, filename, "Second", templateDir, "    [Fields.Field3]\n    Name=\"colour\"\n    Type=\"colour\"\n")
+	err := s.Reload()
+	if err == nil || !strings.Contains(err.Error(), `"colour" is not a known field type`) || !strings.Contains(err.Error(), "Missing") {
+		t.Fatalf("Expected both the config and the template problems but got %v", err)
+	}
+}
@@ -0,0 +1,51 @@
+// Copyright (c) 2024 Owen Waller. All rights reserved.
+package server
+
+import (
+	"errors"
+	"log"
+	"strings"
+
+	"github.com/owenwaller/emailformgateway/config"
+	"github.com/owenwaller/emailformgateway/queue"
+	"github.com/owenwaller/emailformgateway/scoring"
+)
+
+var errSpamScore = errors.New("the content scored over the threshold")
+
+// scoreFields scores the content of the submission. It must be called before the fields
+// are validated, as validation escapes the values.
+func scoreFields(sd config.ScoringData, formFields map[string]config.FieldData, fields []Field) scoring.Result {
+	var texts, emails []string
+	for _, f := range fields {
+		if isEmailField(formFields, f.Name) {
+			emails = append(emails, strings.TrimSpace(f.Value))
+		} else {
+			texts = append(texts, f.Value)
+		}
+	}
+	result, err := scoring.Score(sd, texts, emails)
+	if err != nil {
+		log.Printf("Error scoring the submission; %s\n", err)
+	}
+	return result
+}
+
+func isEmailField(formFields map[string]config.FieldData, name string) bool {
+	fd, found := formField(formFields, name)
+	return found && strings.EqualFold(fd.Type, config.FieldTypeEmail)
+}
+
+// quarantineSpam sends the system email of a submission that scored as spam to the form's
+// quarantine recipient, or keeps it in the spool's quarantine directory if there isn't one.
+// The customer is never sent an acknowledgement.
+func (s *Server) quarantineSpam(form config.FormData, etd config.EmailTemplateData) error {
+	if form.Scoring.QuarantineTo != "" {
+		return s.enqueue(queue.SystemEmail, etd) // deliver sends it to QuarantineTo
+	}
+	if s.queue == nil {
+		return errors.New("The mail queue has not been opened.")
+	}
+	_, err := s.queue.Quarantine(queue.SystemEmail, etd)
+	return err
+}
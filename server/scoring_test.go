@@ -0,0 +1,99 @@
+// Copyright (c) 2024 Owen Waller. All rights reserved.
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/owenwaller/emailformgateway/config"
+	"github.com/owenwaller/emailformgateway/queue"
+)
+
+func withScoring(action, quarantineTo string) func(*config.Config) {
+	return func(c *config.Config) {
+		c.Scoring = config.ScoringData{
+			Threshold:       5,
+			Action:          action,
+			QuarantineTo:    quarantineTo,
+			Phrases:         config.ScoreRuleData{Score: 3, List: []string{"crypto investment"}},
+			DisposableEmail: config.ScoreRuleData{Score: 3},
+		}
+	}
+}
+
+// postSpam posts the test fields with a spam phrase from a disposable email address.
+func postSpam(t *testing.T, s *Server) formResponse {
+	fields := []Field{
+		{Name: "name", Value: "Me"},
+		{Name: "email", Value: "me@mailinator.com"},
+		{Name: "subject", Value: "The subject"},
+		{Name: "feedback", Value: "A great crypto investment"},
+	}
+	b, err := json.Marshal(fields)
+	if err != nil {
+		t.Fatalf("Could not encode fields: %s", err)
+	}
+	w, fr := postJSON(t, s, b)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d but got %d", http.StatusOK, w.Code)
+	}
+	return fr
+}
+
+func TestScoringReject(t *testing.T) {
+	s := newTestServer(t, withScoring(config.ScoreActionReject, ""))
+	fr := postSpam(t, s)
+	if !fr.Valid {
+		t.Fatalf("Expected a plausible success response but got %+v", fr)
+	}
+	if s.spam.get(errSpamScore) != 1 {
+		t.Fatalf("Expected the rejection to be counted")
+	}
+	if n := pendingCount(t, s); n != 0 {
+		t.Fatalf("Expected no queued emails but got %d", n)
+	}
+	// a submission under the threshold is delivered as normal
+	b, err := json.Marshal(newTestFields())
+	if err != nil {
+		t.Fatalf("Could not encode fields: %s", err)
+	}
+	postJSON(t, s, b)
+	if n := pendingCount(t, s); n != 2 {
+		t.Fatalf("Expected %d queued emails but got %d", 2, n)
+	}
+}
+
+func TestScoringQuarantineTo(t *testing.T) {
+	s := newTestServer(t, withScoring(config.ScoreActionQuarantine, "spam@example.com"))
+	fr := postSpam(t, s)
+	if !fr.Valid {
+		t.Fatalf("Expected a valid response but got %+v", fr)
+	}
+	pending, err := s.queue.Pending()
+	if err != nil {
+		t.Fatalf("Could not read the spool: %s", err)
+	}
+	if len(pending) != 1 {
+		t.Fatalf("Expected only the system email to be queued but got %d emails", len(pending))
+	}
+	j := pending[0]
+	if j.Kind != queue.SystemEmail || !j.Data.Spam || j.Data.SpamScore != 6 || len(j.Data.SpamRules) != 2 {
+		t.Fatalf("Expected a system email flagged as spam but got %s %+v", j.Kind, j.Data)
+	}
+}
+
+func TestScoringQuarantineSpool(t *testing.T) {
+	s := newTestServer(t, withScoring(config.ScoreActionQuarantine, ""))
+	postSpam(t, s)
+	if n := pendingCount(t, s); n != 0 {
+		t.Fatalf("Expected no queued emails but got %d", n)
+	}
+	quarantined, err := s.queue.Quarantined()
+	if err != nil {
+		t.Fatalf("Could not read the quarantine: %s", err)
+	}
+	if len(quarantined) != 1 || quarantined[0].Kind != queue.SystemEmail || !quarantined[0].Data.Spam {
+		t.Fatalf("Expected the system email to be quarantined but got %d jobs", len(quarantined))
+	}
+}
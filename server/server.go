@@ -5,17 +5,22 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"log"
 
 	"net"
 	"net/http"
+	"net/url"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
 
 	"github.com/owenwaller/emailformgateway/config"
 	"github.com/owenwaller/emailformgateway/emailer"
+	"github.com/owenwaller/emailformgateway/queue"
+	"github.com/owenwaller/emailformgateway/ratelimit"
 	"github.com/owenwaller/emailformgateway/validation"
-	"github.com/rs/cors"
 	"github.com/spf13/viper"
 	"golang.org/x/text/cases"
 	"golang.org/x/text/language"
@@ -27,58 +32,424 @@ type Field struct {
 }
 
 type formResponse struct {
-	Valid     bool
-	BadFields []string
+	Valid       bool
+	BadFields   []string
+	FieldErrors []FieldError      `json:",omitempty"` // why each of the BadFields is bad
+	Error       string            `json:",omitempty"` // one of the Err* codes, empty when the request was handled
+	Suggestions map[string]string `json:",omitempty"` // a field to a corrected email address e.g. "me@gmail.com" for "me@gmial.com"
 }
 
+// FieldError says why a field is bad, the Message can be shown next to the field.
+type FieldError struct {
+	Field   string
+	Code    string // one of the FieldErr* codes
+	Message string // the field's Message from the config, or one for the Code
+}
+
+// The codes for a bad field, in FieldError.Code
+const (
+	FieldErrMissing       = "missing"        // a required field was not posted at all
+	FieldErrRequired      = "required"       // the field is empty, or a required checkbox is not ticked
+	FieldErrInvalid       = "invalid"        // the value is not valid for the field's type
+	FieldErrTooShort      = "too_short"      // the value is shorter than the MinLength
+	FieldErrTooLong       = "too_long"       // the value is longer than the MaxLength
+	FieldErrPattern       = "pattern"        // the value does not match the Pattern
+	FieldErrUndeliverable = "undeliverable"  // the email address can't be delivered to, see EmailCheck
+	FieldErrTooManyFiles  = "too_many_files" // more files were uploaded than the MaxCount
+	FieldErrUnknown       = "unknown"        // the field is not one of the form's, see Invalid.UnknownFields
+)
+
+// The error codes returned to the client in formResponse.Error
+const (
+	ErrBadRequest         = "bad_request"         // the request body could not be read or decoded
+	ErrDeliveryFailed     = "delivery_failed"     // the emails could not be queued for delivery
+	ErrForbidden          = "forbidden"           // the request came from a site the gateway does not serve
+	ErrCaptchaFailed      = "captcha_failed"      // the CAPTCHA was missing or not solved
+	ErrCaptchaUnavailable = "captcha_unavailable" // the CAPTCHA provider could not be asked
+	ErrRateLimited        = "rate_limited"        // the form was posted too often, see the Retry-After header
+)
+
+// the HTTP status code written for each error code
+var errorStatus = map[string]int{
+	ErrBadRequest:         http.StatusBadRequest,
+	ErrDeliveryFailed:     http.StatusServiceUnavailable,
+	ErrForbidden:          http.StatusForbidden,
+	ErrCaptchaFailed:      http.StatusForbidden,
+	ErrCaptchaUnavailable: http.StatusServiceUnavailable,
+	ErrRateLimited:        http.StatusTooManyRequests,
+}
+
+// Server serves the forms. The config is an immutable snapshot, Reload swaps in a new one.
+// A request or a delivery loads the snapshot once and uses it throughout, so it never sees half of a reload.
 type Server struct {
-	config  *config.Config
-	mux     *http.ServeMux
-	corsMux http.Handler
-	domain  string
-	host    string
+	config     atomic.Pointer[config.Config]
+	routes     atomic.Pointer[http.ServeMux] // rebuilt by Reload, as the forms may have changed
+	route      string                        // the route of the top level form
+	configFile string                        // the file the config was read from, Reload reads it again
+	domain     string
+	host       string
+	queue      *queue.Queue
+	reloadMu   sync.Mutex
+	watcher    *watcher
+	tokens     usedTokens // kept across reloads, a token can't be used again after a reload
+	spam       spamCounts
+	rateStore  ratelimit.Store // the rate limit buckets, kept across reloads
+	rateOnce   sync.Once
+	resolver   validation.Resolver // looks up the domains of email addresses, tests replace it
+	transports formTransports      // of the current config snapshot
+}
+
+// formTransports are the transports the emails of a config snapshot's forms are sent with, by form and tenant.
+// A transport is built the first time it is used, so the CA and client certificate files are read once
+// for each snapshot rather than for every email. A new snapshot, from Reload, gets new transports.
+type formTransports struct {
+	mu         sync.Mutex
+	config     *config.Config
+	transports map[[2]string]emailer.Transport
 }
 
 func NewServer(host, port, domain string) *Server {
 	s := new(Server)
 	s.host = host + ":" + port
 	s.domain = domain
+	s.resolver = net.DefaultResolver
 	return s
 }
 
-func (s *Server) SetRouteHandler(route string) {
-	s.mux = http.NewServeMux()
-	s.mux.HandleFunc(route, s.gatewayHandler)
-	s.corsMux = cors.Default().Handler(s.mux)
+// SetRouteHandler serves the top level form on route, and every named form on its own route.
+// ReadConfig must have been called first, otherwise only the top level form is served.
+// The top level form is not served if the config only has named forms.
+func (s *Server) SetRouteHandler(route string) error {
+	mux, err := s.buildRoutes(s.config.Load(), route)
+	if err != nil {
+		return err
+	}
+	s.route = route
+	s.routes.Store(mux)
+	return nil
+}
+
+func (s *Server) buildRoutes(c *config.Config, route string) (*http.ServeMux, error) {
+	mux := http.NewServeMux()
+	routes := make(map[string]string) // route to form name, to catch two forms on one route
+	if c == nil || len(c.Forms) == 0 || len(c.Fields) != 0 {
+		mux.Handle(route, s.corsHandler(c, "", s.gatewayHandler))
+		routes[route] = "the top level form"
+		if c != nil && c.AntiSpam.Secret != "" {
+			mux.Handle(tokenPath(route), s.tokenCorsHandler(c, "", s.tokenHandler("")))
+			routes[tokenPath(route)] = "the tokens of the top level form"
+		}
+	}
+	if c != nil {
+		for _, name := range sortedKeys(c.Forms) {
+			f, _ := c.Form(name)
+			if other, found := routes[f.Route]; found {
+				return nil, fmt.Errorf("The form %q and %s both use the route %q.", name, other, f.Route)
+			}
+			// each route has its own cross origin policy, see corsHandler
+			mux.Handle(f.Route, s.corsHandler(c, name, s.formHandler(name)))
+			routes[f.Route] = fmt.Sprintf("the form %q", name)
+			if f.AntiSpam.Secret == "" {
+				continue
+			}
+			if other, found := routes[tokenPath(f.Route)]; found {
+				return nil, fmt.Errorf("The tokens of the form %q and %s both use the route %q.", name, other, tokenPath(f.Route))
+			}
+			mux.Handle(tokenPath(f.Route), s.tokenCorsHandler(c, name, s.tokenHandler(name)))
+			routes[tokenPath(f.Route)] = fmt.Sprintf("the tokens of the form %q", name)
+		}
+	}
+	return mux, nil
+}
+
+// ServeHTTP passes the request to the current routes.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.routes.Load().ServeHTTP(w, r)
+}
+
+// tenantFor returns the name of the tenant a request was made to, or an empty name if
+// there are no tenants. A request from a site that is not a tenant, or from an origin the
+// tenant does not allow, is an error.
+func tenantFor(c *config.Config, r *http.Request) (string, error) {
+	if len(c.Tenants) == 0 {
+		return "", nil
+	}
+	host := requestHost(r)
+	name, found := c.MatchTenant(host)
+	if !found {
+		return "", fmt.Errorf("No tenant serves the host %q.", host)
+	}
+	t, _ := c.Tenant(name)
+	origin := r.Header.Get("Origin")
+	if origin != "" && !t.AllowsOrigin(origin) {
+		return "", fmt.Errorf("The tenant %q does not allow the origin %q.", name, origin)
+	}
+	return name, nil
+}
+
+// requestHost returns the host of the page that made the request, from the Origin header
+// if the browser sent one, otherwise from the Host header.
+func requestHost(r *http.Request) string {
+	if origin := r.Header.Get("Origin"); origin != "" {
+		u, err := url.Parse(origin)
+		if err == nil && u.Hostname() != "" {
+			return u.Hostname()
+		}
+	}
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		return r.Host // no port
+	}
+	return host
+}
+
+// formConfig returns the config of a form as submitted to a tenant, and the domain for its Message-IDs.
+func (s *Server) formConfig(c *config.Config, formName, tenantName string) (config.FormData, string, error) {
+	form, found := c.Form(formName)
+	if !found {
+		return config.FormData{}, "", fmt.Errorf("Unknown form %q", formName)
+	}
+	if tenantName == "" {
+		return form, s.domain, nil
+	}
+	t, found := c.Tenant(tenantName)
+	if !found {
+		return config.FormData{}, "", fmt.Errorf("Unknown tenant %q", tenantName)
+	}
+	domain := t.Domain
+	if domain == "" {
+		domain = s.domain
+	}
+	return t.Apply(form), domain, nil
 }
 
 func (s *Server) ReadConfig(configFileName string) error {
-	// read the config once, befire we handle any incomming HTTP requests
-	// Reading elements within the config struct is concurrent SAFE. Writing is NOT
-	// So we write the config ONCE, here before any requests are processed.
-	// Further WRITES to the config from other go routines e.g. http handlers are NOT safe.
-	// See; https://groups.google.com/g/golang-nuts/c/omjV3dIVQL0/m/Be1__bkzAAAJ
+	// read the config before we handle any incomming HTTP requests
+	// The config is never written once it has been stored, Reload reads a whole new config and swaps it in.
+	c, err := loadConfig(configFileName) // if configFileName is an empty string the default name "config" will be used.
+	if err != nil {
+		return fmt.Errorf("Could not find a config file called %q: %s\n", configFileName, err)
+	}
+	// a config with problems is refused now, rather than when a form is submitted
+	err = s.checkConfig(c)
+	if err != nil {
+		return err
+	}
+	s.configFile = viper.ConfigFileUsed()
+	s.config.Store(c)
+	return nil
+}
 
-	// := doesn't work in this case, so we need to declare err beforehand.
-	// See: https://github.com/golang/go/issues/6842
-	var err error
-	s.config, err = config.ReadConfig(configFileName) // if configFileName is an empty string the default name "config" will be used.
+// CheckConfig reads and checks a config, and the routes of its forms, without using it.
+// The emails of every form are built from sample data, but not sent.
+func (s *Server) CheckConfig(configFileName, route string) error {
+	c, err := loadConfig(configFileName)
 	if err != nil {
 		return fmt.Errorf("Could not find a config file called %q: %s\n", configFileName, err)
 	}
-	// set the full path to the templates - this doesn't change for the lifetime of the server
-	s.config.Templates.CustomerTextFileName = config.BuildTemplateFilename(s.config.Templates.Dir, s.config.Templates.CustomerText)
-	s.config.Templates.CustomerHtmlFileName = config.BuildTemplateFilename(s.config.Templates.Dir, s.config.Templates.CustomerHtml)
-	s.config.Templates.SystemTextFileName = config.BuildTemplateFilename(s.config.Templates.Dir, s.config.Templates.SystemText)
-	s.config.Templates.SystemHtmlFileName = config.BuildTemplateFilename(s.config.Templates.Dir, s.config.Templates.SystemHtml)
+	err = s.checkConfig(c)
+	if err != nil {
+		return err
+	}
+	_, err = s.buildRoutes(c, route)
+	return err
+}
+
+func loadConfig(configFileName string) (*config.Config, error) {
+	c, err := config.ReadConfig(configFileName)
+	if err != nil {
+		return nil, err
+	}
+	setTemplateFileNames(c)
+	return c, nil
+}
+
+// reloadConfig reads the config again from the file it was first read from.
+func reloadConfig(configFile string) (*config.Config, error) {
+	c, err := config.RereadConfig(configFile)
+	if err != nil {
+		return nil, err
+	}
+	setTemplateFileNames(c)
+	return c, nil
+}
+
+func setTemplateFileNames(c *config.Config) {
+	// set the full path to the templates - this doesn't change for the lifetime of the config
+	c.Templates.CustomerTextFileName = config.BuildTemplateFilename(c.Templates.Dir, c.Templates.CustomerText)
+	c.Templates.CustomerHtmlFileName = config.BuildTemplateFilename(c.Templates.Dir, c.Templates.CustomerHtml)
+	c.Templates.SystemTextFileName = config.BuildTemplateFilename(c.Templates.Dir, c.Templates.SystemText)
+	c.Templates.SystemHtmlFileName = config.BuildTemplateFilename(c.Templates.Dir, c.Templates.SystemHtml)
+}
+
+// OpenQueue opens the outbound mail spool named in the config and starts its workers.
+// ReadConfig must have been called first.
+func (s *Server) OpenQueue() error {
+	q, err := queue.New(s.config.Load().Queue, s.deliver)
+	if err != nil {
+		return err
+	}
+	err = q.Start()
+	if err != nil {
+		q.Close()
+		return err
+	}
+	s.queue = q
 	return nil
 }
 
+// CloseQueue stops the queue workers. Undelivered emails stay in the spool.
+func (s *Server) CloseQueue() {
+	if s.queue != nil {
+		s.queue.Close()
+	}
+}
+
 func (s *Server) Start() error {
-	return http.ListenAndServe(s.host, s.corsMux)
+	if s.queue == nil {
+		if err := s.OpenQueue(); err != nil {
+			return err
+		}
+	}
+	defer s.CloseQueue()
+	if s.rateStore == nil {
+		if err := s.OpenRateLimits(); err != nil {
+			return err
+		}
+	}
+	defer s.CloseRateLimits()
+	err := s.Watch()
+	if err != nil {
+		return err
+	}
+	defer s.StopWatching()
+	return http.ListenAndServe(s.host, s)
+}
+
+// handleInvalid applies the form's policy to a submission that failed validation.
+// The customer is never sent an acknowledgement, as the email address may be the bad field.
+func (s *Server) handleInvalid(form config.FormData, etd config.EmailTemplateData) error {
+	switch strings.ToLower(form.Invalid.Policy) {
+	case config.InvalidPolicyFlag:
+		return s.enqueue(queue.SystemEmail, etd)
+	case config.InvalidPolicyQuarantine:
+		if s.queue == nil {
+			return errors.New("The mail queue has not been opened.")
+		}
+		_, err := s.queue.Quarantine(queue.SystemEmail, etd)
+		return err
+	default:
+		// config.InvalidPolicyReject, or anything we don't understand
+		return nil
+	}
+}
+
+// deliversInvalid reports if the form's policy delivers a submission that failed validation.
+func deliversInvalid(form config.FormData) bool {
+	policy := strings.ToLower(form.Invalid.Policy)
+	return policy == config.InvalidPolicyFlag || policy == config.InvalidPolicyQuarantine
+}
+
+func (s *Server) enqueue(kind string, etd config.EmailTemplateData) error {
+	if s.queue == nil {
+		return errors.New("The mail queue has not been opened.")
+	}
+	_, err := s.queue.Enqueue(kind, etd)
+	return err
+}
+
+// deliver is called by the queue workers to send one queued email, using the config of the form and tenant it came from.
+// An email the SMTP server refused outright is not tried again.
+func (s *Server) deliver(j *queue.Job) error {
+	err := s.deliverJob(j)
+	if emailer.IsPermanent(err) {
+		return queue.Permanent(err)
+	}
+	return err
 }
 
+func (s *Server) deliverJob(j *queue.Job) error {
+	c := s.config.Load()
+	form, domain, err := s.formConfig(c, j.Data.Form, j.Data.Tenant)
+	if err != nil {
+		return err
+	}
+	transport, err := s.transport(c, j.Data.Form, j.Data.Tenant, form)
+	if err != nil {
+		return err
+	}
+	switch j.Kind {
+	case queue.CustomerEmail:
+		return emailer.SendCustomerEmail(j.Data, transport, form.Addresses, form.Subjects, form.Templates, domain)
+	case queue.SystemEmail:
+		subjects := form.Subjects
+		addresses := form.Addresses
+		if j.Data.Flagged {
+			subjects.System = form.Invalid.FlaggedPrefix + " " + subjects.System
+		}
+		if j.Data.Spam {
+			subjects.System = config.DefaultSpamPrefix + " " + subjects.System
+			if form.Scoring.QuarantineTo != "" {
+				addresses.SystemTo = form.Scoring.QuarantineTo
+				addresses.SystemToName = ""
+			}
+		}
+		if form.SpamFilter.Type == "" {
+			return emailer.SendSystemEmail(j.Data, transport, addresses, subjects, form.Templates, domain)
+		}
+		email, err := emailer.BuildSystemEmail(j.Data, addresses, subjects, form.Templates, domain)
+		if err != nil {
+			return err
+		}
+		email, blocked := s.filterSpam(form.SpamFilter, j, email)
+		if blocked {
+			return s.blockSpam(j)
+		}
+		return emailer.SendSystemMessage(transport, addresses, email)
+	default:
+		return fmt.Errorf("Unknown email job kind %q", j.Kind)
+	}
+}
+
+// transport returns the transport of the form, as it is for the tenant, in the config snapshot c.
+// It is built once for the current snapshot. An older snapshot, still in use while a reload
+// swaps in a new one, gets a transport of its own.
+func (s *Server) transport(c *config.Config, name, tenant string, form config.FormData) (emailer.Transport, error) {
+	s.transports.mu.Lock()
+	defer s.transports.mu.Unlock()
+	current := s.config.Load()
+	if s.transports.config != current {
+		s.transports.config = current
+		s.transports.transports = make(map[[2]string]emailer.Transport)
+	}
+	if c != current {
+		return emailer.NewTransport(form.Transport, form.Smtp, form.Auth, form.Relays)
+	}
+	key := [2]string{name, tenant}
+	if t, found := s.transports.transports[key]; found {
+		return t, nil
+	}
+	t, err := emailer.NewTransport(form.Transport, form.Smtp, form.Auth, form.Relays)
+	if err != nil {
+		return nil, err
+	}
+	s.transports.transports[key] = t
+	return t, nil
+}
+
+// gatewayHandler handles the top level form.
 func (s *Server) gatewayHandler(w http.ResponseWriter, r *http.Request) {
+	s.handleForm(w, r, "")
+}
+
+// formHandler returns the handler for a named form.
+func (s *Server) formHandler(name string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.handleForm(w, r, name)
+	}
+}
+
+func (s *Server) handleForm(w http.ResponseWriter, r *http.Request, name string) {
 	// The web form sends a JSON array of key value encoded pairs like this:
 	// [
 	// 	{
@@ -99,63 +470,193 @@ func (s *Server) gatewayHandler(w http.ResponseWriter, r *http.Request) {
 	// 	}
 	// ]
 	//
-	// read the json and decode it
-	body, err := io.ReadAll(r.Body)
+	// Plain HTML forms post the same names and values url or multipart encoded, see decodeFields.
+	var fr formResponse
+	c := s.config.Load()
+	tenant, err := tenantFor(c, r)
 	if err != nil {
-		fmt.Printf("Could not read the http request body: %s", err)
+		log.Printf("Refusing request; %s\n", err)
+		fr.setError(ErrForbidden)
+		writeResponse(w, &fr)
+		return
+	}
+	form, _, err := s.formConfig(c, name, tenant)
+	if err != nil {
+		// the route exists, so the form must have been removed from the config
+		log.Printf("Could not find the config for the form; %s\n", err)
+		fr.setError(ErrDeliveryFailed)
+		writeResponse(w, &fr)
+		return
+	}
+	// the client is limited before anything else is done for it, as each check takes some work
+	ip := clientIP(r, c.Proxies)
+	if wait, limited := s.limitClient(c.RateLimit, ip); limited {
+		tooManyRequests(w, r, form.Redirect, wait)
+		return
 	}
-	var fields []Field
-	err = json.Unmarshal(body, &fields)
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodySize(form.Fields))
+	fields, err := decodeFields(r)
 	if err != nil {
-		fmt.Printf("Error could not decode JSON - \"%s\"\n", err)
+		log.Printf("Error could not decode the form fields - \"%s\"\n", err)
+		fr.setError(ErrBadRequest)
+		respond(w, r, form.Redirect, &fr)
+		return
 	}
 
-	// validate and write the http response.
-	var fr formResponse
-	s.scrubFields(fields, &fr)
-	// The server always writes HTTP 200 OK back to the client along with the form response.
-	// The form response always sets the formResponse.Valid field to true or false. The browser based client
-	// then looks at the value of the valid field to determine if the form data was rejected or not.
-	// This isn't very RESTful, but it is the way it works ATM
-	writeResponse(w, &fr)
+	// a bot is told its submission was sent, rather than which check it failed
+	nonce, expires, err := checkSpam(form.AntiSpam, name, fields, time.Now())
+	if err != nil {
+		s.rejectSpam(w, r, form, name, ip, err)
+		return
+	}
+	// the CAPTCHA is checked once the cheaper checks have passed, as it asks the provider
+	captchaField, code := checkCaptcha(r, ip, form.Captcha, fields)
+	if code != "" {
+		fr.setError(code)
+		respond(w, r, form.Redirect, &fr)
+		return
+	}
+	fields = withoutFields(fields, append(antiSpamFields(form.AntiSpam), captchaField))
+	fields = unknownFields(form.Invalid.UnknownFields, form.Fields, fields, &fr)
+	if wait, limited := s.limitSubmission(c.RateLimit, form.Fields, fields); limited {
+		tooManyRequests(w, r, form.Redirect, wait)
+		return
+	}
+	score := scoreFields(form.Scoring, form.Fields, fields)
+	spam := score.Spam(form.Scoring)
+	if spam && !strings.EqualFold(form.Scoring.Action, config.ScoreActionQuarantine) {
+		log.Printf("The submission to the form %q matched the scoring rules %s\n", name, strings.Join(score.Rules, ", "))
+		s.rejectSpam(w, r, form, name, ip, errSpamScore)
+		return
+	}
+
+	// validate the fields, the response is written once we know if the emails were queued.
+	values := scrubFields(form.Fields, fields, &fr)
+	s.checkEmails(r.Context(), form.EmailCheck, form.Fields, fields, &fr)
+	attachments := scrubFiles(form.Fields, r, &fr)
 
-	log.Printf("SystemTo: %q\n", viper.GetString("Addresses.SystemTo"))
-	log.Printf("SystemToName: %q\n", viper.GetString("Addresses.SystemToName"))
-	log.Printf("Templates Dir: %q\n", viper.GetString("Templates.Dir"))
-	log.Printf("Config File: %q\n", viper.ConfigFileUsed())
+	log.Printf("SystemTo: %q\n", form.Addresses.SystemTo)
+	log.Printf("SystemToName: %q\n", form.Addresses.SystemToName)
+	log.Printf("Templates Dir: %q\n", form.Templates.Dir)
 
 	// build the EmailTemplateData that we pass to emailer.SendMail. This holds the info we want to add to the email messages.
 	var etd config.EmailTemplateData
+	etd.Form = name
+	etd.Tenant = tenant
 	etd.FormData = createFormDataMap(fields)
-	var ip, _, _ = net.SplitHostPort(r.RemoteAddr)
+	etd.Values = values
+	etd.CustomerTo = customerAddress(form.Fields, values)
+	setTypedText(etd.FormData, values)
 	var xForwardedFor = r.Header.Get("X-FORWARDED-FOR")
 	var ua = r.UserAgent()
 	etd.UserAgent = ua
-	etd.RemoteIp = ip
+	etd.ClientIP = ip
+	etd.RemoteIp = remoteIP(r)
 	etd.XForwardedFor = xForwardedFor
+	etd.Attachments = attachments
+	etd.Spam = spam
+	etd.SpamScore = score.Score
+	etd.SpamRules = score.Rules
+
+	// The token is used up by a submission that is delivered. A submission that is rejected
+	// for its bad fields can be corrected and sent again with the same token.
+	if nonce != "" && (len(fr.BadFields) == 0 || deliversInvalid(form) || spam) && !s.tokens.use(nonce, expires, time.Now()) {
+		s.rejectSpam(w, r, form, name, ip, errTokenReused)
+		return
+	}
+
+	// spam is quarantined whether or not it is valid, the response still gives the bad fields
+	if spam {
+		etd.Flagged = len(fr.BadFields) != 0
+		etd.BadFields = fr.BadFields
+		err = s.quarantineSpam(form, etd)
+		if err != nil {
+			log.Printf("Failed to quarantine spam; %s\n", err)
+			fr.setError(ErrDeliveryFailed)
+		}
+		respond(w, r, form.Redirect, &fr)
+		return
+	}
+
+	// a submission that failed validation is only delivered if the config says so
+	if len(fr.BadFields) != 0 {
+		etd.Flagged = true
+		etd.BadFields = fr.BadFields
+		err = s.handleInvalid(form, etd)
+		if err != nil {
+			log.Printf("Failed to %s invalid submission; %s\n", form.Invalid.Policy, err)
+			fr.setError(ErrDeliveryFailed)
+		}
+		respond(w, r, form.Redirect, &fr)
+		return
+	}
 
-	// try to send the email
-	err = emailer.SendEmail(etd, s.config.Smtp, s.config.Auth, s.config.Addresses, s.config.Subjects, s.config.Templates, s.domain)
+	// queue the emails, the queue workers deliver them and retry if the SMTP server is unavailable.
+	// The system email is queued first. If that fails nothing has been queued, so the client can safely resubmit.
+	err = s.enqueue(queue.SystemEmail, etd)
 	if err != nil {
-		log.Fatalf("Failed to send email; %s", err)
+		log.Printf("Failed to queue %s email; %s\n", queue.SystemEmail, err)
+		fr.setError(ErrDeliveryFailed)
+		respond(w, r, form.Redirect, &fr)
+		return
+	}
+	// Once the system email is queued the message has reached us, so a failure to
+	// queue the acknowledgement is logged but not reported as a failure.
+	// The customer is not sent their files back, so they are not spooled twice.
+	// A form without an email address to answer gets no acknowledgement.
+	if etd.CustomerTo != "" {
+		etd.Attachments = nil
+		err = s.enqueue(queue.CustomerEmail, etd)
+		if err != nil {
+			log.Printf("Failed to queue %s email; %s\n", queue.CustomerEmail, err)
+		}
 	}
-	//fmt.Printf("SENT!\n")
+
+	// If the form data was queued the server writes HTTP 200 OK back to the client along with the form response.
+	// A plain HTML form post is redirected to the configured success or failure page instead.
+	// The form response always sets the formResponse.Valid field to true or false. The browser based client
+	// then looks at the value of the valid field to determine if the form data was rejected or not.
+	// Requests that could not be handled get a 4xx or 5xx status code and formResponse.Error says why.
+	respond(w, r, form.Redirect, &fr)
 }
 
-func (s *Server) scrubFields(fields []Field, fr *formResponse) {
+// scrubFields validates the posted fields against the form's fields, and returns the typed values of the
+// valid ones, for the templates.
+func scrubFields(formFields map[string]config.FieldData, fields []Field, fr *formResponse) map[string]config.FieldValue {
+	titler := cases.Title(language.English)
+	values := make(map[string]config.FieldValue)
 	//fmt.Printf("formResponse.Valid=%v\n", fr.Valid)
 	// look in the config to see what fields we should expect
-	for _, v := range s.config.Fields {
-		// find the type of the fields in the fields map we were sent that has the same name
-		match, err := find(v.Name, fields)
-		if err != nil {
-			//fmt.Printf("Error: %s\n", err)
+	for _, v := range formFields {
+		var value config.FieldValue
+		var valid bool
+		switch strings.ToLower(v.Type) {
+		case config.FieldTypeFile:
+			continue // uploaded files are checked by scrubFiles
+		case config.FieldTypeMultiSelect:
+			// each value that was chosen is a field of its own, nothing chosen sends no field at all
+			value, valid = validateMultiSelect(findAll(v.Name, fields), v, fr)
+		default:
+			// find the type of the fields in the fields map we were sent that has the same name
+			match, err := find(v.Name, fields)
+			if err != nil {
+				if v.IsRequired() && !isCheckbox(v) {
+					fr.setFieldError(v, v.Name, FieldErrMissing)
+					continue
+				}
+				// a field that is not required may be left out, and a checkbox that is not ticked is not sent
+				match = &Field{Name: v.Name}
+			}
+			// else we have a match
+			//fmt.Printf("Match found: \"%#v\"\n", match)
+			// now we have a match we need to validate it according to its type
+			value, valid = validateField(match, v, fr)
+		}
+		if valid {
+			values[titler.String(v.Name)] = value
 		}
-		// else we have a match
-		//fmt.Printf("Match found: \"%#v\"\n", match)
-		// now we have a match we need to validate it according to its type
-		validateField(match, v.Type, fr)
 	}
+	return values
 }
 
 func find(name string, fields []Field) (*Field, error) {
@@ -169,27 +670,152 @@ func find(name string, fields []Field) (*Field, error) {
 	return nil, errors.New("Could not find a field named \"" + name + "\" in the json block.")
 }
 
-func validateField(match *Field, requiredType string, fr *formResponse) {
-	match.Value = strings.TrimSpace(match.Value)
+// findAll returns every field with the name, a field that can have several values is sent once for each.
+func findAll(name string, fields []Field) []*Field {
+	var matches []*Field
+	for i := range fields {
+		if strings.EqualFold(fields[i].Name, name) {
+			matches = append(matches, &fields[i])
+		}
+	}
+	return matches
+}
+
+func validateField(match *Field, fd config.FieldData, fr *formResponse) (config.FieldValue, bool) {
+	// the typed fields are checked as they were posted, as the scrubbing is only for text
+	posted := strings.TrimSpace(match.Value)
+	if posted == "" && !fd.IsRequired() {
+		posted = fd.Default
+	}
+	match.Value = posted
 	match.Value = validation.RemoveEmailHeaders(match.Value)
 	match.Value = validation.RemoveScriptTagsAndContents(match.Value)
 	match.Value = validation.EscapeHTML(match.Value)
 	valid := false
-	requiredType = strings.ToLower(requiredType)
+	requiredType := strings.ToLower(fd.Type)
+	value := config.FieldValue{Type: requiredType, Text: match.Value}
+	// an empty field is only checked for its type if it is a checkbox, as an empty checkbox is not ticked
+	if posted == "" && !isCheckbox(fd) {
+		if fd.IsRequired() {
+			fr.setFieldError(fd, match.Name, FieldErrRequired)
+			return value, false
+		}
+		return value, true
+	}
+	if code := checkConstraints(fd, posted); code != "" {
+		fr.setFieldError(fd, match.Name, code)
+		return value, false
+	}
 	switch requiredType {
-	case "email":
+	case config.FieldTypeEmail:
 		valid = validation.ValidateAsEmail(match.Value)
-	case "textrestricted":
+	case config.FieldTypeTextRestricted:
 		valid = validation.ValidateAsRestrictedText(match.Value)
-	case "textunrestricted":
+	case config.FieldTypeTextUnrestricted:
 		valid = validation.ValidateAsUnrestrictedText(match.Value)
+	case config.FieldTypeInteger:
+		value.Int, valid = validation.ValidateAsInteger(posted, fd.Min, fd.Max)
+	case config.FieldTypeDecimal:
+		value.Decimal, valid = validation.ValidateAsDecimal(posted, fd.Min, fd.Max)
+	case config.FieldTypePhone:
+		value.Text, valid = validation.ValidateAsPhone(posted)
+	case config.FieldTypeURL:
+		_, valid = validation.ValidateAsURL(posted)
+	case config.FieldTypeDate:
+		value.Time, valid = validation.ValidateAsDate(posted)
+	case config.FieldTypeDateTime:
+		value.Time, valid = validation.ValidateAsDateTime(posted)
+	case config.FieldTypeSelect, config.FieldTypeEnum:
+		value.Type = config.FieldTypeSelect
+		value.Text, valid = validation.ValidateAsSelect(posted, fd.AllowedValues)
+	case config.FieldTypeCheckbox, config.FieldTypeBoolean:
+		value.Type = config.FieldTypeCheckbox
+		value.Bool, valid = validation.ValidateAsCheckbox(posted)
+		if valid && !value.Bool && fd.IsRequired() {
+			fr.setFieldError(fd, match.Name, FieldErrRequired)
+			return value, false
+		}
 	default:
 		//fmt.Printf("Unknown imput type: \"%s\"\n", requiredType)
 	}
 
 	if !valid {
-		fr.setBadFields(match)
+		fr.setFieldError(fd, match.Name, FieldErrInvalid)
+	}
+	return value, valid
+}
+
+func isCheckbox(fd config.FieldData) bool {
+	t := strings.ToLower(fd.Type)
+	return t == config.FieldTypeCheckbox || t == config.FieldTypeBoolean
+}
+
+// checkConstraints checks the value against the field's lengths and pattern, and returns the
+// FieldErr* code for the first one it fails, or an empty string.
+func checkConstraints(fd config.FieldData, posted string) string {
+	length := utf8.RuneCountInString(posted)
+	if fd.MinLength > 0 && length < fd.MinLength {
+		return FieldErrTooShort
+	}
+	if fd.MaxLength > 0 && length > fd.MaxLength {
+		return FieldErrTooLong
+	}
+	if fd.Pattern != "" {
+		matches, err := validation.MatchPattern(fd.Pattern, posted)
+		if err != nil {
+			log.Printf("Error the pattern of the field %q is not a regexp; %s\n", fd.Name, err)
+		}
+		if !matches {
+			return FieldErrPattern
+		}
+	}
+	return ""
+}
+
+// validateMultiSelect validates every value chosen in a multi select field, it is a bad field if any of them are bad.
+func validateMultiSelect(matches []*Field, fd config.FieldData, fr *formResponse) (config.FieldValue, bool) {
+	if len(matches) == 0 && fd.IsRequired() {
+		fr.setFieldError(fd, fd.Name, FieldErrRequired)
+		return config.FieldValue{}, false
+	}
+	posted := make([]string, 0, len(matches))
+	for _, m := range matches {
+		posted = append(posted, strings.TrimSpace(m.Value))
+	}
+	chosen, valid := validation.ValidateAsMultiSelect(posted, fd.AllowedValues)
+	if !valid {
+		fr.setFieldError(fd, matches[0].Name, FieldErrInvalid)
+		return config.FieldValue{}, false
+	}
+	return config.FieldValue{Type: config.FieldTypeMultiSelect, Text: strings.Join(chosen, ", "), List: chosen}, true
+}
+
+// fieldErrorMessage returns the message for a bad field, the field's own Message if it has one.
+func fieldErrorMessage(fd config.FieldData, code string) string {
+	if fd.Message != "" {
+		return fd.Message
+	}
+	switch code {
+	case FieldErrMissing, FieldErrRequired:
+		return "This field is required."
+	case FieldErrTooShort:
+		return fmt.Sprintf("This is too short, it must be at least %d characters.", fd.MinLength)
+	case FieldErrTooLong:
+		return fmt.Sprintf("This is too long, it must be at most %d characters.", fd.MaxLength)
+	case FieldErrPattern:
+		return "This is not in the right format."
+	case FieldErrUndeliverable:
+		return "Email can't be delivered to this address."
+	case FieldErrTooManyFiles:
+		maxCount := fd.MaxCount
+		if maxCount <= 0 {
+			maxCount = config.DefaultMaxFileCount
+		}
+		return fmt.Sprintf("Too many files, at most %d can be uploaded.", maxCount)
+	case FieldErrUnknown:
+		return "This field is not part of the form."
 	}
+	return "This is not valid."
 }
 
 func writeResponse(w http.ResponseWriter, fr *formResponse) {
@@ -197,8 +823,12 @@ func writeResponse(w http.ResponseWriter, fr *formResponse) {
 	if err != nil {
 		log.Printf("Error could not create JSON response \"%s\"\n", err)
 	}
+	status := http.StatusOK
+	if code, found := errorStatus[fr.Error]; found {
+		status = code
+	}
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	w.WriteHeader(http.StatusOK)
+	w.WriteHeader(status)
 	_, err = w.Write(body)
 	if err != nil {
 		log.Printf("Error: Could not write response \"%s\"\n", err)
@@ -218,21 +848,72 @@ func createFormDataMap(formFields []Field) map[string]string {
 	return m
 }
 
+// customerAddress returns the address the acknowledgement is sent to, the valid value of the form's
+// first email field, in the order of the config's keys, that has one. It returns "" if none has.
+func customerAddress(formFields map[string]config.FieldData, values map[string]config.FieldValue) string {
+	titler := cases.Title(language.English)
+	for _, k := range sortedKeys(formFields) {
+		v := formFields[k]
+		if !strings.EqualFold(v.Type, config.FieldTypeEmail) {
+			continue
+		}
+		if value, found := values[titler.String(v.Name)]; found && value.Text != "" {
+			return value.Text
+		}
+	}
+	return ""
+}
+
+// setTypedText gives FormData the text of the fields whose typed value is written differently to what was
+// posted, e.g. the E.164 form of a phone number, or every choice of a multi select rather than the last.
+// A field that was left out gets its Default.
+func setTypedText(formData map[string]string, values map[string]config.FieldValue) {
+	for name, v := range values {
+		_, posted := formData[name]
+		switch {
+		case !posted:
+			formData[name] = v.Text
+		case v.Type == config.FieldTypePhone, v.Type == config.FieldTypeSelect, v.Type == config.FieldTypeMultiSelect:
+			formData[name] = v.Text
+		}
+	}
+}
+
 func (fr *formResponse) setBadFields(match *Field) {
 	fr.BadFields = append(fr.BadFields, match.Name)
 }
 
+// setFieldError makes the field bad, and says why.
+func (fr *formResponse) setFieldError(fd config.FieldData, name, code string) {
+	fr.setBadFields(&Field{Name: name})
+	fr.FieldErrors = append(fr.FieldErrors, FieldError{Field: name, Code: code, Message: fieldErrorMessage(fd, code)})
+}
+
+func (fr *formResponse) setError(code string) {
+	fr.Error = code
+}
+
 func (fr *formResponse) setValidity() {
-	if len(fr.BadFields) == 0 { // have not yet appended so still good.
+	if len(fr.BadFields) == 0 && fr.Error == "" { // have not yet appended so still good.
 		fr.Valid = true
 	} else {
 		fr.Valid = false
 	}
 }
 
+func (fr *formResponse) setSuggestion(field, address string) {
+	if fr.Suggestions == nil {
+		fr.Suggestions = make(map[string]string)
+	}
+	fr.Suggestions[field] = address
+}
+
 func (fr *formResponse) clearBadFields() {
 	fr.Valid = false
 	fr.BadFields = nil
+	fr.FieldErrors = nil
+	fr.Error = ""
+	fr.Suggestions = nil
 }
 
 func (fr *formResponse) marshal() (buf []byte, err error) {
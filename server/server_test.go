@@ -8,8 +8,14 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/owenwaller/emailformgateway/config"
+	"github.com/owenwaller/emailformgateway/queue"
 	"github.com/spf13/viper"
 )
 
@@ -150,6 +156,666 @@ func TestServerResponseHeader(t *testing.T) {
 
 }
 
+func TestServerResponseWithError(t *testing.T) {
+	var codes = map[string]int{
+		ErrBadRequest:     http.StatusBadRequest,
+		ErrDeliveryFailed: http.StatusServiceUnavailable,
+		ErrForbidden:      http.StatusForbidden,
+	}
+	for code, expectedReturnCode := range codes {
+		var fr formResponse
+		fr.setError(code)
+
+		w := httptest.NewRecorder()
+		writeResponse(w, &fr)
+
+		if w.Code != expectedReturnCode {
+			t.Fatalf("Did not get the correct HTTP response code for %q. Expected %v got %v\n", code, expectedReturnCode, w.Code)
+		}
+		var expectedBody = "{\"Valid\":false,\"BadFields\":null,\"Error\":\"" + code + "\"}"
+		var body = w.Body.String()
+		if expectedBody != body {
+			t.Fatalf("Did not get the correct HTTP response body. Expected %v got %v\n", expectedBody, body)
+		}
+	}
+}
+
+// newTestServer creates a server with the default test fields, without reading a config file.
+// The options change the config before it is stored, as a stored config is never changed, and the forms
+// are then served on "/". The queue is opened on a temporary spool, but the workers are not started,
+// so nothing is delivered.
+func newTestServer(t *testing.T, options ...func(*config.Config)) *Server {
+	s := NewServer("localhost", "0", "example.com")
+	c := new(config.Config)
+	c.Fields = make(map[string]config.FieldData)
+	c.Fields["field1"] = config.FieldData{Name: "name", Type: "textRestricted"}
+	c.Fields["field2"] = config.FieldData{Name: "email", Type: "email"}
+	c.Fields["field3"] = config.FieldData{Name: "subject", Type: "textRestricted"}
+	c.Fields["field4"] = config.FieldData{Name: "feedback", Type: "textUnrestricted"}
+	for _, option := range options {
+		option(c)
+	}
+	s.config.Store(c)
+	err := s.SetRouteHandler("/")
+	if err != nil {
+		t.Fatalf("Could not set the routes: %s", err)
+	}
+	q, err := queue.New(config.QueueData{Dir: t.TempDir()}, nil)
+	if err != nil {
+		t.Fatalf("Could not create the queue: %s", err)
+	}
+	s.queue = q
+	return s
+}
+
+func newTestFields() []Field {
+	fields := make([]Field, 0)
+	fields = append(fields, Field{Name: "name", Value: "Me"})
+	fields = append(fields, Field{Name: "email", Value: "me@example.com"})
+	fields = append(fields, Field{Name: "subject", Value: "The subject"})
+	fields = append(fields, Field{Name: "feedback", Value: "The feedback"})
+	return fields
+}
+
+// postJSON posts body to the gateway handler and decodes the form response.
+func postJSON(t *testing.T, s *Server, body []byte) (*httptest.ResponseRecorder, formResponse) {
+	r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+	r.Header.Set("Content-Type", "application/json; charset=utf-8")
+	w := httptest.NewRecorder()
+	s.gatewayHandler(w, r)
+
+	var fr formResponse
+	err := json.Unmarshal(w.Body.Bytes(), &fr)
+	if err != nil {
+		t.Fatalf("Could not decode form response JSON %q: %s", w.Body.String(), err)
+	}
+	return w, fr
+}
+
+func TestGatewayHandlerQueuesEmails(t *testing.T) {
+	s := newTestServer(t)
+	b, err := json.Marshal(newTestFields())
+	if err != nil {
+		t.Fatalf("Could not encode fields: %s", err)
+	}
+	w, fr := postJSON(t, s, b)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d but got %d", http.StatusOK, w.Code)
+	}
+	if !fr.Valid || fr.Error != "" {
+		t.Fatalf("Expected a valid response without an error but got %+v", fr)
+	}
+	pending, err := s.queue.Pending()
+	if err != nil {
+		t.Fatalf("Could not read the spool: %s", err)
+	}
+	if len(pending) != 2 {
+		t.Fatalf("Expected %d queued emails but got %d", 2, len(pending))
+	}
+}
+
+func TestGatewayHandlerCustomerAddress(t *testing.T) {
+	optional := false
+	var checks = []struct {
+		name    string
+		field   config.FieldData
+		value   string
+		pending int
+	}{
+		{"email", config.FieldData{Name: "email", Type: "email"}, "me@example.com", 2},
+		{"another name", config.FieldData{Name: "contact", Type: "email"}, "me@example.com", 2},
+		{"left empty", config.FieldData{Name: "email", Type: "email", Required: &optional}, "", 1},
+	}
+	for _, c := range checks {
+		s := newTestServer(t, func(tc *config.Config) { tc.Fields["field2"] = c.field })
+		fields := newTestFields()
+		fields[1] = Field{Name: c.field.Name, Value: c.value}
+		b, err := json.Marshal(fields)
+		if err != nil {
+			t.Fatalf("Could not encode fields: %s", err)
+		}
+		_, fr := postJSON(t, s, b)
+		if !fr.Valid {
+			t.Fatalf("%s: expected a valid response but got %+v", c.name, fr)
+		}
+		// the acknowledgement is only queued when there is an address to send it to
+		pending, err := s.queue.Pending()
+		if err != nil || len(pending) != c.pending {
+			t.Fatalf("%s: expected %d queued emails but got %d. Error: %v", c.name, c.pending, len(pending), err)
+		}
+		for _, j := range pending {
+			if j.Data.CustomerTo != c.value {
+				t.Fatalf("%s: expected the customer address %q but got %q", c.name, c.value, j.Data.CustomerTo)
+			}
+		}
+	}
+}
+
+func TestGatewayHandlerInvalidPolicies(t *testing.T) {
+	var policies = []struct {
+		policy      string
+		pending     int
+		quarantined int
+	}{
+		{config.InvalidPolicyReject, 0, 0},
+		{config.InvalidPolicyFlag, 1, 0},
+		{config.InvalidPolicyQuarantine, 0, 1},
+	}
+	for _, p := range policies {
+		s := newTestServer(t, func(c *config.Config) { c.Invalid.Policy = p.policy })
+		fields := newTestFields()
+		fields[1].Value = "not an email address"
+		b, err := json.Marshal(fields)
+		if err != nil {
+			t.Fatalf("Could not encode fields: %s", err)
+		}
+		w, fr := postJSON(t, s, b)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected status %d but got %d", p.policy, http.StatusOK, w.Code)
+		}
+		if fr.Valid || len(fr.BadFields) != 1 || fr.BadFields[0] != "email" {
+			t.Fatalf("%s: expected the email field to be bad but got %+v", p.policy, fr)
+		}
+		pending, err := s.queue.Pending()
+		if err != nil || len(pending) != p.pending {
+			t.Fatalf("%s: expected %d queued emails but got %d. Error: %v", p.policy, p.pending, len(pending), err)
+		}
+		for _, j := range pending {
+			if j.Kind != queue.SystemEmail || !j.Data.Flagged {
+				t.Fatalf("%s: expected only a flagged system email but got a %s email, flagged %t", p.policy, j.Kind, j.Data.Flagged)
+			}
+		}
+		quarantined, err := s.queue.Quarantined()
+		if err != nil || len(quarantined) != p.quarantined {
+			t.Fatalf("%s: expected %d quarantined emails but got %d. Error: %v", p.policy, p.quarantined, len(quarantined), err)
+		}
+	}
+}
+
+// withTypedFields adds a field of each of the typed field types to the test form.
+func withTypedFields(c *config.Config) {
+	min, max := 1.0, 10.0
+	fields := c.Fields
+	fields["field5"] = config.FieldData{Name: "quantity", Type: "integer", Min: &min, Max: &max}
+	fields["field6"] = config.FieldData{Name: "price", Type: "decimal"}
+	fields["field7"] = config.FieldData{Name: "phone", Type: "phone"}
+	fields["field8"] = config.FieldData{Name: "website", Type: "url"}
+	fields["field9"] = config.FieldData{Name: "start", Type: "date"}
+	fields["field10"] = config.FieldData{Name: "topic", Type: "enum", AllowedValues: []string{"Go", "Python"}}
+	fields["field11"] = config.FieldData{Name: "languages", Type: "multiselect", AllowedValues: []string{"Go", "Python", "Scratch"}}
+	fields["field12"] = config.FieldData{Name: "subscribe", Type: "checkbox"}
+}
+
+func newTypedTestFields() []Field {
+	return append(newTestFields(),
+		Field{Name: "quantity", Value: "3"},
+		Field{Name: "price", Value: "9.99"},
+		Field{Name: "phone", Value: "+44 1632 960123"},
+		Field{Name: "website", Value: "https://www.example.com/"},
+		Field{Name: "start", Value: "2024-03-01"},
+		Field{Name: "topic", Value: "go"},
+		Field{Name: "languages", Value: "scratch"},
+		Field{Name: "languages", Value: "Go"},
+	)
+}
+
+func TestGatewayHandlerTypedFields(t *testing.T) {
+	s := newTestServer(t, withTypedFields)
+	b, err := json.Marshal(newTypedTestFields())
+	if err != nil {
+		t.Fatalf("Could not encode fields: %s", err)
+	}
+	_, fr := postJSON(t, s, b)
+	if !fr.Valid {
+		t.Fatalf("Expected the typed fields to be valid but got %+v", fr)
+	}
+	pending, err := s.queue.Pending()
+	if err != nil || len(pending) != 2 {
+		t.Fatalf("Expected %d queued emails but got %d. Error: %v", 2, len(pending), err)
+	}
+	// the values are read back from the spool, so they must survive being written as JSON
+	etd := pending[0].Data
+	v := etd.Values
+	if v["Quantity"].Int != 3 || v["Price"].Decimal != 9.99 || v["Phone"].Text != "+441632960123" ||
+		v["Website"].Text != "https://www.example.com/" || !v["Start"].Time.Equal(time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)) ||
+		v["Topic"].Text != "Go" || v["Subscribe"].Bool || v["Name"].Text != "Me" {
+		t.Fatalf("The typed values are wrong: %+v", v)
+	}
+	if !reflect.DeepEqual(v["Languages"].List, []string{"Scratch", "Go"}) {
+		t.Fatalf("Expected the languages [Scratch Go] but got %q", v["Languages"].List)
+	}
+	if etd.FormData["Phone"] != "+441632960123" || etd.FormData["Languages"] != "Scratch, Go" || etd.FormData["Topic"] != "Go" {
+		t.Fatalf("Expected FormData to have the typed text but got %v", etd.FormData)
+	}
+}
+
+func TestGatewayHandlerBadTypedFields(t *testing.T) {
+	var bad = []Field{
+		{Name: "quantity", Value: "11"},
+		{Name: "price", Value: "cheap"},
+		{Name: "phone", Value: "01632 960123"},
+		{Name: "website", Value: "javascript:alert(1)"},
+		{Name: "start", Value: "2024-02-30"},
+		{Name: "topic", Value: "Rust"},
+		{Name: "languages", Value: "Rust"},
+		{Name: "subscribe", Value: "maybe"},
+	}
+	for _, f := range bad {
+		s := newTestServer(t, withTypedFields)
+		fields := newTypedTestFields()
+		replaced := false
+		for i := range fields {
+			if fields[i].Name == f.Name {
+				fields[i].Value = f.Value
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			fields = append(fields, f)
+		}
+		b, err := json.Marshal(fields)
+		if err != nil {
+			t.Fatalf("Could not encode fields: %s", err)
+		}
+		_, fr := postJSON(t, s, b)
+		if fr.Valid || !reflect.DeepEqual(fr.BadFields, []string{f.Name}) {
+			t.Fatalf("%s=%q: expected only the field to be bad but got %+v", f.Name, f.Value, fr)
+		}
+	}
+}
+
+func TestGatewayHandlerFieldConstraints(t *testing.T) {
+	optional, required := false, true
+	var checks = []struct {
+		name     string
+		field    config.FieldData
+		fields   []Field // posted instead of the test fields of the same name
+		expected []FieldError
+	}{
+		{"optional and left out", config.FieldData{Name: "subject", Type: "textRestricted", Required: &optional},
+			[]Field{{Name: "subject"}}, nil},
+		{"required and left out", config.FieldData{Name: "subject", Type: "textRestricted"},
+			[]Field{{Name: "subject"}}, []FieldError{{"subject", FieldErrMissing, "This field is required."}}},
+		{"required and empty", config.FieldData{Name: "subject", Type: "textRestricted"},
+			[]Field{{Name: "subject", Value: "  "}}, []FieldError{{"subject", FieldErrRequired, "This field is required."}}},
+		{"too short", config.FieldData{Name: "subject", Type: "textRestricted", MinLength: 20},
+			nil, []FieldError{{"subject", FieldErrTooShort, "This is too short, it must be at least 20 characters."}}},
+		{"too long", config.FieldData{Name: "feedback", Type: "textUnrestricted", MaxLength: 5},
+			nil, []FieldError{{"feedback", FieldErrTooLong, "This is too long, it must be at most 5 characters."}}},
+		{"not too long in characters", config.FieldData{Name: "feedback", Type: "textUnrestricted", MaxLength: 5},
+			[]Field{{Name: "feedback", Value: "héllo"}}, nil},
+		{"pattern", config.FieldData{Name: "subject", Type: "textRestricted", Pattern: "[A-Z]{2}", Message: "Give the two letter code."},
+			nil, []FieldError{{"subject", FieldErrPattern, "Give the two letter code."}}},
+		{"invalid", config.FieldData{Name: "email", Type: "email"},
+			[]Field{{Name: "email", Value: "not an address"}}, []FieldError{{"email", FieldErrInvalid, "This is not valid."}}},
+		{"required checkbox", config.FieldData{Name: "agree", Type: "checkbox", Required: &required},
+			nil, []FieldError{{"agree", FieldErrRequired, "This field is required."}}},
+		{"optional multiselect", config.FieldData{Name: "topics", Type: "multiselect", AllowedValues: []string{"Go"}},
+			nil, nil},
+	}
+	for _, c := range checks {
+		s := newTestServer(t, func(tc *config.Config) {
+			for k, f := range tc.Fields {
+				if f.Name == c.field.Name {
+					delete(tc.Fields, k)
+				}
+			}
+			tc.Fields["field5"] = c.field
+		})
+		var fields []Field
+		for _, f := range newTestFields() {
+			if len(c.fields) == 0 || !strings.EqualFold(f.Name, c.fields[0].Name) {
+				fields = append(fields, f)
+			}
+		}
+		for _, f := range c.fields {
+			if f.Value != "" {
+				fields = append(fields, f)
+			}
+		}
+		b, err := json.Marshal(fields)
+		if err != nil {
+			t.Fatalf("Could not encode fields: %s", err)
+		}
+		_, fr := postJSON(t, s, b)
+		if !reflect.DeepEqual(fr.FieldErrors, c.expected) {
+			t.Fatalf("%s: expected the field errors %+v but got %+v", c.name, c.expected, fr.FieldErrors)
+		}
+		if fr.Valid != (c.expected == nil) {
+			t.Fatalf("%s: expected valid to be %t but got %+v", c.name, c.expected == nil, fr)
+		}
+	}
+}
+
+func TestGatewayHandlerFieldDefault(t *testing.T) {
+	optional := false
+	s := newTestServer(t, func(c *config.Config) {
+		c.Fields["field3"] = config.FieldData{Name: "subject", Type: "textRestricted", Required: &optional, Default: "No subject"}
+		c.Fields["field5"] = config.FieldData{Name: "count", Type: "integer", Required: &optional, Default: "1"}
+	})
+	fields := newTestFields()
+	fields[2].Value = "" // the subject is empty, and the count is left out
+	b, err := json.Marshal(fields)
+	if err != nil {
+		t.Fatalf("Could not encode fields: %s", err)
+	}
+	_, fr := postJSON(t, s, b)
+	if !fr.Valid {
+		t.Fatalf("Expected the defaults to be valid but got %+v", fr)
+	}
+	pending, err := s.queue.Pending()
+	if err != nil || len(pending) != 2 {
+		t.Fatalf("Expected %d queued emails but got %d. Error: %v", 2, len(pending), err)
+	}
+	etd := pending[0].Data
+	if etd.FormData["Subject"] != "No subject" || etd.FormData["Count"] != "1" || etd.Values["Count"].Int != 1 {
+		t.Fatalf("Expected the defaults but got %v %+v", etd.FormData, etd.Values)
+	}
+}
+
+func TestGatewayHandlerMissingFields(t *testing.T) {
+	s := newTestServer(t)
+	// nothing but the name is posted, which used to panic on the nil field
+	b, err := json.Marshal([]Field{{Name: "name", Value: "Me"}})
+	if err != nil {
+		t.Fatalf("Could not encode fields: %s", err)
+	}
+	w, fr := postJSON(t, s, b)
+	if w.Code != http.StatusOK || fr.Valid {
+		t.Fatalf("Expected an invalid response with status %d but got %d %+v", http.StatusOK, w.Code, fr)
+	}
+	var missing []string
+	for _, fe := range fr.FieldErrors {
+		if fe.Code != FieldErrMissing {
+			t.Fatalf("Expected every field error to be %q but got %+v", FieldErrMissing, fe)
+		}
+		missing = append(missing, fe.Field)
+	}
+	sort.Strings(missing)
+	sort.Strings(fr.BadFields)
+	expected := []string{"email", "feedback", "subject"}
+	if !reflect.DeepEqual(missing, expected) || !reflect.DeepEqual(fr.BadFields, expected) {
+		t.Fatalf("Expected the missing fields %v but got %v, bad fields %v", expected, missing, fr.BadFields)
+	}
+}
+
+func TestGatewayHandlerUnknownFields(t *testing.T) {
+	var checks = []struct {
+		policy   string
+		valid    bool
+		kept     bool
+		expected []FieldError
+	}{
+		{"", true, true, nil},
+		{config.UnknownFieldsKeep, true, true, nil},
+		{config.UnknownFieldsDrop, true, false, nil},
+		{"Reject", false, false, []FieldError{{"extra", FieldErrUnknown, "This field is not part of the form."}}},
+	}
+	for _, c := range checks {
+		s := newTestServer(t, func(tc *config.Config) { tc.Invalid.UnknownFields = c.policy })
+		// the extra field is sent twice, it is only reported once
+		fields := append(newTestFields(), Field{Name: "extra", Value: "1"}, Field{Name: "extra", Value: "2"})
+		b, err := json.Marshal(fields)
+		if err != nil {
+			t.Fatalf("Could not encode fields: %s", err)
+		}
+		_, fr := postJSON(t, s, b)
+		if fr.Valid != c.valid || !reflect.DeepEqual(fr.FieldErrors, c.expected) {
+			t.Fatalf("%q: expected valid %t and the field errors %+v but got %+v", c.policy, c.valid, c.expected, fr)
+		}
+		if !c.valid {
+			continue
+		}
+		pending, err := s.queue.Pending()
+		if err != nil || len(pending) != 2 {
+			t.Fatalf("%q: expected %d queued emails but got %d. Error: %v", c.policy, 2, len(pending), err)
+		}
+		if _, found := pending[0].Data.FormData["Extra"]; found != c.kept {
+			t.Fatalf("%q: expected the extra field to be kept %t but got %v", c.policy, c.kept, pending[0].Data.FormData)
+		}
+	}
+}
+
+func TestGatewayHandlerBadJSON(t *testing.T) {
+	s := newTestServer(t)
+	w, fr := postJSON(t, s, []byte("{not json"))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected status %d but got %d", http.StatusBadRequest, w.Code)
+	}
+	if fr.Valid || fr.Error != ErrBadRequest {
+		t.Fatalf("Expected an invalid response with error %q but got %+v", ErrBadRequest, fr)
+	}
+}
+
+func TestGatewayHandlerQueueUnavailable(t *testing.T) {
+	s := newTestServer(t)
+	s.queue = nil
+	b, err := json.Marshal(newTestFields())
+	if err != nil {
+		t.Fatalf("Could not encode fields: %s", err)
+	}
+	w, fr := postJSON(t, s, b)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected status %d but got %d", http.StatusServiceUnavailable, w.Code)
+	}
+	if fr.Valid || fr.Error != ErrDeliveryFailed {
+		t.Fatalf("Expected an invalid response with error %q but got %+v", ErrDeliveryFailed, fr)
+	}
+}
+
+func TestSetRouteHandlerForms(t *testing.T) {
+	s := newTestServer(t, func(c *config.Config) {
+		c.Forms = make(map[string]config.FormData)
+		c.Forms["support"] = config.FormData{Route: "/support", Fields: map[string]config.FieldData{
+			"field1": {Name: "email", Type: "email"},
+			"field2": {Name: "problem", Type: "textUnrestricted"},
+		}}
+		c.Forms["sales"] = config.FormData{} // served on /sales, with the top level fields
+	})
+
+	var posts = []struct {
+		route  string
+		fields []Field
+		form   string
+	}{
+		{"/", newTestFields(), ""},
+		{"/support", []Field{{Name: "email", Value: "me@example.com"}, {Name: "problem", Value: "It broke"}}, "support"},
+		{"/sales", newTestFields(), "sales"},
+	}
+	for _, p := range posts {
+		b, err := json.Marshal(p.fields)
+		if err != nil {
+			t.Fatalf("Could not encode fields: %s", err)
+		}
+		r := httptest.NewRequest(http.MethodPost, p.route, bytes.NewReader(b))
+		r.Header.Set("Content-Type", "application/json; charset=utf-8")
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		var fr formResponse
+		err = json.Unmarshal(w.Body.Bytes(), &fr)
+		if err != nil || !fr.Valid {
+			t.Fatalf("%s: expected a valid response but got %q. Error: %v", p.route, w.Body.String(), err)
+		}
+	}
+	pending, err := s.queue.Pending()
+	if err != nil {
+		t.Fatalf("Could not read the spool: %s", err)
+	}
+	forms := make(map[string]int)
+	for _, j := range pending {
+		forms[j.Data.Form]++
+	}
+	for _, p := range posts {
+		if forms[p.form] != 2 {
+			t.Fatalf("Expected %d queued emails for the form %q but got %d", 2, p.form, forms[p.form])
+		}
+	}
+}
+
+func TestSetRouteHandlerDuplicateRoute(t *testing.T) {
+	s := newTestServer(t)
+	c := *s.config.Load()
+	c.Forms = map[string]config.FormData{"support": {Route: "/"}}
+	s.config.Store(&c)
+	err := s.SetRouteHandler("/")
+	if err == nil {
+		t.Fatalf("Expected an error serving two forms on the same route but got nil")
+	}
+}
+
+func TestDeliverUnknownForm(t *testing.T) {
+	s := newTestServer(t)
+	j := &queue.Job{Kind: queue.SystemEmail, Data: config.EmailTemplateData{Form: "removed"}}
+	err := s.deliver(j)
+	if err == nil {
+		t.Fatalf("Expected an error delivering an email for a form that is not in the config but got nil")
+	}
+}
+
+func TestDeliverTransport(t *testing.T) {
+	dir := t.TempDir()
+	s := newTestServer(t, withSpamFilter(t, config.SpamFilterData{}), func(c *config.Config) {
+		c.Transport = config.TransportData{Type: config.TransportFile, Dir: dir}
+	})
+	data := config.EmailTemplateData{FormData: map[string]string{"Name": "Me", "Email": "me@example.com"}, CustomerTo: "me@example.com"}
+	for _, kind := range []string{queue.SystemEmail, queue.CustomerEmail} {
+		err := s.deliver(&queue.Job{ID: kind, Kind: kind, Data: data})
+		if err != nil {
+			t.Fatalf("Could not deliver the %s email: %s", kind, err)
+		}
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil || len(files) != 2 {
+		t.Fatalf("Expected the transport to write %d emails but got %d. Error: %v", 2, len(files), err)
+	}
+}
+
+func TestDeliverTransportReused(t *testing.T) {
+	s := newTestServer(t, withSpamFilter(t, config.SpamFilterData{}), func(c *config.Config) {
+		c.Transport = config.TransportData{Type: config.TransportFile, Dir: t.TempDir()}
+	})
+	data := config.EmailTemplateData{FormData: map[string]string{"Name": "Me", "Email": "me@example.com"}, CustomerTo: "me@example.com"}
+	err := s.deliver(&queue.Job{ID: "1", Kind: queue.SystemEmail, Data: data})
+	if err != nil {
+		t.Fatalf("Could not deliver the email: %s", err)
+	}
+	c := s.config.Load()
+	form, _, _ := s.formConfig(c, "", "")
+	first, err := s.transport(c, "", "", form)
+	if err != nil {
+		t.Fatalf("Could not get the transport: %s", err)
+	}
+	second, _ := s.transport(c, "", "", form)
+	if first != second {
+		t.Fatalf("Expected the transport to be built once for the config")
+	}
+
+	// a new config, as from a reload, gets a new transport
+	reloaded := *c
+	dir := t.TempDir()
+	reloaded.Transport = config.TransportData{Type: config.TransportFile, Dir: dir}
+	s.config.Store(&reloaded)
+	err = s.deliver(&queue.Job{ID: "2", Kind: queue.SystemEmail, Data: data})
+	if err != nil {
+		t.Fatalf("Could not deliver the email: %s", err)
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil || len(files) != 1 {
+		t.Fatalf("Expected the new config's transport to write %d email but got %d. Error: %v", 1, len(files), err)
+	}
+}
+
+func TestGatewayHandlerTenants(t *testing.T) {
+	var requests = []struct {
+		host   string
+		origin string
+		status int
+		tenant string
+	}{
+		{"example.com", "", http.StatusOK, "example"},
+		{"gateway.local:9301", "https://shop.example.com", http.StatusOK, "example"},
+		{"gateway.local:9301", "https://other.org", http.StatusOK, "other"},
+		{"gateway.local:9301", "https://evil.com", http.StatusForbidden, ""},
+		{"gateway.local:9301", "", http.StatusForbidden, ""},
+		{"example.com", "https://www.other.org", http.StatusForbidden, ""}, // other.org does not allow www
+	}
+	for _, req := range requests {
+		s := newTestServer(t, func(c *config.Config) {
+			c.Tenants = make(map[string]config.TenantData)
+			c.Tenants["example"] = config.TenantData{Hosts: []string{"example.com", "*.example.com"}}
+			c.Tenants["other"] = config.TenantData{Hosts: []string{"other.org", "*.other.org"}, AllowedOrigins: []string{"https://other.org"}}
+		})
+		b, err := json.Marshal(newTestFields())
+		if err != nil {
+			t.Fatalf("Could not encode fields: %s", err)
+		}
+		r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(b))
+		r.Host = req.host
+		r.Header.Set("Content-Type", "application/json; charset=utf-8")
+		if req.origin != "" {
+			r.Header.Set("Origin", req.origin)
+		}
+		w := httptest.NewRecorder()
+		s.gatewayHandler(w, r)
+		if w.Code != req.status {
+			t.Fatalf("%s %s: expected status %d but got %d", req.host, req.origin, req.status, w.Code)
+		}
+		pending, err := s.queue.Pending()
+		if err != nil {
+			t.Fatalf("Could not read the spool: %s", err)
+		}
+		for _, j := range pending {
+			if j.Data.Tenant != req.tenant {
+				t.Fatalf("%s %s: expected the email to be queued for tenant %q but got %q", req.host, req.origin, req.tenant, j.Data.Tenant)
+			}
+		}
+	}
+}
+
+func TestFormConfigTenant(t *testing.T) {
+	s := newTestServer(t, func(c *config.Config) {
+		c.Smtp = config.SmtpData{Host: "smtp.localhost", Port: 25}
+		c.Auth = config.AuthData{Username: "top", Password: "secret"}
+		c.Tenants = map[string]config.TenantData{
+			"example": {Hosts: []string{"example.com"}, Domain: "mail.example.com", Smtp: config.SmtpData{Host: "smtp.example.com", Port: 465}},
+			"other":   {Hosts: []string{"other.org"}},
+		}
+	})
+	form, domain, err := s.formConfig(s.config.Load(), "", "example")
+	if err != nil {
+		t.Fatalf("Could not get the form config: %s", err)
+	}
+	if domain != "mail.example.com" || form.Smtp.Host != "smtp.example.com" || form.Auth != (config.AuthData{}) {
+		t.Fatalf("Expected the example tenant's domain and relay, without the top level auth. Got %q %+v %+v", domain, form.Smtp, form.Auth)
+	}
+	form, domain, err = s.formConfig(s.config.Load(), "", "other")
+	if err != nil || domain != "example.com" || form.Smtp != s.config.Load().Smtp || form.Auth != s.config.Load().Auth {
+		t.Fatalf("Expected the other tenant to use the top level config. Got %q %+v. Error: %v", domain, form.Smtp, err)
+	}
+	_, _, err = s.formConfig(s.config.Load(), "", "removed")
+	if err == nil {
+		t.Fatalf("Expected an error for a tenant that is not in the config but got nil")
+	}
+}
+
+func TestSetRouteHandlerTenantCors(t *testing.T) {
+	s := newTestServer(t, func(c *config.Config) {
+		c.Tenants = map[string]config.TenantData{"example": {Hosts: []string{"example.com"}}}
+	})
+	for origin, allowed := range map[string]bool{"https://example.com": true, "https://evil.com": false} {
+		r := httptest.NewRequest(http.MethodOptions, "/", nil)
+		r.Header.Set("Origin", origin)
+		r.Header.Set("Access-Control-Request-Method", http.MethodPost)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		result := w.Header().Get("Access-Control-Allow-Origin") == origin
+		if result != allowed {
+			t.Fatalf("%s: expected the origin to be allowed %t but got %t", origin, allowed, result)
+		}
+	}
+}
+
 // Test sending an email using an HTTP POST as the browser does.
 func TestServerSendEmail(t *testing.T) {
 	// The web form sends a JSON array of key value encoded pairs like this:
@@ -236,6 +902,13 @@ func TestServerSendEmail(t *testing.T) {
 	}
 	// set the filename in server
 	srvUnderTest.ReadConfig(filename)
+	// spool the emails into a temporary directory and only try once, so a failure shows up in the dead letters
+	srvUnderTest.config.Load().Queue.Dir = t.TempDir()
+	srvUnderTest.config.Load().Queue.MaxAttempts = 1
+	err = srvUnderTest.OpenQueue()
+	if err != nil {
+		t.Fatalf("Could not open the queue: %s", err)
+	}
 	// now create a test server around the handler - we don't need to set a route as we call the handler directly
 	s := httptest.NewServer(http.HandlerFunc(srvUnderTest.gatewayHandler))
 	defer s.Close()
@@ -270,6 +943,29 @@ func TestServerSendEmail(t *testing.T) {
 	if fr.BadFields != nil {
 		t.Fatalf("Expected BadFields to be %v but got %v.", nil, fr.BadFields)
 	}
+	// the emails are sent by the queue workers, wait for them to leave the spool
+	deadline := time.Now().Add(time.Minute)
+	for {
+		pending, err := srvUnderTest.queue.Pending()
+		if err != nil {
+			t.Fatalf("Could not read the spool: %s", err)
+		}
+		if len(pending) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %d emails to be sent", len(pending))
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	srvUnderTest.CloseQueue()
+	dead, err := srvUnderTest.queue.Dead()
+	if err != nil {
+		t.Fatalf("Could not read the dead letters: %s", err)
+	}
+	for _, j := range dead {
+		t.Errorf("Failed to send the %s email: %s", j.Kind, j.LastError)
+	}
 }
 
 func TestCreateFromDataMap(t *testing.T) {
@@ -0,0 +1,43 @@
+// Copyright (c) 2024 Owen Waller. All rights reserved.
+package server
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"github.com/owenwaller/emailformgateway/config"
+	"github.com/owenwaller/emailformgateway/queue"
+	"github.com/owenwaller/emailformgateway/spamfilter"
+)
+
+// filterSpam passes the system email through the form's spam filter, and returns it with the filter's
+// X-Spam-* headers added. It reports if the email scored over the threshold, and should not be sent.
+// If the filter can't be asked the email is sent as it is, a filter that is down must not stop the forms.
+func (s *Server) filterSpam(fd config.SpamFilterData, j *queue.Job, email []byte) ([]byte, bool) {
+	checker, err := spamfilter.New(fd)
+	if err != nil || checker == nil {
+		log.Printf("Not filtering %s email job %s; %v\n", j.Kind, j.ID, err)
+		return email, false
+	}
+	verdict, err := checker.Check(context.Background(), email)
+	if err != nil {
+		log.Printf("Sending %s email job %s without a spam filter verdict; %s\n", j.Kind, j.ID, err)
+		return email, false
+	}
+	return spamfilter.AddHeaders(email, verdict), verdict.Blocked(fd.Threshold)
+}
+
+// blockSpam keeps a system email the spam filter blocked in the spool's quarantine directory, where an
+// operator can release it. The job is then done, so it is never retried.
+func (s *Server) blockSpam(j *queue.Job) error {
+	if s.queue == nil {
+		return errors.New("The mail queue has not been opened.")
+	}
+	q, err := s.queue.Quarantine(j.Kind, j.Data)
+	if err != nil {
+		return err
+	}
+	log.Printf("The spam filter blocked %s email job %s, it is quarantined as job %s\n", j.Kind, j.ID, q.ID)
+	return nil
+}
@@ -0,0 +1,90 @@
+// Copyright (c) 2024 Owen Waller. All rights reserved.
+package server
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/textproto"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/owenwaller/emailformgateway/config"
+	"github.com/owenwaller/emailformgateway/queue"
+)
+
+// fakeSpamd answers every connection as spamd does for an email that scored score.
+func fakeSpamd(t *testing.T, score string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			tp := textproto.NewReader(bufio.NewReader(conn))
+			tp.ReadLine()
+			h, _ := tp.ReadMIMEHeader()
+			n, _ := strconv.Atoi(h.Get("Content-Length"))
+			io.CopyN(io.Discard, tp.R, int64(n))
+			io.WriteString(conn, "SPAMD/1.1 0 EX_OK\r\nSpam: True ; "+score+" / 5.0\r\n\r\nBAYES_99\r\n")
+			conn.Close()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func withSpamFilter(t *testing.T, fd config.SpamFilterData) func(*config.Config) {
+	dir, err := filepath.Abs("..")
+	if err != nil {
+		t.Fatalf("Could not find the templates: %s", err)
+	}
+	return func(c *config.Config) {
+		c.Templates = config.EmailTemplatesData{Dir: dir, CustomerText: "customer-email-text.template",
+			CustomerHtml: "customer-email-html.template", SystemText: "system-email-text.template",
+			SystemHtml: "system-email-html.template"}
+		c.Addresses = config.EmailAddressData{SystemFrom: "form@example.com", SystemTo: "owner@example.com"}
+		c.SpamFilter = fd
+	}
+}
+
+func TestSpamFilterBlocks(t *testing.T) {
+	s := newTestServer(t, withSpamFilter(t, config.SpamFilterData{Type: "spamd", Address: fakeSpamd(t, "15.0"), Threshold: 10}))
+	j := &queue.Job{ID: "job1", Kind: queue.SystemEmail, Data: config.EmailTemplateData{FormData: map[string]string{"Name": "Me"}}}
+	err := s.deliver(j)
+	if err != nil {
+		t.Fatalf("Expected the blocked email to be done with but got: %s", err)
+	}
+	quarantined, err := s.queue.Quarantined()
+	if err != nil {
+		t.Fatalf("Could not read the quarantine: %s", err)
+	}
+	if len(quarantined) != 1 || quarantined[0].Kind != queue.SystemEmail {
+		t.Fatalf("Expected the system email to be quarantined but got %d jobs", len(quarantined))
+	}
+}
+
+func TestSpamFilterHeaders(t *testing.T) {
+	fd := config.SpamFilterData{Type: "spamd", Address: fakeSpamd(t, "6.0"), Threshold: 10}
+	s := newTestServer(t, withSpamFilter(t, fd))
+	j := &queue.Job{ID: "job1", Kind: queue.SystemEmail}
+	email, blocked := s.filterSpam(fd, j, []byte("Subject: Hi\r\n\r\nHello\r\n"))
+	if blocked {
+		t.Fatalf("Expected a score under the threshold not to be blocked")
+	}
+	if !strings.HasPrefix(string(email), "X-Spam-Flag: YES\r\nX-Spam-Score: 6.0\r\n") {
+		t.Fatalf("Expected the verdict to be added but got %q", email)
+	}
+	// a filter that is down lets the email through as it is
+	fd.Address = "127.0.0.1:1"
+	email, blocked = s.filterSpam(fd, j, []byte("Subject: Hi\r\n\r\nHello\r\n"))
+	if blocked || string(email) != "Subject: Hi\r\n\r\nHello\r\n" {
+		t.Fatalf("Expected the email to be sent unchanged but got %t %q", blocked, email)
+	}
+}
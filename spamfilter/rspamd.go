@@ -0,0 +1,86 @@
+// Copyright (c) 2024 Owen Waller. All rights reserved.
+package spamfilter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// rspamdCheckPath is rspamd's endpoint for checking a message, on the normal and the controller worker.
+const rspamdCheckPath = "/checkv2"
+
+// The rspamd actions that mean the email is spam, the others are "no action", "greylist" and "soft reject".
+var rspamdSpamActions = map[string]bool{
+	"add header":      true,
+	"rewrite subject": true,
+	"reject":          true,
+}
+
+// rspamd posts the email to rspamd's HTTP API.
+type rspamd struct {
+	url      string
+	password string
+	client   *http.Client
+}
+
+// rspamdAnswer is the JSON rspamd answers with, only the parts used.
+type rspamdAnswer struct {
+	Score         float64                 `json:"score"`
+	RequiredScore float64                 `json:"required_score"`
+	Action        string                  `json:"action"`
+	Symbols       map[string]rspamdSymbol `json:"symbols"`
+}
+
+type rspamdSymbol struct {
+	Score float64 `json:"score"`
+}
+
+func newRspamd(address, password string, timeout time.Duration) *rspamd {
+	return &rspamd{
+		url:      strings.TrimSuffix(address, "/") + rspamdCheckPath,
+		password: password,
+		client:   &http.Client{Timeout: timeout},
+	}
+}
+
+func (r *rspamd) Check(ctx context.Context, email []byte) (Verdict, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.url, bytes.NewReader(email))
+	if err != nil {
+		return Verdict{}, err
+	}
+	if r.password != "" {
+		req.Header.Set("Password", r.password)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return Verdict{}, fmt.Errorf("Could not ask rspamd: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Verdict{}, fmt.Errorf("Could not ask rspamd: %s answered %s", r.url, resp.Status)
+	}
+	var answer rspamdAnswer
+	err = json.NewDecoder(io.LimitReader(resp.Body, maxAnswerSize)).Decode(&answer)
+	if err != nil {
+		return Verdict{}, fmt.Errorf("Could not read rspamd's answer: %w", err)
+	}
+	v := Verdict{
+		Spam:     rspamdSpamActions[strings.ToLower(answer.Action)],
+		Score:    answer.Score,
+		Required: answer.RequiredScore,
+	}
+	for name, s := range answer.Symbols {
+		if s.Score != 0 {
+			v.Symbols = append(v.Symbols, name)
+		}
+	}
+	sort.Strings(v.Symbols)
+	return v, nil
+}
@@ -0,0 +1,123 @@
+// Copyright (c) 2024 Owen Waller. All rights reserved.
+package spamfilter
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxAnswerSize limits how much of the filter's answer is read.
+const maxAnswerSize = 64 << 10
+
+// spamd speaks the spamc protocol to SpamAssassin's spamd. A SYMBOLS request is sent, spamd answers
+//
+//	SPAMD/1.1 0 EX_OK
+//	Content-length: 27
+//	Spam: True ; 15.0 / 5.0
+//
+//	BAYES_99,URIBL_BLACK,...
+//
+// and closes the connection.
+type spamd struct {
+	address string
+	user    string
+	timeout time.Duration
+}
+
+func (s *spamd) Check(ctx context.Context, email []byte) (Verdict, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", s.address)
+	if err != nil {
+		return Verdict{}, fmt.Errorf("Could not connect to spamd: %w", err)
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	w := bufio.NewWriter(conn)
+	fmt.Fprintf(w, "SYMBOLS SPAMC/1.5\r\nContent-length: %d\r\n", len(email))
+	if s.user != "" {
+		fmt.Fprintf(w, "User: %s\r\n", s.user)
+	}
+	w.WriteString("\r\n")
+	w.Write(email)
+	err = w.Flush()
+	if err != nil {
+		return Verdict{}, fmt.Errorf("Could not send the email to spamd: %w", err)
+	}
+	return readSpamdAnswer(io.LimitReader(conn, maxAnswerSize))
+}
+
+func readSpamdAnswer(r io.Reader) (Verdict, error) {
+	tp := textproto.NewReader(bufio.NewReader(r))
+	line, err := tp.ReadLine()
+	if err != nil {
+		return Verdict{}, fmt.Errorf("Could not read spamd's answer: %w", err)
+	}
+	// e.g. "SPAMD/1.1 0 EX_OK", anything but 0 is an error
+	parts := strings.SplitN(line, " ", 3)
+	if len(parts) < 2 || !strings.HasPrefix(parts[0], "SPAMD/") {
+		return Verdict{}, fmt.Errorf("spamd answered %q", line)
+	}
+	if parts[1] != "0" {
+		return Verdict{}, fmt.Errorf("spamd answered with an error: %q", line)
+	}
+	h, err := tp.ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return Verdict{}, fmt.Errorf("Could not read spamd's answer: %w", err)
+	}
+	spam := h.Get("Spam")
+	if spam == "" {
+		return Verdict{}, fmt.Errorf("spamd's answer has no Spam header")
+	}
+	v, err := parseSpamHeader(spam)
+	if err != nil {
+		return Verdict{}, err
+	}
+	body, err := io.ReadAll(tp.R)
+	if err != nil {
+		return Verdict{}, fmt.Errorf("Could not read spamd's answer: %w", err)
+	}
+	for _, symbol := range strings.Split(strings.TrimSpace(string(body)), ",") {
+		if symbol = strings.TrimSpace(symbol); symbol != "" {
+			v.Symbols = append(v.Symbols, symbol)
+		}
+	}
+	return v, nil
+}
+
+// parseSpamHeader parses spamd's "True ; 15.0 / 5.0" header.
+func parseSpamHeader(spam string) (Verdict, error) {
+	var v Verdict
+	flag, scores, found := strings.Cut(spam, ";")
+	score, required, found2 := strings.Cut(scores, "/")
+	if !found || !found2 {
+		return v, fmt.Errorf("Could not read spamd's Spam header %q", spam)
+	}
+	switch strings.ToLower(strings.TrimSpace(flag)) {
+	case "true", "yes":
+		v.Spam = true
+	case "false", "no":
+	default:
+		return v, fmt.Errorf("Could not read spamd's Spam header %q", spam)
+	}
+	var err error
+	v.Score, err = strconv.ParseFloat(strings.TrimSpace(score), 64)
+	if err != nil {
+		return v, fmt.Errorf("Could not read spamd's Spam header %q", spam)
+	}
+	v.Required, err = strconv.ParseFloat(strings.TrimSpace(required), 64)
+	if err != nil {
+		return v, fmt.Errorf("Could not read spamd's Spam header %q", spam)
+	}
+	return v, nil
+}
@@ -0,0 +1,102 @@
+// Copyright (c) 2024 Owen Waller. All rights reserved.
+package spamfilter
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/owenwaller/emailformgateway/config"
+)
+
+// DefaultTimeout is how long the filter has to answer.
+const DefaultTimeout = 10 * time.Second
+
+// maxHeaderLine is where the X-Spam-Status header is folded, RFC 5322 recommends 78 characters.
+const maxHeaderLine = 78
+
+// Verdict is what the filter made of an email.
+type Verdict struct {
+	Spam     bool
+	Score    float64
+	Required float64  // the score the filter considers spam
+	Symbols  []string // the filter's rules that matched
+}
+
+// Blocked reports if the email scored the threshold or more. No threshold never blocks.
+func (v Verdict) Blocked(threshold float64) bool {
+	return threshold > 0 && v.Score >= threshold
+}
+
+// Checker asks a spam filter about an email.
+type Checker interface {
+	// Check returns the filter's verdict on the email, which is a complete RFC 5322 message.
+	Check(ctx context.Context, email []byte) (Verdict, error)
+}
+
+// New returns the checker for the config, or nil if there is no filter.
+func New(fd config.SpamFilterData) (Checker, error) {
+	timeout := fd.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	switch strings.ToLower(fd.Type) {
+	case "":
+		return nil, nil
+	case config.SpamFilterSpamd:
+		return &spamd{address: fd.Address, user: fd.User, timeout: timeout}, nil
+	case config.SpamFilterRspamd:
+		return newRspamd(fd.Address, fd.Password, timeout), nil
+	default:
+		return nil, fmt.Errorf("Unknown spam filter %q", fd.Type)
+	}
+}
+
+// AddHeaders returns the email with the verdict added as the X-Spam-Flag, X-Spam-Score and
+// X-Spam-Status headers, in the form SpamAssassin uses. Any X-Spam-* headers the email
+// already has are left alone, the new ones are put before them.
+func AddHeaders(email []byte, v Verdict) []byte {
+	flag, status := "NO", "No"
+	if v.Spam {
+		flag, status = "YES", "Yes"
+	}
+	status = fmt.Sprintf("%s, score=%s required=%s", status, formatScore(v.Score), formatScore(v.Required))
+	if len(v.Symbols) != 0 {
+		status += " tests=" + strings.Join(v.Symbols, ",")
+	}
+	var b bytes.Buffer
+	b.WriteString("X-Spam-Flag: " + flag + "\r\n")
+	b.WriteString("X-Spam-Score: " + formatScore(v.Score) + "\r\n")
+	b.WriteString(fold("X-Spam-Status: "+status) + "\r\n")
+	b.Write(email)
+	return b.Bytes()
+}
+
+func formatScore(score float64) string {
+	return strconv.FormatFloat(score, 'f', 1, 64)
+}
+
+// fold breaks a header that is too long after its commas and spaces.
+func fold(header string) string {
+	var b strings.Builder
+	line := 0
+	for len(header) > 0 {
+		i := strings.IndexAny(header, ", ")
+		token := header
+		if i >= 0 {
+			token = header[:i+1]
+		}
+		header = header[len(token):]
+		if line > 0 && line+len(token) > maxHeaderLine {
+			b.WriteString("\r\n\t")
+			line = 1
+			token = strings.TrimLeft(token, " ")
+		}
+		b.WriteString(token)
+		line += len(token)
+	}
+	return b.String()
+}
@@ -0,0 +1,145 @@
+// Copyright (c) 2024 Owen Waller. All rights reserved.
+package spamfilter
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/owenwaller/emailformgateway/config"
+)
+
+const testEmail = "From: me@example.com\r\nTo: you@example.com\r\nSubject: Hi\r\n\r\nHello\r\n"
+
+// fakeSpamd answers each connection with answer, and sends the requests it read to requests.
+func fakeSpamd(t *testing.T, answer string) (string, chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	requests := make(chan string, 1)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			tp := textproto.NewReader(bufio.NewReader(conn))
+			line, _ := tp.ReadLine()
+			h, _ := tp.ReadMIMEHeader()
+			n, _ := strconv.Atoi(h.Get("Content-Length"))
+			body := make([]byte, n)
+			io.ReadFull(tp.R, body)
+			requests <- line + "\n" + h.Get("User") + "\n" + string(body)
+			io.WriteString(conn, answer)
+			conn.Close()
+		}
+	}()
+	return l.Addr().String(), requests
+}
+
+func TestSpamd(t *testing.T) {
+	address, requests := fakeSpamd(t, "SPAMD/1.1 0 EX_OK\r\nContent-length: 24\r\nSpam: True ; 15.0 / 5.0\r\n\r\nBAYES_99,URIBL_BLACK\r\n")
+	c, err := New(config.SpamFilterData{Type: "spamd", Address: address, User: "forms"})
+	if err != nil {
+		t.Fatalf("Could not create the checker: %s", err)
+	}
+	v, err := c.Check(context.Background(), []byte(testEmail))
+	if err != nil {
+		t.Fatalf("Could not check the email: %s", err)
+	}
+	expected := Verdict{Spam: true, Score: 15, Required: 5, Symbols: []string{"BAYES_99", "URIBL_BLACK"}}
+	if !reflect.DeepEqual(v, expected) {
+		t.Fatalf("Expected %+v but got %+v", expected, v)
+	}
+	if r := <-requests; r != "SYMBOLS SPAMC/1.5\nforms\n"+testEmail {
+		t.Fatalf("spamd was sent %q", r)
+	}
+}
+
+func TestSpamdErrors(t *testing.T) {
+	var answers = []string{
+		"SPAMD/1.1 76 Bad header line\r\n\r\n",
+		"SPAMD/1.1 0 EX_OK\r\n\r\n",
+		"SPAMD/1.1 0 EX_OK\r\nSpam: Maybe ; 1 / 5\r\n\r\n",
+		"HTTP/1.1 200 OK\r\n\r\n",
+	}
+	for _, a := range answers {
+		address, _ := fakeSpamd(t, a)
+		c, _ := New(config.SpamFilterData{Type: "spamd", Address: address})
+		_, err := c.Check(context.Background(), []byte(testEmail))
+		if err == nil {
+			t.Fatalf("Expected an error for the answer %q but got nil", a)
+		}
+	}
+	c, _ := New(config.SpamFilterData{Type: "spamd", Address: "127.0.0.1:1", Timeout: time.Second})
+	_, err := c.Check(context.Background(), []byte(testEmail))
+	if err == nil {
+		t.Fatalf("Expected an error for an unreachable spamd but got nil")
+	}
+}
+
+func TestRspamd(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Method != http.MethodPost || r.URL.Path != "/checkv2" || r.Header.Get("Password") != "secret" || string(body) != testEmail {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"score": 7.5, "required_score": 15, "action": "add header",
+			"symbols": map[string]interface{}{
+				"R_SPF_ALLOW":  map[string]interface{}{"score": 0},
+				"MISSING_DATE": map[string]interface{}{"score": 1.5},
+				"BAYES_SPAM":   map[string]interface{}{"score": 6},
+			},
+		})
+	}))
+	defer srv.Close()
+	c, err := New(config.SpamFilterData{Type: "RSPAMD", Address: srv.URL + "/", Password: "secret"})
+	if err != nil {
+		t.Fatalf("Could not create the checker: %s", err)
+	}
+	v, err := c.Check(context.Background(), []byte(testEmail))
+	if err != nil {
+		t.Fatalf("Could not check the email: %s", err)
+	}
+	expected := Verdict{Spam: true, Score: 7.5, Required: 15, Symbols: []string{"BAYES_SPAM", "MISSING_DATE"}}
+	if !reflect.DeepEqual(v, expected) {
+		t.Fatalf("Expected %+v but got %+v", expected, v)
+	}
+	c, _ = New(config.SpamFilterData{Type: "rspamd", Address: srv.URL})
+	_, err = c.Check(context.Background(), []byte(testEmail))
+	if err == nil {
+		t.Fatalf("Expected an error without the password but got nil")
+	}
+}
+
+func TestAddHeaders(t *testing.T) {
+	v := Verdict{Spam: true, Score: 6.3, Required: 5, Symbols: []string{"A_VERY_LONG_SYMBOL_NAME", "ANOTHER_VERY_LONG_SYMBOL_NAME", "THIRD"}}
+	email := string(AddHeaders([]byte(testEmail), v))
+	expected := "X-Spam-Flag: YES\r\nX-Spam-Score: 6.3\r\n" +
+		"X-Spam-Status: Yes, score=6.3 required=5.0 tests=A_VERY_LONG_SYMBOL_NAME,\r\n\tANOTHER_VERY_LONG_SYMBOL_NAME,THIRD\r\n" + testEmail
+	if email != expected {
+		t.Fatalf("Expected\n%q\nbut got\n%q", expected, email)
+	}
+	for _, line := range strings.Split(email, "\r\n") {
+		if len(line) > maxHeaderLine+1 {
+			t.Fatalf("The header line %q is too long", line)
+		}
+	}
+	if v.Blocked(0) || !v.Blocked(6) || v.Blocked(7) {
+		t.Fatalf("Blocked does not compare the score to the threshold")
+	}
+}
@@ -0,0 +1,237 @@
+// Copyright (c) 2024 Owen Waller. All rights reserved.
+package validation
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/mail"
+	"net/netip"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// DefaultLookupTimeout is how long the DNS look ups for an address may take.
+const DefaultLookupTimeout = 5 * time.Second
+
+// The reasons CheckEmail gives for refusing an address
+var (
+	ErrEmailSyntax  = errors.New("the address does not parse")
+	ErrDomainSyntax = errors.New("the domain is not a valid domain name")
+	ErrIPLiteral    = errors.New("the domain is an IP address")
+	ErrLocalDomain  = errors.New("the domain is only used on local networks")
+	ErrNoMailServer = errors.New("the domain can't receive email")
+	ErrDisposable   = errors.New("the domain is a throw away email service")
+)
+
+// localDomains are the special use names that are never on the public internet, RFC 6761 and RFC 6762.
+var localDomains = []string{"localhost", "local", "localdomain", "internal", "test", "example", "invalid", "home.arpa"}
+
+// Resolver looks up the DNS records that show a domain can receive email. net.DefaultResolver is one.
+type Resolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// EmailChecker checks an email address beyond its syntax.
+type EmailChecker struct {
+	Deliverable bool     // check the domain is a public domain name, and with a Resolver that it has mail servers
+	Resolver    Resolver // nil skips the DNS look ups
+	Timeout     time.Duration
+	Disposable  []string // the domains of throw away email services, a sub domain of one is refused too
+}
+
+// CheckEmail returns nil if the address passes the checks, or one of the Err* reasons if it does not.
+func (ec *EmailChecker) CheckEmail(ctx context.Context, address string) error {
+	domain, err := EmailDomain(address)
+	if err != nil {
+		return err
+	}
+	if ec.Deliverable {
+		err = checkDomain(domain)
+		if err != nil {
+			return err
+		}
+	}
+	if inDomains(domain, ec.Disposable) {
+		return ErrDisposable
+	}
+	if !ec.Deliverable || ec.Resolver == nil {
+		return nil
+	}
+	timeout := ec.Timeout
+	if timeout <= 0 {
+		timeout = DefaultLookupTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return lookupMailServer(ctx, ec.Resolver, domain)
+}
+
+// checkDomain checks the domain of an address is a domain name on the public internet.
+func checkDomain(domain string) error {
+	if strings.HasPrefix(domain, "[") {
+		return ErrIPLiteral
+	}
+	if _, err := netip.ParseAddr(domain); err == nil {
+		return ErrIPLiteral
+	}
+	if !ValidateAsDomain(domain) {
+		return ErrDomainSyntax
+	}
+	if isLocalDomain(domain) {
+		return ErrLocalDomain
+	}
+	return nil
+}
+
+// EmailDomain returns the lower case domain of an address.
+func EmailDomain(address string) (string, error) {
+	a, err := mail.ParseAddress(address)
+	if err != nil {
+		return "", ErrEmailSyntax
+	}
+	at := strings.LastIndex(a.Address, "@")
+	if at < 0 {
+		return "", ErrEmailSyntax
+	}
+	return strings.ToLower(strings.TrimSuffix(a.Address[at+1:], ".")), nil
+}
+
+// ValidateAsDomain checks the syntax of a domain name. It must have at least two labels, each label
+// is letters, digits and hyphens that do not start or end it, and the top level domain is not a number.
+// Letters may be any unicode letter, so internationalised domain names are accepted.
+func ValidateAsDomain(domain string) bool {
+	if len(domain) > 253 {
+		return false
+	}
+	labels := strings.Split(domain, ".")
+	if len(labels) < 2 {
+		return false
+	}
+	for _, l := range labels {
+		if len(l) == 0 || len(l) > 63 || strings.HasPrefix(l, "-") || strings.HasSuffix(l, "-") {
+			return false
+		}
+		for _, c := range l {
+			if c != '-' && !unicode.IsLetter(c) && !unicode.IsDigit(c) {
+				return false
+			}
+		}
+	}
+	return strings.IndexFunc(labels[len(labels)-1], func(c rune) bool { return !unicode.IsDigit(c) }) >= 0
+}
+
+func isLocalDomain(domain string) bool {
+	return inDomains(domain, localDomains)
+}
+
+// inDomains reports if the domain is one of the domains, or a sub domain of one.
+func inDomains(domain string, domains []string) bool {
+	for _, d := range domains {
+		d = strings.ToLower(d)
+		if domain == d || strings.HasSuffix(domain, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupMailServer looks for the domain's MX records, or the A and AAAA records mail falls back to
+// when there are none, RFC 5321 section 5.1. A domain with a "." MX record does not accept email, RFC 7505.
+// Only an answer that the domain has no records fails the check, a look up that times out does not.
+func lookupMailServer(ctx context.Context, r Resolver, domain string) error {
+	mxs, err := r.LookupMX(ctx, domain)
+	if err == nil && len(mxs) != 0 {
+		for _, mx := range mxs {
+			if mx.Host != "." && mx.Host != "" {
+				return nil
+			}
+		}
+		return ErrNoMailServer
+	}
+	if err != nil && !isNotFound(err) {
+		return nil
+	}
+	hosts, err := r.LookupHost(ctx, domain)
+	if err == nil && len(hosts) != 0 {
+		return nil
+	}
+	if err != nil && !isNotFound(err) {
+		return nil
+	}
+	return ErrNoMailServer
+}
+
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// popularDomains are the domains most addresses are at, a domain a typo away from one is probably misspelt.
+var popularDomains = []string{
+	"aol.com", "att.net", "btinternet.com", "comcast.net", "gmail.com", "gmx.com", "gmx.de", "googlemail.com",
+	"hotmail.co.uk", "hotmail.com", "hotmail.fr", "icloud.com", "live.com", "live.co.uk", "mac.com", "mail.com",
+	"me.com", "msn.com", "outlook.com", "proton.me", "protonmail.com", "sky.com", "verizon.net", "web.de",
+	"yahoo.co.uk", "yahoo.com", "yahoo.fr", "yandex.ru", "ymail.com",
+}
+
+// SuggestEmail returns the address with its domain corrected, if the domain looks like a misspelling of a
+// popular one e.g. "me@gmial.com" gives "me@gmail.com". It returns an empty string if there is no suggestion.
+func SuggestEmail(address string) string {
+	a, err := mail.ParseAddress(address)
+	if err != nil {
+		return ""
+	}
+	at := strings.LastIndex(a.Address, "@")
+	if at < 0 {
+		return ""
+	}
+	domain := strings.ToLower(a.Address[at+1:])
+	best, bestDistance := "", 3
+	for _, d := range popularDomains {
+		if d == domain {
+			return ""
+		}
+		// short domains are a typo away from many others, so they must be closer
+		limit := 2
+		if len(d) < 8 {
+			limit = 1
+		}
+		if dist := distance(domain, d); dist <= limit && dist < bestDistance {
+			best, bestDistance = d, dist
+		}
+	}
+	if best == "" {
+		return ""
+	}
+	return a.Address[:at+1] + best
+}
+
+// distance is the optimal string alignment distance, the Levenshtein distance with the
+// transposition of two neighbouring characters as one edit, as in "gmial".
+func distance(a, b string) int {
+	s, t := []rune(a), []rune(b)
+	d := make([][]int, len(s)+1)
+	for i := range d {
+		d[i] = make([]int, len(t)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+	for i := 1; i <= len(s); i++ {
+		for j := 1; j <= len(t); j++ {
+			cost := 1
+			if s[i-1] == t[j-1] {
+				cost = 0
+			}
+			d[i][j] = min(d[i-1][j]+1, d[i][j-1]+1, d[i-1][j-1]+cost)
+			if i > 1 && j > 1 && s[i-1] == t[j-2] && s[i-2] == t[j-1] {
+				d[i][j] = min(d[i][j], d[i-2][j-2]+1)
+			}
+		}
+	}
+	return d[len(s)][len(t)]
+}
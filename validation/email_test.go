@@ -0,0 +1,118 @@
+// Copyright (c) 2024 Owen Waller. All rights reserved.
+package validation
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+// fakeResolver answers from its maps, a domain that is in neither does not exist.
+type fakeResolver struct {
+	mx    map[string][]*net.MX
+	hosts map[string][]string
+	err   error // returned by every look up, if set
+}
+
+func (r *fakeResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	if mx, found := r.mx[name]; found {
+		return mx, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r *fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	if hosts, found := r.hosts[host]; found {
+		return hosts, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func newFakeResolver() *fakeResolver {
+	return &fakeResolver{
+		mx: map[string][]*net.MX{
+			"example.com": {{Host: "mx.example.com.", Pref: 10}},
+			"nomail.org":  {{Host: ".", Pref: 0}},
+		},
+		hosts: map[string][]string{"a-only.net": {"192.0.2.1"}},
+	}
+}
+
+func TestCheckEmail(t *testing.T) {
+	ec := EmailChecker{Deliverable: true, Resolver: newFakeResolver(), Disposable: []string{"mailinator.com"}}
+	var checks = []struct {
+		address  string
+		expected error
+	}{
+		{"me@example.com", nil},
+		{"Me <me@EXAMPLE.com>", nil},
+		{"me@a-only.net", nil},
+		{"me@", ErrEmailSyntax},
+		{"a@b", ErrDomainSyntax},
+		{"me@-bad.com", ErrDomainSyntax},
+		{"me@example.123", ErrDomainSyntax},
+		{"me@[192.0.2.1]", ErrIPLiteral},
+		{"me@192.0.2.1", ErrIPLiteral},
+		{"me@printer.local", ErrLocalDomain},
+		{"me@dev.localhost", ErrLocalDomain},
+		{"me@mx.mailinator.com", ErrDisposable},
+		{"me@nomail.org", ErrNoMailServer},
+		{"me@missing.example.net", ErrNoMailServer},
+	}
+	for _, c := range checks {
+		err := ec.CheckEmail(context.Background(), c.address)
+		if !errors.Is(err, c.expected) {
+			t.Fatalf("%q: expected %v but got %v", c.address, c.expected, err)
+		}
+	}
+}
+
+func TestCheckEmailWithoutDeliverable(t *testing.T) {
+	ec := EmailChecker{Resolver: newFakeResolver(), Disposable: []string{"mailinator.com"}}
+	err := ec.CheckEmail(context.Background(), "me@missing.example.net")
+	if err != nil {
+		t.Fatalf("Expected only the disposable domains to be checked but got %s", err)
+	}
+	err = ec.CheckEmail(context.Background(), "me@mailinator.com")
+	if err != ErrDisposable {
+		t.Fatalf("Expected %v but got %v", ErrDisposable, err)
+	}
+}
+
+func TestCheckEmailLookupFails(t *testing.T) {
+	r := &fakeResolver{err: &net.DNSError{Err: "i/o timeout", Name: "example.net", IsTimeout: true}}
+	ec := EmailChecker{Deliverable: true, Resolver: r}
+	err := ec.CheckEmail(context.Background(), "me@example.net")
+	if err != nil {
+		t.Fatalf("Expected a look up that timed out not to fail the address but got %s", err)
+	}
+}
+
+func TestSuggestEmail(t *testing.T) {
+	var suggestions = []struct {
+		address  string
+		expected string
+	}{
+		{"me@gmial.com", "me@gmail.com"},
+		{"me@gmail.con", "me@gmail.com"},
+		{"Me@Hotmial.com", "Me@hotmail.com"},
+		{"me@yaho.com", "me@yahoo.com"},
+		{"me@gmail.com", ""},
+		{"me@mail.com", ""},
+		{"me@example.com", ""},
+		{"not an address", ""},
+	}
+	for _, s := range suggestions {
+		suggestion := SuggestEmail(s.address)
+		if suggestion != s.expected {
+			t.Fatalf("%q: expected the suggestion %q but got %q", s.address, s.expected, suggestion)
+		}
+	}
+}
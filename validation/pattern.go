@@ -0,0 +1,23 @@
+// Copyright (c) 2024 Owen Waller. All rights reserved.
+package validation
+
+import (
+	"regexp"
+	"sync"
+)
+
+// patterns caches the compiled field patterns, a form uses the same few over and over.
+var patterns sync.Map // pattern to *regexp.Regexp
+
+// MatchPattern reports if the whole of s matches the pattern, not just part of it.
+func MatchPattern(pattern, s string) (bool, error) {
+	re, found := patterns.Load(pattern)
+	if !found {
+		compiled, err := regexp.Compile(`^(?:` + pattern + `)$`)
+		if err != nil {
+			return false, err
+		}
+		re, _ = patterns.LoadOrStore(pattern, compiled)
+	}
+	return re.(*regexp.Regexp).MatchString(s), nil
+}
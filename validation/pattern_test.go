@@ -0,0 +1,30 @@
+// Copyright (c) 2024 Owen Waller. All rights reserved.
+package validation
+
+import "testing"
+
+func TestMatchPattern(t *testing.T) {
+	var checks = []struct {
+		pattern string
+		s       string
+		matches bool
+	}{
+		{"[A-Z]{2}[0-9]{6}", "AB123456", true},
+		{"[A-Z]{2}[0-9]{6}", "xAB123456", false},
+		{"[A-Z]{2}[0-9]{6}", "AB1234567", false},
+		{"yes|no", "no", true},
+		{"yes|no", "yesno", false},
+	}
+	for _, c := range checks {
+		for i := 0; i < 2; i++ { // the second time the pattern is cached
+			matches, err := MatchPattern(c.pattern, c.s)
+			if err != nil || matches != c.matches {
+				t.Fatalf("%q %q: expected %t but got %t, %v", c.pattern, c.s, c.matches, matches, err)
+			}
+		}
+	}
+	_, err := MatchPattern("[", "x")
+	if err == nil {
+		t.Fatalf("Expected an error for a bad pattern but got nil")
+	}
+}
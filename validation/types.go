@@ -0,0 +1,142 @@
+// Copyright (c) 2024 Owen Waller. All rights reserved.
+package validation
+
+import (
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The layouts a date or datetime field is accepted in, the first is what an HTML input sends.
+var (
+	dateLayouts     = []string{"2006-01-02"}
+	dateTimeLayouts = []string{"2006-01-02T15:04", "2006-01-02T15:04:05", time.RFC3339, "2006-01-02 15:04", "2006-01-02 15:04:05"}
+)
+
+// the values a checkbox is sent with, an HTML checkbox without a value attribute sends "on"
+var (
+	checkedValues   = map[string]bool{"on": true, "true": true, "yes": true, "1": true, "checked": true}
+	uncheckedValues = map[string]bool{"off": true, "false": true, "no": true, "0": true, "": true}
+)
+
+// inRange reports if v is between min and max, a nil limit is no limit.
+func inRange(v float64, min, max *float64) bool {
+	return (min == nil || v >= *min) && (max == nil || v <= *max)
+}
+
+// ValidateAsInteger parses a whole number, in the range.
+func ValidateAsInteger(s string, min, max *float64) (int64, bool) {
+	i, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || !inRange(float64(i), min, max) {
+		return 0, false
+	}
+	return i, true
+}
+
+// ValidateAsDecimal parses a decimal number e.g. "-1.25", in the range. Exponents, infinities and NaN are refused.
+func ValidateAsDecimal(s string, min, max *float64) (float64, bool) {
+	if strings.ContainsAny(s, "eEiInN_xXpP") {
+		return 0, false
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsInf(f, 0) || !inRange(f, min, max) {
+		return 0, false
+	}
+	return f, true
+}
+
+// ValidateAsPhone checks an international phone number, and returns it in E.164 form e.g. "+441632960123".
+// The number must start with + and a country code. Spaces, dots, hyphens and brackets are removed, so
+// "+44 (0)1632 960123" is not accepted as the (0) would be dialled, but "+44 1632 960-123" is.
+func ValidateAsPhone(s string) (string, bool) {
+	if !strings.HasPrefix(s, "+") {
+		return "", false
+	}
+	var b strings.Builder
+	b.WriteByte('+')
+	for _, c := range s[1:] {
+		switch {
+		case c >= '0' && c <= '9':
+			b.WriteRune(c)
+		case c == ' ' || c == '.' || c == '-' || c == '(' || c == ')':
+		default:
+			return "", false
+		}
+	}
+	e164 := b.String()
+	// a country code never starts with 0, and E.164 allows at most 15 digits
+	if len(e164) < 8 || len(e164) > 16 || e164[1] == '0' || strings.Contains(s, "(0)") {
+		return "", false
+	}
+	return e164, true
+}
+
+// ValidateAsURL checks an absolute http or https URL with a host.
+func ValidateAsURL(s string) (string, bool) {
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || strings.ContainsAny(s, " \t") {
+		return "", false
+	}
+	return u.String(), true
+}
+
+// ValidateAsDate parses a date as an HTML date input sends it, e.g. "2024-03-01".
+func ValidateAsDate(s string) (time.Time, bool) {
+	return parseTime(s, dateLayouts)
+}
+
+// ValidateAsDateTime parses a date and time as an HTML datetime-local input sends it, e.g. "2024-03-01T14:30",
+// or in RFC 3339 form. A time without a zone is UTC.
+func ValidateAsDateTime(s string) (time.Time, bool) {
+	return parseTime(s, dateTimeLayouts)
+}
+
+func parseTime(s string, layouts []string) (time.Time, bool) {
+	for _, l := range layouts {
+		t, err := time.Parse(l, s)
+		if err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// ValidateAsSelect checks the value is one of the allowed values, without regard to case.
+// It returns the allowed value, as it is written in the config.
+func ValidateAsSelect(s string, allowed []string) (string, bool) {
+	for _, a := range allowed {
+		if strings.EqualFold(s, a) {
+			return a, true
+		}
+	}
+	return "", false
+}
+
+// ValidateAsMultiSelect checks each of the values is one of the allowed values. It returns the allowed
+// values that were chosen, once each. Choosing nothing is valid.
+func ValidateAsMultiSelect(values []string, allowed []string) ([]string, bool) {
+	chosen := make([]string, 0, len(values))
+	seen := make(map[string]bool)
+	for _, v := range values {
+		a, valid := ValidateAsSelect(v, allowed)
+		if !valid {
+			return nil, false
+		}
+		if !seen[a] {
+			chosen = append(chosen, a)
+			seen[a] = true
+		}
+	}
+	return chosen, true
+}
+
+// ValidateAsCheckbox parses the value a checkbox was sent with, e.g. "on" or "false".
+func ValidateAsCheckbox(s string) (bool, bool) {
+	s = strings.ToLower(s)
+	if checkedValues[s] {
+		return true, true
+	}
+	return false, uncheckedValues[s]
+}
@@ -0,0 +1,177 @@
+// Copyright (c) 2024 Owen Waller. All rights reserved.
+package validation
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestValidateAsInteger(t *testing.T) {
+	min, max := 1.0, 10.0
+	var checks = []struct {
+		s        string
+		expected int64
+		valid    bool
+	}{
+		{"5", 5, true},
+		{"1", 1, true},
+		{"10", 10, true},
+		{"0", 0, false},
+		{"11", 0, false},
+		{"5.0", 0, false},
+		{"five", 0, false},
+		{"", 0, false},
+	}
+	for _, c := range checks {
+		i, valid := ValidateAsInteger(c.s, &min, &max)
+		if i != c.expected || valid != c.valid {
+			t.Fatalf("%q: expected %d, %t but got %d, %t", c.s, c.expected, c.valid, i, valid)
+		}
+	}
+	i, valid := ValidateAsInteger("-7", nil, nil)
+	if i != -7 || !valid {
+		t.Fatalf("Expected no range to allow -7 but got %d, %t", i, valid)
+	}
+}
+
+func TestValidateAsDecimal(t *testing.T) {
+	min := 0.0
+	var checks = []struct {
+		s        string
+		expected float64
+		valid    bool
+	}{
+		{"1.25", 1.25, true},
+		{"0", 0, true},
+		{"-0.5", 0, false},
+		{"1e3", 0, false},
+		{"NaN", 0, false},
+		{"Inf", 0, false},
+		{"0x1p3", 0, false},
+		{"1,5", 0, false},
+	}
+	for _, c := range checks {
+		f, valid := ValidateAsDecimal(c.s, &min, nil)
+		if f != c.expected || valid != c.valid {
+			t.Fatalf("%q: expected %g, %t but got %g, %t", c.s, c.expected, c.valid, f, valid)
+		}
+	}
+}
+
+func TestValidateAsPhone(t *testing.T) {
+	var checks = []struct {
+		s        string
+		expected string
+		valid    bool
+	}{
+		{"+441632960123", "+441632960123", true},
+		{"+44 1632 960-123", "+441632960123", true},
+		{"+1 (555) 010.0199", "+15550100199", true},
+		{"01632 960123", "", false},
+		{"+44 (0)1632 960123", "", false},
+		{"+0441632960123", "", false},
+		{"+12345", "", false},
+		{"+1234567890123456", "", false},
+		{"+44 1632 ext 123", "", false},
+	}
+	for _, c := range checks {
+		p, valid := ValidateAsPhone(c.s)
+		if p != c.expected || valid != c.valid {
+			t.Fatalf("%q: expected %q, %t but got %q, %t", c.s, c.expected, c.valid, p, valid)
+		}
+	}
+}
+
+func TestValidateAsURL(t *testing.T) {
+	var checks = []struct {
+		s     string
+		valid bool
+	}{
+		{"https://www.example.com/path?q=1", true},
+		{"http://example.com", true},
+		{"ftp://example.com", false},
+		{"javascript:alert(1)", false},
+		{"www.example.com", false},
+		{"https:///path", false},
+		{"https://example.com/a b", false},
+	}
+	for _, c := range checks {
+		_, valid := ValidateAsURL(c.s)
+		if valid != c.valid {
+			t.Fatalf("%q: expected %t but got %t", c.s, c.valid, valid)
+		}
+	}
+}
+
+func TestValidateAsDate(t *testing.T) {
+	d, valid := ValidateAsDate("2024-03-01")
+	if !valid || !d.Equal(time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("Could not parse the date, got %s, %t", d, valid)
+	}
+	for _, s := range []string{"2024-02-30", "01/03/2024", "2024-03-01T10:00"} {
+		if _, valid := ValidateAsDate(s); valid {
+			t.Fatalf("Expected %q not to be a date", s)
+		}
+	}
+	var dateTimes = []struct {
+		s        string
+		expected time.Time
+	}{
+		{"2024-03-01T14:30", time.Date(2024, 3, 1, 14, 30, 0, 0, time.UTC)},
+		{"2024-03-01T14:30:15", time.Date(2024, 3, 1, 14, 30, 15, 0, time.UTC)},
+		{"2024-03-01T14:30:00+01:00", time.Date(2024, 3, 1, 13, 30, 0, 0, time.UTC)},
+	}
+	for _, c := range dateTimes {
+		dt, valid := ValidateAsDateTime(c.s)
+		if !valid || !dt.Equal(c.expected) {
+			t.Fatalf("%q: expected %s but got %s, %t", c.s, c.expected, dt, valid)
+		}
+	}
+	if _, valid := ValidateAsDateTime("2024-03-01"); valid {
+		t.Fatalf("Expected a date without a time not to be a datetime")
+	}
+}
+
+func TestValidateAsSelect(t *testing.T) {
+	allowed := []string{"Go", "Python", "Scratch"}
+	v, valid := ValidateAsSelect("go", allowed)
+	if v != "Go" || !valid {
+		t.Fatalf("Expected \"Go\" but got %q, %t", v, valid)
+	}
+	if _, valid := ValidateAsSelect("Rust", allowed); valid {
+		t.Fatalf("Expected a value that is not allowed to be refused")
+	}
+	chosen, valid := ValidateAsMultiSelect([]string{"scratch", "Go", "SCRATCH"}, allowed)
+	if !valid || !reflect.DeepEqual(chosen, []string{"Scratch", "Go"}) {
+		t.Fatalf("Expected [Scratch Go] but got %q, %t", chosen, valid)
+	}
+	if _, valid := ValidateAsMultiSelect([]string{"Go", "Rust"}, allowed); valid {
+		t.Fatalf("Expected a value that is not allowed to be refused")
+	}
+	chosen, valid = ValidateAsMultiSelect(nil, allowed)
+	if !valid || len(chosen) != 0 {
+		t.Fatalf("Expected choosing nothing to be valid but got %q, %t", chosen, valid)
+	}
+}
+
+func TestValidateAsCheckbox(t *testing.T) {
+	var checks = []struct {
+		s       string
+		checked bool
+		valid   bool
+	}{
+		{"on", true, true},
+		{"True", true, true},
+		{"1", true, true},
+		{"off", false, true},
+		{"", false, true},
+		{"maybe", false, false},
+	}
+	for _, c := range checks {
+		checked, valid := ValidateAsCheckbox(c.s)
+		if checked != c.checked || valid != c.valid {
+			t.Fatalf("%q: expected %t, %t but got %t, %t", c.s, c.checked, c.valid, checked, valid)
+		}
+	}
+}
@@ -4,8 +4,11 @@ package validation
 import (
 	//"fmt"
 	"html/template"
+	"mime"
+	"net/http"
 	"net/mail"
 	"regexp"
+	"strings"
 )
 
 const (
@@ -88,6 +91,30 @@ func ValidateAsUnrestrictedText(s string) bool {
 	return accept
 }
 
+// ValidateAsFile sniffs the type of an uploaded file from its content, the type the browser
+// claims is ignored. It returns the sniffed type and if it is one of the allowed types.
+// An allowed type of "image/*" accepts any image, no allowed types accepts everything.
+func ValidateAsFile(data []byte, allowed []string) (string, bool) {
+	contentType := http.DetectContentType(data)
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return contentType, false
+	}
+	if len(allowed) == 0 {
+		return mediaType, true
+	}
+	for _, a := range allowed {
+		a = strings.ToLower(strings.TrimSpace(a))
+		if a == mediaType || a == "*/*" {
+			return mediaType, true
+		}
+		if strings.HasSuffix(a, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(a, "*")) {
+			return mediaType, true
+		}
+	}
+	return mediaType, false
+}
+
 func acceptUnicode(s string, cc map[rune]bool) bool {
 	present := map[rune]bool{
 		Letter:      false,
@@ -204,3 +204,27 @@ func TestRemoveScriptTagsAndContents(t *testing.T) {
 	}
 
 }
+
+func TestValidateAsFile(t *testing.T) {
+	var png = []byte("\x89PNG\x0D\x0A\x1A\x0A\x00\x00\x00\x0DIHDR")
+	var text = []byte("a plain text log file\n")
+	var files = []struct {
+		data     []byte
+		allowed  []string
+		expected string
+		valid    bool
+	}{
+		{png, []string{"image/png"}, "image/png", true},
+		{png, []string{"image/*"}, "image/png", true},
+		{png, nil, "image/png", true},
+		{png, []string{"text/plain"}, "image/png", false},
+		{text, []string{"image/*", "text/plain"}, "text/plain", true},
+		{text, []string{"image/*"}, "text/plain", false},
+	}
+	for i, f := range files {
+		result, valid := ValidateAsFile(f.data, f.allowed)
+		if result != f.expected || valid != f.valid {
+			t.Fatalf("Case %d: expected %q, %t but got %q, %t\n", i, f.expected, f.valid, result, valid)
+		}
+	}
+}